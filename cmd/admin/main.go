@@ -0,0 +1,205 @@
+// Утилита выгрузки и загрузки всех метрик сервера.
+//
+// Команды:
+//
+//	export  выгрузка метрик в формате json, csv или openmetrics из памяти сервера или из его хранилища
+//	import  загрузка выгрузки в режиме replace, merge или counters-add, -dry-run только показывает изменения
+//
+// Адрес сервера берется из флага -a или переменной окружения ADDRESS,
+// ключ подписи запросов - из флага -k или переменной окружения KEY.
+// Сервер принимает административные запросы, только если они подписаны ключом KEY
+// или отправлены из доверенной подсети TRUSTED_SUBNET.
+// Параметры команды: admin <команда> -help
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/compression"
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/cryptohash"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+)
+
+type serverFlags struct {
+	address *string
+	key     *string
+	scheme  *string
+}
+
+func newServerFlags(fs *flag.FlagSet) serverFlags {
+	address := os.Getenv("ADDRESS")
+	if address == "" {
+		address = constants.AddressServer
+	}
+	return serverFlags{
+		address: fs.String("a", address, "адрес сервера"),
+		key:     fs.String("k", os.Getenv("KEY"), "ключ подписи запросов"),
+		scheme:  fs.String("scheme", constants.SchemeHTTP, "протокол: http или https"),
+	}
+}
+
+// do отправляет запрос серверу, подписывая его ключом, если он задан.
+// Ответ со статусом не 200 возвращается как ошибка с текстом ответа.
+func (sf serverFlags) do(method string, path string, query url.Values, body []byte, header http.Header) ([]byte, error) {
+	u := url.URL{Scheme: *sf.scheme, Host: *sf.address, Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	if *sf.key != "" {
+		nonce, err := cryptohash.NewNonce()
+		if err != nil {
+			return nil, err
+		}
+		timestamp := cryptohash.FormatTimestamp(time.Now())
+		req.Header.Set(constants.HeaderTimestamp, timestamp)
+		req.Header.Set(constants.HeaderNonce, nonce)
+		req.Header.Set(constants.HeaderSignature,
+			cryptohash.SignRequest(*sf.key, req.Method, req.URL.Path, timestamp, nonce, body))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(respBody))
+	}
+	return respBody, nil
+}
+
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	sf := newServerFlags(fs)
+	format := fs.String("format", constants.ExportJSON, "формат выгрузки: json, csv, openmetrics")
+	source := fs.String("source", "memory", "откуда выгружать: memory или имя хранилища (db, file, bolt)")
+	output := fs.String("o", "", "файл выгрузки, по умолчанию стандартный вывод")
+	_ = fs.Parse(args)
+
+	query := url.Values{"format": {*format}, "source": {*source}}
+	body, err := sf.do(http.MethodGet, "/admin/export", query, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+	return os.WriteFile(*output, body, 0600)
+}
+
+func load(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	sf := newServerFlags(fs)
+	format := fs.String("format", constants.ExportJSON, "формат выгрузки: json, csv, openmetrics")
+	mode := fs.String("mode", constants.ImportMerge, "режим загрузки: replace, merge, counters-add")
+	dryRun := fs.Bool("dry-run", false, "только показать изменения, не загружая метрики")
+	input := fs.String("i", "", "файл выгрузки, по умолчанию стандартный ввод")
+	gzip := fs.Bool("gzip", true, "сжимать тело запроса gzip")
+	_ = fs.Parse(args)
+
+	var data []byte
+	var err error
+	if *input == "" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*input)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Выгрузка проверяется до отправки, чтобы ошибка формата была видна с номером строки файла.
+	if _, err = repository.DecodeMetrics(bytes.NewReader(data), *format); err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", repository.ContentType(*format))
+	if *gzip {
+		if data, err = compression.Compress(data); err != nil {
+			return err
+		}
+		header.Set("Content-Encoding", "gzip")
+	}
+
+	query := url.Values{"format": {*format}, "mode": {*mode}, "dry_run": {fmt.Sprint(*dryRun)}}
+	body, err := sf.do(http.MethodPost, "/admin/import", query, data, header)
+	if err != nil {
+		return err
+	}
+
+	var report repository.ImportReport
+	if err = json.Unmarshal(body, &report); err != nil {
+		return err
+	}
+	for _, c := range report.Changes {
+		switch c.Action {
+		case repository.ActionAdd:
+			fmt.Printf("+ %-8s %-30s %s\n", c.MType, c.ID, c.New)
+		case repository.ActionRemove:
+			fmt.Printf("- %-8s %-30s %s\n", c.MType, c.ID, c.Old)
+		default:
+			fmt.Printf("~ %-8s %-30s %s -> %s\n", c.MType, c.ID, c.Old, c.New)
+		}
+	}
+	result := "загружено"
+	if report.DryRun {
+		result = "будет загружено"
+	}
+	fmt.Printf("%s, режим %s: добавлено %d, изменено %d, удалено %d, без изменений %d\n",
+		result, report.Mode, report.Added, report.Changed, report.Removed, report.Unchanged)
+	// Повтор загрузки в режиме counters-add учел бы значения дважды, поэтому ошибка записи только сообщается.
+	if !report.DryRun && !report.Persisted {
+		return fmt.Errorf("метрики загружены в память сервера, но не записаны в хранилища, повторять загрузку не нужно: %s",
+			report.PersistError)
+	}
+
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: admin export|import [flags]")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		log.Fatal("не указана команда")
+	}
+
+	commands := map[string]func([]string) error{
+		"export": export,
+		"import": load,
+	}
+
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		log.Fatalf("неизвестная команда: %s", os.Args[1])
+	}
+	if err := command(os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+}
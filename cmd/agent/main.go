@@ -3,15 +3,19 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -24,7 +28,9 @@ import (
 	"github.com/andynikk/advancedmetrics/internal/encoding"
 	"github.com/andynikk/advancedmetrics/internal/encryption"
 	"github.com/andynikk/advancedmetrics/internal/environment"
+	"github.com/andynikk/advancedmetrics/internal/networks"
 	"github.com/andynikk/advancedmetrics/internal/repository"
+	"github.com/andynikk/advancedmetrics/internal/signature"
 )
 
 type MetricsGauge map[string]repository.Gauge
@@ -40,6 +46,10 @@ type data struct {
 type agent struct {
 	cfg           *environment.AgentConfig
 	KeyEncryption *encryption.KeyEncryption
+	realIP        string
+	client        *http.Client
+	signKey       ed25519.PrivateKey
+	hashScheme    atomic.Value
 	data
 }
 
@@ -58,8 +68,8 @@ func (eam *emtyArrMetrics) prepareMetrics(key *encryption.KeyEncryption) ([]byte
 		return nil, err
 	}
 
-	if key.PublicKey != nil {
-		gziparrMetrics, err = key.RsaEncrypt(gziparrMetrics)
+	if key != nil && key.PublicKey != nil {
+		gziparrMetrics, err = key.Encrypt(gziparrMetrics)
 		if err != nil {
 			return nil, err
 		}
@@ -163,9 +173,41 @@ func (a *agent) goMetrixScan(ctx context.Context, cancelFunc context.CancelFunc)
 	}
 }
 
+// currentHashScheme схема хеширования метрик, согласованная с сервером.
+func (a *agent) currentHashScheme() string {
+	if scheme, ok := a.hashScheme.Load().(string); ok {
+		return scheme
+	}
+	if a.cfg != nil && a.cfg.HashScheme != "" {
+		return a.cfg.HashScheme
+	}
+	return constants.HashSchemeV1
+}
+
+// negotiateHashScheme переходит на схему v1, если сервер не сообщил о поддержке текущей схемы.
+// Старый сервер не присылает заголовок Accept-Hash-Scheme и проверяет хеши только по схеме v1.
+func (a *agent) negotiateHashScheme(resp *http.Response) {
+	scheme := a.currentHashScheme()
+	if scheme == constants.HashSchemeV1 {
+		return
+	}
+	for _, accepted := range strings.Split(resp.Header.Get(constants.HeaderAcceptHashScheme), ",") {
+		if strings.TrimSpace(accepted) == scheme {
+			return
+		}
+	}
+	constants.Logger.InfoLog(fmt.Sprintf("server does not accept hash scheme %s, falling back to %s",
+		scheme, constants.HashSchemeV1))
+	a.hashScheme.Store(constants.HashSchemeV1)
+}
+
 func (a *agent) Post2Server(allMterics []byte) error {
 
-	addressPost := fmt.Sprintf("http://%s/updates", a.cfg.Address)
+	scheme := a.cfg.Scheme
+	if scheme == "" {
+		scheme = constants.SchemeHTTP
+	}
+	addressPost := fmt.Sprintf("%s://%s/updates", scheme, a.cfg.Address)
 
 	req, err := http.NewRequest("POST", addressPost, bytes.NewReader(allMterics))
 	if err != nil {
@@ -174,21 +216,65 @@ func (a *agent) Post2Server(allMterics []byte) error {
 
 		return errors.New("-- ошибка отправки данных на сервер (1)")
 	}
+	// По идентификатору запроса ошибку агента можно найти в журнале сервера.
+	requestID, err := cryptohash.NewNonce()
+	if err != nil {
+		constants.Logger.ErrorLog(err)
+		return errors.New("-- ошибка отправки данных на сервер (4)")
+	}
+	req.Header.Set(constants.HeaderRequestID, requestID)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Content-Encoding", "gzip")
-	if a.KeyEncryption.PublicKey != nil {
+	if a.realIP != "" {
+		req.Header.Set(constants.HeaderRealIP, a.realIP)
+	}
+	if a.cfg.Key != "" {
+		req.Header.Set(constants.HeaderHashScheme, a.currentHashScheme())
+	}
+	if a.cfg.Key != "" || a.signKey != nil {
+		nonce, err := cryptohash.NewNonce()
+		if err != nil {
+			constants.Logger.ErrorLog(err)
+			return errors.New("-- ошибка отправки данных на сервер (3)")
+		}
+		timestamp := cryptohash.FormatTimestamp(time.Now())
+
+		req.Header.Set(constants.HeaderTimestamp, timestamp)
+		req.Header.Set(constants.HeaderNonce, nonce)
+		if a.cfg.Key != "" {
+			hmacSignature := cryptohash.SignRequest(a.cfg.Key, req.Method, req.URL.Path, timestamp, nonce, allMterics)
+			req.Header.Set(constants.HeaderSignature, hmacSignature)
+		}
+		if a.signKey != nil {
+			message := cryptohash.RequestMessage(req.Method, req.URL.Path, timestamp, nonce, allMterics)
+			if a.cfg.AgentID != "" {
+				req.Header.Set(constants.HeaderAgentID, a.cfg.AgentID)
+			}
+			req.Header.Set(constants.HeaderAgentSignature, signature.Sign(a.signKey, []byte(message)))
+		}
+	}
+	if a.KeyEncryption != nil && a.KeyEncryption.PublicKey != nil {
 		req.Header.Set("Content-Encryption", a.KeyEncryption.TypeEncryption)
+		req.Header.Set(constants.HeaderKeyID, a.KeyEncryption.KeyID)
 	}
 
 	defer req.Body.Close()
 
-	client := &http.Client{}
+	client := a.client
+	if client == nil {
+		client = &http.Client{}
+	}
 	resp, err := client.Do(req)
 	if err != nil {
-		constants.Logger.ErrorLog(err)
+		constants.Logger.Log.Error().Err(err).Str("request_id", requestID).Msg("")
 		return errors.New("-- ошибка отправки данных на сервер (2)")
 	}
 	defer resp.Body.Close()
+	a.negotiateHashScheme(resp)
+	if resp.StatusCode >= http.StatusBadRequest {
+		constants.Logger.Log.Warn().Str("request_id", requestID).Int("status", resp.StatusCode).
+			Msg("server rejected metrics")
+	}
 
 	return nil
 }
@@ -220,14 +306,13 @@ func (a *agent) SendMetricsServer() (MapMetricsButch, error) {
 	allMetrics := make(emtyArrMetrics, 0)
 	i := 0
 	sch := 0
+	hashScheme := a.currentHashScheme()
 	tempMetricsGauge := &a.data.metricsGauge
 	for key, val := range *tempMetricsGauge {
 		valFloat64 := float64(val)
 
-		msg := fmt.Sprintf("%s:gauge:%f", key, valFloat64)
-		heshVal := cryptohash.HeshSHA256(msg, a.cfg.Key)
-
-		metrica := encoding.Metrics{ID: key, MType: val.Type(), Value: &valFloat64, Hash: heshVal}
+		metrica := encoding.Metrics{ID: key, MType: val.Type(), Value: &valFloat64}
+		metrica.Hash = cryptohash.MetricHash(hashScheme, a.cfg.Key, &metrica)
 		allMetrics = append(allMetrics, metrica)
 
 		i++
@@ -244,10 +329,8 @@ func (a *agent) SendMetricsServer() (MapMetricsButch, error) {
 	}
 
 	cPollCount := repository.Counter(a.data.pollCount)
-	msg := fmt.Sprintf("%s:counter:%d", "PollCount", a.data.pollCount)
-	heshVal := cryptohash.HeshSHA256(msg, a.cfg.Key)
-
-	metrica := encoding.Metrics{ID: "PollCount", MType: cPollCount.Type(), Delta: &a.data.pollCount, Hash: heshVal}
+	metrica := encoding.Metrics{ID: "PollCount", MType: cPollCount.Type(), Delta: &a.data.pollCount}
+	metrica.Hash = cryptohash.MetricHash(hashScheme, a.cfg.Key, &metrica)
 	allMetrics = append(allMetrics, metrica)
 
 	mapMatricsButch[sch] = allMetrics
@@ -281,6 +364,9 @@ func main() {
 	fmt.Println(fmt.Sprintf("Build commit: %s", buildCommit))
 
 	configAgent := environment.InitConfigAgent()
+	if err := configAgent.Validate(); err != nil {
+		log.Fatal(err)
+	}
 	certPublicKey, _ := encryption.InitPublicKey(configAgent.CryptoKey)
 
 	a := agent{
@@ -292,6 +378,33 @@ func main() {
 		KeyEncryption: certPublicKey,
 	}
 
+	if configAgent.Scheme == constants.SchemeHTTPS {
+		tlsConfig, err := encryption.ClientTLSConfig(configAgent.TLSCA, configAgent.TLSCert, configAgent.TLSKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+
+	if !cryptohash.SupportedHashScheme(configAgent.HashScheme) {
+		log.Fatalf("неизвестная схема хеширования: %s", configAgent.HashScheme)
+	}
+
+	if configAgent.SignKey != "" {
+		signKey, err := signature.LoadPrivateKey(configAgent.SignKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.signKey = signKey
+	}
+
+	outboundIP, err := networks.GetOutboundIP(configAgent.Address)
+	if err != nil {
+		constants.Logger.ErrorLog(err)
+	} else {
+		a.realIP = outboundIP.String()
+	}
+
 	ctx, cancelFunc := context.WithCancel(context.Background())
 
 	go a.goMetrixScan(ctx, cancelFunc)
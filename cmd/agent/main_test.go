@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"io"
 	"net/http"
@@ -199,3 +200,40 @@ func BenchmarkSendMetrics(b *testing.B) {
 	}
 	wg.Wait()
 }
+
+func TestPost2ServerAgentID(t *testing.T) {
+	_, signKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+	}))
+	defer ts.Close()
+
+	a := agent{cfg: &environment.AgentConfig{Address: strings.TrimPrefix(ts.URL, "http://")}, signKey: signKey}
+
+	t.Run("Checking empty agent id", func(t *testing.T) {
+		if err = a.Post2Server([]byte("[]")); err != nil {
+			t.Fatal(err)
+		}
+		if len(header.Values(constants.HeaderAgentID)) != 0 {
+			t.Errorf("Error empty %s header sent", constants.HeaderAgentID)
+		}
+		if header.Get(constants.HeaderAgentSignature) == "" {
+			t.Error("Error request without agent signature")
+		}
+	})
+
+	t.Run("Checking agent id", func(t *testing.T) {
+		a.cfg.AgentID = "agent-1"
+		if err = a.Post2Server([]byte("[]")); err != nil {
+			t.Fatal(err)
+		}
+		if header.Get(constants.HeaderAgentID) != "agent-1" {
+			t.Errorf("Error %s header: %q", constants.HeaderAgentID, header.Get(constants.HeaderAgentID))
+		}
+	})
+}
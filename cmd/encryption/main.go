@@ -1,17 +1,235 @@
+// Утилита выпуска и проверки сертификатов и ключей.
+//
+// Команды:
+//
+//	generate  самоподписанный сертификат и ключ (по умолчанию publicKey.cer и privateKey.pfx)
+//	ca        сертификат и ключ собственного удостоверяющего центра
+//	issue     сертификат агента или сервера, подписанный удостоверяющим центром
+//	inspect   описание сертификата
+//	check     проверка срока действия сертификата
+//
+// Без команды, как и прежде, выполняется generate: в рабочем каталоге создаются publicKey.cer и privateKey.pfx.
+// Флаги без команды относятся к generate.
+// Параметры команды: encryption <команда> -help
 package main
 
 import (
-	"github.com/andynikk/advancedmetrics/internal/constants"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/andynikk/advancedmetrics/internal/encryption"
 )
 
-func main() {
-	arrCert, err := encryption.CreateCert()
+type certFlags struct {
+	certPath     *string
+	keyPath      *string
+	keyType      *string
+	keyBits      *int
+	serialNumber *int64
+	validity     *time.Duration
+	commonName   *string
+	organization *string
+	country      *string
+	hosts        *string
+	force        *bool
+}
+
+func newCertFlags(fs *flag.FlagSet, certPath string, keyPath string, commonName string, hosts string) certFlags {
+	return certFlags{
+		certPath:     fs.String("cert", certPath, "файл сертификата"),
+		keyPath:      fs.String("key", keyPath, "файл приватного ключа"),
+		keyType:      fs.String("key-type", encryption.KeyTypeRSA, "тип ключа: rsa, ecdsa, ed25519"),
+		keyBits:      fs.Int("bits", 0, "длина ключа: rsa 4096 по умолчанию, ecdsa 256, 384 или 521"),
+		serialNumber: fs.Int64("serial", 0, "серийный номер сертификата, 0 - случайный"),
+		validity:     fs.Duration("validity", encryption.DefaultCertValidity(), "срок действия сертификата"),
+		commonName:   fs.String("cn", commonName, "имя субъекта (CN)"),
+		organization: fs.String("org", "AdvancedMetrics", "организация субъекта"),
+		country:      fs.String("country", "RU", "страна субъекта"),
+		hosts:        fs.String("hosts", hosts, "DNS-имена и IP-адреса через запятую"),
+		force:        fs.Bool("force", false, "перезаписать существующие файлы"),
+	}
+}
+
+func (cf certFlags) options() encryption.CertOptions {
+	var hosts []string
+	for _, host := range strings.Split(*cf.hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return encryption.CertOptions{
+		KeyType:      *cf.keyType,
+		KeyBits:      *cf.keyBits,
+		SerialNumber: *cf.serialNumber,
+		CommonName:   *cf.commonName,
+		Organization: *cf.organization,
+		Country:      *cf.country,
+		Validity:     *cf.validity,
+		Hosts:        hosts,
+	}
+}
+
+func (cf certFlags) save(pair *encryption.CertKeyPair) error {
+	if err := encryption.SaveKeyInFile(&pair.CertPEM, *cf.certPath, 0644, *cf.force); err != nil {
+		return err
+	}
+	if err := encryption.SaveKeyInFile(&pair.KeyPEM, *cf.keyPath, 0600, *cf.force); err != nil {
+		return err
+	}
+	fmt.Printf("certificate: %s\nprivate key: %s\n", *cf.certPath, *cf.keyPath)
+	fmt.Print(encryption.DescribeCertificate(pair.Cert))
+
+	return nil
+}
+
+// generate самоподписанный сертификат, он же корень доверия для TLS.
+func generate(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	cf := newCertFlags(fs, "publicKey.cer", "privateKey.pfx", "localhost", "localhost,127.0.0.1,::1")
+	_ = fs.Parse(args)
+
+	opts := cf.options()
+	opts.IsCA = true
+	pair, err := encryption.CreateCertificate(opts)
+	if err != nil {
+		return err
+	}
+	return cf.save(pair)
+}
+
+// ca сертификат собственного удостоверяющего центра.
+func ca(args []string) error {
+	fs := flag.NewFlagSet("ca", flag.ExitOnError)
+	cf := newCertFlags(fs, "ca.cer", "ca.pfx", "AdvancedMetrics CA", "")
+	_ = fs.Parse(args)
+
+	opts := cf.options()
+	opts.IsCA = true
+	pair, err := encryption.CreateCertificate(opts)
 	if err != nil {
-		constants.Logger.ErrorLog(err)
-		return
+		return err
+	}
+	return cf.save(pair)
+}
+
+// issue сертификат агента или сервера, подписанный удостоверяющим центром.
+func issue(args []string) error {
+	fs := flag.NewFlagSet("issue", flag.ExitOnError)
+	caCertPath := fs.String("ca-cert", "ca.cer", "сертификат удостоверяющего центра")
+	caKeyPath := fs.String("ca-key", "ca.pfx", "приватный ключ удостоверяющего центра")
+	cf := newCertFlags(fs, "", "", "", "")
+	_ = fs.Parse(args)
+
+	if *cf.commonName == "" {
+		return errors.New("не указано имя субъекта (-cn)")
+	}
+	if *cf.certPath == "" {
+		*cf.certPath = *cf.commonName + ".cer"
+	}
+	if *cf.keyPath == "" {
+		*cf.keyPath = *cf.commonName + ".pfx"
 	}
 
-	encryption.SaveKeyInFile(&arrCert[0], "publicKey.cer")
-	encryption.SaveKeyInFile(&arrCert[1], "privateKey.pfx")
+	caCert, err := encryption.LoadCertificate(*caCertPath)
+	if err != nil {
+		return err
+	}
+	caKey, err := encryption.LoadSigner(*caKeyPath)
+	if err != nil {
+		return err
+	}
+	if !caCert.IsCA {
+		return fmt.Errorf("сертификат %s не является сертификатом удостоверяющего центра", *caCertPath)
+	}
+
+	opts := cf.options()
+	opts.Parent = caCert
+	opts.ParentKey = caKey
+	if caCert.NotAfter.Before(time.Now().Add(opts.Validity)) {
+		opts.Validity = time.Until(caCert.NotAfter)
+	}
+	pair, err := encryption.CreateCertificate(opts)
+	if err != nil {
+		return err
+	}
+	return cf.save(pair)
+}
+
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	certPath := fs.String("cert", "publicKey.cer", "файл сертификата")
+	_ = fs.Parse(args)
+
+	cert, err := encryption.LoadCertificate(*certPath)
+	if err != nil {
+		return err
+	}
+	fmt.Print(encryption.DescribeCertificate(cert))
+
+	return nil
+}
+
+// check завершается с ошибкой, если хотя бы один сертификат истек или истекает раньше, чем через -warn.
+func check(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	warn := fs.Duration("warn", 30*24*time.Hour, "предупреждать, если до окончания срока действия осталось меньше")
+	_ = fs.Parse(args)
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"publicKey.cer"}
+	}
+
+	failed := 0
+	for _, path := range paths {
+		cert, err := encryption.LoadCertificate(path)
+		if err == nil {
+			err = encryption.CheckExpiry(cert, time.Now(), *warn)
+		}
+		if err != nil {
+			failed++
+			fmt.Printf("%s: %s\n", path, err.Error())
+			continue
+		}
+		fmt.Printf("%s: OK, действует до %s\n", path, cert.NotAfter.Format(time.RFC3339))
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("проблемных сертификатов: %d", failed)
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: encryption [generate|ca|issue|inspect|check] [flags]")
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		args = append([]string{"generate"}, args...)
+	}
+
+	commands := map[string]func([]string) error{
+		"generate": generate,
+		"ca":       ca,
+		"issue":    issue,
+		"inspect":  inspect,
+		"check":    check,
+	}
+
+	command, ok := commands[args[0]]
+	if !ok {
+		usage()
+		log.Fatalf("неизвестная команда: %s", args[0])
+	}
+	if err := command(args[1:]); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,508 @@
+// Клиент командной строки сервера метрик.
+//
+// Команды:
+//
+//	push   отправка метрик: из аргументов "тип имя значение ..." или со стандартного ввода
+//	       (JSON-массив или объект encoding.Metrics, либо строки "тип имя значение")
+//	get    значение метрики: get <тип> <имя>
+//	list   все метрики с главной страницы сервера
+//	watch  опрос метрики с интервалом -interval и вывод изменений: watch <тип> <имя>
+//
+// Запросы отправляются так же, как их отправляет агент: тело сжимается gzip (-gzip),
+// шифруется открытым ключом сервера (-crypto-key), метрики и запрос подписываются ключом -k,
+// запрос подписывается ключом Ed25519 агента -agent-key от имени агента -agent-id.
+// По https (-scheme https) сервер проверяется по сертификатам -ca, для mTLS указываются
+// сертификат -cert и ключ -key-file клиента.
+// Адрес сервера, ключи и пути к файлам берутся также из переменных окружения ADDRESS, KEY, CRYPTO_KEY,
+// TLS_CA, TLS_CERT, TLS_KEY, AGENT_ID и SIGN_KEY, как у агента.
+// Вывод - таблица или JSON (-o table|json).
+// Параметры команды: metricsctl <команда> -help
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/compression"
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/cryptohash"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/encryption"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+	"github.com/andynikk/advancedmetrics/internal/signature"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// listItem строка метрики на главной странице сервера.
+var listItem = regexp.MustCompile(`<li><b>(.*) = (.*)</b></li>`)
+
+type client struct {
+	address    *string
+	scheme     *string
+	key        *string
+	hashScheme *string
+	cryptoKey  *string
+	tlsCA      *string
+	tlsCert    *string
+	tlsKey     *string
+	agentID    *string
+	agentKey   *string
+	gzip       *bool
+	output     *string
+	timeout    *time.Duration
+
+	ke      *encryption.KeyEncryption
+	signKey ed25519.PrivateKey
+	http    *http.Client
+}
+
+func newClient(fs *flag.FlagSet) *client {
+	address := os.Getenv("ADDRESS")
+	if address == "" {
+		address = constants.AddressServer
+	}
+	return &client{
+		address:    fs.String("a", address, "адрес сервера"),
+		scheme:     fs.String("scheme", constants.SchemeHTTP, "протокол: http или https"),
+		key:        fs.String("k", os.Getenv("KEY"), "ключ хеша метрик и подписи запросов"),
+		hashScheme: fs.String("hash-scheme", constants.HashSchemeV1, "схема хеширования метрик: v1 или v2"),
+		cryptoKey:  fs.String("crypto-key", os.Getenv("CRYPTO_KEY"), "файл с открытым ключом сервера"),
+		tlsCA:      fs.String("ca", os.Getenv("TLS_CA"), "сертификаты, по которым проверяется сервер https"),
+		tlsCert:    fs.String("cert", os.Getenv("TLS_CERT"), "сертификат клиента для mTLS"),
+		tlsKey:     fs.String("key-file", os.Getenv("TLS_KEY"), "ключ сертификата клиента для mTLS"),
+		agentID:    fs.String("agent-id", os.Getenv("AGENT_ID"), "идентификатор агента в реестре доверенных агентов"),
+		agentKey:   fs.String("agent-key", os.Getenv("SIGN_KEY"), "файл с приватным ключом Ed25519 агента"),
+		gzip:       fs.Bool("gzip", true, "сжимать запросы и принимать сжатые ответы gzip"),
+		output:     fs.String("o", outputTable, "формат вывода: table или json"),
+		timeout:    fs.Duration("timeout", 5*time.Second, "время ожидания ответа сервера"),
+	}
+}
+
+// init проверяет параметры, загружает открытый ключ сервера, ключ агента и настройки TLS.
+func (c *client) init() error {
+	if *c.output != outputTable && *c.output != outputJSON {
+		return fmt.Errorf("неизвестный формат вывода: %s", *c.output)
+	}
+	if !cryptohash.SupportedHashScheme(*c.hashScheme) {
+		return fmt.Errorf("неизвестная схема хеширования: %s", *c.hashScheme)
+	}
+	if *c.cryptoKey != "" {
+		ke, err := encryption.InitPublicKey(*c.cryptoKey)
+		if err != nil {
+			return err
+		}
+		c.ke = ke
+	}
+	if *c.agentKey != "" {
+		if *c.agentID == "" {
+			return errors.New("для подписи ключом агента нужен идентификатор агента -agent-id")
+		}
+		signKey, err := signature.LoadPrivateKey(*c.agentKey)
+		if err != nil {
+			return err
+		}
+		c.signKey = signKey
+	}
+
+	c.http = &http.Client{Timeout: *c.timeout}
+	if *c.scheme == constants.SchemeHTTPS {
+		tlsConfig, err := encryption.ClientTLSConfig(*c.tlsCA, *c.tlsCert, *c.tlsKey)
+		if err != nil {
+			return err
+		}
+		c.http.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	return nil
+}
+
+// do отправляет запрос и возвращает тело ответа.
+// Тело запроса сжимается, шифруется и подписывается, как у агента. Ответ не 200 возвращается как ошибка.
+func (c *client) do(method string, path string, body []byte) ([]byte, *http.Response, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("%s://%s%s", *c.scheme, *c.address, path), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+		if *c.gzip {
+			if body, err = compression.Compress(body); err != nil {
+				return nil, nil, err
+			}
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		if c.ke != nil {
+			if body, err = c.ke.Encrypt(body); err != nil {
+				return nil, nil, err
+			}
+			req.Header.Set("Content-Encryption", c.ke.TypeEncryption)
+			req.Header.Set(constants.HeaderKeyID, c.ke.KeyID)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	if *c.gzip {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	if *c.key != "" {
+		req.Header.Set(constants.HeaderHashScheme, *c.hashScheme)
+	}
+	if *c.key != "" || c.signKey != nil {
+		nonce, err := cryptohash.NewNonce()
+		if err != nil {
+			return nil, nil, err
+		}
+		timestamp := cryptohash.FormatTimestamp(time.Now())
+		req.Header.Set(constants.HeaderTimestamp, timestamp)
+		req.Header.Set(constants.HeaderNonce, nonce)
+		if *c.key != "" {
+			req.Header.Set(constants.HeaderSignature,
+				cryptohash.SignRequest(*c.key, req.Method, req.URL.Path, timestamp, nonce, body))
+		}
+		if c.signKey != nil {
+			message := cryptohash.RequestMessage(req.Method, req.URL.Path, timestamp, nonce, body)
+			req.Header.Set(constants.HeaderAgentID, *c.agentID)
+			req.Header.Set(constants.HeaderAgentSignature, signature.Sign(c.signKey, []byte(message)))
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.Contains(resp.Header.Get("Content-Encoding"), "gzip") {
+		if respBody, err = compression.Decompress(respBody); err != nil {
+			return nil, nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(respBody))
+	}
+	return respBody, resp, nil
+}
+
+// print выводит метрики таблицей или JSON-массивом.
+func (c *client) print(metrics encoding.ArrMetrics) error {
+	if *c.output == outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(metrics)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tNAME\tVALUE")
+	for _, m := range metrics {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", m.MType, m.ID, repository.MetricText(m))
+	}
+	return tw.Flush()
+}
+
+// listedMetric метрика главной страницы: только имя и значение, тип страница не сообщает.
+type listedMetric struct {
+	ID    string `json:"id"`
+	Value string `json:"value"`
+}
+
+// parseMetric метрика из текстовых типа, имени и значения.
+func parseMetric(mType string, id string, value string) (encoding.Metrics, error) {
+	m := encoding.Metrics{ID: id, MType: mType}
+	switch mType {
+	case "gauge":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return m, fmt.Errorf("%w: %s: %s", repository.ErrBadValue, id, value)
+		}
+		m.Value = &v
+	case "counter":
+		d, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return m, fmt.Errorf("%w: %s: %s", repository.ErrBadValue, id, value)
+		}
+		m.Delta = &d
+	default:
+		return m, fmt.Errorf("%w: %s", repository.ErrUnknownType, mType)
+	}
+	return m, nil
+}
+
+// readMetrics метрики со стандартного ввода: JSON или строки "тип имя значение".
+func readMetrics(r io.Reader) (encoding.ArrMetrics, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		var metrics encoding.ArrMetrics
+		err = json.Unmarshal(trimmed, &metrics)
+		return metrics, err
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		var m encoding.Metrics
+		err = json.Unmarshal(trimmed, &m)
+		return encoding.ArrMetrics{m}, err
+	}
+
+	var metrics encoding.ArrMetrics
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("строка %d: ожидается \"тип имя значение\"", n)
+		}
+		m, err := parseMetric(fields[0], fields[1], fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("строка %d: %w", n, err)
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, scanner.Err()
+}
+
+// push отправляет метрики на "/updates" пакетами по batch метрик, подписывая каждую метрику ключом.
+func (c *client) push(metrics encoding.ArrMetrics, batch int) error {
+	for i := range metrics {
+		metrics[i].Hash = ""
+		if *c.key != "" {
+			metrics[i].Hash = cryptohash.MetricHash(*c.hashScheme, *c.key, &metrics[i])
+		}
+	}
+
+	size := batch
+	if size <= 0 {
+		size = len(metrics)
+	}
+	for sent := metrics; len(sent) != 0; {
+		n := size
+		if n > len(sent) {
+			n = len(sent)
+		}
+		body, err := json.Marshal(sent[:n])
+		if err != nil {
+			return err
+		}
+		if _, _, err = c.do(http.MethodPost, "/updates", body); err != nil {
+			return err
+		}
+		sent = sent[n:]
+	}
+
+	return nil
+}
+
+func push(args []string) error {
+	fs := flag.NewFlagSet("push", flag.ExitOnError)
+	c := newClient(fs)
+	batch := fs.Int("batch", constants.WriteFlushSize, "количество метрик в одном запросе")
+	_ = fs.Parse(args)
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	var metrics encoding.ArrMetrics
+	if fs.NArg() == 0 {
+		var err error
+		if metrics, err = readMetrics(os.Stdin); err != nil {
+			return err
+		}
+	} else {
+		if fs.NArg()%3 != 0 {
+			return errors.New("метрики задаются тройками \"тип имя значение\"")
+		}
+		for i := 0; i < fs.NArg(); i += 3 {
+			m, err := parseMetric(fs.Arg(i), fs.Arg(i+1), fs.Arg(i+2))
+			if err != nil {
+				return err
+			}
+			metrics = append(metrics, m)
+		}
+	}
+	if len(metrics) == 0 {
+		return errors.New("нет метрик для отправки")
+	}
+
+	if err := c.push(metrics, *batch); err != nil {
+		return err
+	}
+	return c.print(metrics)
+}
+
+// value запрашивает значение метрики и проверяет его хеш, если задан ключ.
+func (c *client) value(mType string, id string) (encoding.Metrics, error) {
+	body, err := json.Marshal(encoding.Metrics{ID: id, MType: mType})
+	if err != nil {
+		return encoding.Metrics{}, err
+	}
+	respBody, resp, err := c.do(http.MethodPost, "/value", body)
+	if err != nil {
+		return encoding.Metrics{}, err
+	}
+
+	var m encoding.Metrics
+	if err = json.Unmarshal(respBody, &m); err != nil {
+		return encoding.Metrics{}, err
+	}
+	if *c.key != "" {
+		scheme := resp.Header.Get(constants.HeaderHashScheme)
+		if scheme == "" {
+			scheme = constants.HashSchemeV1
+		}
+		if !cryptohash.VerifyMetricHash(scheme, *c.key, &m) {
+			return encoding.Metrics{}, fmt.Errorf("метрика %s: неверный хеш ответа сервера", id)
+		}
+	}
+	return m, nil
+}
+
+func get(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	c := newClient(fs)
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("usage: metricsctl get <тип> <имя>")
+	}
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	m, err := c.value(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	return c.print(encoding.ArrMetrics{m})
+}
+
+func list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	c := newClient(fs)
+	_ = fs.Parse(args)
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	body, _, err := c.do(http.MethodGet, "/", nil)
+	if err != nil {
+		return err
+	}
+
+	metrics := make([]listedMetric, 0)
+	for _, item := range listItem.FindAllStringSubmatch(string(body), -1) {
+		metrics = append(metrics, listedMetric{ID: html.UnescapeString(item[1]), Value: html.UnescapeString(item[2])})
+	}
+
+	if *c.output == outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(metrics)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVALUE")
+	for _, m := range metrics {
+		fmt.Fprintf(tw, "%s\t%s\n", m.ID, m.Value)
+	}
+	return tw.Flush()
+}
+
+func watch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	c := newClient(fs)
+	interval := fs.Duration("interval", time.Second, "интервал опроса")
+	count := fs.Int("count", 0, "количество опросов, 0 - без ограничения")
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("usage: metricsctl watch <тип> <имя>")
+	}
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	last := ""
+	for n := 0; *count == 0 || n < *count; n++ {
+		if n != 0 {
+			<-ticker.C
+		}
+		m, err := c.value(fs.Arg(0), fs.Arg(1))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		value := repository.MetricText(m)
+		if value == last {
+			continue
+		}
+		last = value
+
+		if *c.output == outputJSON {
+			observed := struct {
+				encoding.Metrics
+				Time time.Time `json:"time"`
+			}{m, time.Now()}
+			if err = json.NewEncoder(os.Stdout).Encode(observed); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Printf("%s  %s %s = %s\n", time.Now().Format(time.RFC3339), m.MType, m.ID, value)
+	}
+
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: metricsctl push|get|list|watch [flags] [args]")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		log.Fatal("не указана команда")
+	}
+
+	commands := map[string]func([]string) error{
+		"push":  push,
+		"get":   get,
+		"list":  list,
+		"watch": watch,
+	}
+
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		log.Fatalf("неизвестная команда: %s", os.Args[1])
+	}
+	if err := command(os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andynikk/advancedmetrics/internal/encryption"
+	"github.com/andynikk/advancedmetrics/internal/environment"
+	"github.com/andynikk/advancedmetrics/internal/handlers"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+	"github.com/andynikk/advancedmetrics/internal/signature"
+)
+
+func TestReadMetrics(t *testing.T) {
+	t.Run("Checking lines", func(t *testing.T) {
+		metrics, err := readMetrics(strings.NewReader("# comment\ngauge Alloc 1.5\n\ncounter PollCount 3\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != 2 || *metrics[0].Value != 1.5 || *metrics[1].Delta != 3 {
+			t.Errorf("Error read lines: %v", metrics)
+		}
+	})
+
+	t.Run("Checking json", func(t *testing.T) {
+		metrics, err := readMetrics(strings.NewReader(`{"id":"PollCount","type":"counter","delta":2}`))
+		if err != nil || len(metrics) != 1 || *metrics[0].Delta != 2 {
+			t.Errorf("Error read json: %v %v", metrics, err)
+		}
+	})
+
+	t.Run("Checking errors", func(t *testing.T) {
+		if _, err := readMetrics(strings.NewReader("counter PollCount 1.5\n")); err == nil {
+			t.Error("Error bad counter value accepted")
+		}
+		if _, err := readMetrics(strings.NewReader("gauge Alloc\n")); err == nil {
+			t.Error("Error short line accepted")
+		}
+	})
+}
+
+func TestClient(t *testing.T) {
+	const key = "secret"
+
+	srv := new(handlers.RepStore)
+	srv.Repo = repository.NewStore()
+	srv.Config = &environment.ServerConfig{Key: key, RequireSignature: true}
+	handlers.InitRoutersMux(srv)
+
+	ts := httptest.NewServer(srv.Router)
+	defer ts.Close()
+
+	newTestClient := func(t *testing.T, args ...string) *client {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		c := newClient(fs)
+		args = append([]string{"-a", strings.TrimPrefix(ts.URL, "http://"), "-k", key, "-crypto-key", "", "-o", "json"}, args...)
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.init(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	for _, hashScheme := range []string{"v1", "v2"} {
+		t.Run("Checking push and get "+hashScheme, func(t *testing.T) {
+			c := newTestClient(t, "-hash-scheme", hashScheme)
+
+			metrics, err := readMetrics(strings.NewReader("counter Pushed 2\ngauge Load 0.25\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = c.push(metrics, 1); err != nil {
+				t.Fatal(err)
+			}
+			if metrics[0].Hash == "" {
+				t.Error("Error pushed metric is not hashed")
+			}
+
+			m, err := c.value("gauge", "Load")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *m.Value != 0.25 {
+				t.Errorf("Error get value: %v", *m.Value)
+			}
+		})
+	}
+
+	t.Run("Checking encryption", func(t *testing.T) {
+		pk, err := encryption.InitPrivateKey("../../privateKey.pfx")
+		if err != nil {
+			t.Skip(err)
+		}
+		srv.PK = pk
+		defer func() { srv.PK = nil }()
+
+		c := newTestClient(t, "-crypto-key", "../../publicKey.cer")
+		metrics, err := readMetrics(strings.NewReader("counter Encrypted 7\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.push(metrics, 0); err != nil {
+			t.Fatal(err)
+		}
+		if m, err := c.value("counter", "Encrypted"); err != nil || *m.Delta != 7 {
+			t.Errorf("Error encrypted push: %v %v", m, err)
+		}
+	})
+
+	t.Run("Checking wrong key", func(t *testing.T) {
+		c := newTestClient(t, "-k", "other")
+		if _, err := c.value("gauge", "Load"); err == nil {
+			t.Error("Error response hash with wrong key accepted")
+		}
+	})
+
+	t.Run("Checking not found", func(t *testing.T) {
+		c := newTestClient(t)
+		if _, err := c.value("gauge", "Missing"); err == nil || !strings.Contains(err.Error(), "404") {
+			t.Errorf("Error missing metric: %v", err)
+		}
+	})
+}
+
+func TestClientTLSAndAgentKey(t *testing.T) {
+	dir := t.TempDir()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentsDir := filepath.Join(dir, "agents")
+	if err = os.Mkdir(agentsDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(agentsDir, "agent1.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentKey := filepath.Join(dir, "agent1.pem")
+	if err = os.WriteFile(agentKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := new(handlers.RepStore)
+	srv.Repo = repository.NewStore()
+	srv.Config = &environment.ServerConfig{}
+	if srv.Agents, err = signature.NewRegistry(agentsDir); err != nil {
+		t.Fatal(err)
+	}
+	handlers.InitRoutersMux(srv)
+
+	ts := httptest.NewTLSServer(srv.Router)
+	defer ts.Close()
+
+	ca := filepath.Join(dir, "ca.cer")
+	err = os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTestClient := func(t *testing.T, args ...string) (*client, error) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		c := newClient(fs)
+		args = append([]string{"-a", strings.TrimPrefix(ts.URL, "https://"), "-scheme", "https", "-ca", ca,
+			"-k", "", "-crypto-key", "", "-cert", "", "-key-file", "", "-o", "json"}, args...)
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return c, c.init()
+	}
+
+	t.Run("Checking signed push over https", func(t *testing.T) {
+		c, err := newTestClient(t, "-agent-id", "agent1", "-agent-key", agentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics, err := readMetrics(strings.NewReader("counter Signed 5\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.push(metrics, 0); err != nil {
+			t.Fatal(err)
+		}
+		if m, ok := srv.Repo.Get("Signed"); !ok || *m.Delta != 5 {
+			t.Errorf("Error signed push: %v", m)
+		}
+	})
+
+	t.Run("Checking push without agent key", func(t *testing.T) {
+		c, err := newTestClient(t, "-agent-id", "", "-agent-key", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics, _ := readMetrics(strings.NewReader("counter Unsigned 1\n"))
+		if err = c.push(metrics, 0); err == nil || !strings.Contains(err.Error(), "401") {
+			t.Errorf("Error unsigned push: %v", err)
+		}
+	})
+
+	t.Run("Checking agent key without id", func(t *testing.T) {
+		if _, err := newTestClient(t, "-agent-id", "", "-agent-key", agentKey); err == nil {
+			t.Error("Error agent key without agent id accepted")
+		}
+	})
+
+	t.Run("Checking unknown server certificate", func(t *testing.T) {
+		c, err := newTestClient(t, "-ca", "", "-agent-id", "agent1", "-agent-key", agentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = c.do("GET", "/healthz", nil); err == nil {
+			t.Error("Error server with unknown certificate accepted")
+		}
+	})
+}
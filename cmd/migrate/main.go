@@ -0,0 +1,145 @@
+// Утилита миграций схемы базы данных метрик.
+//
+// Команды:
+//
+//	status  список миграций и отметка о применении
+//	up      применение миграций, -to ограничивает номер последней применяемой миграции
+//	down    откат последних миграций, по умолчанию одной, -steps задает количество
+//
+// Строка соединения берется из флага -d или переменной окружения DATABASE_DSN.
+// Параметры команды: migrate <команда> -help
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/migrations"
+	"github.com/andynikk/advancedmetrics/internal/postgresql"
+)
+
+func dsnFlag(fs *flag.FlagSet) *string {
+	return fs.String("d", os.Getenv("DATABASE_DSN"), "строка соединения с базой")
+}
+
+func connect(ctx context.Context, dsn string) (*postgresql.DBConnector, *migrations.Migrator, error) {
+	if dsn == "" {
+		return nil, nil, errors.New("не указана строка соединения с базой (-d или DATABASE_DSN)")
+	}
+	dbc, err := postgresql.PoolDB(ctx, dsn, postgresql.PoolConfig{})
+	if err != nil {
+		return nil, nil, err
+	}
+	migrator, err := migrations.New(dbc.Pool)
+	if err != nil {
+		dbc.Pool.Close()
+		return nil, nil, err
+	}
+	return dbc, migrator, nil
+}
+
+func status(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	dsn := dsnFlag(fs)
+	_ = fs.Parse(args)
+
+	ctx := context.Background()
+	dbc, migrator, err := connect(ctx, *dsn)
+	if err != nil {
+		return err
+	}
+	defer dbc.Pool.Close()
+
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		applied := "не применена"
+		if s.Applied {
+			applied = "применена " + s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%04d %-30s %s\n", s.Version, s.Name, applied)
+	}
+
+	return nil
+}
+
+func up(args []string) error {
+	fs := flag.NewFlagSet("up", flag.ExitOnError)
+	dsn := dsnFlag(fs)
+	to := fs.Int("to", 0, "номер последней применяемой миграции, 0 - все")
+	_ = fs.Parse(args)
+
+	ctx := context.Background()
+	dbc, migrator, err := connect(ctx, *dsn)
+	if err != nil {
+		return err
+	}
+	defer dbc.Pool.Close()
+
+	applied, err := migrator.Up(ctx, *to)
+	for _, m := range applied {
+		fmt.Printf("применена %04d %s\n", m.Version, m.Name)
+	}
+	if err == nil && len(applied) == 0 {
+		fmt.Println("схема актуальна")
+	}
+
+	return err
+}
+
+func down(args []string) error {
+	fs := flag.NewFlagSet("down", flag.ExitOnError)
+	dsn := dsnFlag(fs)
+	steps := fs.Int("steps", 1, "количество откатываемых миграций")
+	_ = fs.Parse(args)
+
+	ctx := context.Background()
+	dbc, migrator, err := connect(ctx, *dsn)
+	if err != nil {
+		return err
+	}
+	defer dbc.Pool.Close()
+
+	reverted, err := migrator.Down(ctx, *steps)
+	for _, m := range reverted {
+		fmt.Printf("откачена %04d %s\n", m.Version, m.Name)
+	}
+	if err == nil && len(reverted) == 0 {
+		fmt.Println("нет примененных миграций")
+	}
+
+	return err
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: migrate status|up|down [flags]")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		log.Fatal("не указана команда")
+	}
+
+	commands := map[string]func([]string) error{
+		"status": status,
+		"up":     up,
+		"down":   down,
+	}
+
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		log.Fatalf("неизвестная команда: %s", os.Args[1])
+	}
+	if err := command(os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -2,14 +2,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encryption"
+	"github.com/andynikk/advancedmetrics/internal/environment"
 	"github.com/andynikk/advancedmetrics/internal/handlers"
+	"github.com/andynikk/advancedmetrics/internal/repository"
 )
 
 type server struct {
@@ -21,15 +30,103 @@ var buildDate = "N/A"
 var buildCommit = "N/A"
 
 // Shutdown working out the service stop.
-// We save the current values of metrics in the database.
-func Shutdown(rs *handlers.RepStore) {
-	rs.Lock()
-	defer rs.Unlock()
+// Дожидается запросов и циклов сервера, сбрасывает очередь записи, сохраняет метрики во все хранилища и закрывает их.
+// Циклы хранилищ останавливаются в их Close последними, поэтому сохранение еще может их использовать.
+func Shutdown(srv *http.Server, rs *handlers.RepStore, timeout time.Duration, cancel context.CancelFunc, loops *sync.WaitGroup) error {
+	var errs []string
+	report := func(step string, err error) {
+		if err != nil {
+			constants.Logger.ErrorLog(fmt.Errorf("shutdown: %s: %w", step, err))
+			errs = append(errs, fmt.Sprintf("%s: %s", step, err.Error()))
+		}
+	}
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), timeout)
+	defer drainCancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		report("drain requests", err)
+		report("close connections", srv.Close())
+	}
+
+	cancel()
+	loops.Wait()
+
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), timeout)
+	defer flushCancel()
+	if rs.Queue != nil {
+		report("write queue", rs.Queue.Close(flushCtx))
+	}
+
+	metrics := rs.PrepareDataBU()
+	for _, backend := range rs.Storage.List() {
+		if err := backend.Upsert(flushCtx, metrics); err != nil {
+			report("flush "+backend.Name(), err)
+			continue
+		}
+		constants.Logger.InfoLog(fmt.Sprintf("storage %s: saved %d metrics", backend.Name(), len(metrics)))
+	}
+	for _, backend := range rs.Storage.List() {
+		report("close "+backend.Name(), backend.Close())
+	}
 
-	for _, val := range rs.Config.TypeMetricsStorage {
-		val.WriteMetric(rs.PrepareDataBU())
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
 	}
 	constants.Logger.InfoLog("server stopped")
+	return nil
+}
+
+// serve принимает запросы по HTTP или HTTPS, если заданы сертификат и ключ сервера.
+// После Shutdown возвращает nil.
+func serve(srv *http.Server, cfg *environment.ServerConfig) error {
+	var err error
+	// Сертификат и ключ заданы вместе или не заданы оба, это проверяет ServerConfig.Validate.
+	if cfg.TLSCert == "" {
+		err = srv.ListenAndServe()
+	} else {
+		if srv.TLSConfig, err = encryption.ServerTLSConfig(cfg.TLSClientCA); err != nil {
+			return err
+		}
+		err = srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// reloadKeys перечитывает приватные ключи и ключи доверенных агентов с диска по сигналу SIGHUP до отмены ctx.
+// Так новый ключ добавляется к старым без перезапуска сервера.
+func (s *server) reloadKeys(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+		case <-ctx.Done():
+			return
+		}
+
+		if agents := s.storege.Agents; agents != nil {
+			if err := agents.Reload(); err != nil {
+				constants.Logger.ErrorLog(err)
+			} else {
+				constants.Logger.InfoLog(fmt.Sprintf("trusted agents reloaded: %s", strings.Join(agents.AgentIDs(), ", ")))
+			}
+		}
+
+		keyRing := s.storege.KeyRing
+		if keyRing == nil {
+			continue
+		}
+		if err := keyRing.Reload(); err != nil {
+			constants.Logger.ErrorLog(err)
+			continue
+		}
+		constants.Logger.InfoLog(fmt.Sprintf("crypto keys reloaded: %s", strings.Join(keyRing.KeyIDs(), ", ")))
+	}
 }
 
 func main() {
@@ -41,24 +138,58 @@ func main() {
 	server := new(server)
 	handlers.NewRepStore(&server.storege)
 	fmt.Println(server.storege.Config.Address)
+	// Фоновые циклы останавливает Shutdown отменой ctx, когда запросы уже обработаны.
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var loops sync.WaitGroup
+	// Значения восстанавливаются до того, как сервер начнет принимать запросы,
+	// иначе первые запросы изменили бы метрики, которые затем перезапишет восстановление.
+	// Если хранилища недоступны, восстановление повторяется в фоне, а метрики до него не принимаются.
 	if server.storege.Config.Restore {
-		go server.storege.RestoreData()
+		if _, err := server.storege.RestoreData(ctx); err != nil {
+			if !errors.Is(err, repository.ErrRestoreUnavailable) {
+				log.Fatal(err)
+			}
+			constants.Logger.ErrorLog(err)
+			loops.Add(1)
+			go func() {
+				defer loops.Done()
+				server.storege.RetryRestore(ctx, constants.RestoreRetryInterval)
+			}()
+		}
 	}
 
-	go server.storege.BackupData()
-
+	loops.Add(2)
+	go func() {
+		defer loops.Done()
+		server.storege.BackupData(ctx)
+	}()
 	go func() {
-		s := &http.Server{
-			Addr:    server.storege.Config.Address,
-			Handler: server.storege.Router}
+		defer loops.Done()
+		server.reloadKeys(ctx)
+	}()
 
-		if err := s.ListenAndServe(); err != nil {
-			constants.Logger.ErrorLog(err)
-			return
-		}
+	srv := &http.Server{
+		Addr:    server.storege.Config.Address,
+		Handler: server.storege.Router}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(srv, server.storege.Config)
 	}()
+
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
-	<-stop
-	Shutdown(&server.storege)
+	select {
+	case sig := <-stop:
+		constants.Logger.InfoLog(fmt.Sprintf("received %s, stopping server", sig))
+	case err := <-serveErr:
+		if err != nil {
+			constants.Logger.ErrorLog(err)
+		}
+	}
+	signal.Stop(stop)
+
+	if err := Shutdown(srv, &server.storege, server.storege.Config.ShutdownTimeout, cancel, &loops); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/andynikk/advancedmetrics/internal/compression"
 	"github.com/andynikk/advancedmetrics/internal/constants"
@@ -18,6 +22,7 @@ import (
 	"github.com/andynikk/advancedmetrics/internal/environment"
 	"github.com/andynikk/advancedmetrics/internal/handlers"
 	"github.com/andynikk/advancedmetrics/internal/repository"
+	"github.com/andynikk/advancedmetrics/internal/repository/repositorytest"
 	"github.com/gorilla/mux"
 )
 
@@ -26,7 +31,7 @@ func TestFuncServer(t *testing.T) {
 	var iDelta int64 = 10
 
 	rp := new(handlers.RepStore)
-	rp.MutexRepo = make(repository.MutexRepo)
+	rp.Repo = repository.NewStore()
 
 	t.Run("Checking init router", func(t *testing.T) {
 		handlers.InitRoutersMux(rp)
@@ -82,18 +87,21 @@ func TestFuncServer(t *testing.T) {
 
 	t.Run("Checking connect DB", func(t *testing.T) {
 		t.Run("Checking create DB table", func(t *testing.T) {
-			typeMetricsStorage, err := repository.InitStoreDB(rp.Config.TypeMetricsStorage, rp.Config.DatabaseDsn)
+			storage, err := repository.InitBackends(context.Background(),
+				[]string{constants.MetricsStorageDB.String()},
+				repository.BackendConfig{DatabaseDsn: rp.Config.DatabaseDsn, Migrate: true})
 			if err != nil {
 				t.Errorf(fmt.Sprintf("Error create DB table: %s", err.Error()))
 			}
-			rp.Config.TypeMetricsStorage = typeMetricsStorage
+			rp.Storage = storage
 			t.Run("Checking handlers /ping GET", func(t *testing.T) {
-				mapTypeStore := rp.Config.TypeMetricsStorage
-				if _, findKey := mapTypeStore[constants.MetricsStorageDB.String()]; !findKey {
+				backend, findKey := rp.Storage.Get(constants.MetricsStorageDB.String())
+				if !findKey {
 					t.Errorf("Error handlers /ping GET")
+					return
 				}
 
-				if mapTypeStore[constants.MetricsStorageDB.String()].ConnDB() == nil {
+				if err := backend.Health(context.Background()); err != nil {
 					t.Errorf("Error handlers /ping GET")
 				}
 			})
@@ -204,17 +212,12 @@ func TestFuncServer(t *testing.T) {
 		})
 
 		t.Run(`Checking method PrepareDataBU`, func(t *testing.T) {
-			valG := repository.Gauge(0)
-			if ok := valG.SetFromText("0.001"); !ok {
+			if _, err := rp.Repo.UpdateText("gauge", "TestGauge", "0.001"); err != nil {
 				t.Errorf(`Error method "PrepareDataBU"`)
 			}
-			rp.MutexRepo["TestGauge"] = &valG
-
-			valC := repository.Counter(0)
-			if ok := valC.SetFromText("58"); !ok {
+			if _, err := rp.Repo.UpdateText("counter", "TestCounter", "58"); err != nil {
 				t.Errorf(`Error method "PrepareDataBU"`)
 			}
-			rp.MutexRepo["TestCounter"] = &valC
 
 			data := rp.PrepareDataBU()
 			if len(data) != 2 {
@@ -224,6 +227,10 @@ func TestFuncServer(t *testing.T) {
 	})
 
 	t.Run("Checking handlers", func(t *testing.T) {
+		// Как и main, сервер принимает метрики только после восстановления.
+		if _, err := rp.RestoreData(context.Background()); err != nil {
+			t.Fatal(err)
+		}
 		ts := httptest.NewServer(rp.Router)
 		defer ts.Close()
 
@@ -312,7 +319,7 @@ func TestFuncServer(t *testing.T) {
 				ts := httptest.NewServer(r)
 
 				rp := new(handlers.RepStore)
-				rp.MutexRepo = make(repository.MutexRepo)
+				rp.Repo = repository.NewStore()
 				rp.Router = nil
 
 				r.HandleFunc("/update/{metType}/{metName}/{metValue}", rp.HandlerSetMetricaPOST).Methods("POST")
@@ -379,24 +386,23 @@ func TestFuncServer(t *testing.T) {
 		}
 
 		t.Run("Checking set val in map", func(t *testing.T) {
-			rs := new(handlers.RepStore)
-			rs.MutexRepo = make(map[string]repository.Metric)
+			repo := make(repository.MutexRepo)
 
 			arrM := testArray(configKey)
 
 			for idx, val := range arrM {
 				if idx == 0 {
 					valG := repository.Gauge(0)
-					rs.MutexRepo[val.ID] = &valG
+					repo[val.ID] = &valG
 				} else {
 					valC := repository.Counter(0)
-					rs.MutexRepo[val.ID] = &valC
+					repo[val.ID] = &valC
 				}
-				rs.MutexRepo[val.ID].Set(val)
+				repo[val.ID].Set(val)
 			}
 
 			erorr := false
-			for idx, val := range rs.MutexRepo {
+			for idx, val := range repo {
 				gauge := repository.Gauge(fValue)
 				counter := repository.Counter(iDelta)
 				if idx == "TestGauge" && val.String() != gauge.String() {
@@ -414,8 +420,7 @@ func TestFuncServer(t *testing.T) {
 
 	t.Run("Checking marshal metrics JSON", func(t *testing.T) {
 
-		for key, val := range rp.MutexRepo {
-			mt := val.GetMetrics(val.Type(), key, rp.Config.Key)
+		for _, mt := range rp.PrepareDataBU() {
 			_, err := mt.MarshalMetrica()
 			if err != nil {
 				t.Errorf("Error checking marshal metrics JSON")
@@ -475,3 +480,90 @@ func testMericCaunter(configKey string) encoding.Metrics {
 
 	return mCounter
 }
+
+func TestShutdown(t *testing.T) {
+	start := func(t *testing.T, delay time.Duration) (*http.Server, *handlers.RepStore, *repositorytest.FakeBackend, chan struct{}, string) {
+		backend := repositorytest.NewFakeBackend("shutdown")
+		rs := &handlers.RepStore{
+			Repo:    repository.NewStore(),
+			Config:  &environment.ServerConfig{StoreInterval: time.Hour},
+			Storage: repository.NewBackends(nil, backend),
+		}
+
+		// Запрос меняет метрику после задержки, как долгий запрос агента.
+		started := make(chan struct{})
+		srv := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			close(started)
+			time.Sleep(delay)
+			if _, err := rs.Repo.UpdateText("counter", "InFlight", "1"); err != nil {
+				t.Error(err)
+			}
+		})}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_ = srv.Serve(ln)
+		}()
+		return srv, rs, backend, started, "http://" + ln.Addr().String()
+	}
+
+	t.Run("Checking drain and flush", func(t *testing.T) {
+		srv, rs, backend, started, url := start(t, 100*time.Millisecond)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var loops sync.WaitGroup
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			rs.BackupData(ctx)
+		}()
+
+		status := make(chan int, 1)
+		go func() {
+			resp, err := http.Get(url)
+			if err != nil {
+				status <- 0
+				return
+			}
+			resp.Body.Close()
+			status <- resp.StatusCode
+		}()
+		<-started
+
+		if err := Shutdown(srv, rs, time.Second, cancel, &loops); err != nil {
+			t.Fatal(err)
+		}
+		if code := <-status; code != http.StatusOK {
+			t.Errorf("Error in-flight request: %d", code)
+		}
+		if ctx.Err() == nil {
+			t.Error("Error background loops not cancelled")
+		}
+		if last := backend.Last(); len(last) != 1 || last[0].ID != "InFlight" || !backend.Closed() {
+			t.Errorf("Error final flush: %v closed %v", last, backend.Closed())
+		}
+	})
+
+	t.Run("Checking drain timeout", func(t *testing.T) {
+		srv, rs, backend, started, url := start(t, time.Second)
+
+		go func() {
+			if resp, err := http.Get(url); err == nil {
+				resp.Body.Close()
+			}
+		}()
+		<-started
+
+		_, cancel := context.WithCancel(context.Background())
+		err := Shutdown(srv, rs, 20*time.Millisecond, cancel, &sync.WaitGroup{})
+		if err == nil || !strings.Contains(err.Error(), "drain requests") {
+			t.Errorf("Error drain timeout: %v", err)
+		}
+		if !backend.Closed() {
+			t.Error("Error storage not closed after drain timeout")
+		}
+	})
+}
@@ -10,6 +10,7 @@ require (
 	github.com/rs/zerolog v1.28.0
 	github.com/salihzain/tagalyzer v0.0.2
 	github.com/shirou/gopsutil/v3 v3.22.10
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/tools v0.3.0
 	honnef.co/go/tools v0.3.3
 )
@@ -35,6 +36,6 @@ require (
 	golang.org/x/crypto v0.2.0 // indirect
 	golang.org/x/exp/typeparams v0.0.0-20220218215828-6cf2b201936e // indirect
 	golang.org/x/mod v0.7.0 // indirect
-	golang.org/x/sys v0.2.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
 	golang.org/x/text v0.4.0 // indirect
 )
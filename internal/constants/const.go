@@ -1,6 +1,8 @@
 package constants
 
 import (
+	"time"
+
 	"github.com/andynikk/advancedmetrics/internal/logger"
 )
 
@@ -9,6 +11,7 @@ type TypeMetricsStorage int
 const (
 	MetricsStorageDB TypeMetricsStorage = iota
 	MetricsStorageFile
+	MetricsStorageBolt
 
 	TimeLivingCertificateYaer   = 10
 	TimeLivingCertificateMounth = 0
@@ -20,61 +23,147 @@ const (
 	StoreInterval  = 300000000000
 	StoreFile      = "/tmp/devops-metrics-db.json"
 	Restore        = true
-	ButchSize      = 10
+	Migrate        = true
+
+	SamplesRetention = 7 * 24 * time.Hour
+
+	DBConnectTimeout = 5 * time.Second
+	DBQueryTimeout   = 5 * time.Second
+	DBRetryTimeout   = 10 * time.Second
+	DBBufferSize     = 10000
+
+	WriteQueueSize     = 10000
+	WriteFlushSize     = 500
+	WriteFlushInterval = time.Second
+	WriteDirectTimeout = 5 * time.Second
+
+	ShutdownTimeout = 10 * time.Second
+	ReadyTimeout    = 2 * time.Second
+
+	RestoreRetryInterval = 5 * time.Second
+
+	LogLevel  = "info"
+	LogFormat = logger.FormatJSON
+
+	SelfMetricsPrefix = "server_"
+
+	StatusUp   = "up"
+	StatusDown = "down"
+
+	BoltFile            = "/tmp/devops-metrics-db.bolt"
+	BoltCompactInterval = time.Hour
+
+	ExportJSON        = "json"
+	ExportCSV         = "csv"
+	ExportOpenMetrics = "openmetrics"
+
+	ImportReplace     = "replace"
+	ImportMerge       = "merge"
+	ImportCountersAdd = "counters-add"
+
+	RestorePrimary = "primary"
+	RestoreNewest  = "newest"
+	RestoreMerge   = "merge"
+
+	FileSyncAlways       = "always"
+	FileSyncInterval     = "interval"
+	FileSyncNever        = "never"
+	FileSyncPeriod       = time.Second
+	FileSnapshotInterval = 5 * time.Minute
+	FileWALMaxSize       = 4 << 20
+
+	SnapshotEncryptionNone = "none"
+	SnapshotEncryptionAES  = "aes"
+	SnapshotEncryptionRSA  = "rsa"
+
+	ButchSize = 10
+
+	TypeEncryption       = "sha512"
+	TypeEncryptionHybrid = "rsa-oaep-aes-256-gcm-v1"
+
+	HeaderRealIP    = "X-Real-IP"
+	HeaderKeyID     = "Encryption-Key-ID"
+	HeaderRequestID = "X-Request-ID"
+
+	HeaderSignature = "X-Signature"
+	HeaderTimestamp = "X-Timestamp"
+	HeaderNonce     = "X-Nonce"
+	SignatureWindow = 5 * time.Minute
 
-	TypeEncryption = "sha512"
+	HeaderAgentID        = "X-Agent-ID"
+	HeaderAgentSignature = "X-Agent-Signature"
 
-	QueryInsertTemplate = `INSERT INTO 
-						metrics.store ("ID", "MType", "Value", "Delta", "Hash") 
+	HeaderHashScheme       = "Hash-Scheme"
+	HeaderAcceptHashScheme = "Accept-Hash-Scheme"
+	HashSchemeV1           = "v1"
+	HashSchemeV2           = "v2"
+
+	SchemeHTTP  = "http"
+	SchemeHTTPS = "https"
+
+	QueryUpsert = `INSERT INTO 
+						metrics.store ("ID", "MType", "Value", "Delta", "Hash", "Updated") 
 					VALUES
-						($1, $2, $3, $4, $5)`
+						($1, $2, $3, $4, $5, $6)
+					ON CONFLICT ("ID", "MType") DO UPDATE SET 
+						"Value" = EXCLUDED."Value", 
+						"Delta" = EXCLUDED."Delta", 
+						"Hash" = EXCLUDED."Hash",
+						"Updated" = EXCLUDED."Updated"`
 
-	QueryUpdateTemplate = `UPDATE 
+	QuerySelect = `SELECT 
+						"ID", "MType", "Value", "Delta", "Hash", "Updated" 
+					FROM 
+						metrics.store`
+
+	QueryDelete = `DELETE FROM 
 						metrics.store 
-					SET 
-						"Value"=$3, "Delta"=$4, "Hash"=$5
 					WHERE 
 						"ID" = $1 
 						and "MType" = $2;`
 
-	QuerySelectWithWhereTemplate = `SELECT 
-						* 
+	QueryInsertSample = `INSERT INTO 
+						metrics.samples ("ID", "MType", "Value", "Delta", "Received") 
+					VALUES
+						($1, $2, $3, $4, $5)`
+
+	QuerySelectSamples = `SELECT 
+						"Received", "Value", "Delta" 
 					FROM 
-						metrics.store
+						metrics.samples
 					WHERE 
 						"ID" = $1 
-						and "MType" = $2;`
-
-	QuerySelect = `SELECT 
-						* 
+						and "MType" = $2
+						and "Received" >= $3
+						and "Received" < $4
+					ORDER BY 
+						"Received"`
+
+	QuerySamplePartitions = `SELECT 
+						c.relname 
 					FROM 
-						metrics.store`
+						pg_inherits i
+						JOIN pg_class c ON c.oid = i.inhrelid
+						JOIN pg_class p ON p.oid = i.inhparent
+						JOIN pg_namespace n ON n.oid = p.relnamespace
+					WHERE 
+						n.nspname = 'metrics' 
+						and p.relname = 'samples'`
+
+	QueryCreateSamplePartition = `CREATE TABLE IF NOT EXISTS metrics.%s 
+					PARTITION OF metrics.samples FOR VALUES FROM ('%s') TO ('%s')`
+
+	QueryDropSamplePartition = `DROP TABLE IF EXISTS metrics.%s`
 
 	NameDB = `yapracticum`
 
 	QueryCheckExistDB = `SELECT datname FROM pg_database WHERE datname = '%s' ORDER BY 1;`
 
 	QueryDB = `CREATE DATABASE %s`
-
-	QuerySchema = `CREATE SCHEMA IF NOT EXISTS metrics`
-
-	QueryTable = `CREATE TABLE IF NOT EXISTS metrics.store
-					(
-						"ID" character varying COLLATE pg_catalog."default",
-						"MType" character varying COLLATE pg_catalog."default",
-						"Value" double precision NOT NULL DEFAULT 0,
-						"Delta" bigint NOT NULL DEFAULT 0,
-						"Hash" character varying COLLATE pg_catalog."default"
-					)
-					
-					TABLESPACE pg_default;
-					
-					ALTER TABLE IF EXISTS metrics.store
-						OWNER to postgres;`
 )
 
 func (tmc TypeMetricsStorage) String() string {
-	return [...]string{"db", "file"}[tmc]
+	return [...]string{"db", "file", "bolt"}[tmc]
 }
 
 var Logger logger.Logger
@@ -0,0 +1,112 @@
+package cryptohash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+)
+
+const canonicalNaN = 0x7FF8000000000001
+
+// SupportedHashSchemes схемы хеширования метрик в порядке предпочтения.
+var SupportedHashSchemes = []string{constants.HashSchemeV2, constants.HashSchemeV1}
+
+// SupportedHashScheme проверяет, что схема хеширования известна.
+func SupportedHashScheme(scheme string) bool {
+	for _, s := range SupportedHashSchemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// LegacyMetricMessage сообщение схемы v1: значение gauge округляется форматом %f до шести знаков.
+// Оставлено для агентов и сохраненных данных, не знающих о схеме v2.
+func LegacyMetricMessage(m *encoding.Metrics) string {
+	if m.MType == "counter" {
+		var delta int64
+		if m.Delta != nil {
+			delta = *m.Delta
+		}
+		return fmt.Sprintf("%s:%s:%d", m.ID, m.MType, delta)
+	}
+
+	var value float64
+	if m.Value != nil {
+		value = *m.Value
+	}
+	return fmt.Sprintf("%s:%s:%f", m.ID, m.MType, value)
+}
+
+// CanonicalMetric каноническое байтовое представление метрики схемы v2.
+// Формат: версия (1 байт) | id | type | число меток (4 байта) | метки, отсортированные по имени | значение.
+// Строки записываются как длина (4 байта, big endian) и байты строки.
+// Значение: 'g' и биты float64 для gauge, 'c' и int64 для counter, 0 если значения нет.
+// Все NaN приводятся к одному представлению, остальные значения, включая Inf и -0, передаются точно.
+func CanonicalMetric(m *encoding.Metrics) []byte {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, 2)
+	buf = appendString(buf, m.ID)
+	buf = appendString(buf, m.MType)
+
+	names := make([]string, 0, len(m.Labels))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(names)))
+	for _, name := range names {
+		buf = appendString(buf, name)
+		buf = appendString(buf, m.Labels[name])
+	}
+
+	switch {
+	case m.Value != nil:
+		bits := math.Float64bits(*m.Value)
+		if math.IsNaN(*m.Value) {
+			bits = canonicalNaN
+		}
+		buf = append(buf, 'g')
+		buf = binary.BigEndian.AppendUint64(buf, bits)
+	case m.Delta != nil:
+		buf = append(buf, 'c')
+		buf = binary.BigEndian.AppendUint64(buf, uint64(*m.Delta))
+	default:
+		buf = append(buf, 0)
+	}
+
+	return buf
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// MetricHash хеш метрики по схеме scheme. Для пустого ключа возвращает пустую строку.
+// Неизвестная схема считается схемой v1.
+func MetricHash(scheme string, strKey string, m *encoding.Metrics) string {
+	if strKey == "" {
+		return ""
+	}
+	if scheme != constants.HashSchemeV2 {
+		return HeshSHA256(LegacyMetricMessage(m), strKey)
+	}
+
+	h := hmac.New(sha256.New, []byte(strKey))
+	h.Write(CanonicalMetric(m))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifyMetricHash сравнивает хеш метрики m.Hash с вычисленным по схеме scheme.
+func VerifyMetricHash(scheme string, strKey string, m *encoding.Metrics) bool {
+	return hmac.Equal([]byte(m.Hash), []byte(MetricHash(scheme, strKey, m)))
+}
@@ -0,0 +1,80 @@
+package cryptohash
+
+import (
+	"math"
+	"testing"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+)
+
+func gaugeMetric(id string, value float64) *encoding.Metrics {
+	return &encoding.Metrics{ID: id, MType: "gauge", Value: &value}
+}
+
+func TestMetricHash(t *testing.T) {
+	const key = "TestKey"
+
+	t.Run("Checking legacy scheme", func(t *testing.T) {
+		m := gaugeMetric("Alloc", 0.01)
+		if got, want := MetricHash(constants.HashSchemeV1, key, m), HeshSHA256("Alloc:gauge:0.010000", key); got != want {
+			t.Errorf("Error legacy hash: %s, want %s", got, want)
+		}
+		delta := int64(5)
+		c := &encoding.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}
+		if got, want := MetricHash(constants.HashSchemeV1, key, c), HeshSHA256("PollCount:counter:5", key); got != want {
+			t.Errorf("Error legacy counter hash: %s, want %s", got, want)
+		}
+	})
+
+	t.Run("Checking exact values", func(t *testing.T) {
+		pairs := [][2]float64{{1e-9, 2e-9}, {1e20, 1e20 + 1e5}, {0, math.Copysign(0, -1)}, {math.Inf(1), math.Inf(-1)}}
+		for _, pair := range pairs {
+			h1 := MetricHash(constants.HashSchemeV2, key, gaugeMetric("Alloc", pair[0]))
+			h2 := MetricHash(constants.HashSchemeV2, key, gaugeMetric("Alloc", pair[1]))
+			if h1 == h2 {
+				t.Errorf("Error values %g and %g must have different hashes", pair[0], pair[1])
+			}
+		}
+		if MetricHash(constants.HashSchemeV1, key, gaugeMetric("Alloc", 1e-9)) !=
+			MetricHash(constants.HashSchemeV1, key, gaugeMetric("Alloc", 2e-9)) {
+			t.Errorf("Error legacy scheme expected to round tiny values")
+		}
+	})
+
+	t.Run("Checking NaN", func(t *testing.T) {
+		nan := math.Float64frombits(0x7FF8000000000abc)
+		h1 := MetricHash(constants.HashSchemeV2, key, gaugeMetric("Alloc", math.NaN()))
+		h2 := MetricHash(constants.HashSchemeV2, key, gaugeMetric("Alloc", nan))
+		if h1 != h2 {
+			t.Errorf("Error all NaN values must have one hash")
+		}
+	})
+
+	t.Run("Checking labels", func(t *testing.T) {
+		m1 := gaugeMetric("Alloc", 1)
+		m1.Labels = map[string]string{"host": "a", "dc": "b"}
+		m2 := gaugeMetric("Alloc", 1)
+		m2.Labels = map[string]string{"dc": "b", "host": "a"}
+		m3 := gaugeMetric("Alloc", 1)
+		m3.Labels = map[string]string{"host": "ad", "dc": ""}
+
+		if MetricHash(constants.HashSchemeV2, key, m1) != MetricHash(constants.HashSchemeV2, key, m2) {
+			t.Errorf("Error labels order must not change hash")
+		}
+		if MetricHash(constants.HashSchemeV2, key, m1) == MetricHash(constants.HashSchemeV2, key, m3) {
+			t.Errorf("Error labels must be encoded unambiguously")
+		}
+	})
+
+	t.Run("Checking verify", func(t *testing.T) {
+		m := gaugeMetric("Alloc", 123.456789123)
+		m.Hash = MetricHash(constants.HashSchemeV2, key, m)
+		if !VerifyMetricHash(constants.HashSchemeV2, key, m) {
+			t.Errorf("Error verify v2 hash")
+		}
+		if VerifyMetricHash(constants.HashSchemeV1, key, m) {
+			t.Errorf("Error v2 hash must not pass v1 check")
+		}
+	})
+}
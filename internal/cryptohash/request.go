@@ -0,0 +1,97 @@
+package cryptohash
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RequestMessage сообщение, которое подписывается для всего запроса.
+// В него входят метод, путь, время отправки, одноразовый номер и хеш тела,
+// поэтому подпись нельзя перенести на другой запрос или повторить позже.
+func RequestMessage(method string, path string, timestamp string, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return fmt.Sprintf("%s\n%s\n%s\n%s\n%x", method, path, timestamp, nonce, bodyHash)
+}
+
+// SignRequest подписывает запрос ключом strKey. Для пустого ключа возвращает пустую строку.
+func SignRequest(strKey string, method string, path string, timestamp string, nonce string, body []byte) string {
+	return HeshSHA256(RequestMessage(method, path, timestamp, nonce, body), strKey)
+}
+
+// VerifyRequest проверяет подпись запроса.
+func VerifyRequest(strKey string, method string, path string, timestamp string, nonce string, body []byte,
+	signature string) bool {
+	if strKey == "" || signature == "" {
+		return false
+	}
+	expected := SignRequest(strKey, method, path, timestamp, nonce, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// NewNonce одноразовый номер запроса.
+func NewNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// FormatTimestamp время отправки запроса в секундах Unix.
+func FormatTimestamp(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// CheckTimestamp проверяет, что время отправки запроса отличается от now не больше чем на window.
+func CheckTimestamp(timestamp string, now time.Time, window time.Duration) (time.Time, error) {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("неверное время запроса: %s", timestamp)
+	}
+	sent := time.Unix(sec, 0)
+	if sent.Before(now.Add(-window)) || sent.After(now.Add(window)) {
+		return time.Time{}, fmt.Errorf("время запроса %s вне допустимого окна %s", sent.Format(time.RFC3339), window)
+	}
+	return sent, nil
+}
+
+// NonceCache хранит использованные одноразовые номера, пока не истечет окно свежести запроса.
+type NonceCache struct {
+	sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewNonceCache создание хранилища одноразовых номеров.
+func NewNonceCache() *NonceCache {
+	return &NonceCache{seen: make(map[string]time.Time)}
+}
+
+// Use отмечает номер как использованный до момента expires.
+// Возвращает false, если номер уже встречался, т.е. запрос повторный.
+func (nc *NonceCache) Use(nonce string, now time.Time, expires time.Time) bool {
+	nc.Lock()
+	defer nc.Unlock()
+
+	if now.Sub(nc.lastPrune) > time.Second {
+		for key, exp := range nc.seen {
+			if now.After(exp) {
+				delete(nc.seen, key)
+			}
+		}
+		nc.lastPrune = now
+	}
+
+	if _, ok := nc.seen[nonce]; ok {
+		return false
+	}
+	nc.seen[nonce] = expires
+
+	return true
+}
@@ -2,16 +2,29 @@ package encoding
 
 import (
 	"encoding/json"
+	"time"
 )
 
 type ArrMetrics []Metrics
 
 type Metrics struct {
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
-	Hash  string   `json:"hash,omitempty"`  // значение хеш-функции
+	ID     string            `json:"id"`               // имя метрики
+	MType  string            `json:"type"`             // параметр, принимающий значение gauge или counter
+	Delta  *int64            `json:"delta,omitempty"`  // значение метрики в случае передачи counter
+	Value  *float64          `json:"value,omitempty"`  // значение метрики в случае передачи gauge
+	Labels map[string]string `json:"labels,omitempty"` // метки метрики, входят в хеш схемы v2; сервер пока не принимает метрики с метками
+	Hash   string            `json:"hash,omitempty"`   // значение хеш-функции
+
+	// время последнего изменения метрики сервером, не входит в хеш и в JSON API:
+	// хранилища записывают его сами, см. repository.record
+	Timestamp *time.Time `json:"-"`
+}
+
+// Sample значение метрики в момент приема обновления.
+type Sample struct {
+	Time  time.Time `json:"time"`            // время приема обновления сервером
+	Delta *int64    `json:"delta,omitempty"` // значение counter
+	Value *float64  `json:"value,omitempty"` // значение gauge
 }
 
 func (m *Metrics) MarshalMetrica() (val []byte, err error) {
@@ -0,0 +1,349 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+)
+
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// CertOptions параметры выпуска сертификата.
+// Если Parent не указан, сертификат самоподписанный.
+type CertOptions struct {
+	KeyType      string
+	KeyBits      int
+	SerialNumber int64
+	CommonName   string
+	Organization string
+	Country      string
+	NotBefore    time.Time
+	Validity     time.Duration
+	Hosts        []string
+	IsCA         bool
+	Parent       *x509.Certificate
+	ParentKey    crypto.Signer
+}
+
+// CertKeyPair выпущенный сертификат и его приватный ключ в формате PEM.
+type CertKeyPair struct {
+	Cert    *x509.Certificate
+	CertPEM bytes.Buffer
+	KeyPEM  bytes.Buffer
+}
+
+// DefaultCertValidity срок действия сертификата по умолчанию.
+func DefaultCertValidity() time.Duration {
+	now := time.Now()
+	notAfter := now.AddDate(constants.TimeLivingCertificateYaer, constants.TimeLivingCertificateMounth,
+		constants.TimeLivingCertificateDay)
+	return notAfter.Sub(now)
+}
+
+// CreateCertificate выпускает сертификат и ключ по параметрам opts.
+// Ключ RSA сохраняется в PKCS #1, как и раньше, ключ ECDSA в SEC 1, ключ Ed25519 в PKCS #8.
+// Для шифрования тела запроса подходит только ключ RSA, ключи ECDSA и Ed25519 годятся для TLS и подписи.
+func CreateCertificate(opts CertOptions) (*CertKeyPair, error) {
+	if (opts.Parent == nil) != (opts.ParentKey == nil) {
+		return nil, errors.New("сертификат и ключ удостоверяющего центра указываются вместе")
+	}
+
+	signer, keyBlock, err := generateKey(opts.KeyType, opts.KeyBits)
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber := big.NewInt(opts.SerialNumber)
+	if opts.SerialNumber == 0 {
+		serialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	notBefore := opts.NotBefore
+	if notBefore.IsZero() {
+		notBefore = time.Now()
+	}
+	validity := opts.Validity
+	if validity <= 0 {
+		validity = DefaultCertValidity()
+	}
+
+	organization := opts.Organization
+	if organization == "" {
+		organization = "AdvancedMetrics"
+	}
+	country := opts.Country
+	if country == "" {
+		country = "RU"
+	}
+
+	skid, err := subjectKeyID(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if opts.KeyType == "" || opts.KeyType == KeyTypeRSA {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	if opts.IsCA {
+		keyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+
+	cert := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   opts.CommonName,
+			Organization: []string{organization},
+			Country:      []string{country},
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		SubjectKeyId:          skid,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		KeyUsage:              keyUsage,
+		IsCA:                  opts.IsCA,
+		BasicConstraintsValid: true,
+	}
+	for _, host := range opts.Hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			cert.IPAddresses = append(cert.IPAddresses, ip)
+		} else if host != "" {
+			cert.DNSNames = append(cert.DNSNames, host)
+		}
+	}
+
+	parent, parentKey := cert, signer
+	if opts.Parent != nil {
+		parent, parentKey = opts.Parent, opts.ParentKey
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, cert, parent, signer.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err = x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	pair := &CertKeyPair{Cert: cert}
+	if err = pem.Encode(&pair.CertPEM, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes}); err != nil {
+		return nil, err
+	}
+	if err = pem.Encode(&pair.KeyPEM, keyBlock); err != nil {
+		return nil, err
+	}
+
+	return pair, nil
+}
+
+func generateKey(keyType string, keyBits int) (crypto.Signer, *pem.Block, error) {
+	switch keyType {
+	case "", KeyTypeRSA:
+		if keyBits == 0 {
+			keyBits = 4096
+		}
+		privateKey, err := rsa.GenerateKey(rand.Reader, keyBits)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privateKey, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}, nil
+	case KeyTypeECDSA:
+		var curve elliptic.Curve
+		switch keyBits {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, nil, fmt.Errorf("неподдерживаемая длина ключа ECDSA: %d", keyBits)
+		}
+		privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privateKey, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, nil
+	case KeyTypeEd25519:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privateKey, &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	default:
+		return nil, nil, fmt.Errorf("неизвестный тип ключа: %s", keyType)
+	}
+}
+
+func subjectKeyID(publicKey crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(der)
+	return sum[:], nil
+}
+
+// SaveKeyInFile сохраняет сертификат или ключ в файл с правами perm.
+// Существующий файл перезаписывается только при overwrite.
+func SaveKeyInFile(key *bytes.Buffer, pathFile string, perm os.FileMode, overwrite bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(pathFile, flags, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(key.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LoadCertificate читает первый сертификат из PEM-файла.
+func LoadCertificate(certPath string) (*x509.Certificate, error) {
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, certData = pem.Decode(certData)
+		if block == nil {
+			return nil, fmt.Errorf("в файле %s не найден сертификат", certPath)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// LoadSigner читает приватный ключ RSA, ECDSA или Ed25519 из PEM-файла.
+func LoadSigner(keyPath string) (crypto.Signer, error) {
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return LoadSignerPEM(keyData)
+}
+
+// LoadSignerPEM разбирает приватный ключ RSA, ECDSA или Ed25519 в формате PEM.
+func LoadSignerPEM(keyData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, errors.New("приватный ключ не найден")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNotPrivateKey, block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("неподдерживаемый тип приватного ключа")
+	}
+	return signer, nil
+}
+
+// PublicKeyType наименование типа открытого ключа сертификата.
+func PublicKeyType(publicKey crypto.PublicKey) string {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA %s", key.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return "unknown"
+	}
+}
+
+// DescribeCertificate текстовое описание сертификата.
+func DescribeCertificate(cert *x509.Certificate) string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "Subject:       %s\n", cert.Subject.String())
+	fmt.Fprintf(&sb, "Issuer:        %s\n", cert.Issuer.String())
+	fmt.Fprintf(&sb, "Serial number: %s\n", cert.SerialNumber.String())
+	fmt.Fprintf(&sb, "Not before:    %s\n", cert.NotBefore.Format(time.RFC3339))
+	fmt.Fprintf(&sb, "Not after:     %s\n", cert.NotAfter.Format(time.RFC3339))
+	fmt.Fprintf(&sb, "Public key:    %s\n", PublicKeyType(cert.PublicKey))
+	fmt.Fprintf(&sb, "CA:            %t\n", cert.IsCA)
+
+	var hosts []string
+	hosts = append(hosts, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		hosts = append(hosts, ip.String())
+	}
+	fmt.Fprintf(&sb, "Hosts:         %s\n", strings.Join(hosts, ", "))
+
+	if publicKey, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+		if keyID, err := KeyID(publicKey); err == nil {
+			fmt.Fprintf(&sb, "Key ID:        %s\n", keyID)
+		}
+	}
+
+	return sb.String()
+}
+
+// CheckExpiry проверяет срок действия сертификата на момент now.
+// Возвращает ошибку, если сертификат еще не действует, истек или истекает раньше, чем через warn.
+func CheckExpiry(cert *x509.Certificate, now time.Time, warn time.Duration) error {
+	switch {
+	case now.Before(cert.NotBefore):
+		return fmt.Errorf("сертификат начинает действовать %s", cert.NotBefore.Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		return fmt.Errorf("срок действия сертификата истек %s", cert.NotAfter.Format(time.RFC3339))
+	case now.Add(warn).After(cert.NotAfter):
+		return fmt.Errorf("срок действия сертификата истекает %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
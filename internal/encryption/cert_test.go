@@ -0,0 +1,57 @@
+package encryption
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestCreateCertificate(t *testing.T) {
+	caPair, err := CreateCertificate(CertOptions{KeyType: KeyTypeECDSA, CommonName: "Test CA", IsCA: true,
+		Validity: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Error create CA: %s", err.Error())
+	}
+	caKey, err := LoadSignerPEM(caPair.KeyPEM.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keyType := range []string{KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519} {
+		t.Run("Checking issue certificate "+keyType, func(t *testing.T) {
+			opts := CertOptions{KeyType: keyType, CommonName: "agent", Hosts: []string{"localhost", "127.0.0.1"},
+				Validity: time.Hour, Parent: caPair.Cert, ParentKey: caKey}
+			if keyType == KeyTypeRSA {
+				opts.KeyBits = 2048
+			}
+			pair, err := CreateCertificate(opts)
+			if err != nil {
+				t.Fatalf("Error issue certificate: %s", err.Error())
+			}
+
+			roots := x509.NewCertPool()
+			roots.AddCert(caPair.Cert)
+			_, err = pair.Cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "localhost",
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+			if err != nil {
+				t.Errorf("Error verify certificate: %s", err.Error())
+			}
+			if _, err = LoadSignerPEM(pair.KeyPEM.Bytes()); err != nil {
+				t.Errorf("Error load private key: %s", err.Error())
+			}
+		})
+	}
+
+	t.Run("Checking expiry", func(t *testing.T) {
+		now := time.Now()
+		if err := CheckExpiry(caPair.Cert, now, time.Hour); err != nil {
+			t.Errorf("Error check expiry: %s", err.Error())
+		}
+		if err := CheckExpiry(caPair.Cert, now, 48*time.Hour); err == nil {
+			t.Errorf("Error check expiry must warn")
+		}
+		if err := CheckExpiry(caPair.Cert, now.Add(72*time.Hour), 0); err == nil {
+			t.Errorf("Error check expiry must fail for expired certificate")
+		}
+	})
+}
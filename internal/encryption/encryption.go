@@ -3,23 +3,39 @@ package encryption
 import (
 	"bytes"
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/x509"
-	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"math/big"
+	"io"
 	"os"
-	"time"
+	"strings"
 
 	"github.com/andynikk/advancedmetrics/internal/constants"
 )
 
+const (
+	hybridVersion byte = 1
+	hybridKeySize      = 32
+)
+
+// ErrNotPrivateKey PEM-файл содержит не приватный ключ (например, сертификат).
+var ErrNotPrivateKey = errors.New("блок PEM не является приватным ключом")
+
+// ErrNotPEM файл не в формате PEM: в нем нет ни одного блока PEM, даже поврежденного.
+var ErrNotPEM = errors.New("файл не в формате PEM")
+
 type KeyEncryption struct {
 	TypeEncryption string
+	KeyID          string
 	PublicKey      *rsa.PublicKey
 	PrivateKey     *rsa.PrivateKey
 }
@@ -34,77 +50,104 @@ func (ke *KeyEncryption) RsaDecrypt(msgByte []byte) ([]byte, error) {
 	return decryptedBytes, err
 }
 
-func CreateCert() ([]bytes.Buffer, error) {
-	var numSert int64
-	var subjectKeyId string
-	var lenKeyByte int
+// Encrypt шифрует сообщение схемой, указанной в TypeEncryption.
+func (ke *KeyEncryption) Encrypt(msg []byte) ([]byte, error) {
+	if ke.TypeEncryption == constants.TypeEncryptionHybrid {
+		return ke.HybridEncrypt(msg)
+	}
+	return ke.RsaEncrypt(msg)
+}
 
-	fmt.Print("Введите уникальный номер сертификата: ")
-	if _, err := fmt.Fscan(os.Stdin, &numSert); err != nil {
-		constants.Logger.ErrorLog(err)
+// Decrypt расшифровывает сообщение по значению заголовка Content-Encryption.
+// Поддерживаются гибридная схема и устаревшее шифрование всего тела RSA-OAEP.
+func (ke *KeyEncryption) Decrypt(contentEncryption string, msg []byte) ([]byte, error) {
+	if strings.Contains(contentEncryption, constants.TypeEncryptionHybrid) {
+		return ke.HybridDecrypt(msg)
+	}
+	return ke.RsaDecrypt(msg)
+}
+
+// HybridEncrypt шифрует сообщение случайным ключом AES-256-GCM, а сам ключ шифрует RSA-OAEP.
+// Формат результата:
+// версия (1 байт) | длина зашифрованного ключа (2 байта, big endian) | зашифрованный ключ | nonce | шифротекст.
+// Заголовок до nonce защищен GCM как дополнительные данные.
+func (ke *KeyEncryption) HybridEncrypt(msg []byte) ([]byte, error) {
+	dataKey := make([]byte, hybridKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := ke.RsaEncrypt(dataKey)
+	if err != nil {
 		return nil, err
 	}
 
-	fmt.Print("Введите ИД ключа субъекта (пример ввода 12346): ")
-	if _, err := fmt.Fscan(os.Stdin, &subjectKeyId); err != nil {
-		constants.Logger.ErrorLog(err)
+	aead, err := newGCM(dataKey)
+	if err != nil {
 		return nil, err
 	}
 
-	fmt.Print("Длина ключа в байтах: ")
-	if _, err := fmt.Fscan(os.Stdin, &lenKeyByte); err != nil {
-		constants.Logger.ErrorLog(err)
+	header := make([]byte, 3, 3+len(wrappedKey))
+	header[0] = hybridVersion
+	binary.BigEndian.PutUint16(header[1:3], uint16(len(wrappedKey)))
+	header = append(header, wrappedKey...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
 
-	cert := &x509.Certificate{
-		SerialNumber: big.NewInt(numSert),
-		Subject: pkix.Name{
-			Organization: []string{"AdvancedMetrics"},
-			Country:      []string{"RU"},
-		},
-		NotBefore: time.Now(),
-		NotAfter: time.Now().AddDate(constants.TimeLivingCertificateYaer, constants.TimeLivingCertificateMounth,
-			constants.TimeLivingCertificateDay),
-		SubjectKeyId: []byte(subjectKeyId),
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:     x509.KeyUsageDigitalSignature,
+	frame := make([]byte, 0, len(header)+len(nonce)+len(msg)+aead.Overhead())
+	frame = append(frame, header...)
+	frame = append(frame, nonce...)
+	frame = aead.Seal(frame, nonce, msg, header)
+
+	return frame, nil
+}
+
+// HybridDecrypt расшифровывает сообщение, зашифрованное HybridEncrypt.
+func (ke *KeyEncryption) HybridDecrypt(frame []byte) ([]byte, error) {
+	if len(frame) < 3 {
+		return nil, errors.New("сообщение слишком короткое")
+	}
+	if frame[0] != hybridVersion {
+		return nil, fmt.Errorf("неизвестная версия шифрования: %d", frame[0])
 	}
 
-	privateKey, err := rsa.GenerateKey(rand.Reader, lenKeyByte)
+	lenKey := int(binary.BigEndian.Uint16(frame[1:3]))
+	if len(frame) < 3+lenKey {
+		return nil, errors.New("сообщение слишком короткое")
+	}
+	header := frame[:3+lenKey]
+
+	dataKey, err := ke.RsaDecrypt(header[3:])
 	if err != nil {
 		return nil, err
 	}
+	if len(dataKey) != hybridKeySize {
+		return nil, errors.New("неверная длина ключа сообщения")
+	}
 
-	certBytes, err := x509.CreateCertificate(rand.Reader, cert, cert, &privateKey.PublicKey, privateKey)
+	aead, err := newGCM(dataKey)
 	if err != nil {
 		return nil, err
 	}
 
-	var certPEM bytes.Buffer
-	_ = pem.Encode(&certPEM, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: certBytes,
-	})
-
-	var privateKeyPEM bytes.Buffer
-	_ = pem.Encode(&privateKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-	})
+	body := frame[len(header):]
+	if len(body) < aead.NonceSize() {
+		return nil, errors.New("сообщение слишком короткое")
+	}
+	nonce, ciphertext := body[:aead.NonceSize()], body[aead.NonceSize():]
 
-	return []bytes.Buffer{certPEM, privateKeyPEM}, nil
+	return aead.Open(nil, nonce, ciphertext, header)
 }
 
-func SaveKeyInFile(key *bytes.Buffer, pathFile string) {
-	file, err := os.Create(pathFile)
-	if err != nil {
-		return
-	}
-	_, err = file.WriteString(key.String())
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return
+		return nil, err
 	}
+	return cipher.NewGCM(block)
 }
 
 func InitPrivateKey(cryptoKeyPath string) (*KeyEncryption, error) {
@@ -112,22 +155,87 @@ func InitPrivateKey(cryptoKeyPath string) (*KeyEncryption, error) {
 	if cryptoKeyPath == "" {
 		return nil, errors.New("путь к приватному ключу не указан")
 	}
-	pvkData, _ := os.ReadFile(cryptoKeyPath)
+	pvkData, err := os.ReadFile(cryptoKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(pvkData)
+}
+
+// ParsePrivateKey разбирает приватный ключ RSA в формате PEM (PKCS #1 или PKCS #8).
+func ParsePrivateKey(pvkData []byte) (*KeyEncryption, error) {
 	pvkBlock, _ := pem.Decode(pvkData)
-	pvk, err := x509.ParsePKCS1PrivateKey(pvkBlock.Bytes)
+	if pvkBlock == nil {
+		if !bytes.Contains(pvkData, []byte("-----BEGIN ")) {
+			return nil, fmt.Errorf("%w: приватный ключ не найден", ErrNotPEM)
+		}
+		return nil, errors.New("приватный ключ не найден")
+	}
+
+	var pvk *rsa.PrivateKey
+	switch pvkBlock.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(pvkBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pvk = key
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(pvkBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("приватный ключ не является ключом RSA")
+		}
+		pvk = rsaKey
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNotPrivateKey, pvkBlock.Type)
+	}
+
+	keyID, err := KeyID(&pvk.PublicKey)
 	if err != nil {
 		return nil, err
 	}
-	return &KeyEncryption{TypeEncryption: constants.TypeEncryption, PrivateKey: pvk, PublicKey: &pvk.PublicKey}, nil
+	return &KeyEncryption{TypeEncryption: constants.TypeEncryption, KeyID: keyID,
+		PrivateKey: pvk, PublicKey: &pvk.PublicKey}, nil
 }
 
 func InitPublicKey(cryptoKeyPath string) (*KeyEncryption, error) {
 	if cryptoKeyPath == "" {
 		return nil, errors.New("не указан путь к публичному ключу")
 	}
-	certData, _ := os.ReadFile(cryptoKeyPath)
+	certData, err := os.ReadFile(cryptoKeyPath)
+	if err != nil {
+		return nil, err
+	}
 	certBlock, _ := pem.Decode(certData)
-	cert, _ := x509.ParseCertificate(certBlock.Bytes)
-	certPublicKey := cert.PublicKey.(*rsa.PublicKey)
-	return &KeyEncryption{TypeEncryption: constants.TypeEncryption, PublicKey: certPublicKey}, nil
+	if certBlock == nil {
+		return nil, errors.New("сертификат не найден")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	certPublicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("открытый ключ сертификата не является ключом RSA")
+	}
+	keyID, err := KeyID(certPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyEncryption{TypeEncryption: constants.TypeEncryptionHybrid, KeyID: keyID, PublicKey: certPublicKey}, nil
+}
+
+// KeyID идентификатор ключа: первые 8 байт SHA-256 от открытого ключа в формате PKIX.
+// Одинаково вычисляется и по сертификату агента, и по приватному ключу сервера.
+func KeyID(publicKey *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
 }
@@ -0,0 +1,110 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"testing"
+
+	"github.com/andynikk/advancedmetrics/internal/compression"
+	"github.com/andynikk/advancedmetrics/internal/constants"
+)
+
+func testKeyEncryption(t *testing.T) *KeyEncryption {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &KeyEncryption{
+		TypeEncryption: constants.TypeEncryptionHybrid,
+		PrivateKey:     privateKey,
+		PublicKey:      &privateKey.PublicKey,
+	}
+}
+
+func TestHybridEncryption(t *testing.T) {
+	ke := testKeyEncryption(t)
+
+	for _, size := range []int{0, 1, 1 << 20, 4 << 20, 16 << 20} {
+		t.Run(fmt.Sprintf("Checking round trip %d bytes", size), func(t *testing.T) {
+			msg := make([]byte, size)
+			if _, err := rand.Read(msg); err != nil {
+				t.Fatal(err)
+			}
+
+			encryptMsg, err := ke.Encrypt(msg)
+			if err != nil {
+				t.Fatalf("Error hybrid encrypt: %s", err.Error())
+			}
+			decryptMsg, err := ke.Decrypt(constants.TypeEncryptionHybrid, encryptMsg)
+			if err != nil {
+				t.Fatalf("Error hybrid decrypt: %s", err.Error())
+			}
+			if !bytes.Equal(msg, decryptMsg) {
+				t.Errorf("Error hybrid round trip")
+			}
+		})
+	}
+
+	t.Run("Checking round trip gzip batch", func(t *testing.T) {
+		msg := bytes.Repeat([]byte(`{"id":"Alloc","type":"gauge","value":123456.789},`), 200000)
+		gzipMsg, err := compression.Compress(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encryptMsg, err := ke.HybridEncrypt(gzipMsg)
+		if err != nil {
+			t.Fatalf("Error hybrid encrypt: %s", err.Error())
+		}
+		decryptMsg, err := ke.HybridDecrypt(encryptMsg)
+		if err != nil {
+			t.Fatalf("Error hybrid decrypt: %s", err.Error())
+		}
+		plainMsg, err := compression.Decompress(decryptMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, plainMsg) {
+			t.Errorf("Error hybrid round trip gzip batch")
+		}
+	})
+
+	t.Run("Checking tampered message", func(t *testing.T) {
+		encryptMsg, err := ke.HybridEncrypt([]byte("Тестовое сообщение"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encryptMsg[len(encryptMsg)-1] ^= 0xff
+		if _, err = ke.HybridDecrypt(encryptMsg); err == nil {
+			t.Errorf("Error tampered message must not be decrypted")
+		}
+	})
+
+	t.Run("Checking unknown version", func(t *testing.T) {
+		encryptMsg, err := ke.HybridEncrypt([]byte("Тестовое сообщение"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encryptMsg[0] = hybridVersion + 1
+		if _, err = ke.HybridDecrypt(encryptMsg); err == nil {
+			t.Errorf("Error unknown version must not be decrypted")
+		}
+	})
+
+	t.Run("Checking legacy rsa encryption", func(t *testing.T) {
+		msg := []byte("Тестовое сообщение")
+		encryptMsg, err := ke.RsaEncrypt(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decryptMsg, err := ke.Decrypt(constants.TypeEncryption, encryptMsg)
+		if err != nil {
+			t.Fatalf("Error legacy rsa decrypt: %s", err.Error())
+		}
+		if !bytes.Equal(msg, decryptMsg) {
+			t.Errorf("Error legacy rsa round trip")
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package encryption
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KeyRing набор приватных ключей сервера, доступных по идентификатору ключа.
+// Позволяет менять пару ключей без остановки всех агентов:
+// на время ротации сервер принимает сообщения, зашифрованные и старым, и новым ключом.
+type KeyRing struct {
+	sync.RWMutex
+	dir   string
+	files []string
+	keys  map[string]*KeyEncryption
+	order []string
+}
+
+// NewKeyRing загружает приватные ключи из каталога dir и отдельных файлов files.
+// Пустые пути пропускаются. Если загрузить ключи не удалось, набор пуст до успешного Reload.
+func NewKeyRing(dir string, files ...string) (*KeyRing, error) {
+	kr := &KeyRing{dir: dir}
+	for _, file := range files {
+		if file != "" {
+			kr.files = append(kr.files, file)
+		}
+	}
+
+	if err := kr.Reload(); err != nil {
+		return kr, err
+	}
+	return kr, nil
+}
+
+// Reload перечитывает ключи с диска.
+// Новый набор заменяет прежний, только если прочитаны все файлы ключей и хотя бы один ключ.
+// Иначе, например если новый ключ еще не дописан на диск, прежний набор сохраняется,
+// а ошибка перечисляет файлы, которые не удалось прочитать. Файлы PEM без приватного ключа
+// (сертификаты рядом с ключами) пропускаются, как и файлы каталога не в формате PEM (README и т.п.).
+// Поврежденный PEM остается ошибкой.
+func (kr *KeyRing) Reload() error {
+	keys := make(map[string]*KeyEncryption)
+	var order []string
+	var errs []string
+
+	add := func(path string, inDir bool) {
+		ke, err := InitPrivateKey(path)
+		if errors.Is(err, ErrNotPrivateKey) || inDir && errors.Is(err, ErrNotPEM) {
+			return
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", path, err.Error()))
+			return
+		}
+		if _, ok := keys[ke.KeyID]; !ok {
+			order = append(order, ke.KeyID)
+		}
+		keys[ke.KeyID] = ke
+	}
+
+	for _, file := range kr.files {
+		add(file, false)
+	}
+
+	if kr.dir != "" {
+		entries, err := os.ReadDir(kr.dir)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				names = append(names, entry.Name())
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			add(filepath.Join(kr.dir, name), true)
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("ключи не перезагружены, используется прежний набор: %s", strings.Join(errs, "; "))
+	}
+	if len(keys) == 0 && (kr.dir != "" || len(kr.files) != 0) {
+		return errors.New("не загружено ни одного приватного ключа")
+	}
+
+	kr.Lock()
+	defer kr.Unlock()
+
+	kr.keys = keys
+	kr.order = order
+
+	return nil
+}
+
+// Len количество загруженных ключей.
+func (kr *KeyRing) Len() int {
+	kr.RLock()
+	defer kr.RUnlock()
+
+	return len(kr.keys)
+}
+
+// KeyIDs идентификаторы загруженных ключей в порядке загрузки.
+func (kr *KeyRing) KeyIDs() []string {
+	kr.RLock()
+	defer kr.RUnlock()
+
+	return append([]string(nil), kr.order...)
+}
+
+// Get возвращает ключ по идентификатору.
+func (kr *KeyRing) Get(keyID string) (*KeyEncryption, bool) {
+	kr.RLock()
+	defer kr.RUnlock()
+
+	ke, ok := kr.keys[keyID]
+	return ke, ok
+}
+
+// Decrypt расшифровывает сообщение ключом keyID.
+// Старые агенты не передают идентификатор ключа, тогда перебираются все ключи по порядку.
+func (kr *KeyRing) Decrypt(keyID string, contentEncryption string, msg []byte) ([]byte, error) {
+	if keyID != "" {
+		ke, ok := kr.Get(keyID)
+		if !ok {
+			return nil, fmt.Errorf("неизвестный идентификатор ключа: %s", keyID)
+		}
+		return ke.Decrypt(contentEncryption, msg)
+	}
+
+	kr.RLock()
+	keys := make([]*KeyEncryption, 0, len(kr.order))
+	for _, id := range kr.order {
+		keys = append(keys, kr.keys[id])
+	}
+	kr.RUnlock()
+
+	if len(keys) == 0 {
+		return nil, errors.New("приватные ключи сервера не загружены")
+	}
+
+	var lastErr error
+	for _, ke := range keys {
+		decryptMsg, err := ke.Decrypt(contentEncryption, msg)
+		if err == nil {
+			return decryptMsg, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,121 @@
+package encryption
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+)
+
+func TestKeyRing(t *testing.T) {
+	dir := t.TempDir()
+	oldCert, oldKey := writeTestCert(t, dir, "old")
+
+	kr, err := NewKeyRing(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kr.Len() != 1 {
+		t.Fatalf("Error load keys: %d", kr.Len())
+	}
+
+	oldPublic, err := InitPublicKey(oldCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPrivate, err := InitPrivateKey(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Checking key id from certificate and private key", func(t *testing.T) {
+		if oldPublic.KeyID == "" || oldPublic.KeyID != oldPrivate.KeyID {
+			t.Errorf("Error key id: %s != %s", oldPublic.KeyID, oldPrivate.KeyID)
+		}
+	})
+
+	newCert, _ := writeTestCert(t, dir, "new")
+	newPublic, err := InitPublicKey(newCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Checking unknown key before reload", func(t *testing.T) {
+		encryptMsg, err := newPublic.Encrypt([]byte("Тестовое сообщение"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = kr.Decrypt(newPublic.KeyID, constants.TypeEncryptionHybrid, encryptMsg); err == nil {
+			t.Errorf("Error unknown key must not decrypt")
+		}
+	})
+
+	if err = kr.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if kr.Len() != 2 {
+		t.Fatalf("Error reload keys: %d", kr.Len())
+	}
+
+	for _, public := range []*KeyEncryption{oldPublic, newPublic} {
+		msg := []byte("Тестовое сообщение " + public.KeyID)
+		encryptMsg, err := public.Encrypt(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("Checking decrypt by key id "+public.KeyID, func(t *testing.T) {
+			decryptMsg, err := kr.Decrypt(public.KeyID, constants.TypeEncryptionHybrid, encryptMsg)
+			if err != nil || !bytes.Equal(msg, decryptMsg) {
+				t.Errorf("Error decrypt by key id")
+			}
+		})
+		t.Run("Checking decrypt without key id "+public.KeyID, func(t *testing.T) {
+			decryptMsg, err := kr.Decrypt("", constants.TypeEncryptionHybrid, encryptMsg)
+			if err != nil || !bytes.Equal(msg, decryptMsg) {
+				t.Errorf("Error decrypt without key id")
+			}
+		})
+	}
+
+	t.Run("Checking reload with stray files", func(t *testing.T) {
+		for name, data := range map[string]string{"README": "ключи сервера\n", ".gitkeep": ""} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(filepath.Join(dir, name))
+		}
+
+		if err := kr.Reload(); err != nil {
+			t.Fatalf("Error reload with stray files: %s", err.Error())
+		}
+		if kr.Len() != 2 {
+			t.Errorf("Error keys after reload with stray files: %v", kr.KeyIDs())
+		}
+
+		// Отдельно указанный файл ключа должен быть ключом.
+		strayRing, err := NewKeyRing("", filepath.Join(dir, "README"))
+		if err == nil || strayRing.Len() != 0 {
+			t.Errorf("Error non-PEM key file must fail")
+		}
+	})
+
+	t.Run("Checking reload with broken key", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(dir, "partial.pfx"), []byte("-----BEGIN RSA PRIVATE"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(filepath.Join(dir, "partial.pfx"))
+		if err := os.Remove(oldKey); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := kr.Reload(); err == nil {
+			t.Fatal("Error reload with broken key must fail")
+		}
+		if _, ok := kr.Get(oldPublic.KeyID); !ok || kr.Len() != 2 {
+			t.Errorf("Error previous keys must be kept: %v", kr.KeyIDs())
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package encryption
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// LoadCertPool читает PEM-файл с одним или несколькими сертификатами удостоверяющего центра.
+func LoadCertPool(caPath string) (*x509.CertPool, error) {
+	caData, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(caData); !ok {
+		return nil, fmt.Errorf("в файле %s не найдено сертификатов", caPath)
+	}
+
+	return pool, nil
+}
+
+// ServerTLSConfig настройки TLS сервера.
+// Если указан clientCAPath, сервер требует сертификат клиента, подписанный этим удостоверяющим центром (mTLS).
+func ServerTLSConfig(clientCAPath string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAPath == "" {
+		return cfg, nil
+	}
+
+	pool, err := LoadCertPool(clientCAPath)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return cfg, nil
+}
+
+// ClientTLSConfig настройки TLS агента.
+// caPath: сертификаты, которым доверяет агент при проверке сервера. Если пусто, используются системные.
+// certPath и keyPath: сертификат и ключ агента для mTLS. Указываются вместе.
+func ClientTLSConfig(caPath string, certPath string, keyPath string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caPath != "" {
+		pool, err := LoadCertPool(caPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (certPath == "") != (keyPath == "") {
+		return nil, errors.New("сертификат и ключ клиента указываются вместе")
+	}
+	if certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
@@ -3,7 +3,9 @@ package environment
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
@@ -14,6 +16,7 @@ import (
 	"github.com/rs/zerolog"
 
 	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/logger"
 	"github.com/andynikk/advancedmetrics/internal/repository"
 )
 
@@ -24,6 +27,13 @@ type AgentConfigENV struct {
 	Key            string        `env:"KEY"`
 	CryptoKey      string        `env:"CRYPTO_KEY"`
 	Config         string        `env:"CONFIG"`
+	Scheme         string        `env:"SCHEME"`
+	TLSCA          string        `env:"TLS_CA"`
+	TLSCert        string        `env:"TLS_CERT"`
+	TLSKey         string        `env:"TLS_KEY"`
+	AgentID        string        `env:"AGENT_ID"`
+	SignKey        string        `env:"SIGN_KEY"`
+	HashScheme     string        `env:"HASH_SCHEME"`
 }
 
 type AgentConfig struct {
@@ -33,6 +43,13 @@ type AgentConfig struct {
 	Key            string
 	CryptoKey      string
 	ConfigFilePath string
+	Scheme         string
+	TLSCA          string
+	TLSCert        string
+	TLSKey         string
+	AgentID        string
+	SignKey        string
+	HashScheme     string
 }
 
 type AgentConfigFile struct {
@@ -40,38 +57,141 @@ type AgentConfigFile struct {
 	ReportInterval string `json:"report_interval"`
 	PollInterval   string `json:"poll_interval"`
 	CryptoKey      string `json:"crypto_key"`
+	Scheme         string `json:"scheme"`
+	TLSCA          string `json:"tls_ca"`
+	TLSCert        string `json:"tls_cert"`
+	TLSKey         string `json:"tls_key"`
+	AgentID        string `json:"agent_id"`
+	SignKey        string `json:"sign_key"`
+	HashScheme     string `json:"hash_scheme"`
 }
 
 type ServerConfigENV struct {
-	Address       string        `env:"ADDRESS" envDefault:"localhost:8080"`
-	StoreInterval time.Duration `env:"STORE_INTERVAL" envDefault:"300s"`
-	StoreFile     string        `env:"STORE_FILE" envDefault:"/tmp/devops-metrics-db.json"`
-	Restore       bool          `env:"RESTORE" envDefault:"true"`
-	Key           string        `env:"KEY"`
-	DatabaseDsn   string        `env:"DATABASE_DSN"`
-	CryptoKey     string        `env:"CRYPTO_KEY"`
-	Config        string        `env:"CONFIG"`
+	Address          string        `env:"ADDRESS" envDefault:"localhost:8080"`
+	StoreInterval    time.Duration `env:"STORE_INTERVAL" envDefault:"300s"`
+	StoreFile        string        `env:"STORE_FILE" envDefault:"/tmp/devops-metrics-db.json"`
+	Restore          bool          `env:"RESTORE" envDefault:"true"`
+	RestorePolicy    string        `env:"RESTORE_POLICY"`
+	Key              string        `env:"KEY"`
+	DatabaseDsn      string        `env:"DATABASE_DSN"`
+	CryptoKey        string        `env:"CRYPTO_KEY"`
+	Config           string        `env:"CONFIG"`
+	TrustedSubnet    string        `env:"TRUSTED_SUBNET"`
+	TLSCert          string        `env:"TLS_CERT"`
+	TLSKey           string        `env:"TLS_KEY"`
+	TLSClientCA      string        `env:"TLS_CLIENT_CA"`
+	CryptoKeyDir     string        `env:"CRYPTO_KEY_DIR"`
+	RequireSignature bool          `env:"REQUIRE_SIGNATURE"`
+	SignatureWindow  time.Duration `env:"SIGNATURE_WINDOW"`
+	TrustedAgentsDir string        `env:"TRUSTED_AGENTS_DIR"`
+	Storage          string        `env:"STORAGE"`
+	BoltFile         string        `env:"BOLT_FILE"`
+	BoltCompact      time.Duration `env:"BOLT_COMPACT_INTERVAL"`
+	FileSync         string        `env:"FILE_SYNC"`
+	FileSyncInterval time.Duration `env:"FILE_SYNC_INTERVAL"`
+	FileSnapshot     time.Duration `env:"FILE_SNAPSHOT_INTERVAL"`
+	FileWALMaxSize   int64         `env:"FILE_WAL_MAX_SIZE"`
+	SnapshotCompress bool          `env:"SNAPSHOT_COMPRESS"`
+	SnapshotEncrypt  string        `env:"SNAPSHOT_ENCRYPTION"`
+	SnapshotKey      string        `env:"SNAPSHOT_KEY"`
+	Migrate          bool          `env:"MIGRATE"`
+	SamplesRetention time.Duration `env:"SAMPLES_RETENTION"`
+	DBMaxConns       int32         `env:"DB_MAX_CONNS"`
+	DBConnectTimeout time.Duration `env:"DB_CONNECT_TIMEOUT"`
+	DBQueryTimeout   time.Duration `env:"DB_QUERY_TIMEOUT"`
+	DBRetryTimeout   time.Duration `env:"DB_RETRY_TIMEOUT"`
+	DBBufferSize     int           `env:"DB_BUFFER_SIZE"`
+	WriteQueueSize   int           `env:"WRITE_QUEUE_SIZE"`
+	WriteFlushSize   int           `env:"WRITE_FLUSH_SIZE"`
+	WriteFlushPeriod time.Duration `env:"WRITE_FLUSH_INTERVAL"`
+	ShutdownTimeout  time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	LogLevel         string        `env:"LOG_LEVEL"`
+	LogFormat        string        `env:"LOG_FORMAT"`
 }
 
 type ServerConfig struct {
-	StoreInterval      time.Duration
-	StoreFile          string
-	Restore            bool
-	Address            string
-	Key                string
-	DatabaseDsn        string
-	TypeMetricsStorage repository.MapTypeStore
-	CryptoKey          string
-	ConfigFilePath     string
+	StoreInterval    time.Duration
+	StoreFile        string
+	Restore          bool
+	RestorePolicy    string
+	Address          string
+	Key              string
+	DatabaseDsn      string
+	Storage          []string
+	BoltFile         string
+	BoltCompact      time.Duration
+	FileSync         string
+	FileSyncInterval time.Duration
+	FileSnapshot     time.Duration
+	FileWALMaxSize   int64
+	SnapshotCompress bool
+	SnapshotEncrypt  string
+	SnapshotKey      string
+	Migrate          bool
+	migrateSet       bool
+	SamplesRetention time.Duration
+	DBMaxConns       int32
+	DBConnectTimeout time.Duration
+	DBQueryTimeout   time.Duration
+	DBRetryTimeout   time.Duration
+	DBBufferSize     int
+	WriteQueueSize   int
+	WriteFlushSize   int
+	WriteFlushPeriod time.Duration
+	ShutdownTimeout  time.Duration
+	LogLevel         string
+	LogFormat        string
+	CryptoKey        string
+	ConfigFilePath   string
+	TrustedSubnet    string
+	TLSCert          string
+	TLSKey           string
+	TLSClientCA      string
+	CryptoKeyDir     string
+	RequireSignature bool
+	SignatureWindow  time.Duration
+	TrustedAgentsDir string
 }
 
 type ServerConfigFile struct {
-	Address       string `json:"address"`
-	Restore       bool   `json:"restore"`
-	StoreInterval string `json:"store_interval"`
-	StoreFile     string `json:"store_file"`
-	DatabaseDsn   string `json:"database_dsn"`
-	CryptoKey     string `json:"crypto_key"`
+	Address          string `json:"address"`
+	Restore          bool   `json:"restore"`
+	RestorePolicy    string `json:"restore_policy"`
+	StoreInterval    string `json:"store_interval"`
+	StoreFile        string `json:"store_file"`
+	DatabaseDsn      string `json:"database_dsn"`
+	CryptoKey        string `json:"crypto_key"`
+	TrustedSubnet    string `json:"trusted_subnet"`
+	TLSCert          string `json:"tls_cert"`
+	TLSKey           string `json:"tls_key"`
+	TLSClientCA      string `json:"tls_client_ca"`
+	CryptoKeyDir     string `json:"crypto_key_dir"`
+	RequireSignature bool   `json:"require_signature"`
+	SignatureWindow  string `json:"signature_window"`
+	TrustedAgentsDir string `json:"trusted_agents_dir"`
+	Storage          string `json:"storage"`
+	BoltFile         string `json:"bolt_file"`
+	BoltCompact      string `json:"bolt_compact_interval"`
+	FileSync         string `json:"file_sync"`
+	FileSyncInterval string `json:"file_sync_interval"`
+	FileSnapshot     string `json:"file_snapshot_interval"`
+	FileWALMaxSize   int64  `json:"file_wal_max_size"`
+	SnapshotCompress bool   `json:"snapshot_compress"`
+	SnapshotEncrypt  string `json:"snapshot_encryption"`
+	SnapshotKey      string `json:"snapshot_key"`
+	Migrate          *bool  `json:"migrate"`
+	SamplesRetention string `json:"samples_retention"`
+	DBMaxConns       int32  `json:"db_max_conns"`
+	DBConnectTimeout string `json:"db_connect_timeout"`
+	DBQueryTimeout   string `json:"db_query_timeout"`
+	DBRetryTimeout   string `json:"db_retry_timeout"`
+	DBBufferSize     int    `json:"db_buffer_size"`
+	WriteQueueSize   int    `json:"write_queue_size"`
+	WriteFlushSize   int    `json:"write_flush_size"`
+	WriteFlushPeriod string `json:"write_flush_interval"`
+	ShutdownTimeout  string `json:"shutdown_timeout"`
+	LogLevel         string `json:"log_level"`
+	LogFormat        string `json:"log_format"`
 }
 
 func ThisOSWindows() bool {
@@ -131,6 +251,10 @@ func GetAgentConfigFile(file *string) AgentConfigFile {
 	}
 	if ThisOSWindows() {
 		sConfig.CryptoKey = strings.Replace(sConfig.CryptoKey, "/", "\\", -1)
+		sConfig.TLSCA = strings.Replace(sConfig.TLSCA, "/", "\\", -1)
+		sConfig.TLSCert = strings.Replace(sConfig.TLSCert, "/", "\\", -1)
+		sConfig.TLSKey = strings.Replace(sConfig.TLSKey, "/", "\\", -1)
+		sConfig.SignKey = strings.Replace(sConfig.SignKey, "/", "\\", -1)
 	}
 
 	return sConfig
@@ -147,6 +271,15 @@ func InitConfigAgent() *AgentConfig {
 	return &configAgent
 }
 
+// Validate проверяет настройки агента после заполнения значениями по умолчанию.
+// Ключ подписи SIGN_KEY без AGENT_ID - ошибка ErrConfig: сервер ищет ключ проверки подписи по AGENT_ID.
+func (ac *AgentConfig) Validate() error {
+	if ac.SignKey != "" && ac.AgentID == "" {
+		return fmt.Errorf("%w: SIGN_KEY задан без AGENT_ID", ErrConfig)
+	}
+	return nil
+}
+
 func (ac *AgentConfig) InitConfigAgentENV() {
 
 	var cfgENV AgentConfigENV
@@ -185,12 +318,54 @@ func (ac *AgentConfig) InitConfigAgentENV() {
 		patchCryptoKey = cfgENV.CryptoKey
 	}
 
+	scheme := ""
+	if _, ok := os.LookupEnv("SCHEME"); ok {
+		scheme = cfgENV.Scheme
+	}
+
+	patchTLSCA := ""
+	if _, ok := os.LookupEnv("TLS_CA"); ok {
+		patchTLSCA = cfgENV.TLSCA
+	}
+
+	patchTLSCert := ""
+	if _, ok := os.LookupEnv("TLS_CERT"); ok {
+		patchTLSCert = cfgENV.TLSCert
+	}
+
+	patchTLSKey := ""
+	if _, ok := os.LookupEnv("TLS_KEY"); ok {
+		patchTLSKey = cfgENV.TLSKey
+	}
+
+	agentID := ""
+	if _, ok := os.LookupEnv("AGENT_ID"); ok {
+		agentID = cfgENV.AgentID
+	}
+
+	patchSignKey := ""
+	if _, ok := os.LookupEnv("SIGN_KEY"); ok {
+		patchSignKey = cfgENV.SignKey
+	}
+
+	hashScheme := ""
+	if _, ok := os.LookupEnv("HASH_SCHEME"); ok {
+		hashScheme = cfgENV.HashScheme
+	}
+
 	ac.Address = addressServ
 	ac.ReportInterval = reportIntervalMetric
 	ac.PollInterval = pollIntervalMetrics
 	ac.Key = keyHash
 	ac.CryptoKey = patchCryptoKey
 	ac.ConfigFilePath = pathFileCfg
+	ac.Scheme = scheme
+	ac.TLSCA = patchTLSCA
+	ac.TLSCert = patchTLSCert
+	ac.TLSKey = patchTLSKey
+	ac.AgentID = agentID
+	ac.SignKey = patchSignKey
+	ac.HashScheme = hashScheme
 }
 
 func (ac *AgentConfig) InitConfigAgentFlag() {
@@ -202,6 +377,13 @@ func (ac *AgentConfig) InitConfigAgentFlag() {
 	cryptoKeyFlag := flag.String("crypto-key", "", "файл с криптоключем")
 	fileCfg := flag.String("config", "", "файл с конфигурацией")
 	fileCfgC := flag.String("c", "", "файл с конфигурацией")
+	schemeFlag := flag.String("scheme", "", "схема подключения к серверу (http, https)")
+	tlsCAFlag := flag.String("tls-ca", "", "файл с сертификатами удостоверяющего центра")
+	tlsCertFlag := flag.String("tls-cert", "", "файл с сертификатом агента для mTLS")
+	tlsKeyFlag := flag.String("tls-key", "", "файл с ключом агента для mTLS")
+	agentIDFlag := flag.String("agent-id", "", "идентификатор агента")
+	signKeyFlag := flag.String("sign-key", "", "файл с ключом Ed25519 для подписи запросов агента")
+	hashSchemeFlag := flag.String("hash-scheme", "", "схема хеширования метрик (v1, v2)")
 
 	flag.Parse()
 
@@ -230,6 +412,27 @@ func (ac *AgentConfig) InitConfigAgentFlag() {
 	if ac.ConfigFilePath == "" {
 		ac.ConfigFilePath = pathFileCfg
 	}
+	if ac.Scheme == "" {
+		ac.Scheme = *schemeFlag
+	}
+	if ac.TLSCA == "" {
+		ac.TLSCA = *tlsCAFlag
+	}
+	if ac.TLSCert == "" {
+		ac.TLSCert = *tlsCertFlag
+	}
+	if ac.TLSKey == "" {
+		ac.TLSKey = *tlsKeyFlag
+	}
+	if ac.AgentID == "" {
+		ac.AgentID = *agentIDFlag
+	}
+	if ac.SignKey == "" {
+		ac.SignKey = *signKeyFlag
+	}
+	if ac.HashScheme == "" {
+		ac.HashScheme = *hashSchemeFlag
+	}
 }
 
 func (ac *AgentConfig) InitConfigAgentFile() {
@@ -258,6 +461,27 @@ func (ac *AgentConfig) InitConfigAgentFile() {
 	if ac.CryptoKey == "" {
 		ac.CryptoKey = patchCryptoKey
 	}
+	if ac.Scheme == "" {
+		ac.Scheme = jsonCfg.Scheme
+	}
+	if ac.TLSCA == "" {
+		ac.TLSCA = jsonCfg.TLSCA
+	}
+	if ac.TLSCert == "" {
+		ac.TLSCert = jsonCfg.TLSCert
+	}
+	if ac.TLSKey == "" {
+		ac.TLSKey = jsonCfg.TLSKey
+	}
+	if ac.AgentID == "" {
+		ac.AgentID = jsonCfg.AgentID
+	}
+	if ac.SignKey == "" {
+		ac.SignKey = jsonCfg.SignKey
+	}
+	if ac.HashScheme == "" {
+		ac.HashScheme = jsonCfg.HashScheme
+	}
 }
 
 func (ac *AgentConfig) InitConfigAgentDefault() {
@@ -275,6 +499,18 @@ func (ac *AgentConfig) InitConfigAgentDefault() {
 	if ac.PollInterval == 0 {
 		ac.PollInterval = pollIntervalMetrics
 	}
+	if ac.Scheme == "" {
+		ac.Scheme = constants.SchemeHTTP
+		if ac.TLSCA != "" || ac.TLSCert != "" {
+			ac.Scheme = constants.SchemeHTTPS
+		}
+	}
+	if ac.AgentID == "" {
+		ac.AgentID, _ = os.Hostname()
+	}
+	if ac.HashScheme == "" {
+		ac.HashScheme = constants.HashSchemeV2
+	}
 }
 
 func GetServerConfigFile(file *string) ServerConfigFile {
@@ -294,12 +530,21 @@ func GetServerConfigFile(file *string) ServerConfigFile {
 	if ThisOSWindows() {
 		sConfig.CryptoKey = strings.Replace(sConfig.CryptoKey, "/", "\\", -1)
 		sConfig.StoreFile = strings.Replace(sConfig.StoreFile, "/", "\\", -1)
+		sConfig.TLSCert = strings.Replace(sConfig.TLSCert, "/", "\\", -1)
+		sConfig.TLSKey = strings.Replace(sConfig.TLSKey, "/", "\\", -1)
+		sConfig.TLSClientCA = strings.Replace(sConfig.TLSClientCA, "/", "\\", -1)
+		sConfig.CryptoKeyDir = strings.Replace(sConfig.CryptoKeyDir, "/", "\\", -1)
+		sConfig.TrustedAgentsDir = strings.Replace(sConfig.TrustedAgentsDir, "/", "\\", -1)
+		sConfig.BoltFile = strings.Replace(sConfig.BoltFile, "/", "\\", -1)
 	}
 
 	return sConfig
 
 }
 
+// ErrConfig недопустимое значение настройки сервера или агента.
+var ErrConfig = errors.New("недопустимое значение настройки")
+
 func InitConfigServer() *ServerConfig {
 	constants.Logger.Log = zerolog.New(os.Stdout).Level(zerolog.InfoLevel)
 
@@ -309,9 +554,41 @@ func InitConfigServer() *ServerConfig {
 	sc.InitConfigServerFile()
 	sc.InitConfigServerDefault()
 
+	// До разбора настроек журнал пишется с уровнем info в формате json, ошибка настроек журнала его не меняет.
+	serverLogger, err := logger.New(os.Stdout, sc.LogLevel, sc.LogFormat)
+	if err != nil {
+		constants.Logger.ErrorLog(err)
+	} else {
+		constants.Logger = serverLogger
+	}
+
 	return &sc
 }
 
+// Validate проверяет настройки после заполнения значениями по умолчанию.
+// Отрицательные размеры очереди записи и интервал ее записи - ошибка ErrConfig:
+// значение по умолчанию подставляется только вместо нуля.
+// Сертификат TLS без ключа, ключ без сертификата и TLS_CLIENT_CA без них - тоже ошибка ErrConfig,
+// иначе сервер молча работал бы по HTTP.
+func (sc *ServerConfig) Validate() error {
+	if (sc.TLSCert == "") != (sc.TLSKey == "") {
+		return fmt.Errorf("%w: TLS_CERT и TLS_KEY задаются вместе", ErrConfig)
+	}
+	if sc.TLSClientCA != "" && sc.TLSCert == "" {
+		return fmt.Errorf("%w: TLS_CLIENT_CA задан без TLS_CERT и TLS_KEY", ErrConfig)
+	}
+	if sc.WriteQueueSize < 0 {
+		return fmt.Errorf("%w: WRITE_QUEUE_SIZE %d", ErrConfig, sc.WriteQueueSize)
+	}
+	if sc.WriteFlushSize < 0 {
+		return fmt.Errorf("%w: WRITE_FLUSH_SIZE %d", ErrConfig, sc.WriteFlushSize)
+	}
+	if sc.WriteFlushPeriod < 0 {
+		return fmt.Errorf("%w: WRITE_FLUSH_INTERVAL %s", ErrConfig, sc.WriteFlushPeriod)
+	}
+	return nil
+}
+
 func (sc *ServerConfig) InitConfigServerENV() {
 
 	var cfgENV ServerConfigENV
@@ -360,30 +637,212 @@ func (sc *ServerConfig) InitConfigServerENV() {
 		patchFileConfig = cfgENV.Config
 	}
 
-	MapTypeStore := make(repository.MapTypeStore)
-	if databaseDsn != "" {
-		typeDB := repository.TypeStoreDataDB{}
-		MapTypeStore[constants.MetricsStorageDB.String()] = &typeDB
-	} else if storeFileMetrics != "" {
-		typeFile := repository.TypeStoreDataFile{}
-		MapTypeStore[constants.MetricsStorageFile.String()] = &typeFile
+	var trustedSubnet string
+	if _, ok := os.LookupEnv("TRUSTED_SUBNET"); ok {
+		trustedSubnet = cfgENV.TrustedSubnet
+	}
+
+	var patchTLSCert string
+	if _, ok := os.LookupEnv("TLS_CERT"); ok {
+		patchTLSCert = cfgENV.TLSCert
+	}
+
+	var patchTLSKey string
+	if _, ok := os.LookupEnv("TLS_KEY"); ok {
+		patchTLSKey = cfgENV.TLSKey
+	}
+
+	var patchTLSClientCA string
+	if _, ok := os.LookupEnv("TLS_CLIENT_CA"); ok {
+		patchTLSClientCA = cfgENV.TLSClientCA
+	}
+
+	var patchCryptoKeyDir string
+	if _, ok := os.LookupEnv("CRYPTO_KEY_DIR"); ok {
+		patchCryptoKeyDir = cfgENV.CryptoKeyDir
+	}
+
+	var requireSignature bool
+	if _, ok := os.LookupEnv("REQUIRE_SIGNATURE"); ok {
+		requireSignature = cfgENV.RequireSignature
+	}
+
+	var signatureWindow time.Duration
+	if _, ok := os.LookupEnv("SIGNATURE_WINDOW"); ok {
+		signatureWindow = cfgENV.SignatureWindow
+	}
+
+	var patchTrustedAgentsDir string
+	if _, ok := os.LookupEnv("TRUSTED_AGENTS_DIR"); ok {
+		patchTrustedAgentsDir = cfgENV.TrustedAgentsDir
+	}
+
+	var storage []string
+	if _, ok := os.LookupEnv("STORAGE"); ok {
+		storage = repository.ParseStorage(cfgENV.Storage)
+	}
+
+	var patchBoltFile string
+	if _, ok := os.LookupEnv("BOLT_FILE"); ok {
+		patchBoltFile = cfgENV.BoltFile
+	}
+
+	var boltCompact time.Duration
+	if _, ok := os.LookupEnv("BOLT_COMPACT_INTERVAL"); ok {
+		boltCompact = cfgENV.BoltCompact
+	}
+
+	var restorePolicy string
+	if _, ok := os.LookupEnv("RESTORE_POLICY"); ok {
+		restorePolicy = cfgENV.RestorePolicy
+	}
+
+	var fileSync string
+	if _, ok := os.LookupEnv("FILE_SYNC"); ok {
+		fileSync = cfgENV.FileSync
+	}
+
+	var fileSyncInterval time.Duration
+	if _, ok := os.LookupEnv("FILE_SYNC_INTERVAL"); ok {
+		fileSyncInterval = cfgENV.FileSyncInterval
+	}
+
+	var fileSnapshot time.Duration
+	if _, ok := os.LookupEnv("FILE_SNAPSHOT_INTERVAL"); ok {
+		fileSnapshot = cfgENV.FileSnapshot
+	}
+
+	var fileWALMaxSize int64
+	if _, ok := os.LookupEnv("FILE_WAL_MAX_SIZE"); ok {
+		fileWALMaxSize = cfgENV.FileWALMaxSize
+	}
+
+	var snapshotCompress bool
+	if _, ok := os.LookupEnv("SNAPSHOT_COMPRESS"); ok {
+		snapshotCompress = cfgENV.SnapshotCompress
+	}
+
+	var snapshotEncrypt string
+	if _, ok := os.LookupEnv("SNAPSHOT_ENCRYPTION"); ok {
+		snapshotEncrypt = cfgENV.SnapshotEncrypt
+	}
+
+	var snapshotKey string
+	if _, ok := os.LookupEnv("SNAPSHOT_KEY"); ok {
+		snapshotKey = cfgENV.SnapshotKey
+	}
+
+	if _, ok := os.LookupEnv("MIGRATE"); ok {
+		sc.Migrate = cfgENV.Migrate
+		sc.migrateSet = true
+	}
+
+	var samplesRetention time.Duration
+	if _, ok := os.LookupEnv("SAMPLES_RETENTION"); ok {
+		samplesRetention = cfgENV.SamplesRetention
+	}
+
+	var dbMaxConns int32
+	if _, ok := os.LookupEnv("DB_MAX_CONNS"); ok {
+		dbMaxConns = cfgENV.DBMaxConns
+	}
+
+	var dbConnectTimeout time.Duration
+	if _, ok := os.LookupEnv("DB_CONNECT_TIMEOUT"); ok {
+		dbConnectTimeout = cfgENV.DBConnectTimeout
+	}
+
+	var dbQueryTimeout time.Duration
+	if _, ok := os.LookupEnv("DB_QUERY_TIMEOUT"); ok {
+		dbQueryTimeout = cfgENV.DBQueryTimeout
+	}
+
+	var dbRetryTimeout time.Duration
+	if _, ok := os.LookupEnv("DB_RETRY_TIMEOUT"); ok {
+		dbRetryTimeout = cfgENV.DBRetryTimeout
+	}
+
+	var dbBufferSize int
+	if _, ok := os.LookupEnv("DB_BUFFER_SIZE"); ok {
+		dbBufferSize = cfgENV.DBBufferSize
+	}
+
+	var writeQueueSize int
+	if _, ok := os.LookupEnv("WRITE_QUEUE_SIZE"); ok {
+		writeQueueSize = cfgENV.WriteQueueSize
+	}
+
+	var writeFlushSize int
+	if _, ok := os.LookupEnv("WRITE_FLUSH_SIZE"); ok {
+		writeFlushSize = cfgENV.WriteFlushSize
+	}
+
+	var writeFlushPeriod time.Duration
+	if _, ok := os.LookupEnv("WRITE_FLUSH_INTERVAL"); ok {
+		writeFlushPeriod = cfgENV.WriteFlushPeriod
+	}
+
+	var shutdownTimeout time.Duration
+	if _, ok := os.LookupEnv("SHUTDOWN_TIMEOUT"); ok {
+		shutdownTimeout = cfgENV.ShutdownTimeout
+	}
+
+	var logLevel string
+	if _, ok := os.LookupEnv("LOG_LEVEL"); ok {
+		logLevel = cfgENV.LogLevel
+	}
+
+	var logFormat string
+	if _, ok := os.LookupEnv("LOG_FORMAT"); ok {
+		logFormat = cfgENV.LogFormat
 	}
 
 	sc.StoreInterval = storeIntervalMetrics
 	sc.StoreFile = storeFileMetrics
 	sc.Restore = restoreMetric
+	sc.RestorePolicy = restorePolicy
 	sc.Address = addressServ
 	sc.Key = keyHash
 	sc.DatabaseDsn = databaseDsn
-	sc.TypeMetricsStorage = MapTypeStore
+	sc.Storage = storage
+	sc.BoltFile = patchBoltFile
+	sc.BoltCompact = boltCompact
+	sc.FileSync = fileSync
+	sc.FileSyncInterval = fileSyncInterval
+	sc.FileSnapshot = fileSnapshot
+	sc.FileWALMaxSize = fileWALMaxSize
+	sc.SnapshotCompress = snapshotCompress
+	sc.SnapshotEncrypt = snapshotEncrypt
+	sc.SnapshotKey = snapshotKey
+	sc.SamplesRetention = samplesRetention
+	sc.DBMaxConns = dbMaxConns
+	sc.DBConnectTimeout = dbConnectTimeout
+	sc.DBQueryTimeout = dbQueryTimeout
+	sc.DBRetryTimeout = dbRetryTimeout
+	sc.DBBufferSize = dbBufferSize
+	sc.WriteQueueSize = writeQueueSize
+	sc.WriteFlushSize = writeFlushSize
+	sc.WriteFlushPeriod = writeFlushPeriod
+	sc.ShutdownTimeout = shutdownTimeout
+	sc.LogLevel = logLevel
+	sc.LogFormat = logFormat
 	sc.CryptoKey = patchCryptoKey
 	sc.ConfigFilePath = patchFileConfig
+	sc.TrustedSubnet = trustedSubnet
+	sc.TLSCert = patchTLSCert
+	sc.TLSKey = patchTLSKey
+	sc.TLSClientCA = patchTLSClientCA
+	sc.CryptoKeyDir = patchCryptoKeyDir
+	sc.RequireSignature = requireSignature
+	sc.SignatureWindow = signatureWindow
+	sc.TrustedAgentsDir = patchTrustedAgentsDir
 }
 
 func (sc *ServerConfig) InitConfigServerFlag() {
 
 	addressPtr := flag.String("a", "", "имя сервера")
 	restorePtr := flag.Bool("r", false, "восстанавливать значения при старте")
+	restorePolicyFlag := flag.String("restore-policy", "", "откуда восстанавливать значения (primary, newest, merge)")
 	storeIntervalPtr := flag.Duration("i", 0, "интервал автосохранения (сек.)")
 	storeFilePtr := flag.String("f", "", "путь к файлу метрик")
 	keyFlag := flag.String("k", "", "ключ хеша")
@@ -391,6 +850,37 @@ func (sc *ServerConfig) InitConfigServerFlag() {
 	cryptoKeyFlag := flag.String("crypto-key", "", "файл с криптоключем")
 	fileCfg := flag.String("config", "", "файл с конфигурацией")
 	fileCfgC := flag.String("c", "", "файл с конфигурацией")
+	trustedSubnetFlag := flag.String("t", "", "доверенная подсеть агентов (CIDR)")
+	tlsCertFlag := flag.String("tls-cert", "", "файл с сертификатом сервера для HTTPS")
+	tlsKeyFlag := flag.String("tls-key", "", "файл с ключом сервера для HTTPS")
+	tlsClientCAFlag := flag.String("tls-client-ca", "", "файл с сертификатом УЦ для проверки агентов (mTLS)")
+	cryptoKeyDirFlag := flag.String("crypto-key-dir", "", "каталог с приватными ключами для ротации")
+	requireSignatureFlag := flag.Bool("require-signature", false, "принимать только подписанные запросы")
+	signatureWindowFlag := flag.Duration("signature-window", 0, "допустимое отклонение времени подписанного запроса")
+	trustedAgentsDirFlag := flag.String("trusted-agents-dir", "", "каталог с открытыми ключами доверенных агентов")
+	storageFlag := flag.String("storage", "", "хранилища метрик через запятую (db, file, bolt)")
+	boltFileFlag := flag.String("bolt-file", "", "путь к файлу базы bbolt")
+	boltCompactFlag := flag.Duration("bolt-compact-interval", 0, "интервал проверки сжатия базы bbolt")
+	fileSyncFlag := flag.String("file-sync", "", "сброс журнала файлового хранилища на диск (always, interval, never)")
+	fileSyncIntervalFlag := flag.Duration("file-sync-interval", 0, "интервал сброса журнала на диск в режиме interval")
+	fileSnapshotFlag := flag.Duration("file-snapshot-interval", 0, "интервал записи снимка файлового хранилища")
+	fileWALMaxSizeFlag := flag.Int64("file-wal-max-size", 0, "размер журнала в байтах, после которого пишется снимок")
+	snapshotCompressFlag := flag.Bool("snapshot-compress", false, "сжимать снимок файлового хранилища gzip")
+	snapshotEncryptFlag := flag.String("snapshot-encryption", "", "шифрование файлового хранилища (none, aes, rsa)")
+	snapshotKeyFlag := flag.String("snapshot-key", "", "ключ AES файлового хранилища в шестнадцатеричном виде")
+	samplesRetentionFlag := flag.Duration("samples-retention", 0, "срок хранения истории метрик в БД")
+	dbMaxConnsFlag := flag.Int("db-max-conns", 0, "максимальное количество соединений с БД, 0 - по умолчанию pgx")
+	dbConnectTimeoutFlag := flag.Duration("db-connect-timeout", 0, "время ожидания соединения с БД")
+	dbQueryTimeoutFlag := flag.Duration("db-query-timeout", 0, "время ожидания записи в БД")
+	dbRetryTimeoutFlag := flag.Duration("db-retry-timeout", 0, "сколько ждать БД при старте, затем подключение продолжается в фоне")
+	dbBufferSizeFlag := flag.Int("db-buffer-size", 0, "сколько значений истории хранить, пока БД недоступна")
+	writeQueueSizeFlag := flag.Int("write-queue-size", 0, "размер очереди записи метрик в хранилища")
+	writeFlushSizeFlag := flag.Int("write-flush-size", 0, "размер пакета записи очереди в хранилища")
+	writeFlushPeriodFlag := flag.Duration("write-flush-interval", 0, "интервал записи очереди в хранилища")
+	shutdownTimeoutFlag := flag.Duration("shutdown-timeout", 0, "сколько ждать завершения запросов при остановке сервера")
+	logLevelFlag := flag.String("log-level", "", "уровень журнала: debug, info, warn, error")
+	logFormatFlag := flag.String("log-format", "", "формат журнала: json или console")
+	migrateFlag := flag.Bool("migrate", constants.Migrate, "применять миграции схемы БД при старте")
 
 	flag.Parse()
 
@@ -401,17 +891,6 @@ func (sc *ServerConfig) InitConfigServerFlag() {
 		pathFileCfg = *fileCfgC
 	}
 
-	MapTypeStore := make(repository.MapTypeStore)
-	if len(sc.TypeMetricsStorage) == 0 {
-		if *keyDatabaseDsn != "" {
-			typeDB := repository.TypeStoreDataDB{}
-			MapTypeStore[constants.MetricsStorageDB.String()] = &typeDB
-		} else if *cryptoKeyFlag != "" {
-			typeFile := repository.TypeStoreDataFile{}
-			MapTypeStore[constants.MetricsStorageFile.String()] = &typeFile
-		}
-	}
-
 	if sc.Address == "" {
 		sc.Address = *addressPtr
 	}
@@ -436,9 +915,106 @@ func (sc *ServerConfig) InitConfigServerFlag() {
 	if sc.ConfigFilePath == "" {
 		sc.ConfigFilePath = pathFileCfg
 	}
-	if len(sc.TypeMetricsStorage) == 0 {
-		sc.TypeMetricsStorage = MapTypeStore
+	if sc.TrustedSubnet == "" {
+		sc.TrustedSubnet = *trustedSubnetFlag
+	}
+	if sc.TLSCert == "" {
+		sc.TLSCert = *tlsCertFlag
+	}
+	if sc.TLSKey == "" {
+		sc.TLSKey = *tlsKeyFlag
+	}
+	if sc.TLSClientCA == "" {
+		sc.TLSClientCA = *tlsClientCAFlag
+	}
+	if sc.CryptoKeyDir == "" {
+		sc.CryptoKeyDir = *cryptoKeyDirFlag
+	}
+	if !sc.RequireSignature {
+		sc.RequireSignature = *requireSignatureFlag
+	}
+	if sc.SignatureWindow == 0 {
+		sc.SignatureWindow = *signatureWindowFlag
+	}
+	if sc.TrustedAgentsDir == "" {
+		sc.TrustedAgentsDir = *trustedAgentsDirFlag
+	}
+	if len(sc.Storage) == 0 {
+		sc.Storage = repository.ParseStorage(*storageFlag)
+	}
+	if sc.BoltFile == "" {
+		sc.BoltFile = *boltFileFlag
+	}
+	if sc.BoltCompact == 0 {
+		sc.BoltCompact = *boltCompactFlag
+	}
+	if sc.RestorePolicy == "" {
+		sc.RestorePolicy = *restorePolicyFlag
+	}
+	if sc.FileSync == "" {
+		sc.FileSync = *fileSyncFlag
+	}
+	if sc.FileSyncInterval == 0 {
+		sc.FileSyncInterval = *fileSyncIntervalFlag
 	}
+	if sc.FileSnapshot == 0 {
+		sc.FileSnapshot = *fileSnapshotFlag
+	}
+	if sc.FileWALMaxSize == 0 {
+		sc.FileWALMaxSize = *fileWALMaxSizeFlag
+	}
+	if !sc.SnapshotCompress {
+		sc.SnapshotCompress = *snapshotCompressFlag
+	}
+	if sc.SnapshotEncrypt == "" {
+		sc.SnapshotEncrypt = *snapshotEncryptFlag
+	}
+	if sc.SnapshotKey == "" {
+		sc.SnapshotKey = *snapshotKeyFlag
+	}
+	if sc.SamplesRetention == 0 {
+		sc.SamplesRetention = *samplesRetentionFlag
+	}
+	if sc.DBMaxConns == 0 {
+		sc.DBMaxConns = int32(*dbMaxConnsFlag)
+	}
+	if sc.DBConnectTimeout == 0 {
+		sc.DBConnectTimeout = *dbConnectTimeoutFlag
+	}
+	if sc.DBQueryTimeout == 0 {
+		sc.DBQueryTimeout = *dbQueryTimeoutFlag
+	}
+	if sc.DBRetryTimeout == 0 {
+		sc.DBRetryTimeout = *dbRetryTimeoutFlag
+	}
+	if sc.DBBufferSize == 0 {
+		sc.DBBufferSize = *dbBufferSizeFlag
+	}
+	if sc.WriteQueueSize == 0 {
+		sc.WriteQueueSize = *writeQueueSizeFlag
+	}
+	if sc.WriteFlushSize == 0 {
+		sc.WriteFlushSize = *writeFlushSizeFlag
+	}
+	if sc.WriteFlushPeriod == 0 {
+		sc.WriteFlushPeriod = *writeFlushPeriodFlag
+	}
+	if sc.ShutdownTimeout == 0 {
+		sc.ShutdownTimeout = *shutdownTimeoutFlag
+	}
+	if sc.LogLevel == "" {
+		sc.LogLevel = *logLevelFlag
+	}
+	if sc.LogFormat == "" {
+		sc.LogFormat = *logFormatFlag
+	}
+	// У флага -migrate значение по умолчанию true, поэтому учитывается только явно указанный флаг.
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "migrate" && !sc.migrateSet {
+			sc.Migrate = *migrateFlag
+			sc.migrateSet = true
+		}
+	})
 }
 
 func (sc *ServerConfig) InitConfigServerFile() {
@@ -456,17 +1032,7 @@ func (sc *ServerConfig) InitConfigServerFile() {
 	storeFileMetrics := jsonCfg.StoreFile
 	databaseDsn := jsonCfg.DatabaseDsn
 	patchCryptoKey := jsonCfg.CryptoKey
-
-	MapTypeStore := make(repository.MapTypeStore)
-	if len(sc.TypeMetricsStorage) == 0 {
-		if databaseDsn != "" {
-			typeDB := repository.TypeStoreDataDB{}
-			MapTypeStore[constants.MetricsStorageDB.String()] = &typeDB
-		} else if storeFileMetrics != "" {
-			typeFile := repository.TypeStoreDataFile{}
-			MapTypeStore[constants.MetricsStorageFile.String()] = &typeFile
-		}
-	}
+	trustedSubnet := jsonCfg.TrustedSubnet
 
 	if sc.Address == "" {
 		sc.Address = addressServ
@@ -486,8 +1052,102 @@ func (sc *ServerConfig) InitConfigServerFile() {
 	if sc.CryptoKey == "" {
 		sc.CryptoKey = patchCryptoKey
 	}
-	if len(sc.TypeMetricsStorage) == 0 {
-		sc.TypeMetricsStorage = MapTypeStore
+	if sc.TrustedSubnet == "" {
+		sc.TrustedSubnet = trustedSubnet
+	}
+	if sc.TLSCert == "" {
+		sc.TLSCert = jsonCfg.TLSCert
+	}
+	if sc.TLSKey == "" {
+		sc.TLSKey = jsonCfg.TLSKey
+	}
+	if sc.TLSClientCA == "" {
+		sc.TLSClientCA = jsonCfg.TLSClientCA
+	}
+	if sc.CryptoKeyDir == "" {
+		sc.CryptoKeyDir = jsonCfg.CryptoKeyDir
+	}
+	if !sc.RequireSignature {
+		sc.RequireSignature = jsonCfg.RequireSignature
+	}
+	if sc.SignatureWindow == 0 {
+		sc.SignatureWindow, _ = time.ParseDuration(jsonCfg.SignatureWindow)
+	}
+	if sc.TrustedAgentsDir == "" {
+		sc.TrustedAgentsDir = jsonCfg.TrustedAgentsDir
+	}
+	if len(sc.Storage) == 0 {
+		sc.Storage = repository.ParseStorage(jsonCfg.Storage)
+	}
+	if sc.BoltFile == "" {
+		sc.BoltFile = jsonCfg.BoltFile
+	}
+	if sc.BoltCompact == 0 {
+		sc.BoltCompact, _ = time.ParseDuration(jsonCfg.BoltCompact)
+	}
+	if sc.RestorePolicy == "" {
+		sc.RestorePolicy = jsonCfg.RestorePolicy
+	}
+	if sc.FileSync == "" {
+		sc.FileSync = jsonCfg.FileSync
+	}
+	if sc.FileSyncInterval == 0 {
+		sc.FileSyncInterval, _ = time.ParseDuration(jsonCfg.FileSyncInterval)
+	}
+	if sc.FileSnapshot == 0 {
+		sc.FileSnapshot, _ = time.ParseDuration(jsonCfg.FileSnapshot)
+	}
+	if sc.FileWALMaxSize == 0 {
+		sc.FileWALMaxSize = jsonCfg.FileWALMaxSize
+	}
+	if !sc.SnapshotCompress {
+		sc.SnapshotCompress = jsonCfg.SnapshotCompress
+	}
+	if sc.SnapshotEncrypt == "" {
+		sc.SnapshotEncrypt = jsonCfg.SnapshotEncrypt
+	}
+	if sc.SnapshotKey == "" {
+		sc.SnapshotKey = jsonCfg.SnapshotKey
+	}
+	if sc.SamplesRetention == 0 {
+		sc.SamplesRetention, _ = time.ParseDuration(jsonCfg.SamplesRetention)
+	}
+	if sc.DBMaxConns == 0 {
+		sc.DBMaxConns = jsonCfg.DBMaxConns
+	}
+	if sc.DBConnectTimeout == 0 {
+		sc.DBConnectTimeout, _ = time.ParseDuration(jsonCfg.DBConnectTimeout)
+	}
+	if sc.DBQueryTimeout == 0 {
+		sc.DBQueryTimeout, _ = time.ParseDuration(jsonCfg.DBQueryTimeout)
+	}
+	if sc.DBRetryTimeout == 0 {
+		sc.DBRetryTimeout, _ = time.ParseDuration(jsonCfg.DBRetryTimeout)
+	}
+	if sc.DBBufferSize == 0 {
+		sc.DBBufferSize = jsonCfg.DBBufferSize
+	}
+	if sc.WriteQueueSize == 0 {
+		sc.WriteQueueSize = jsonCfg.WriteQueueSize
+	}
+	if sc.WriteFlushSize == 0 {
+		sc.WriteFlushSize = jsonCfg.WriteFlushSize
+	}
+	if sc.WriteFlushPeriod == 0 {
+		sc.WriteFlushPeriod, _ = time.ParseDuration(jsonCfg.WriteFlushPeriod)
+	}
+	if sc.ShutdownTimeout == 0 {
+		sc.ShutdownTimeout, _ = time.ParseDuration(jsonCfg.ShutdownTimeout)
+	}
+	if sc.LogLevel == "" {
+		sc.LogLevel = jsonCfg.LogLevel
+	}
+	if sc.LogFormat == "" {
+		sc.LogFormat = jsonCfg.LogFormat
+	}
+	if !sc.migrateSet && jsonCfg.Migrate != nil {
+		sc.Migrate = *jsonCfg.Migrate
+		sc.migrateSet = true
 	}
 }
 
@@ -505,5 +1165,71 @@ func (sc *ServerConfig) InitConfigServerDefault() {
 	if !sc.Restore {
 		sc.Restore = constants.Restore
 	}
+	if sc.SignatureWindow == 0 {
+		sc.SignatureWindow = constants.SignatureWindow
+	}
+	if len(sc.Storage) == 0 {
+		sc.Storage = repository.DefaultStorage(sc.DatabaseDsn, sc.StoreFile)
+	}
+	if sc.BoltFile == "" {
+		sc.BoltFile = constants.BoltFile
+	}
+	if sc.BoltCompact == 0 {
+		sc.BoltCompact = constants.BoltCompactInterval
+	}
+	if sc.RestorePolicy == "" {
+		sc.RestorePolicy = constants.RestorePrimary
+	}
+	if sc.FileSync == "" {
+		sc.FileSync = constants.FileSyncAlways
+	}
+	if sc.FileSyncInterval == 0 {
+		sc.FileSyncInterval = constants.FileSyncPeriod
+	}
+	if sc.FileSnapshot == 0 {
+		sc.FileSnapshot = constants.FileSnapshotInterval
+	}
+	if sc.FileWALMaxSize == 0 {
+		sc.FileWALMaxSize = constants.FileWALMaxSize
+	}
+	if sc.SnapshotEncrypt == "" {
+		sc.SnapshotEncrypt = constants.SnapshotEncryptionNone
+	}
+	if !sc.migrateSet {
+		sc.Migrate = constants.Migrate
+	}
+	if sc.SamplesRetention == 0 {
+		sc.SamplesRetention = constants.SamplesRetention
+	}
+	if sc.DBConnectTimeout == 0 {
+		sc.DBConnectTimeout = constants.DBConnectTimeout
+	}
+	if sc.DBQueryTimeout == 0 {
+		sc.DBQueryTimeout = constants.DBQueryTimeout
+	}
+	if sc.DBRetryTimeout == 0 {
+		sc.DBRetryTimeout = constants.DBRetryTimeout
+	}
+	if sc.DBBufferSize == 0 {
+		sc.DBBufferSize = constants.DBBufferSize
+	}
+	if sc.WriteQueueSize == 0 {
+		sc.WriteQueueSize = constants.WriteQueueSize
+	}
+	if sc.WriteFlushSize == 0 {
+		sc.WriteFlushSize = constants.WriteFlushSize
+	}
+	if sc.WriteFlushPeriod == 0 {
+		sc.WriteFlushPeriod = constants.WriteFlushInterval
+	}
+	if sc.ShutdownTimeout == 0 {
+		sc.ShutdownTimeout = constants.ShutdownTimeout
+	}
+	if sc.LogLevel == "" {
+		sc.LogLevel = constants.LogLevel
+	}
+	if sc.LogFormat == "" {
+		sc.LogFormat = constants.LogFormat
+	}
 
 }
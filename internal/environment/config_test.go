@@ -0,0 +1,66 @@
+package environment
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestServerConfigValidate(t *testing.T) {
+	valid := ServerConfig{WriteQueueSize: 10, WriteFlushSize: 5, WriteFlushPeriod: time.Second}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Error valid config rejected: %v", err)
+	}
+
+	tests := map[string]func(sc *ServerConfig){
+		"WRITE_QUEUE_SIZE":     func(sc *ServerConfig) { sc.WriteQueueSize = -1 },
+		"WRITE_FLUSH_SIZE":     func(sc *ServerConfig) { sc.WriteFlushSize = -1 },
+		"WRITE_FLUSH_INTERVAL": func(sc *ServerConfig) { sc.WriteFlushPeriod = -time.Second },
+	}
+	for name, invalidate := range tests {
+		t.Run("Checking negative "+name, func(t *testing.T) {
+			sc := valid
+			invalidate(&sc)
+			if err := sc.Validate(); !errors.Is(err, ErrConfig) {
+				t.Errorf("Error negative %s accepted: %v", name, err)
+			}
+		})
+	}
+
+	tlsTests := map[string]func(sc *ServerConfig){
+		"TLS_CERT without TLS_KEY":   func(sc *ServerConfig) { sc.TLSKey = "" },
+		"TLS_KEY without TLS_CERT":   func(sc *ServerConfig) { sc.TLSCert = "" },
+		"TLS_CLIENT_CA without pair": func(sc *ServerConfig) { sc.TLSCert, sc.TLSKey = "", "" },
+	}
+	for name, invalidate := range tlsTests {
+		t.Run("Checking "+name, func(t *testing.T) {
+			sc := valid
+			sc.TLSCert, sc.TLSKey, sc.TLSClientCA = "server.crt", "server.key", "ca.crt"
+			if err := sc.Validate(); err != nil {
+				t.Fatalf("Error full TLS config rejected: %v", err)
+			}
+			invalidate(&sc)
+			if err := sc.Validate(); !errors.Is(err, ErrConfig) {
+				t.Errorf("Error partial TLS config accepted: %v", err)
+			}
+		})
+	}
+}
+
+func TestAgentConfigValidate(t *testing.T) {
+	valid := AgentConfig{AgentID: "agent-1", SignKey: "agent.pem"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Error valid config rejected: %v", err)
+	}
+	if err := (&AgentConfig{}).Validate(); err != nil {
+		t.Errorf("Error config without signing rejected: %v", err)
+	}
+
+	t.Run("Checking SIGN_KEY without AGENT_ID", func(t *testing.T) {
+		ac := valid
+		ac.AgentID = ""
+		if err := ac.Validate(); !errors.Is(err, ErrConfig) {
+			t.Errorf("Error SIGN_KEY without AGENT_ID accepted: %v", err)
+		}
+	})
+}
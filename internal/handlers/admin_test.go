@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/cryptohash"
+	"github.com/andynikk/advancedmetrics/internal/environment"
+	"github.com/andynikk/advancedmetrics/internal/networks"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+	"github.com/andynikk/advancedmetrics/internal/repository/repositorytest"
+)
+
+func TestHandlerExportImport(t *testing.T) {
+	srv := new(RepStore)
+	srv.Repo = repository.NewStore()
+	srv.Config = &environment.ServerConfig{}
+	InitRoutersMux(srv)
+
+	trustedSubnet, err := networks.ParseSubnet("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.TrustedSubnet = trustedSubnet
+
+	ts := httptest.NewServer(srv.Router)
+	defer ts.Close()
+
+	// Административные запросы принимаются только из доверенной подсети.
+	admin := func(method string, path string, body io.Reader) (*http.Response, error) {
+		rq, err := http.NewRequest(method, ts.URL+path, body)
+		if err != nil {
+			return nil, err
+		}
+		rq.Header.Set(constants.HeaderRealIP, "127.0.0.1")
+		return http.DefaultClient.Do(rq)
+	}
+
+	for _, path := range []string{"/update/gauge/Alloc/1.5", "/update/counter/PollCount/4"} {
+		resp, err := admin(http.MethodPost, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := admin(http.MethodGet, "/admin/export?format=csv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/csv") {
+		t.Fatalf("Error export: %s %s", resp.Status, exported)
+	}
+
+	if _, err = srv.Repo.UpdateText("counter", "PollCount", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	importCSV := func(t *testing.T, query string) repository.ImportReport {
+		resp, err := admin(http.MethodPost, "/admin/import?format=csv&"+query, bytes.NewReader(exported))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("Error import: %s %s", resp.Status, body)
+		}
+		var report repository.ImportReport
+		if err = json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	t.Run("Checking dry run", func(t *testing.T) {
+		report := importCSV(t, "mode=replace&dry_run=true")
+		if !report.DryRun || report.Changed != 1 || report.Unchanged != 1 {
+			t.Errorf("Error dry run report: %+v", report)
+		}
+		if mt, _ := srv.Repo.Get("PollCount"); *mt.Delta != 5 {
+			t.Errorf("Error dry run changed counter: %d", *mt.Delta)
+		}
+	})
+
+	t.Run("Checking replace", func(t *testing.T) {
+		report := importCSV(t, "mode=replace")
+		if mt, _ := srv.Repo.Get("PollCount"); *mt.Delta != 4 {
+			t.Errorf("Error replaced counter: %d", *mt.Delta)
+		}
+		if !report.Persisted || report.PersistError != "" {
+			t.Errorf("Error persisted report: %+v", report)
+		}
+	})
+
+	t.Run("Checking storage error", func(t *testing.T) {
+		backend := repositorytest.NewFakeBackend("file")
+		backend.UpsertErr = errors.New("storage unavailable")
+		srv.Storage = repository.NewBackends(nil, backend)
+		srv.Queue = repository.NewWriteQueue(srv.Storage, 100, 50, time.Hour)
+		defer func() {
+			backend.UpsertErr = nil
+			srv.Queue.Close(context.Background())
+			srv.Storage, srv.Queue = repository.Backends{}, nil
+		}()
+
+		report := importCSV(t, "mode=counters-add")
+		if report.Persisted || !strings.Contains(report.PersistError, "storage unavailable") {
+			t.Errorf("Error report of failed write: %+v", report)
+		}
+		// Метрики загружены в память, а не записанные остаются в очереди до следующей записи.
+		if mt, _ := srv.Repo.Get("PollCount"); *mt.Delta != 8 {
+			t.Errorf("Error imported counter: %d", *mt.Delta)
+		}
+		if depth := srv.Queue.Stats().Depth; depth == 0 {
+			t.Errorf("Error failed metrics must stay in queue")
+		}
+	})
+
+	t.Run("Checking bad request", func(t *testing.T) {
+		resp, err := admin(http.MethodGet, "/admin/export?source=bolt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Error export from unknown storage: %s", resp.Status)
+		}
+	})
+}
+
+func TestHandlerAdminAccess(t *testing.T) {
+	srv := new(RepStore)
+	srv.Repo = repository.NewStore()
+	srv.Config = &environment.ServerConfig{Key: "secret"}
+	InitRoutersMux(srv)
+
+	ts := httptest.NewServer(srv.Router)
+	defer ts.Close()
+
+	checkForbidden := func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/admin/export")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Error export status: %s", resp.Status)
+		}
+
+		resp, err = http.Post(ts.URL+"/admin/import?format=csv&mode=replace", "text/csv",
+			strings.NewReader("id,type,value,timestamp\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Error import status: %s", resp.Status)
+		}
+	}
+
+	t.Run("Checking unsigned request", checkForbidden)
+
+	t.Run("Checking signed request", func(t *testing.T) {
+		rq, err := http.NewRequest(http.MethodGet, ts.URL+"/admin/export", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce, err := cryptohash.NewNonce()
+		if err != nil {
+			t.Fatal(err)
+		}
+		timestamp := cryptohash.FormatTimestamp(time.Now())
+		rq.Header.Set(constants.HeaderTimestamp, timestamp)
+		rq.Header.Set(constants.HeaderNonce, nonce)
+		rq.Header.Set(constants.HeaderSignature,
+			cryptohash.SignRequest("secret", rq.Method, rq.URL.Path, timestamp, nonce, nil))
+
+		resp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Error signed export status: %s", resp.Status)
+		}
+	})
+
+	t.Run("Checking default config", func(t *testing.T) {
+		srv.Config = &environment.ServerConfig{}
+		checkForbidden(t)
+	})
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/cryptohash"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/environment"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+	"github.com/andynikk/advancedmetrics/internal/repository/repositorytest"
+)
+
+func TestHashScheme(t *testing.T) {
+	const key = "TestKey"
+
+	srv := new(RepStore)
+	srv.Repo = repository.NewStore()
+	srv.Config = &environment.ServerConfig{Key: key}
+	storage := repositorytest.NewFakeBackend("file")
+	srv.Storage = repository.NewBackends(nil, storage)
+	InitRoutersMux(srv)
+
+	ts := httptest.NewServer(srv.Router)
+	defer ts.Close()
+
+	postUpdates := func(t *testing.T, scheme string, hashScheme string, value float64) *http.Response {
+		m := encoding.Metrics{ID: "TestHashScheme", MType: "gauge", Value: &value}
+		m.Hash = cryptohash.MetricHash(hashScheme, key, &m)
+		body, err := json.Marshal(encoding.ArrMetrics{m})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scheme != "" {
+			req.Header.Set(constants.HeaderHashScheme, scheme)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("Checking v2 hash", func(t *testing.T) {
+		resp := postUpdates(t, constants.HashSchemeV2, constants.HashSchemeV2, 1e-9)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Error v2 hash: %d", resp.StatusCode)
+		}
+		if resp.Header.Get(constants.HeaderHashScheme) != constants.HashSchemeV2 {
+			t.Errorf("Error v2 hash scheme header: %q", resp.Header.Get(constants.HeaderHashScheme))
+		}
+	})
+	t.Run("Checking legacy agent", func(t *testing.T) {
+		resp := postUpdates(t, "", constants.HashSchemeV1, 0.5)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Error legacy hash: %d", resp.StatusCode)
+		}
+		if resp.Header.Get(constants.HeaderAcceptHashScheme) == "" {
+			t.Errorf("Error server must advertise hash schemes")
+		}
+	})
+	t.Run("Checking scheme mismatch", func(t *testing.T) {
+		resp := postUpdates(t, constants.HashSchemeV1, constants.HashSchemeV2, 1e-9)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Error scheme mismatch: %d", resp.StatusCode)
+		}
+	})
+	t.Run("Checking labels", func(t *testing.T) {
+		value := 1.0
+		m := encoding.Metrics{ID: "TestLabels", MType: "gauge", Value: &value, Labels: map[string]string{"host": "a"}}
+		m.Hash = cryptohash.MetricHash(constants.HashSchemeV2, key, &m)
+		body, err := json.Marshal(encoding.ArrMetrics{m})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(constants.HeaderHashScheme, constants.HashSchemeV2)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Error labeled metric must be rejected: %d", resp.StatusCode)
+		}
+		if _, ok := srv.Repo.Get("TestLabels"); ok {
+			t.Error("Error labeled metric stored without labels")
+		}
+	})
+	t.Run("Checking bad metric in batch", func(t *testing.T) {
+		signed := func(m encoding.Metrics) encoding.Metrics {
+			m.Hash = cryptohash.MetricHash(constants.HashSchemeV2, key, &m)
+			return m
+		}
+		delta, value := int64(1), 2.0
+		bad := map[string]encoding.Metrics{
+			"hash":     {ID: "BatchBad", MType: "gauge", Value: &value, Hash: "bad"},
+			"labels":   signed(encoding.Metrics{ID: "BatchBad", MType: "gauge", Value: &value, Labels: map[string]string{"host": "a"}}),
+			"type":     signed(encoding.Metrics{ID: "TestHashScheme", MType: "counter", Delta: &delta}),
+			"reserved": signed(encoding.Metrics{ID: "server_batch", MType: "gauge", Value: &value}),
+		}
+		for name, m := range bad {
+			batches := len(storage.Batches())
+			batch := encoding.ArrMetrics{
+				signed(encoding.Metrics{ID: "BatchCounter", MType: "counter", Delta: &delta}),
+				m,
+				signed(encoding.Metrics{ID: "BatchGauge", MType: "gauge", Value: &value}),
+			}
+			body, err := json.Marshal(batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set(constants.HeaderHashScheme, constants.HashSchemeV2)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("Error batch with bad %s: %d", name, resp.StatusCode)
+			}
+			if _, ok := srv.Repo.Get("BatchCounter"); ok {
+				t.Errorf("Error batch with bad %s partly applied", name)
+			}
+			if len(storage.Batches()) != batches {
+				t.Errorf("Error batch with bad %s written to storage", name)
+			}
+		}
+	})
+	t.Run("Checking unknown scheme", func(t *testing.T) {
+		resp := postUpdates(t, "v9", constants.HashSchemeV2, 1)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Error unknown scheme: %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/environment"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+	"github.com/andynikk/advancedmetrics/internal/repository/repositorytest"
+)
+
+func TestHandlerHistory(t *testing.T) {
+	backend := repositorytest.NewFakeBackend("history")
+
+	srv := new(RepStore)
+	srv.Repo = repository.NewStore()
+	srv.Config = &environment.ServerConfig{}
+	srv.Storage = repository.NewBackends(nil, backend)
+	InitRoutersMux(srv)
+
+	ts := httptest.NewServer(srv.Router)
+	defer ts.Close()
+
+	for _, delta := range []int64{2, 3} {
+		delta := delta
+		body, err := json.Marshal(encoding.ArrMetrics{{ID: "PollCount", MType: "counter", Delta: &delta}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(ts.URL+"/updates", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get := func(t *testing.T, query string) (*http.Response, []encoding.Sample) {
+		resp, err := http.Get(ts.URL + "/history/counter/PollCount" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var samples []encoding.Sample
+		if resp.StatusCode == http.StatusOK {
+			if err = json.NewDecoder(resp.Body).Decode(&samples); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp, samples
+	}
+
+	t.Run("Checking samples", func(t *testing.T) {
+		resp, samples := get(t, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Error history status: %d", resp.StatusCode)
+		}
+		if len(samples) != 2 || *samples[0].Delta != 2 || *samples[1].Delta != 5 {
+			t.Errorf("Error history must contain totals of each update: %+v", samples)
+		}
+	})
+	t.Run("Checking range", func(t *testing.T) {
+		to := time.Now().Add(-time.Hour).Format(time.RFC3339)
+		resp, samples := get(t, "?to="+to)
+		if resp.StatusCode != http.StatusOK || len(samples) != 0 {
+			t.Errorf("Error history out of range: %d %+v", resp.StatusCode, samples)
+		}
+	})
+	t.Run("Checking bad range", func(t *testing.T) {
+		if resp, _ := get(t, "?from=yesterday"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Error bad from must be rejected: %d", resp.StatusCode)
+		}
+	})
+	t.Run("Checking without history", func(t *testing.T) {
+		srv.Storage = repository.Backends{}
+		if resp, _ := get(t, ""); resp.StatusCode != http.StatusNotImplemented {
+			t.Errorf("Error history without db: %d", resp.StatusCode)
+		}
+	})
+}
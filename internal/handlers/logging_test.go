@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/environment"
+	"github.com/andynikk/advancedmetrics/internal/logger"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+)
+
+func TestLogRequests(t *testing.T) {
+	var buf bytes.Buffer
+	testLogger, err := logger.New(&buf, "info", logger.FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultLogger := constants.Logger
+	constants.Logger = testLogger
+	defer func() { constants.Logger = defaultLogger }()
+
+	srv := new(RepStore)
+	srv.Repo = repository.NewStore()
+	srv.Config = &environment.ServerConfig{}
+	InitRoutersMux(srv)
+
+	ts := httptest.NewServer(srv.Router)
+	defer ts.Close()
+
+	get := func(t *testing.T, path string, requestID string) (*http.Response, map[string]interface{}) {
+		buf.Reset()
+		rq, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rq.Header.Set(constants.HeaderRequestID, requestID)
+		rq.Header.Set(constants.HeaderAgentID, "agent-1")
+		resp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		var entry map[string]interface{}
+		if err = json.Unmarshal([]byte(lines[len(lines)-1]), &entry); err != nil {
+			t.Fatalf("Error log entry %q: %v", buf.String(), err)
+		}
+		return resp, entry
+	}
+
+	t.Run("Checking agent request id", func(t *testing.T) {
+		resp, entry := get(t, "/healthz", "agent-req-1")
+		if resp.Header.Get(constants.HeaderRequestID) != "agent-req-1" {
+			t.Errorf("Error response request id: %q", resp.Header.Get(constants.HeaderRequestID))
+		}
+		want := map[string]interface{}{
+			"level": "info", "message": "request", "request_id": "agent-req-1", "method": "GET",
+			"path": "/healthz", "agent_id": "agent-1", "status": float64(200), "bytes": float64(15),
+		}
+		for key, value := range want {
+			if entry[key] != value {
+				t.Errorf("Error log field %s: %v, want %v", key, entry[key], value)
+			}
+		}
+		if _, ok := entry["duration_ms"]; !ok {
+			t.Error("Error log without duration_ms")
+		}
+	})
+
+	t.Run("Checking generated request id", func(t *testing.T) {
+		resp, entry := get(t, "/value/gauge/Missing", "bad id")
+		id := resp.Header.Get(constants.HeaderRequestID)
+		if len(id) != 32 || entry["request_id"] != id {
+			t.Errorf("Error generated request id: %q, logged %v", id, entry["request_id"])
+		}
+		if entry["level"] != "warn" || entry["status"] != float64(http.StatusNotFound) {
+			t.Errorf("Error log entry of not found: %v", entry)
+		}
+	})
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/cryptohash"
+	"github.com/andynikk/advancedmetrics/internal/environment"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+	"github.com/andynikk/advancedmetrics/internal/signature"
+)
+
+func TestCheckSignature(t *testing.T) {
+	const key = "TestKey"
+
+	srv := new(RepStore)
+	srv.Repo = repository.NewStore()
+	srv.Config = &environment.ServerConfig{Key: key, SignatureWindow: time.Minute}
+	InitRoutersMux(srv)
+
+	ts := httptest.NewServer(srv.Router)
+	defer ts.Close()
+
+	const path = "/update/counter/TestSignature/1"
+	signedRequest := func(t *testing.T, sent time.Time, nonce string, body []byte, signBody []byte) *http.Response {
+		timestamp := cryptohash.FormatTimestamp(sent)
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(constants.HeaderTimestamp, timestamp)
+		req.Header.Set(constants.HeaderNonce, nonce)
+		req.Header.Set(constants.HeaderSignature,
+			cryptohash.SignRequest(key, http.MethodPost, path, timestamp, nonce, signBody))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("Checking signed request", func(t *testing.T) {
+		resp := signedRequest(t, time.Now(), "nonce-1", nil, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Error signed request: %d", resp.StatusCode)
+		}
+	})
+	t.Run("Checking replayed request", func(t *testing.T) {
+		resp := signedRequest(t, time.Now(), "nonce-1", nil, nil)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Error replayed request: %d", resp.StatusCode)
+		}
+	})
+	t.Run("Checking stale request", func(t *testing.T) {
+		resp := signedRequest(t, time.Now().Add(-time.Hour), "nonce-2", nil, nil)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Error stale request: %d", resp.StatusCode)
+		}
+	})
+	t.Run("Checking tampered body", func(t *testing.T) {
+		resp := signedRequest(t, time.Now(), "nonce-3", []byte("tampered"), nil)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Error tampered body: %d", resp.StatusCode)
+		}
+	})
+	t.Run("Checking unsigned request when signature required", func(t *testing.T) {
+		srv.Config.RequireSignature = true
+		defer func() { srv.Config.RequireSignature = false }()
+
+		resp, err := http.Post(ts.URL+path, "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Error unsigned request: %d", resp.StatusCode)
+		}
+	})
+
+	if mt, _ := srv.Repo.Get("TestSignature"); repository.MetricText(mt) != "1" {
+		t.Errorf("Error counter must be increased only once, got %s", repository.MetricText(mt))
+	}
+}
+
+func TestCheckAgentSignature(t *testing.T) {
+	dir := t.TempDir()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "agent1.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, foreignKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := new(RepStore)
+	srv.Repo = repository.NewStore()
+	srv.Config = &environment.ServerConfig{SignatureWindow: time.Minute}
+	if srv.Agents, err = signature.NewRegistry(dir); err != nil {
+		t.Fatal(err)
+	}
+	InitRoutersMux(srv)
+
+	ts := httptest.NewServer(srv.Router)
+	defer ts.Close()
+
+	const path = "/update/counter/TestAgentSignature/1"
+	agentRequest := func(t *testing.T, agentID string, nonce string, key ed25519.PrivateKey) (int, string) {
+		timestamp := cryptohash.FormatTimestamp(time.Now())
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(constants.HeaderTimestamp, timestamp)
+		req.Header.Set(constants.HeaderNonce, nonce)
+		req.Header.Set(constants.HeaderAgentID, agentID)
+		if key != nil {
+			message := cryptohash.RequestMessage(http.MethodPost, path, timestamp, nonce, nil)
+			req.Header.Set(constants.HeaderAgentSignature, signature.Sign(key, []byte(message)))
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body := new(bytes.Buffer)
+		if _, err = body.ReadFrom(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body.String()
+	}
+
+	t.Run("Checking signed request", func(t *testing.T) {
+		if status, body := agentRequest(t, "agent1", "nonce-1", privateKey); status != http.StatusOK {
+			t.Errorf("Error signed request: %d %s", status, body)
+		}
+	})
+	t.Run("Checking unsigned request", func(t *testing.T) {
+		status, body := agentRequest(t, "agent1", "nonce-2", nil)
+		if status != http.StatusUnauthorized || !strings.Contains(body, "agent1") {
+			t.Errorf("Error unsigned request: %d %s", status, body)
+		}
+	})
+	t.Run("Checking foreign key", func(t *testing.T) {
+		status, body := agentRequest(t, "agent1", "nonce-3", foreignKey)
+		if status != http.StatusUnauthorized || !strings.Contains(body, "agent1") {
+			t.Errorf("Error foreign key: %d %s", status, body)
+		}
+	})
+	t.Run("Checking unknown agent", func(t *testing.T) {
+		status, body := agentRequest(t, "agent2", "nonce-4", privateKey)
+		if status != http.StatusUnauthorized || !strings.Contains(body, "agent2") {
+			t.Errorf("Error unknown agent: %d %s", status, body)
+		}
+	})
+	t.Run("Checking replayed request", func(t *testing.T) {
+		if status, body := agentRequest(t, "agent1", "nonce-1", privateKey); status != http.StatusUnauthorized {
+			t.Errorf("Error replayed request: %d %s", status, body)
+		}
+	})
+
+	if mt, _ := srv.Repo.Get("TestAgentSignature"); repository.MetricText(mt) != "1" {
+		t.Errorf("Error counter must be increased only once, got %s", repository.MetricText(mt))
+	}
+}
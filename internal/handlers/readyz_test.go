@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/environment"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+	"github.com/andynikk/advancedmetrics/internal/repository/repositorytest"
+)
+
+func TestHandlerReadyz(t *testing.T) {
+	bolt := repositorytest.NewFakeBackend("bolt")
+	bolt.HealthErr = errors.New("bolt unavailable")
+
+	srv := new(RepStore)
+	srv.Repo = repository.NewStore()
+	srv.Config = &environment.ServerConfig{Restore: true, CryptoKey: "missing.pfx"}
+	srv.Storage = repository.NewBackends(nil, repositorytest.NewFakeBackend("file"), bolt)
+	InitRoutersMux(srv)
+
+	ts := httptest.NewServer(srv.Router)
+	defer ts.Close()
+
+	readyz := func(t *testing.T) (int, map[string]ComponentStatus) {
+		resp, err := http.Get(ts.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var readiness Readiness
+		if err = json.NewDecoder(resp.Body).Decode(&readiness); err != nil {
+			t.Fatal(err)
+		}
+		components := make(map[string]ComponentStatus)
+		for _, c := range readiness.Components {
+			components[c.Name] = c
+		}
+		return resp.StatusCode, components
+	}
+
+	t.Run("Checking liveness", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Error /healthz status: %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Checking not ready", func(t *testing.T) {
+		status, components := readyz(t)
+		if status != http.StatusServiceUnavailable || len(components) != 4 {
+			t.Fatalf("Error /readyz: %d %v", status, components)
+		}
+		for _, name := range []string{"restore", "storage/bolt", "keys"} {
+			if c := components[name]; c.Status != constants.StatusDown || c.Error == "" || c.LastErrorAt == nil {
+				t.Errorf("Error component %s: %+v", name, c)
+			}
+		}
+		if c := components["storage/file"]; c.Status != constants.StatusUp || c.LastError != "" {
+			t.Errorf("Error component storage/file: %+v", c)
+		}
+	})
+
+	t.Run("Checking ready", func(t *testing.T) {
+		srv.Restored = &repository.RestoreReport{Policy: constants.RestorePrimary}
+		srv.Config.CryptoKey = ""
+		bolt.HealthErr = nil
+
+		status, components := readyz(t)
+		if status != http.StatusOK {
+			t.Fatalf("Error /readyz: %d %v", status, components)
+		}
+		// Последняя ошибка остается в ответе после восстановления компонента.
+		if c := components["storage/bolt"]; c.Status != constants.StatusUp || c.Error != "" || c.LastError != "bolt unavailable" {
+			t.Errorf("Error recovered component: %+v", c)
+		}
+	})
+
+	t.Run("Checking ping without DB", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Error /ping without DB: %d", resp.StatusCode)
+		}
+	})
+}
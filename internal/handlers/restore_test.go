@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/environment"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+	"github.com/andynikk/advancedmetrics/internal/repository/repositorytest"
+)
+
+func TestRestoreDBDownAtStart(t *testing.T) {
+	db := repositorytest.NewFakeBackend("db")
+	db.LoadErr = repository.ErrDBUnavailable
+
+	srv := new(RepStore)
+	srv.Repo = repository.NewStore()
+	srv.Config = &environment.ServerConfig{Restore: true, RestorePolicy: constants.RestorePrimary}
+	srv.Storage = repository.NewBackends(nil, db)
+	InitRoutersMux(srv)
+
+	ts := httptest.NewServer(srv.Router)
+	defer ts.Close()
+
+	status := func(t *testing.T, method string, path string) int {
+		rq, err := http.NewRequest(method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("Checking DB down", func(t *testing.T) {
+		if _, err := srv.RestoreData(context.Background()); err == nil {
+			t.Fatal("Error restore without DB succeeded")
+		}
+		if code := status(t, http.MethodPost, "/update/counter/PollCount/5"); code != http.StatusServiceUnavailable {
+			t.Errorf("Error update before restore: %d", code)
+		}
+		if code := status(t, http.MethodGet, "/readyz"); code != http.StatusServiceUnavailable {
+			t.Errorf("Error /readyz before restore: %d", code)
+		}
+		if len(db.Batches()) != 0 {
+			t.Errorf("Error metrics written before restore: %v", db.Batches())
+		}
+	})
+
+	t.Run("Checking DB up", func(t *testing.T) {
+		var total int64 = 10
+		db.LoadErr = nil
+		db.Metrics = encoding.ArrMetrics{{ID: "PollCount", MType: "counter", Delta: &total}}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.RetryRestore(ctx, time.Millisecond)
+
+		if code := status(t, http.MethodGet, "/readyz"); code != http.StatusOK {
+			t.Errorf("Error /readyz after restore: %d", code)
+		}
+		if code := status(t, http.MethodPost, "/update/counter/PollCount/5"); code != http.StatusOK {
+			t.Fatalf("Error update after restore: %d", code)
+		}
+		if last := db.Last(); len(last) != 1 || *last[0].Delta != 15 {
+			t.Errorf("Error counter total in DB: %v", last)
+		}
+	})
+}
@@ -6,13 +6,15 @@ package handlers
 import (
 	"bytes"
 	"context"
-	"crypto/hmac"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,7 +27,11 @@ import (
 	"github.com/andynikk/advancedmetrics/internal/encoding"
 	"github.com/andynikk/advancedmetrics/internal/encryption"
 	"github.com/andynikk/advancedmetrics/internal/environment"
+	"github.com/andynikk/advancedmetrics/internal/logger"
+	"github.com/andynikk/advancedmetrics/internal/networks"
 	"github.com/andynikk/advancedmetrics/internal/repository"
+	"github.com/andynikk/advancedmetrics/internal/signature"
+	"github.com/andynikk/advancedmetrics/internal/telemetry"
 )
 
 type MetricType int
@@ -37,13 +43,27 @@ const (
 )
 
 // RepStore структура для настроек сервера, роутера и хранилище метрик.
-// Хранилище метрик защищено sync.Mutex
+// Временное хранилище метрик Repo разделено на сегменты со своими блокировками.
+// Принятые метрики записываются в физические хранилища через очередь Queue,
+// без очереди - сразу при обработке запроса.
+// Telemetry - метрики самого сервера, их отдают "/metrics" и запросы значения метрики.
 type RepStore struct {
-	Config *environment.ServerConfig
-	PK     *encryption.KeyEncryption
-	Router *mux.Router
-	sync.Mutex
-	repository.MapMetrics
+	Config        *environment.ServerConfig
+	PK            *encryption.KeyEncryption
+	KeyRing       *encryption.KeyRing
+	Router        *mux.Router
+	TrustedSubnet *net.IPNet
+	Agents        *signature.Registry
+	Storage       repository.Backends
+	Queue         *repository.WriteQueue
+	Repo          *repository.Store
+	Restored      *repository.RestoreReport
+	Telemetry     *telemetry.Registry
+	nonces        *cryptohash.NonceCache
+
+	restoreMu  sync.RWMutex
+	readyMu    sync.Mutex
+	lastErrors map[string]componentError
 }
 
 func (mt MetricType) String() string {
@@ -57,31 +77,102 @@ func (et MetricError) String() string {
 // NewRepStore инициализация хранилища, роутера, заполнение настроек.
 func NewRepStore(rs *RepStore) {
 
-	rs.MutexRepo = make(repository.MutexRepo)
+	rs.Repo = repository.NewStore()
 
 	InitRoutersMux(rs)
 
 	rs.Config = environment.InitConfigServer()
+	if err := rs.Config.Validate(); err != nil {
+		log.Fatal(err)
+	}
 	rs.PK, _ = encryption.InitPrivateKey(rs.Config.CryptoKey)
+	keyRing, err := encryption.NewKeyRing(rs.Config.CryptoKeyDir, rs.Config.CryptoKey)
+	if err != nil {
+		constants.Logger.ErrorLog(err)
+	}
+	rs.KeyRing = keyRing
+
+	trustedSubnet, err := networks.ParseSubnet(rs.Config.TrustedSubnet)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rs.TrustedSubnet = trustedSubnet
 
-	rs.Config.TypeMetricsStorage, _ = repository.InitStoreDB(rs.Config.TypeMetricsStorage, rs.Config.DatabaseDsn)
-	rs.Config.TypeMetricsStorage, _ = repository.InitStoreFile(rs.Config.TypeMetricsStorage, rs.Config.StoreFile)
+	if rs.Config.TrustedAgentsDir != "" {
+		agents, err := signature.NewRegistry(rs.Config.TrustedAgentsDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rs.Agents = agents
+	}
+
+	backendConfig := repository.BackendConfig{
+		DatabaseDsn:          rs.Config.DatabaseDsn,
+		Migrate:              rs.Config.Migrate,
+		SamplesRetention:     rs.Config.SamplesRetention,
+		DBMaxConns:           rs.Config.DBMaxConns,
+		DBConnectTimeout:     rs.Config.DBConnectTimeout,
+		DBQueryTimeout:       rs.Config.DBQueryTimeout,
+		DBRetryTimeout:       rs.Config.DBRetryTimeout,
+		DBBufferSize:         rs.Config.DBBufferSize,
+		StoreFile:            rs.Config.StoreFile,
+		BoltFile:             rs.Config.BoltFile,
+		BoltCompactInterval:  rs.Config.BoltCompact,
+		FileSync:             rs.Config.FileSync,
+		FileSyncInterval:     rs.Config.FileSyncInterval,
+		FileSnapshotInterval: rs.Config.FileSnapshot,
+		FileWALMaxSize:       rs.Config.FileWALMaxSize,
+		SnapshotCompress:     rs.Config.SnapshotCompress,
+		SnapshotEncryption:   rs.Config.SnapshotEncrypt,
+		SnapshotKey:          rs.Config.SnapshotKey,
+		SnapshotPK:           rs.PK,
+		WriteObserver:        rs.Telemetry.ObserveWrite,
+	}
+	storage, err := repository.InitBackends(context.Background(), rs.Config.Storage, backendConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rs.Storage = storage
+	rs.Queue = repository.NewWriteQueue(storage, rs.Config.WriteQueueSize, rs.Config.WriteFlushSize, rs.Config.WriteFlushPeriod)
+	registerQueueMetrics(rs.Telemetry, rs.Queue)
 }
 
 // InitRoutersMux создание роутера.
-// Описание методов для обработки handlers сервера
+// Описание методов для обработки handlers сервера.
+// Имя маршрута используется в метриках сервера, запросы к маршрутам без имени не учитываются.
 func InitRoutersMux(rs *RepStore) {
 
 	r := mux.NewRouter()
-
-	r.HandleFunc("/", rs.HandlerGetAllMetrics).Methods("GET")
-	r.HandleFunc("/value/{metType}/{metName}", rs.HandlerGetValue).Methods("GET")
-	r.HandleFunc("/ping", rs.HandlerPingDB).Methods("GET")
-
-	r.HandleFunc("/update/{metType}/{metName}/{metValue}", rs.HandlerSetMetricaPOST).Methods("POST")
-	r.HandleFunc("/update", rs.HandlerUpdateMetricJSON).Methods("POST")
-	r.HandleFunc("/updates", rs.HandlerUpdatesMetricJSON).Methods("POST")
-	r.HandleFunc("/value", rs.HandlerValueMetricaJSON).Methods("POST")
+	rs.nonces = cryptohash.NewNonceCache()
+	rs.Telemetry = telemetry.NewRegistry()
+	rs.Telemetry.Gauge("repo_size", func() float64 {
+		if rs.Repo == nil {
+			return 0
+		}
+		return float64(rs.Repo.Len())
+	})
+	r.Use(rs.LogRequests, rs.Instrument)
+
+	r.HandleFunc("/", rs.HandlerGetAllMetrics).Methods("GET").Name("all")
+	r.HandleFunc("/value/{metType}/{metName}", rs.HandlerGetValue).Methods("GET").Name("value_text")
+	r.HandleFunc("/ping", rs.HandlerPingDB).Methods("GET").Name("ping")
+	r.HandleFunc("/health", rs.HandlerHealth).Methods("GET").Name("health")
+	r.HandleFunc("/healthz", rs.HandlerHealthz).Methods("GET").Name("healthz")
+	r.HandleFunc("/readyz", rs.HandlerReadyz).Methods("GET").Name("readyz")
+	r.HandleFunc("/queue", rs.HandlerQueue).Methods("GET").Name("queue")
+	r.HandleFunc("/metrics", rs.HandlerSelfMetrics).Methods("GET").Name("metrics")
+	r.HandleFunc("/history/{metType}/{metName}", rs.HandlerHistory).Methods("GET").Name("history")
+
+	r.HandleFunc("/update/{metType}/{metName}/{metValue}",
+		rs.CheckTrustedSubnet(rs.CheckRestored(rs.CheckSignature(rs.HandlerSetMetricaPOST)))).Methods("POST").Name("update_text")
+	r.HandleFunc("/update", rs.CheckTrustedSubnet(rs.CheckRestored(rs.CheckSignature(rs.HandlerUpdateMetricJSON)))).Methods("POST").Name("update")
+	r.HandleFunc("/updates", rs.CheckTrustedSubnet(rs.CheckRestored(rs.CheckSignature(rs.HandlerUpdatesMetricJSON)))).Methods("POST").Name("updates")
+	r.HandleFunc("/value", rs.HandlerValueMetricaJSON).Methods("POST").Name("value")
+
+	r.HandleFunc("/admin/export",
+		rs.CheckTrustedSubnet(rs.CheckAdmin(rs.CheckSignature(rs.HandlerExport)))).Methods("GET").Name("admin_export")
+	r.HandleFunc("/admin/import",
+		rs.CheckTrustedSubnet(rs.CheckAdmin(rs.CheckRestored(rs.CheckSignature(rs.HandlerImport))))).Methods("POST").Name("admin_import")
 
 	r.HandleFunc("/debug/pprof", pprof.Index)
 	r.HandleFunc("/debug/pprof/", pprof.Index)
@@ -101,94 +192,413 @@ func InitRoutersMux(rs *RepStore) {
 	rs.Router = r
 }
 
-// Добавляет в хранилище метрику. Определяет тип метрики (gauge, counter).
-// В зависимости от типа добавляет нужное значение.
-// При успешном выполнении возвращает http-статус "ОК" (200)
-func (rs *RepStore) setValueInMap(metType string, metName string, metValue string) int {
-
-	switch metType {
-	case GaugeMetric.String():
-		if val, findKey := rs.MutexRepo[metName]; findKey {
-			if ok := val.SetFromText(metValue); !ok {
-				return http.StatusBadRequest
-			}
-		} else {
+// responseRecorder запоминает http-статус и размер ответа handler.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
 
-			valG := repository.Gauge(0)
-			if ok := valG.SetFromText(metValue); !ok {
-				return http.StatusBadRequest
-			}
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return n, err
+}
 
-			rs.MutexRepo[metName] = &valG
+// countingReader считает байты, прочитанные из тела запроса.
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.bytes += int64(n)
+	return n, err
+}
+
+// requestID идентификатор запроса из заголовка X-Request-ID, если агент его передал,
+// иначе новый случайный. Переданный агентом идентификатор принимается, если он не длиннее 128 символов
+// и состоит из букв, цифр и знаков ".-_:", чтобы его можно было без экранирования писать в журнал.
+func requestID(rq *http.Request) string {
+	id := rq.Header.Get(constants.HeaderRequestID)
+	valid := id != "" && len(id) <= 128
+	for i := 0; valid && i < len(id); i++ {
+		c := id[i]
+		valid = c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '.' || c == '-' || c == '_' || c == ':'
+	}
+	if valid {
+		return id
+	}
+
+	id, err := cryptohash.NewNonce()
+	if err != nil {
+		constants.Logger.ErrorLog(err)
+	}
+	return id
+}
+
+// LogRequests добавляет в контекст запроса журнал с идентификатором запроса, методом, путем
+// и идентификатором агента из X-Agent-ID, его возвращает constants.Logger.Ctx.
+// Идентификатор запроса возвращается агенту в заголовке X-Request-ID.
+// После обработки пишет в журнал статус, длительность и размер ответа:
+// ответы со статусом 500 и выше - с уровнем error, 400 и выше - warn, остальные - info.
+func (rs *RepStore) LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		start := time.Now()
+		id := requestID(rq)
+		rw.Header().Set(constants.HeaderRequestID, id)
+
+		fields := constants.Logger.Log.With().
+			Str("request_id", id).
+			Str("method", rq.Method).
+			Str("path", rq.URL.Path)
+		if agentID := rq.Header.Get(constants.HeaderAgentID); agentID != "" {
+			fields = fields.Str("agent_id", agentID)
 		}
+		requestLogger := &logger.Logger{Log: fields.Logger()}
+		rq = rq.WithContext(requestLogger.WithContext(rq.Context()))
+
+		recorder := &responseRecorder{ResponseWriter: rw}
+		next.ServeHTTP(recorder, rq)
 
-	case CounterMetric.String():
-		if val, findKey := rs.MutexRepo[metName]; findKey {
-			if ok := val.SetFromText(metValue); !ok {
-				return http.StatusBadRequest
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		event := requestLogger.Log.Info()
+		switch {
+		case status >= http.StatusInternalServerError:
+			event = requestLogger.Log.Error()
+		case status >= http.StatusBadRequest:
+			event = requestLogger.Log.Warn()
+		}
+		event.Int("status", status).
+			Float64("duration_ms", float64(time.Since(start).Microseconds())/1000).
+			Int64("bytes", recorder.bytes).
+			Msg("request")
+	})
+}
+
+// Instrument учитывает в метриках сервера запросы к именованным маршрутам:
+// статус, длительность и размер тела запроса, прочитанного handler, и ответа.
+func (rs *RepStore) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		route := mux.CurrentRoute(rq)
+		if rs.Telemetry == nil || route == nil || route.GetName() == "" {
+			next.ServeHTTP(rw, rq)
+			return
+		}
+
+		start := time.Now()
+		body := &countingReader{ReadCloser: rq.Body}
+		rq.Body = body
+		recorder := &responseRecorder{ResponseWriter: rw}
+
+		next.ServeHTTP(recorder, rq)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		rs.Telemetry.ObserveRequest(route.GetName(), recorder.status, time.Since(start), body.bytes, recorder.bytes)
+	})
+}
+
+// CheckTrustedSubnet пропускает к handler только запросы агентов из доверенной подсети.
+// Проверяется и IP-адрес из заголовка X-Real-IP, и адрес сокета.
+// Запрос не из подсети отклоняется со статусом 403 до дешифровки и разбора тела.
+func (rs *RepStore) CheckTrustedSubnet(next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, rq *http.Request) {
+		if rs.TrustedSubnet == nil {
+			next(rw, rq)
+			return
+		}
+
+		headerIP := rq.Header.Get(constants.HeaderRealIP)
+		remoteIP := networks.RemoteIP(rq)
+		if !networks.AddressAllowed(rs.TrustedSubnet, headerIP, remoteIP) {
+			constants.Logger.Ctx(rq.Context()).InfoLog(fmt.Sprintf("request rejected: agent ip %q, remote ip %s not in trusted subnet %s",
+				headerIP, remoteIP, rs.TrustedSubnet))
+			http.Error(rw, "Адрес агента не входит в доверенную подсеть", http.StatusForbidden)
+			return
+		}
+
+		next(rw, rq)
+	}
+}
+
+// CheckRestored пропускает к handler изменения метрик только после восстановления метрик при запуске.
+// Пока восстановление не удалось, запросы отклоняются со статусом 503: принятые до восстановления
+// значения counter затерли бы в хранилище накопленные суммы.
+func (rs *RepStore) CheckRestored(next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, rq *http.Request) {
+		if rs.restorePending() {
+			http.Error(rw, "Метрики сервера еще не восстановлены", http.StatusServiceUnavailable)
+			return
+		}
+
+		next(rw, rq)
+	}
+}
+
+// CheckAdmin пропускает к административному handler только запросы, источник которых проверен:
+// из доверенной подсети TRUSTED_SUBNET (ее проверяет CheckTrustedSubnet) или подписанные ключом KEY
+// либо ключом доверенного агента (подпись проверяет CheckSignature).
+// Если ни подсеть, ни ключи не заданы, административные запросы отклоняются со статусом 403:
+// иначе любой мог бы выгрузить или заменить все метрики сервера.
+func (rs *RepStore) CheckAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, rq *http.Request) {
+		key := ""
+		if rs.Config != nil {
+			key = rs.Config.Key
+		}
+
+		switch {
+		case rs.TrustedSubnet != nil, rs.Agents != nil:
+		case key != "" && rq.Header.Get(constants.HeaderSignature) != "":
+		default:
+			constants.Logger.Ctx(rq.Context()).InfoLog(fmt.Sprintf("admin request rejected: %s %s: no trusted subnet or signature",
+				rq.Method, rq.URL.Path))
+			http.Error(rw, "Административный запрос должен быть из доверенной подсети или подписан ключом",
+				http.StatusForbidden)
+			return
+		}
+
+		next(rw, rq)
+	}
+}
+
+// CheckSignature проверяет подпись всего запроса.
+// Подпись HMAC-SHA256 общим ключом KEY передается в заголовке X-Signature,
+// подпись Ed25519 собственным ключом агента в заголовках X-Agent-ID и X-Agent-Signature.
+// Обе подписи покрывают метод, путь, время (X-Timestamp), одноразовый номер (X-Nonce) и тело запроса.
+// Если задан каталог доверенных агентов, запрос без подписи агента отклоняется.
+// Запрос вне окна свежести или с уже использованным номером отклоняется со статусом 401.
+// Неподписанные запросы принимаются, если не включен параметр REQUIRE_SIGNATURE.
+func (rs *RepStore) CheckSignature(next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, rq *http.Request) {
+		key := ""
+		window := constants.SignatureWindow
+		requireSignature := false
+		if rs.Config != nil {
+			key = rs.Config.Key
+			requireSignature = rs.Config.RequireSignature
+			if rs.Config.SignatureWindow != 0 {
+				window = rs.Config.SignatureWindow
 			}
-		} else {
+		}
 
-			valC := repository.Counter(0)
-			if ok := valC.SetFromText(metValue); !ok {
-				return http.StatusBadRequest
+		hmacSignature := rq.Header.Get(constants.HeaderSignature)
+		agentID := rq.Header.Get(constants.HeaderAgentID)
+		agentSignature := rq.Header.Get(constants.HeaderAgentSignature)
+		if hmacSignature == "" && rs.Agents == nil {
+			if requireSignature {
+				http.Error(rw, "Запрос не подписан", http.StatusUnauthorized)
+				return
 			}
+			next(rw, rq)
+			return
+		}
+		if rs.Agents != nil && agentSignature == "" {
+			constants.Logger.Ctx(rq.Context()).InfoLog(fmt.Sprintf("request rejected: agent %q: request is not signed by agent key", agentID))
+			http.Error(rw, fmt.Sprintf("Агент %q: запрос не подписан ключом агента", agentID), http.StatusUnauthorized)
+			return
+		}
 
-			rs.MutexRepo[metName] = &valC
+		body, err := io.ReadAll(rq.Body)
+		if err != nil {
+			constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+			http.Error(rw, "Ошибка чтения тела запроса", http.StatusInternalServerError)
+			return
+		}
+		rq.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now()
+		timestamp := rq.Header.Get(constants.HeaderTimestamp)
+		nonce := rq.Header.Get(constants.HeaderNonce)
+
+		sent, err := cryptohash.CheckTimestamp(timestamp, now, window)
+		if err != nil {
+			constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+			http.Error(rw, "Запрос устарел", http.StatusUnauthorized)
+			return
+		}
+		if nonce == "" {
+			http.Error(rw, "Не указан одноразовый номер запроса", http.StatusUnauthorized)
+			return
+		}
+		if hmacSignature != "" &&
+			!cryptohash.VerifyRequest(key, rq.Method, rq.URL.Path, timestamp, nonce, body, hmacSignature) {
+			constants.Logger.Ctx(rq.Context()).InfoLog(fmt.Sprintf("request signature mismatch: %s %s", rq.Method, rq.URL.Path))
+			http.Error(rw, "Неверная подпись запроса", http.StatusUnauthorized)
+			return
+		}
+		if rs.Agents != nil {
+			message := cryptohash.RequestMessage(rq.Method, rq.URL.Path, timestamp, nonce, body)
+			if err = rs.Agents.Verify(agentID, []byte(message), agentSignature); err != nil {
+				constants.Logger.Ctx(rq.Context()).InfoLog(fmt.Sprintf("request rejected: %s %s: %s", rq.Method, rq.URL.Path, err.Error()))
+				http.Error(rw, err.Error(), http.StatusUnauthorized)
+				return
+			}
 		}
+		if !rs.nonces.Use(nonce, now, sent.Add(window)) {
+			constants.Logger.Ctx(rq.Context()).InfoLog(fmt.Sprintf("request replay rejected: nonce %s", nonce))
+			http.Error(rw, "Повторный запрос", http.StatusUnauthorized)
+			return
+		}
+
+		next(rw, rq)
+	}
+}
+
+// decryptBody расшифровывает тело запроса по заголовку Content-Encryption.
+// Гибридная схема и устаревшее шифрование RSA-OAEP принимаются одновременно,
+// чтобы старые и новые агенты могли работать с одним сервером.
+// Ключ выбирается по заголовку Encryption-Key-ID из набора ключей сервера.
+func (rs *RepStore) decryptBody(rq *http.Request, body []byte) ([]byte, error) {
+	contentEncryption := rq.Header.Get("Content-Encryption")
+	if !strings.Contains(contentEncryption, constants.TypeEncryptionHybrid) &&
+		!strings.Contains(contentEncryption, constants.TypeEncryption) {
+		return body, nil
+	}
+
+	var decrypted []byte
+	var err error
+	switch {
+	case rs.KeyRing != nil && rs.KeyRing.Len() != 0:
+		decrypted, err = rs.KeyRing.Decrypt(rq.Header.Get(constants.HeaderKeyID), contentEncryption, body)
+	case rs.PK == nil || rs.PK.PrivateKey == nil:
+		err = errors.New("приватный ключ сервера не загружен")
 	default:
-		return http.StatusNotImplemented
+		decrypted, err = rs.PK.Decrypt(contentEncryption, body)
+	}
+	if err != nil && rs.Telemetry != nil {
+		rs.Telemetry.DecryptFailures.Add(1)
+	}
+
+	return decrypted, err
+}
+
+// decompressBody распаковывает тело запроса, сжатое gzip, по заголовку Content-Encoding.
+func (rs *RepStore) decompressBody(rq *http.Request, body []byte) ([]byte, error) {
+	if !strings.Contains(rq.Header.Get("Content-Encoding"), "gzip") {
+		return body, nil
+	}
+
+	decompressed, err := compression.Decompress(body)
+	if err != nil && rs.Telemetry != nil {
+		rs.Telemetry.DecompressFailures.Add(1)
+	}
+	return decompressed, err
+}
+
+// Добавляет в хранилище метрику. Определяет тип метрики (gauge, counter).
+// В зависимости от типа добавляет нужное значение.
+// При успешном выполнении возвращает значение метрики после изменения и http-статус "ОК" (200)
+func (rs *RepStore) setValueInMap(ctx context.Context, metType string, metName string, metValue string) (encoding.Metrics, int) {
+
+	mt, err := rs.Repo.UpdateText(metType, metName, metValue)
+	if err != nil {
+		constants.Logger.Ctx(ctx).ErrorLog(err)
+		return mt, updateStatus(err)
 	}
 
-	return http.StatusOK
+	return mt, http.StatusOK
 }
 
-func (rs *RepStore) SetValueInMapJSON(a []encoding.Metrics) int {
+// updateStatus http-статус ошибки изменения метрики во временном хранилище.
+func updateStatus(err error) int {
+	if errors.Is(err, repository.ErrUnknownType) {
+		return http.StatusNotImplemented
+	}
+	return http.StatusBadRequest
+}
 
-	rs.Lock()
-	defer rs.Unlock()
+// hashScheme схема хеширования метрик из заголовка Hash-Scheme запроса.
+// Без заголовка используется схема v1, чтобы старые агенты продолжали работать.
+// Поддерживаемые схемы сервер сообщает в заголовке ответа Accept-Hash-Scheme.
+func hashScheme(rw http.ResponseWriter, rq *http.Request) (string, bool) {
+	rw.Header().Set(constants.HeaderAcceptHashScheme, strings.Join(cryptohash.SupportedHashSchemes, ", "))
+
+	scheme := rq.Header.Get(constants.HeaderHashScheme)
+	if scheme == "" {
+		scheme = constants.HashSchemeV1
+	}
+	if !cryptohash.SupportedHashScheme(scheme) {
+		http.Error(rw, "Неизвестная схема хеширования: "+scheme, http.StatusBadRequest)
+		return "", false
+	}
+	rw.Header().Set(constants.HeaderHashScheme, scheme)
+
+	return scheme, true
+}
+
+// SetValueInMapJSON добавляет метрики в хранилище, проверяя их хеши по схеме scheme.
+// Возвращает значения метрик после изменения с хешами схемы v1, как они записываются в физическое хранилище.
+// Метрики применяются одним пакетом: чтение всех метрик видит их вместе.
+// Если хотя бы одна метрика не прошла проверку, не применяется ни одна.
+// Возвращенные вместе с ошибкой метрики все же применены (см. Store.UpdateBatch) и должны быть записаны.
+func (rs *RepStore) SetValueInMapJSON(ctx context.Context, a []encoding.Metrics, scheme string) (encoding.ArrMetrics, int) {
 
 	for _, v := range a {
-		var heshVal string
-
-		switch v.MType {
-		case GaugeMetric.String():
-			var valValue float64
-			valValue = *v.Value
-
-			msg := fmt.Sprintf("%s:gauge:%f", v.ID, valValue)
-			heshVal = cryptohash.HeshSHA256(msg, rs.Config.Key)
-			if _, findKey := rs.MutexRepo[v.ID]; !findKey {
-				valG := repository.Gauge(0)
-				rs.MutexRepo[v.ID] = &valG
-			}
-		case CounterMetric.String():
-			var valDelta int64
-			valDelta = *v.Delta
-
-			msg := fmt.Sprintf("%s:counter:%d", v.ID, valDelta)
-			heshVal = cryptohash.HeshSHA256(msg, rs.Config.Key)
-			if _, findKey := rs.MutexRepo[v.ID]; !findKey {
-				valC := repository.Counter(0)
-				rs.MutexRepo[v.ID] = &valC
+		if v.MType != GaugeMetric.String() && v.MType != CounterMetric.String() {
+			return nil, http.StatusNotImplemented
+		}
+
+		if v.Hash != "" && !cryptohash.VerifyMetricHash(scheme, rs.Config.Key, &v) {
+			if rs.Telemetry != nil {
+				rs.Telemetry.HashFailures.Add(1)
 			}
-		default:
-			return http.StatusNotImplemented
+			constants.Logger.Ctx(ctx).InfoLog(fmt.Sprintf("metric %s: hash mismatch, scheme %s", v.ID, scheme))
+			return nil, http.StatusBadRequest
 		}
+	}
+
+	status := http.StatusOK
+	applied, err := rs.Repo.UpdateBatch(a)
+	if err != nil {
+		constants.Logger.Ctx(ctx).ErrorLog(err)
+		status = updateStatus(err)
+	}
 
-		heshAgent := []byte(v.Hash)
-		heshServer := []byte(heshVal)
+	updated := make(encoding.ArrMetrics, 0, len(applied))
+	for _, mt := range applied {
+		updated = append(updated, rs.signV1(mt))
+	}
+	return updated, status
+}
 
-		hmacEqual := hmac.Equal(heshServer, heshAgent)
+// signV1 добавляет к метрике хеш схемы v1 по ключу сервера.
+func (rs *RepStore) signV1(mt encoding.Metrics) encoding.Metrics {
+	key := ""
+	if rs.Config != nil {
+		key = rs.Config.Key
+	}
+	mt.Hash = cryptohash.MetricHash(constants.HashSchemeV1, key, &mt)
+	return mt
+}
 
-		if v.Hash != "" && !hmacEqual {
-			constants.Logger.InfoLog(fmt.Sprintf("++ %s - %s", v.Hash, heshVal))
-			return http.StatusBadRequest
+// metric текущее значение метрики id: метрики сервера с префиксом constants.SelfMetricsPrefix
+// берутся из Telemetry, остальные - из временного хранилища.
+func (rs *RepStore) metric(id string) (encoding.Metrics, bool) {
+	if repository.ReservedID(id) {
+		if rs.Telemetry == nil {
+			return encoding.Metrics{}, false
 		}
-		rs.MutexRepo[v.ID].Set(v)
+		return rs.Telemetry.Get(id)
 	}
-	return http.StatusOK
-
+	return rs.Repo.Get(id)
 }
 
 // HandlerGetValue Handler, который работает с GET запросом формата "/value/{metType}/{metName}"
@@ -198,25 +608,18 @@ func (rs *RepStore) HandlerGetValue(rw http.ResponseWriter, rq *http.Request) {
 	metType := mux.Vars(rq)["metType"]
 	metName := mux.Vars(rq)["metName"]
 
-	rs.Lock()
-	defer rs.Unlock()
-
-	if _, findKey := rs.MutexRepo[metName]; !findKey {
-		constants.Logger.InfoLog(fmt.Sprintf("== %d", 3))
-		rw.WriteHeader(http.StatusNotFound)
+	mt, findKey := rs.metric(metName)
+	if !findKey {
 		http.Error(rw, "Метрика "+metName+" с типом "+metType+" не найдена", http.StatusNotFound)
 		return
 	}
 
-	strMetric := rs.MutexRepo[metName].String()
+	strMetric := repository.MetricText(mt)
 	_, err := io.WriteString(rw, strMetric)
 	if err != nil {
-		constants.Logger.ErrorLog(err)
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 		return
 	}
-
-	rw.WriteHeader(http.StatusOK)
-
 }
 
 // HandlerSetMetricaPOST Handler, который работает с POST запросом формата "/update/{metType}/{metName}/{metValue}".
@@ -224,14 +627,18 @@ func (rs *RepStore) HandlerGetValue(rw http.ResponseWriter, rq *http.Request) {
 // Значение метрики записывается во временное хранилище метрик repository.MapMetrics
 func (rs *RepStore) HandlerSetMetricaPOST(rw http.ResponseWriter, rq *http.Request) {
 
-	rs.Lock()
-	defer rs.Unlock()
-
 	metType := mux.Vars(rq)["metType"]
 	metName := mux.Vars(rq)["metName"]
 	metValue := mux.Vars(rq)["metValue"]
 
-	rw.WriteHeader(rs.setValueInMap(metType, metName, metValue))
+	mt, res := rs.setValueInMap(rq.Context(), metType, metName, metValue)
+	rw.WriteHeader(res)
+
+	if res == http.StatusOK {
+		if err := rs.persist(rq.Context(), encoding.ArrMetrics{rs.signV1(mt)}); err != nil {
+			constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		}
+	}
 }
 
 // HandlerUpdateMetricJSON Handler, который работает с POST запросом формата "/update".
@@ -240,32 +647,29 @@ func (rs *RepStore) HandlerSetMetricaPOST(rw http.ResponseWriter, rq *http.Reque
 // Сохраняет значение в физическое и временное хранилище.
 func (rs *RepStore) HandlerUpdateMetricJSON(rw http.ResponseWriter, rq *http.Request) {
 
-	contentEncoding := rq.Header.Get("Content-Encoding")
-	contentEncryption := rq.Header.Get("Content-Encryption")
-
+	scheme, ok := hashScheme(rw, rq)
+	if !ok {
+		return
+	}
 	bytBody, err := io.ReadAll(rq.Body)
 	if err != nil {
-		constants.Logger.InfoLog(fmt.Sprintf("$$ 1 %s", err.Error()))
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 		http.Error(rw, "Ошибка получения Content-Encoding", http.StatusInternalServerError)
 		return
 	}
 
-	if strings.Contains(contentEncryption, constants.TypeEncryption) {
-		bytBody, err = rs.PK.RsaDecrypt(bytBody)
-		if err != nil {
-			constants.Logger.ErrorLog(err)
-			http.Error(rw, "Ошибка дешифровки", http.StatusInternalServerError)
-			return
-		}
+	bytBody, err = rs.decryptBody(rq, bytBody)
+	if err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		http.Error(rw, "Ошибка дешифровки", http.StatusInternalServerError)
+		return
 	}
 
-	if strings.Contains(contentEncoding, "gzip") {
-		bytBody, err = compression.Decompress(bytBody)
-		if err != nil {
-			constants.Logger.InfoLog(fmt.Sprintf("$$ 2 %s", err.Error()))
-			http.Error(rw, "Ошибка распаковки", http.StatusInternalServerError)
-			return
-		}
+	bytBody, err = rs.decompressBody(rq, bytBody)
+	if err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		http.Error(rw, "Ошибка распаковки", http.StatusInternalServerError)
+		return
 	}
 
 	bodyJSON := bytes.NewReader(bytBody)
@@ -273,33 +677,32 @@ func (rs *RepStore) HandlerUpdateMetricJSON(rw http.ResponseWriter, rq *http.Req
 	var v []encoding.Metrics
 	err = json.NewDecoder(bodyJSON).Decode(&v)
 	if err != nil {
-		constants.Logger.InfoLog(fmt.Sprintf("$$ 3 %s", err.Error()))
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 		http.Error(rw, "Ошибка получения JSON", http.StatusInternalServerError)
 		return
 	}
 
 	rw.Header().Add("Content-Type", "application/json")
-	res := rs.SetValueInMapJSON(v)
+	arrMetrics, res := rs.SetValueInMapJSON(rq.Context(), v, scheme)
 	rw.WriteHeader(res)
 
-	var arrMetrics encoding.ArrMetrics
-	for _, val := range v {
-		mt := rs.MutexRepo[val.ID].GetMetrics(val.MType, val.ID, rs.Config.Key)
-		metricsJSON, err := mt.MarshalMetrica()
+	for _, mt := range arrMetrics {
+		respMetric := mt
+		respMetric.Hash = cryptohash.MetricHash(scheme, rs.Config.Key, &respMetric)
+		metricsJSON, err := respMetric.MarshalMetrica()
 		if err != nil {
-			constants.Logger.ErrorLog(err)
+			constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 			return
 		}
 		if _, err := rw.Write(metricsJSON); err != nil {
-			constants.Logger.ErrorLog(err)
+			constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 			return
 		}
-		arrMetrics = append(arrMetrics, mt)
 	}
 
-	if res == http.StatusOK {
-		for _, val := range rs.Config.TypeMetricsStorage {
-			val.WriteMetric(arrMetrics)
+	if len(arrMetrics) != 0 {
+		if err := rs.persist(rq.Context(), arrMetrics); err != nil {
+			constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 		}
 	}
 }
@@ -309,61 +712,106 @@ func (rs *RepStore) HandlerUpdateMetricJSON(rw http.ResponseWriter, rq *http.Req
 // Может принимать JSON в жатом виде gzip. Сохраняет значение в физическое и временное хранилище.
 func (rs *RepStore) HandlerUpdatesMetricJSON(rw http.ResponseWriter, rq *http.Request) {
 
-	var bodyJSON io.Reader
+	scheme, ok := hashScheme(rw, rq)
+	if !ok {
+		return
+	}
 
-	contentEncoding := rq.Header.Get("Content-Encoding")
-	contentEncryption := rq.Header.Get("Content-Encryption")
+	var bodyJSON io.Reader
 
 	bytBody, err := io.ReadAll(rq.Body)
 	if err != nil {
-		constants.Logger.ErrorLog(err)
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 		http.Error(rw, "Ошибка получения Content-Encoding", http.StatusInternalServerError)
 		return
 	}
 
-	if strings.Contains(contentEncryption, constants.TypeEncryption) {
-		bytBody, err = rs.PK.RsaDecrypt(bytBody)
-		if err != nil {
-			constants.Logger.ErrorLog(err)
-			http.Error(rw, "Ошибка дешифровки", http.StatusInternalServerError)
-			return
-		}
+	bytBody, err = rs.decryptBody(rq, bytBody)
+	if err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		http.Error(rw, "Ошибка дешифровки", http.StatusInternalServerError)
+		return
 	}
 
-	if strings.Contains(contentEncoding, "gzip") {
-		bytBody, err = compression.Decompress(bytBody)
-		if err != nil {
-			constants.Logger.ErrorLog(err)
-			http.Error(rw, "Ошибка распаковки", http.StatusInternalServerError)
-			return
-		}
+	bytBody, err = rs.decompressBody(rq, bytBody)
+	if err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		http.Error(rw, "Ошибка распаковки", http.StatusInternalServerError)
+		return
 	}
 
 	bodyJSON = bytes.NewReader(bytBody)
 	respByte, err := io.ReadAll(bodyJSON)
 
 	if err != nil {
-		constants.Logger.ErrorLog(err)
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 		http.Error(rw, "Ошибка распаковки", http.StatusInternalServerError)
+		return
 	}
 
 	var storedData encoding.ArrMetrics
 	if err := json.Unmarshal(respByte, &storedData); err != nil {
-		constants.Logger.ErrorLog(err)
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 		http.Error(rw, "Ошибка распаковки", http.StatusInternalServerError)
+		return
 	}
 
-	//for _, val := range storedData {
-	//	if val.ID == "BuckHashSys" {
-	//		fmt.Println(fmt.Sprintf("BuckHashSys: %f", *val.Value))
-	//	}
-	//}
+	// В хранилище записываются итоговые значения с хешами схемы v1, как и при резервном копировании:
+	// Upsert заменяет сохраненное значение, и дельта counter, записанная как есть,
+	// при восстановлении заменила бы накопленную сумму.
+	arrMetrics, res := rs.SetValueInMapJSON(rq.Context(), storedData, scheme)
+	if res != http.StatusOK {
+		if len(arrMetrics) != 0 {
+			if err := rs.persist(rq.Context(), arrMetrics); err != nil {
+				constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+			}
+		}
+		http.Error(rw, "Ошибка сохранения метрик", res)
+		return
+	}
+
+	if err := rs.persist(rq.Context(), arrMetrics); err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+	}
+}
 
-	rs.SetValueInMapJSON(storedData)
+// persist ставит принятые метрики в очередь записи в физические хранилища и в историю.
+// Если очередь заполнена, ждет свободного места, пока не отменен запрос: так агенты замедляются,
+// когда хранилища не успевают. Не дождавшись места, очередь записывает метрики сама, и запрос
+// завершается успешно: метрики уже в памяти сервера. Без очереди или после ее остановки
+// метрики записываются сразу.
+// Возвращает ошибки записи в хранилища, метрики в памяти сервера при этом уже сохранены.
+func (rs *RepStore) persist(ctx context.Context, arrMetrics encoding.ArrMetrics) error {
+	at := time.Now()
+	arrMetrics = withTimestamp(arrMetrics, at)
+	if rs.Queue != nil {
+		err := rs.Queue.Enqueue(ctx, arrMetrics, at)
+		if !errors.Is(err, repository.ErrQueueClosed) {
+			return err
+		}
+	}
+
+	var errs []string
+	if err := rs.Storage.Upsert(ctx, arrMetrics); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := rs.Storage.AppendSamples(ctx, arrMetrics, at); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
 
-	for _, val := range rs.Config.TypeMetricsStorage {
-		val.WriteMetric(storedData)
+// withTimestamp копия метрик со временем изменения at для физического хранилища.
+func withTimestamp(arrMetrics encoding.ArrMetrics, at time.Time) encoding.ArrMetrics {
+	stamped := make(encoding.ArrMetrics, len(arrMetrics))
+	for i, mt := range arrMetrics {
+		mt.Timestamp = &at
+		stamped[i] = mt
 	}
+	return stamped
 }
 
 // HandlerValueMetricaJSON Handler, который работает с POST запросом формата "/value".
@@ -371,36 +819,35 @@ func (rs *RepStore) HandlerUpdatesMetricJSON(rw http.ResponseWriter, rq *http.Re
 // Может принимать JSON в жатом виде gzip. Возвращает значение метрики по типу и наименованию.
 func (rs *RepStore) HandlerValueMetricaJSON(rw http.ResponseWriter, rq *http.Request) {
 
+	scheme, ok := hashScheme(rw, rq)
+	if !ok {
+		return
+	}
+
 	var bodyJSON io.Reader
 	bodyJSON = rq.Body
 
 	acceptEncoding := rq.Header.Get("Accept-Encoding")
-	contentEncoding := rq.Header.Get("Content-Encoding")
-	contentEncryption := rq.Header.Get("Content-Encryption")
 
 	bytBody, err := io.ReadAll(rq.Body)
 	if err != nil {
-		constants.Logger.ErrorLog(err)
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 		http.Error(rw, "Ошибка получения Content-Encoding", http.StatusInternalServerError)
 		return
 	}
 
-	if strings.Contains(contentEncryption, constants.TypeEncryption) {
-		bytBody, err = rs.PK.RsaDecrypt(bytBody)
-		if err != nil {
-			constants.Logger.ErrorLog(err)
-			http.Error(rw, "Ошибка дешифровки", http.StatusInternalServerError)
-			return
-		}
+	bytBody, err = rs.decryptBody(rq, bytBody)
+	if err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		http.Error(rw, "Ошибка дешифровки", http.StatusInternalServerError)
+		return
 	}
 
-	if strings.Contains(contentEncoding, "gzip") {
-		bytBody, err = compression.Decompress(bytBody)
-		if err != nil {
-			constants.Logger.ErrorLog(err)
-			http.Error(rw, "Ошибка распаковки", http.StatusInternalServerError)
-			return
-		}
+	bytBody, err = rs.decompressBody(rq, bytBody)
+	if err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		http.Error(rw, "Ошибка распаковки", http.StatusInternalServerError)
+		return
 	}
 
 	bodyJSON = bytes.NewReader(bytBody)
@@ -408,29 +855,24 @@ func (rs *RepStore) HandlerValueMetricaJSON(rw http.ResponseWriter, rq *http.Req
 	v := encoding.Metrics{}
 	err = json.NewDecoder(bodyJSON).Decode(&v)
 	if err != nil {
-		constants.Logger.ErrorLog(err)
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 		http.Error(rw, "Ошибка получения JSON", http.StatusInternalServerError)
 		return
 	}
 	metType := v.MType
 	metName := v.ID
 
-	rs.Lock()
-	defer rs.Unlock()
-
-	if _, findKey := rs.MutexRepo[metName]; !findKey {
-
-		constants.Logger.InfoLog(fmt.Sprintf("== %d %s %d %s", 1, metName, len(rs.MutexRepo), rs.Config.DatabaseDsn))
-
-		rw.WriteHeader(http.StatusNotFound)
+	mt, findKey := rs.metric(metName)
+	if !findKey {
 		http.Error(rw, "Метрика "+metName+" с типом "+metType+" не найдена", http.StatusNotFound)
 		return
 	}
 
-	mt := rs.MutexRepo[metName].GetMetrics(metType, metName, rs.Config.Key)
+	mt.MType = metType
+	mt.Hash = cryptohash.MetricHash(scheme, rs.Config.Key, &mt)
 	metricsJSON, err := mt.MarshalMetrica()
 	if err != nil {
-		constants.Logger.ErrorLog(err)
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 		return
 	}
 
@@ -439,7 +881,7 @@ func (rs *RepStore) HandlerValueMetricaJSON(rw http.ResponseWriter, rq *http.Req
 	bytMterica = append(bytMterica, bt...)
 	compData, err := compression.Compress(bytMterica)
 	if err != nil {
-		constants.Logger.ErrorLog(err)
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 	}
 
 	var bodyBate []byte
@@ -452,31 +894,498 @@ func (rs *RepStore) HandlerValueMetricaJSON(rw http.ResponseWriter, rq *http.Req
 	}
 
 	if _, err := rw.Write(bodyBate); err != nil {
-		constants.Logger.ErrorLog(err)
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 		return
 	}
 }
 
-// HandlerPingDB Handler, который работает с GET запросом формата "/ping"
-// Handler проверяет соединение с физическим хранилищем метрик.
-// Физическое хранилище регулируется параметром среды "DATABASE_DSN" или флагом "d"
-// Если заполнено "DATABASE_DSN" или "d", то это база данных. Иначе файл.
+// HandlerPingDB Handler, который работает с GET запросом формата "/ping".
+// Проверяет доступность всех используемых хранилищ: БД, файла, bbolt.
+// Если недоступно хотя бы одно хранилище - статус 500 с причиной.
 func (rs *RepStore) HandlerPingDB(rw http.ResponseWriter, rq *http.Request) {
 	defer rq.Body.Close()
-	mapTypeStore := rs.Config.TypeMetricsStorage
-	if _, findKey := mapTypeStore[constants.MetricsStorageDB.String()]; !findKey {
-		constants.Logger.ErrorLog(errors.New("соединение с базой отсутствует"))
+
+	for _, backend := range rs.Storage.List() {
+		if err := backend.Health(rq.Context()); err != nil {
+			constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+			http.Error(rw, backend.Name()+": "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+// HandlerHealth Handler, который работает с GET запросом формата "/health".
+// Возвращает JSON-массив состояний хранилищ: доступность, причину недоступности
+// и количество значений, ожидающих записи. Если недоступно хотя бы одно хранилище - статус 503.
+func (rs *RepStore) HandlerHealth(rw http.ResponseWriter, rq *http.Request) {
+	defer rq.Body.Close()
+
+	statuses, healthy := rs.Storage.Status(rq.Context())
+	body, err := json.Marshal(statuses)
+	if err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if mapTypeStore[constants.MetricsStorageDB.String()].ConnDB() == nil {
-		constants.Logger.ErrorLog(errors.New("соединение с базой отсутствует"))
+	rw.Header().Set("Content-Type", "application/json")
+	if healthy {
+		rw.WriteHeader(http.StatusOK)
+	} else {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if _, err = rw.Write(body); err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+	}
+}
+
+// ComponentStatus состояние компонента сервера в ответе "/readyz".
+// Status: up - компонент готов, down - не готов
+// Latency: длительность проверки в миллисекундах
+// Error: причина неготовности при этой проверке
+// LastError, LastErrorAt: последняя ошибка компонента и ее время, сохраняются и после восстановления
+type ComponentStatus struct {
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	Latency     float64    `json:"latency_ms"`
+	Error       string     `json:"error,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Readiness ответ "/readyz": общее состояние и состояния компонентов.
+type Readiness struct {
+	Status     string            `json:"status"`
+	Components []ComponentStatus `json:"components"`
+}
+
+// componentError последняя ошибка компонента.
+type componentError struct {
+	err string
+	at  time.Time
+}
+
+// readinessCheck проверка готовности одного компонента.
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// restorePending восстановление метрик включено, но еще не удалось.
+func (rs *RepStore) restorePending() bool {
+	if rs.Config == nil || !rs.Config.Restore {
+		return false
+	}
+	rs.restoreMu.RLock()
+	defer rs.restoreMu.RUnlock()
+	return rs.Restored == nil
+}
+
+// checkRestore готовность восстановления: метрики восстановлены или восстановление отключено.
+func (rs *RepStore) checkRestore(ctx context.Context) error {
+	if rs.restorePending() {
+		return errors.New("восстановление метрик не завершено")
+	}
+	return nil
+}
+
+// checkKeys готовность ключей: загружены все ключи, указанные в настройках.
+func (rs *RepStore) checkKeys(ctx context.Context) error {
+	if rs.Config == nil {
+		return nil
+	}
+	keyRingLoaded := rs.KeyRing != nil && rs.KeyRing.Len() != 0
+	if rs.Config.CryptoKeyDir != "" && !keyRingLoaded {
+		return fmt.Errorf("ключи из каталога %s не загружены", rs.Config.CryptoKeyDir)
+	}
+	if rs.Config.CryptoKey != "" && !keyRingLoaded && (rs.PK == nil || rs.PK.PrivateKey == nil) {
+		return fmt.Errorf("приватный ключ %s не загружен", rs.Config.CryptoKey)
+	}
+	if rs.Config.TrustedAgentsDir != "" && (rs.Agents == nil || len(rs.Agents.AgentIDs()) == 0) {
+		return fmt.Errorf("ключи доверенных агентов из каталога %s не загружены", rs.Config.TrustedAgentsDir)
+	}
+	return nil
+}
+
+// Readiness проверяет готовность сервера: восстановление метрик, доступность каждого хранилища и загрузку ключей.
+// Проверки выполняются одновременно, каждая не дольше constants.ReadyTimeout.
+func (rs *RepStore) Readiness(ctx context.Context) (Readiness, bool) {
+	checks := []readinessCheck{{name: "restore", check: rs.checkRestore}}
+	for _, backend := range rs.Storage.List() {
+		checks = append(checks, readinessCheck{name: "storage/" + backend.Name(), check: backend.Health})
+	}
+	checks = append(checks, readinessCheck{name: "keys", check: rs.checkKeys})
+
+	ctx, cancel := context.WithTimeout(ctx, constants.ReadyTimeout)
+	defer cancel()
+
+	components := make([]ComponentStatus, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c readinessCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := c.check(ctx)
+			components[i] = ComponentStatus{
+				Name:    c.name,
+				Status:  constants.StatusUp,
+				Latency: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				components[i].Status = constants.StatusDown
+				components[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	rs.readyMu.Lock()
+	defer rs.readyMu.Unlock()
+	if rs.lastErrors == nil {
+		rs.lastErrors = make(map[string]componentError)
+	}
+
+	ready := true
+	for i := range components {
+		component := &components[i]
+		if component.Error != "" {
+			ready = false
+			rs.lastErrors[component.Name] = componentError{err: component.Error, at: time.Now().UTC()}
+		}
+		if last, ok := rs.lastErrors[component.Name]; ok {
+			at := last.at
+			component.LastError = last.err
+			component.LastErrorAt = &at
+		}
+	}
+
+	readiness := Readiness{Status: constants.StatusUp, Components: components}
+	if !ready {
+		readiness.Status = constants.StatusDown
+	}
+	return readiness, ready
+}
+
+// HandlerHealthz Handler, который работает с GET запросом формата "/healthz".
+// Проверка живости процесса для Kubernetes: отвечает 200, пока сервер обрабатывает запросы.
+func (rs *RepStore) HandlerHealthz(rw http.ResponseWriter, rq *http.Request) {
+	defer rq.Body.Close()
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if _, err := io.WriteString(rw, `{"status":"`+constants.StatusUp+`"}`); err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+	}
+}
+
+// HandlerReadyz Handler, который работает с GET запросом формата "/readyz".
+// Проверка готовности для Kubernetes: возвращает JSON с состоянием каждого компонента,
+// длительностью проверки и последней ошибкой. Если не готов хотя бы один компонент - статус 503.
+func (rs *RepStore) HandlerReadyz(rw http.ResponseWriter, rq *http.Request) {
+	defer rq.Body.Close()
+
+	readiness, ready := rs.Readiness(rq.Context())
+	body, err := json.Marshal(readiness)
+	if err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	rw.Header().Set("Content-Type", "application/json")
+	if ready {
+		rw.WriteHeader(http.StatusOK)
+	} else {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if _, err = rw.Write(body); err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+	}
+}
+
+// queueMetricsPrefix префикс метрик очереди записи среди метрик сервера.
+const queueMetricsPrefix = constants.SelfMetricsPrefix + "write_queue_"
+
+// registerQueueMetrics добавляет состояние очереди queue в метрики сервера r:
+// длительность записи - gauge в секундах, количество записей, ошибок, ожиданий,
+// записей в обход очереди и потерянных значений истории - counter.
+func registerQueueMetrics(r *telemetry.Registry, queue *repository.WriteQueue) {
+	r.Gauge("write_queue_depth", func() float64 { return float64(queue.Stats().Depth) })
+	r.Gauge("write_queue_capacity", func() float64 { return float64(queue.Stats().Capacity) })
+	r.Gauge("write_queue_flush_latency_seconds", func() float64 { return queue.Stats().LastFlush.Seconds() })
+	r.Gauge("write_queue_flush_latency_max_seconds", func() float64 { return queue.Stats().MaxFlush.Seconds() })
+	r.Counter("write_queue_flushes", func() int64 { return queue.Stats().Flushes })
+	r.Counter("write_queue_flush_errors", func() int64 { return queue.Stats().FlushErrors })
+	r.Counter("write_queue_blocked", func() int64 { return queue.Stats().Blocked })
+	r.Counter("write_queue_direct", func() int64 { return queue.Stats().Direct })
+	r.Counter("write_queue_dropped_samples", func() int64 { return queue.Stats().DroppedSamples })
+}
+
+// HandlerQueue Handler, который работает с GET запросом формата "/queue".
+// Возвращает JSON-массив метрик сервера server_write_queue_*: глубину очереди, длительность записи,
+// количество записей, ошибок, ожиданий свободного места, записей в обход очереди и потерянных значений истории.
+func (rs *RepStore) HandlerQueue(rw http.ResponseWriter, rq *http.Request) {
+	defer rq.Body.Close()
+
+	if rs.Queue == nil {
+		http.Error(rw, "Очередь записи метрик не используется", http.StatusNotFound)
+		return
+	}
+
+	var metrics encoding.ArrMetrics
+	for _, mt := range rs.Telemetry.Metrics() {
+		if strings.HasPrefix(mt.ID, queueMetricsPrefix) {
+			metrics = append(metrics, mt)
+		}
+	}
+	body, err := json.Marshal(metrics)
+	if err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if _, err = rw.Write(body); err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+	}
+}
+
+// HandlerSelfMetrics Handler, который работает с GET запросом формата "/metrics?format=".
+// Возвращает метрики самого сервера в формате json (по умолчанию), csv или openmetrics:
+// количество, длительность и размер запросов по маршрутам, ошибки дешифровки, распаковки и хешей,
+// длительность записи в хранилища и размер временного хранилища.
+func (rs *RepStore) HandlerSelfMetrics(rw http.ResponseWriter, rq *http.Request) {
+	defer rq.Body.Close()
+
+	format := exportFormat(rq)
+
+	var body bytes.Buffer
+	if err := repository.EncodeMetrics(&body, format, rs.Telemetry.Metrics()); err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, repository.ErrUnknownFormat) {
+			status = http.StatusBadRequest
+		}
+		http.Error(rw, err.Error(), status)
+		return
+	}
+
+	rw.Header().Set("Content-Type", repository.ContentType(format))
 	rw.WriteHeader(http.StatusOK)
+	if _, err := rw.Write(body.Bytes()); err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+	}
+}
+
+// HandlerHistory Handler, который работает с GET запросом формата "/history/{metType}/{metName}?from=&to=".
+// Возвращает JSON-массив значений метрики из истории в БД за период [from, to).
+// Время указывается в формате RFC 3339, по умолчанию - последний час.
+func (rs *RepStore) HandlerHistory(rw http.ResponseWriter, rq *http.Request) {
+	metType := mux.Vars(rq)["metType"]
+	metName := mux.Vars(rq)["metName"]
+
+	if metType != GaugeMetric.String() && metType != CounterMetric.String() {
+		http.Error(rw, "Неизвестный тип метрики "+metType, http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now()
+	if value := rq.URL.Query().Get("to"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(rw, "Неверное время to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	from := to.Add(-time.Hour)
+	if value := rq.URL.Query().Get("from"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(rw, "Неверное время from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		http.Error(rw, "Время from должно быть раньше to", http.StatusBadRequest)
+		return
+	}
+
+	samples, err := rs.Storage.Samples(rq.Context(), repository.MetricKey{ID: metName, MType: metType}, from, to)
+	if errors.Is(err, repository.ErrNoSampleStore) {
+		http.Error(rw, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		http.Error(rw, "Ошибка чтения истории метрики", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(rw).Encode(samples); err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+	}
+}
+
+// exportFormat формат выгрузки из параметра format запроса, по умолчанию json.
+func exportFormat(rq *http.Request) string {
+	if format := rq.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	return constants.ExportJSON
+}
+
+// HandlerExport Handler, который работает с GET запросом формата "/admin/export?format=&source=".
+// Выгружает все метрики в формате json, csv или openmetrics.
+// source: memory - текущие значения сервера (по умолчанию), имя хранилища (db, file, bolt) - сохраненные в нем значения.
+func (rs *RepStore) HandlerExport(rw http.ResponseWriter, rq *http.Request) {
+	defer rq.Body.Close()
+
+	format := exportFormat(rq)
+	source := rq.URL.Query().Get("source")
+
+	var metrics encoding.ArrMetrics
+	if source == "" || source == "memory" {
+		metrics = rs.Repo.Snapshot()
+	} else {
+		backend, ok := rs.Storage.Get(source)
+		if !ok {
+			http.Error(rw, "Хранилище "+source+" не используется", http.StatusNotFound)
+			return
+		}
+		var err error
+		if metrics, err = backend.LoadAll(rq.Context()); err != nil {
+			constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+			http.Error(rw, "Ошибка чтения хранилища "+source, http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	var body bytes.Buffer
+	if err := repository.EncodeMetrics(&body, format, metrics); err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, repository.ErrUnknownFormat) {
+			status = http.StatusBadRequest
+		}
+		http.Error(rw, err.Error(), status)
+		return
+	}
+
+	rw.Header().Set("Content-Type", repository.ContentType(format))
+	rw.WriteHeader(http.StatusOK)
+	if _, err := rw.Write(body.Bytes()); err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+	}
+}
+
+// HandlerImport Handler, который работает с POST запросом формата "/admin/import?format=&mode=&dry_run=".
+// Загружает метрики из выгрузки HandlerExport в режиме mode: replace, merge (по умолчанию) или counters-add.
+// При dry_run=true значения не меняются. Возвращает JSON с изменениями метрик
+// и признаком persisted записи в физические хранилища.
+// Тело может быть сжато gzip и зашифровано, как у "/updates".
+func (rs *RepStore) HandlerImport(rw http.ResponseWriter, rq *http.Request) {
+	defer rq.Body.Close()
+
+	mode := rq.URL.Query().Get("mode")
+	if mode == "" {
+		mode = constants.ImportMerge
+	}
+	dryRun, err := strconv.ParseBool(rq.URL.Query().Get("dry_run"))
+	if err != nil && rq.URL.Query().Get("dry_run") != "" {
+		http.Error(rw, "Неверное значение dry_run", http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(rq.Body)
+	if err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		http.Error(rw, "Ошибка чтения тела запроса", http.StatusInternalServerError)
+		return
+	}
+	if body, err = rs.decryptBody(rq, body); err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		http.Error(rw, "Ошибка дешифровки", http.StatusInternalServerError)
+		return
+	}
+	if body, err = rs.decompressBody(rq, body); err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		http.Error(rw, "Ошибка распаковки", http.StatusBadRequest)
+		return
+	}
+
+	metrics, err := repository.DecodeMetrics(bytes.NewReader(body), exportFormat(rq))
+	if err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := rs.Repo.Import(metrics, mode, dryRun, time.Now())
+	if err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !dryRun {
+		constants.Logger.Ctx(rq.Context()).InfoLog(fmt.Sprintf("metrics imported, mode %s: added %d, changed %d, removed %d",
+			mode, result.Report.Added, result.Report.Changed, result.Report.Removed))
+
+		if err = rs.persistImport(rq.Context(), result); err != nil {
+			constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+			result.Report.PersistError = err.Error()
+		}
+		result.Report.Persisted = err == nil
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(rw).Encode(result.Report); err != nil {
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
+	}
+}
+
+// persistImport записывает загруженные метрики в физические хранилища и удаляет из них удаленные.
+// Очередь записывается и после постановки метрик, чтобы вернуть ошибку записи. Ответ при ошибке
+// остается успешным с Persisted false: метрики уже загружены в память, и повтор загрузки
+// в режиме counters-add учел бы значения дважды.
+func (rs *RepStore) persistImport(ctx context.Context, result repository.ImportResult) error {
+	var errs []string
+
+	// Очередь записывается до удаления, иначе она вернула бы в хранилища удаленные метрики.
+	if rs.Queue != nil && len(result.Deleted) != 0 {
+		if err := rs.Queue.Flush(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := rs.Storage.Delete(ctx, result.Deleted...); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	updated := make(encoding.ArrMetrics, 0, len(result.Updated))
+	for _, mt := range result.Updated {
+		updated = append(updated, rs.signV1(mt))
+	}
+	if err := rs.persist(ctx, updated); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if rs.Queue != nil && len(updated) != 0 {
+		if err := rs.Queue.Flush(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
 }
 
 func (rs *RepStore) HandleFunc(rw http.ResponseWriter, rq *http.Request) {
@@ -489,7 +1398,7 @@ func (rs *RepStore) HandleFunc(rw http.ResponseWriter, rq *http.Request) {
 // Выводит на страницу список наименований и значений метрик.
 func (rs *RepStore) HandlerGetAllMetrics(rw http.ResponseWriter, rq *http.Request) {
 
-	arrMetricsAndValue := rs.MapMetrics.TextMetricsAndValue()
+	arrMetricsAndValue := rs.Repo.TextMetricsAndValue()
 
 	var strMetrics string
 	content := `<!DOCTYPE html>
@@ -519,7 +1428,7 @@ func (rs *RepStore) HandlerGetAllMetrics(rw http.ResponseWriter, rq *http.Reques
 	byteMterics := bytes.NewBuffer(metricsHTML).Bytes()
 	compData, err := compression.Compress(byteMterics)
 	if err != nil {
-		constants.Logger.ErrorLog(err)
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 	}
 
 	var bodyBate []byte
@@ -533,58 +1442,90 @@ func (rs *RepStore) HandlerGetAllMetrics(rw http.ResponseWriter, rq *http.Reques
 	rw.Header().Add("Content-Type", "text/html")
 	rw.Header().Add("Metrics-Val", strMetrics)
 	if _, err := rw.Write(bodyBate); err != nil {
-		constants.Logger.ErrorLog(err)
-		return
+		constants.Logger.Ctx(rq.Context()).ErrorLog(err)
 	}
-	rw.WriteHeader(http.StatusOK)
 }
 
+// PrepareDataBU значения всех метрик временного хранилища с хешами схемы v1 для записи в физическое.
 func (rs *RepStore) PrepareDataBU() encoding.ArrMetrics {
 
-	var storedData encoding.ArrMetrics
-	for key, val := range rs.MutexRepo {
-		storedData = append(storedData, val.GetMetrics(val.Type(), key, rs.Config.Key))
+	storedData := rs.Repo.Snapshot()
+	for i := range storedData {
+		storedData[i] = rs.signV1(storedData[i])
 	}
 	return storedData
 }
 
-// RestoreData При запуске сервера получает значения из фзического хранилища.
-// И заполняет временое хранилище RepStore {
-func (rs *RepStore) RestoreData() {
+// RestoreData При запуске сервера получает значения из физического хранилища
+// по политике восстановления из настроек и заполняет временное хранилище RepStore.
+// Метрики с неверным хешем пропускаются. Отчет о восстановлении пишется в журнал и сохраняется в RepStore.
+func (rs *RepStore) RestoreData(ctx context.Context) (repository.RestoreReport, error) {
 
-	var arrMetricsAll []encoding.Metrics
+	arrMetrics, report, err := rs.Storage.Restore(ctx, rs.Config.RestorePolicy)
+	if err != nil {
+		return report, err
+	}
 
-	for _, val := range rs.Config.TypeMetricsStorage {
-		arrMetrics, err := val.GetMetric()
-		if err != nil {
-			constants.Logger.ErrorLog(err)
+	restored := make(encoding.ArrMetrics, 0, len(arrMetrics))
+	for _, mt := range arrMetrics {
+		if mt.Hash != "" && !cryptohash.VerifyMetricHash(constants.HashSchemeV1, rs.Config.Key, &mt) {
+			constants.Logger.InfoLog(fmt.Sprintf("metric %s: hash mismatch, not restored", mt.ID))
 			continue
 		}
-		for _, valArr := range arrMetrics {
-			arrMetricsAll = append(arrMetricsAll, valArr)
-		}
+		restored = append(restored, mt)
+	}
+	if err = rs.Repo.Restore(restored); err != nil {
+		return report, err
 	}
+	report.Restored = len(restored)
+
+	rs.restoreMu.Lock()
+	rs.Restored = &report
+	rs.restoreMu.Unlock()
+	constants.Logger.InfoLog(report.String())
 
-	rs.SetValueInMapJSON(arrMetricsAll)
+	return report, nil
+}
+
+// RetryRestore повторяет RestoreData раз в interval, пока восстановление не удастся или не отменен ctx.
+func (rs *RepStore) RetryRestore(ctx context.Context, interval time.Duration) {
+
+	retryTicker := time.NewTicker(interval)
+	defer retryTicker.Stop()
+	for {
+		select {
+		case <-retryTicker.C:
+
+			if _, err := rs.RestoreData(ctx); err != nil {
+				constants.Logger.ErrorLog(err)
+				continue
+			}
+			return
+
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
 // BackupData Сохраняет данные из временного хранилища RepStore в физическое.
 // Если параметр среды "RESTORE" тогда будет сохранятся один раз в n секунд.
-// Количество секунд регулируется параметром среды "STORE_INTERVAL" или флагом "i"
-func (rs *RepStore) BackupData() {
+// Количество секунд регулируется параметром среды "STORE_INTERVAL" или флагом "i".
+// Работает до отмены ctx. Последнее сохранение при остановке сервера делает Shutdown.
+func (rs *RepStore) BackupData(ctx context.Context) {
 
-	ctx, cancelFunc := context.WithCancel(context.Background())
 	saveTicker := time.NewTicker(rs.Config.StoreInterval)
+	defer saveTicker.Stop()
 	for {
 		select {
 		case <-saveTicker.C:
 
-			for _, val := range rs.Config.TypeMetricsStorage {
-				val.WriteMetric(rs.PrepareDataBU())
+			storedData := rs.PrepareDataBU()
+			if err := rs.Storage.Upsert(ctx, storedData); err != nil {
+				constants.Logger.ErrorLog(err)
 			}
 
 		case <-ctx.Done():
-			cancelFunc()
 			return
 		}
 	}
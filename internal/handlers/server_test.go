@@ -79,11 +79,9 @@ func ExampleRepStore_HandlerGetValue() {
 }
 
 func init() {
-	rs.MutexRepo = make(repository.MutexRepo)
-	valG := repository.Gauge(0)
-	if ok := valG.SetFromText("0.001"); !ok {
+	rs.Repo = repository.NewStore()
+	if _, err := rs.Repo.UpdateText("gauge", "TestGauge", "0.001"); err != nil {
 		return
 	}
-	rs.MutexRepo["TestGauge"] = &valG
 	InitRoutersMux(&rs)
 }
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/environment"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+	"github.com/andynikk/advancedmetrics/internal/repository/repositorytest"
+)
+
+func TestSelfMetrics(t *testing.T) {
+	srv := new(RepStore)
+	srv.Repo = repository.NewStore()
+	srv.Config = &environment.ServerConfig{Key: "secret"}
+	InitRoutersMux(srv)
+	srv.Storage = repository.NewBackends(srv.Telemetry.ObserveWrite, repositorytest.NewFakeBackend("file"))
+	queue := repository.NewWriteQueue(repository.NewBackends(nil), 10, 5, time.Hour)
+	defer queue.Close(context.Background())
+	registerQueueMetrics(srv.Telemetry, queue)
+
+	ts := httptest.NewServer(srv.Router)
+	defer ts.Close()
+
+	post := func(t *testing.T, path string, contentEncoding string, body string) int {
+		rq, err := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentEncoding != "" {
+			rq.Header.Set("Content-Encoding", contentEncoding)
+		}
+		resp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	post(t, "/update/gauge/Alloc/1.5", "", "")
+	post(t, "/updates", "", `[{"id":"PollCount","type":"counter","delta":1,"hash":"bad"}]`)
+	post(t, "/updates", "gzip", "not gzip")
+
+	t.Run("Checking reserved namespace", func(t *testing.T) {
+		if status := post(t, "/update/counter/server_http_updates_requests/1", "", ""); status != http.StatusBadRequest {
+			t.Errorf("Error agent metric in reserved namespace accepted: %d", status)
+		}
+	})
+
+	t.Run("Checking endpoint", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var metrics encoding.ArrMetrics
+		if err = json.NewDecoder(resp.Body).Decode(&metrics); err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]encoding.Metrics)
+		for _, mt := range metrics {
+			got[mt.ID] = mt
+		}
+
+		counters := map[string]int64{
+			"server_http_update_text_requests":                2,
+			"server_http_update_text_errors":                  1,
+			"server_http_updates_requests":                    2,
+			"server_http_updates_errors":                      2,
+			"server_hash_failures":                            1,
+			"server_decompress_failures":                      1,
+			"server_storage_file_write_latency_seconds_count": 1,
+		}
+		for id, delta := range counters {
+			if mt, ok := got[id]; !ok || *mt.Delta != delta {
+				t.Errorf("Error metric %s: %+v", id, mt)
+			}
+		}
+		if mt := got["server_repo_size"]; mt.Value == nil || *mt.Value != 1 {
+			t.Errorf("Error metric server_repo_size: %+v", mt)
+		}
+		if mt := got["server_write_queue_capacity"]; mt.Value == nil || *mt.Value != 10 {
+			t.Errorf("Error metric server_write_queue_capacity: %+v", mt)
+		}
+	})
+
+	t.Run("Checking read API", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/value/counter/server_http_update_text_requests")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "2" {
+			t.Errorf("Error value of server metric: %d %s", resp.StatusCode, body)
+		}
+
+		resp, err = http.Post(ts.URL+"/value", "application/json",
+			strings.NewReader(`{"id":"server_repo_size","type":"gauge"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mt encoding.Metrics
+		err = json.NewDecoder(resp.Body).Decode(&mt)
+		resp.Body.Close()
+		if err != nil || mt.Value == nil || *mt.Value != 1 || mt.Hash == "" {
+			t.Errorf("Error json value of server metric: %+v %v", mt, err)
+		}
+	})
+}
@@ -1,17 +1,69 @@
+// Package logger: журнал сервера и агента на основе zerolog.
+//
+// Журнал запроса с его идентификатором и агентом хранится в контексте запроса,
+// его возвращает Ctx. Без журнала в контексте используется общий.
 package logger
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
 	"github.com/rs/zerolog"
 )
 
+// Форматы журнала: FormatJSON - строка JSON на запись, FormatConsole - текст для чтения человеком.
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
 type Logger struct {
 	Log zerolog.Logger
 }
 
+type ctxKey struct{}
+
+// New журнал уровня level (debug, info, warn, error) в формате format с выводом в w.
+// Пустые уровень и формат - info и json.
+func New(w io.Writer, level string, format string) (Logger, error) {
+	lvl := zerolog.InfoLevel
+	if level != "" {
+		var err error
+		if lvl, err = zerolog.ParseLevel(level); err != nil {
+			return Logger{}, fmt.Errorf("неизвестный уровень журнала %q", level)
+		}
+	}
+
+	switch format {
+	case "", FormatJSON:
+	case FormatConsole:
+		w = zerolog.ConsoleWriter{Out: w, NoColor: true, TimeFormat: time.RFC3339}
+	default:
+		return Logger{}, fmt.Errorf("неизвестный формат журнала %q", format)
+	}
+
+	return Logger{Log: zerolog.New(w).Level(lvl).With().Timestamp().Logger()}, nil
+}
+
+// WithContext добавляет журнал в контекст, см. Ctx.
+func (l *Logger) WithContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// Ctx журнал из контекста ctx, например журнал запроса. Если в контексте журнала нет - l.
+func (l *Logger) Ctx(ctx context.Context) *Logger {
+	if ctxLogger, ok := ctx.Value(ctxKey{}).(*Logger); ok {
+		return ctxLogger
+	}
+	return l
+}
+
 func (l *Logger) ErrorLog(err error) {
 	l.Log.Error().Err(err).Msg("")
 }
 
 func (l *Logger) InfoLog(infoString string) {
-	l.Log.Info().Msgf("%+v\n", infoString)
+	l.Log.Info().Msg(infoString)
 }
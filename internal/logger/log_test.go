@@ -0,0 +1,55 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("Checking level", func(t *testing.T) {
+		var buf bytes.Buffer
+		l, err := New(&buf, "warn", FormatJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.InfoLog("skipped")
+		l.Log.Warn().Str("request_id", "42").Msg("written")
+		if strings.Contains(buf.String(), "skipped") || !strings.Contains(buf.String(), `"request_id":"42"`) {
+			t.Errorf("Error log output: %s", buf.String())
+		}
+	})
+
+	t.Run("Checking console format", func(t *testing.T) {
+		var buf bytes.Buffer
+		l, err := New(&buf, "", FormatConsole)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.InfoLog("started")
+		if !strings.Contains(buf.String(), "INF started") {
+			t.Errorf("Error console output: %s", buf.String())
+		}
+	})
+
+	t.Run("Checking errors", func(t *testing.T) {
+		if _, err := New(&bytes.Buffer{}, "verbose", FormatJSON); err == nil {
+			t.Error("Error unknown level accepted")
+		}
+		if _, err := New(&bytes.Buffer{}, "info", "xml"); err == nil {
+			t.Error("Error unknown format accepted")
+		}
+	})
+}
+
+func TestCtx(t *testing.T) {
+	var common, request Logger
+	if common.Ctx(context.Background()) != &common {
+		t.Error("Error common logger expected without context logger")
+	}
+	ctx := request.WithContext(context.Background())
+	if common.Ctx(ctx) != &request {
+		t.Error("Error context logger expected")
+	}
+}
@@ -0,0 +1,341 @@
+// Package migrations версионирует схему базы данных метрик.
+// Миграции - пары файлов sql/NNNN_имя.up.sql и sql/NNNN_имя.down.sql, встроенные в бинарный файл.
+// Примененные версии хранятся в таблице schema_version.
+package migrations
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//go:embed sql/*.sql
+var embedded embed.FS
+
+// ErrPending схема базы данных отстает от версии сервера.
+var ErrPending = errors.New("в базе данных не применены миграции")
+
+const (
+	queryLock = `SELECT pg_advisory_xact_lock(7243518901)`
+
+	queryVersionTable = `CREATE TABLE IF NOT EXISTS public.schema_version
+					(
+						version integer PRIMARY KEY,
+						name character varying NOT NULL,
+						applied_at timestamp with time zone NOT NULL DEFAULT now()
+					)`
+
+	queryVersionTableExists = `SELECT to_regclass('public.schema_version') IS NOT NULL`
+
+	querySelectVersions = `SELECT version, applied_at FROM public.schema_version`
+
+	queryInsertVersion = `INSERT INTO public.schema_version (version, name) VALUES ($1, $2)`
+
+	queryDeleteVersion = `DELETE FROM public.schema_version WHERE version = $1`
+)
+
+// Migration миграция схемы.
+// Version: номер миграции, миграции применяются по возрастанию номера
+// Name: имя миграции из имени файла
+// Up: SQL применения миграции
+// Down: SQL отката миграции
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status состояние миграции в базе данных.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Load возвращает встроенные миграции по возрастанию номера.
+func Load() ([]Migration, error) {
+	return parse(embedded, "sql")
+}
+
+// parse читает миграции из каталога dir.
+// Каждая миграция должна иметь файлы up и down, номера идут подряд с 1.
+func parse(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(fileName, ".sql") {
+			continue
+		}
+
+		base := strings.TrimSuffix(fileName, ".sql")
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("миграция %s: ожидается суффикс .up.sql или .down.sql", fileName)
+		}
+		base = strings.TrimSuffix(base, "."+direction)
+
+		number, name, ok := strings.Cut(base, "_")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("миграция %s: ожидается имя вида NNNN_имя", fileName)
+		}
+		version, err := strconv.Atoi(number)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("миграция %s: неверный номер %q", fileName, number)
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("миграция %d: разные имена %q и %q", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			return nil, fmt.Errorf("миграция %d_%s: нужны непустые файлы up и down", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("пропущена миграция %d", i+1)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Migrator применяет и откатывает миграции.
+// Каждая миграция выполняется в своей транзакции под блокировкой pg_advisory_xact_lock,
+// поэтому несколько серверов, запущенных одновременно, не применят миграцию дважды.
+type Migrator struct {
+	pool       *pgxpool.Pool
+	migrations []Migration
+}
+
+// New создает Migrator со встроенными миграциями.
+func New(pool *pgxpool.Pool) (*Migrator, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{pool: pool, migrations: migrations}, nil
+}
+
+// Latest номер последней известной миграции.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Status состояние всех миграций.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var exists bool
+	if err := m.pool.QueryRow(ctx, queryVersionTableExists).Scan(&exists); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]time.Time)
+	if exists {
+		var err error
+		if applied, err = appliedVersions(ctx, m.pool); err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses = append(statuses, Status{Migration: migration, Applied: ok, AppliedAt: appliedAt})
+	}
+	return statuses, nil
+}
+
+// Version номер последней примененной миграции, 0 - миграции не применялись.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for _, s := range statuses {
+		if s.Applied {
+			version = s.Version
+		}
+	}
+	return version, nil
+}
+
+// Up применяет все непримененные миграции с номером не больше target, 0 - все миграции.
+// Возвращает примененные миграции.
+func (m *Migrator) Up(ctx context.Context, target int) ([]Migration, error) {
+	if target <= 0 || target > m.Latest() {
+		target = m.Latest()
+	}
+
+	var done []Migration
+	for {
+		migration, err := m.step(ctx, func(applied map[int]time.Time) (Migration, bool) {
+			for _, migration := range m.migrations {
+				if migration.Version > target {
+					break
+				}
+				if _, ok := applied[migration.Version]; !ok {
+					return migration, true
+				}
+			}
+			return Migration{}, false
+		}, true)
+		if err != nil {
+			return done, err
+		}
+		if migration == nil {
+			return done, nil
+		}
+		done = append(done, *migration)
+	}
+}
+
+// Down откатывает steps последних примененных миграций.
+// Возвращает откаченные миграции.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	for i := 0; i < steps; i++ {
+		migration, err := m.step(ctx, func(applied map[int]time.Time) (Migration, bool) {
+			for j := len(m.migrations) - 1; j >= 0; j-- {
+				if _, ok := applied[m.migrations[j].Version]; ok {
+					return m.migrations[j], true
+				}
+			}
+			return Migration{}, false
+		}, false)
+		if err != nil {
+			return done, err
+		}
+		if migration == nil {
+			break
+		}
+		done = append(done, *migration)
+	}
+	return done, nil
+}
+
+// step выполняет одну миграцию, выбранную next, в отдельной транзакции.
+// Миграция выбирается уже под блокировкой, по версиям, которые видны в этой транзакции.
+func (m *Migrator) step(ctx context.Context, next func(map[int]time.Time) (Migration, bool), up bool) (*Migration, error) {
+	tx, err := m.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	if _, err = tx.Exec(ctx, queryLock); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(ctx, queryVersionTable); err != nil {
+		return nil, err
+	}
+	applied, err := appliedVersions(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	migration, ok := next(applied)
+	if !ok {
+		return nil, tx.Commit(ctx)
+	}
+
+	if up {
+		if _, err = tx.Exec(ctx, migration.Up); err != nil {
+			return nil, fmt.Errorf("миграция %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		_, err = tx.Exec(ctx, queryInsertVersion, migration.Version, migration.Name)
+	} else {
+		if _, err = tx.Exec(ctx, migration.Down); err != nil {
+			return nil, fmt.Errorf("откат миграции %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		_, err = tx.Exec(ctx, queryDeleteVersion, migration.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &migration, tx.Commit(ctx)
+}
+
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+func appliedVersions(ctx context.Context, q querier) (map[int]time.Time, error) {
+	rows, err := q.Query(ctx, querySelectVersions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// Check возвращает ErrPending, если применены не все миграции.
+func (m *Migrator) Check(ctx context.Context) error {
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version < m.Latest() {
+		return fmt.Errorf("%w: версия схемы %d, нужна %d", ErrPending, version, m.Latest())
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("Error no embedded migrations")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 || m.Name == "" || m.Up == "" || m.Down == "" {
+			t.Errorf("Error migration %d: %+v", i+1, m)
+		}
+		if strings.Contains(m.Up, "OWNER to") {
+			t.Errorf("Error migration %d must not set owner", m.Version)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(data)}
+	}
+
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			fsys: fstest.MapFS{
+				"sql/0002_b.up.sql":   file("SELECT 2"),
+				"sql/0002_b.down.sql": file("SELECT -2"),
+				"sql/0001_a.up.sql":   file("SELECT 1"),
+				"sql/0001_a.down.sql": file("SELECT -1"),
+			},
+		},
+		{
+			name:    "missing down",
+			fsys:    fstest.MapFS{"sql/0001_a.up.sql": file("SELECT 1")},
+			wantErr: true,
+		},
+		{
+			name: "gap",
+			fsys: fstest.MapFS{
+				"sql/0001_a.up.sql":   file("SELECT 1"),
+				"sql/0001_a.down.sql": file("SELECT -1"),
+				"sql/0003_c.up.sql":   file("SELECT 3"),
+				"sql/0003_c.down.sql": file("SELECT -3"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "different names",
+			fsys: fstest.MapFS{
+				"sql/0001_a.up.sql":   file("SELECT 1"),
+				"sql/0001_b.down.sql": file("SELECT -1"),
+			},
+			wantErr: true,
+		},
+		{
+			name:    "bad name",
+			fsys:    fstest.MapFS{"sql/first.up.sql": file("SELECT 1")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run("Checking "+tt.name, func(t *testing.T) {
+			migrations, err := parse(tt.fsys, "sql")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Error parse: %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (len(migrations) != 2 || migrations[0].Name != "a" || migrations[1].Up != "SELECT 2") {
+				t.Errorf("Error parse result: %+v", migrations)
+			}
+		})
+	}
+}
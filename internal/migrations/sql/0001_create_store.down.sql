@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS metrics.store;
+
+DROP SCHEMA IF EXISTS metrics;
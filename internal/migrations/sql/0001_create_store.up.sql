@@ -0,0 +1,10 @@
+CREATE SCHEMA IF NOT EXISTS metrics;
+
+CREATE TABLE IF NOT EXISTS metrics.store
+(
+    "ID" character varying COLLATE pg_catalog."default",
+    "MType" character varying COLLATE pg_catalog."default",
+    "Value" double precision NOT NULL DEFAULT 0,
+    "Delta" bigint NOT NULL DEFAULT 0,
+    "Hash" character varying COLLATE pg_catalog."default"
+);
@@ -0,0 +1,5 @@
+ALTER TABLE metrics.store DROP CONSTRAINT IF EXISTS store_pkey;
+
+ALTER TABLE metrics.store ALTER COLUMN "ID" DROP NOT NULL;
+
+ALTER TABLE metrics.store ALTER COLUMN "MType" DROP NOT NULL;
@@ -0,0 +1,16 @@
+LOCK TABLE metrics.store IN SHARE ROW EXCLUSIVE MODE;
+
+DELETE FROM metrics.store WHERE "ID" IS NULL OR "MType" IS NULL;
+
+DELETE FROM
+    metrics.store a
+USING
+    metrics.store b
+WHERE
+    a.ctid < b.ctid
+    AND a."ID" = b."ID"
+    AND a."MType" = b."MType";
+
+DROP INDEX IF EXISTS metrics.store_id_mtype_idx;
+
+ALTER TABLE metrics.store ADD CONSTRAINT store_pkey PRIMARY KEY ("ID", "MType");
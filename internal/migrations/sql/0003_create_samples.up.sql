@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS metrics.samples
+(
+    "ID" character varying NOT NULL,
+    "MType" character varying NOT NULL,
+    "Value" double precision,
+    "Delta" bigint,
+    "Received" timestamp with time zone NOT NULL
+) PARTITION BY RANGE ("Received");
+
+CREATE INDEX IF NOT EXISTS samples_id_mtype_received_idx
+    ON metrics.samples ("ID", "MType", "Received");
@@ -0,0 +1 @@
+ALTER TABLE metrics.store DROP COLUMN IF EXISTS "Updated";
@@ -0,0 +1 @@
+ALTER TABLE metrics.store ADD COLUMN IF NOT EXISTS "Updated" timestamp with time zone;
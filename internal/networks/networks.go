@@ -0,0 +1,64 @@
+// Package networks работает с сетевыми адресами агента и сервера.
+package networks
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// GetOutboundIP возвращает IP-адрес, с которого агент ходит на сервер.
+// Соединение по UDP не отправляет пакетов, а только выбирает исходящий интерфейс.
+func GetOutboundIP(address string) (net.IP, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, errors.New("не удалось определить исходящий адрес")
+	}
+
+	return localAddr.IP, nil
+}
+
+// ParseSubnet разбирает доверенную подсеть в формате CIDR.
+// Для пустой строки возвращает nil, т.е. проверка подсети отключена.
+func ParseSubnet(cidr string) (*net.IPNet, error) {
+	if cidr == "" {
+		return nil, nil
+	}
+	_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return nil, err
+	}
+
+	return ipNet, nil
+}
+
+// RemoteIP возвращает IP-адрес сокета, с которого пришел запрос.
+func RemoteIP(rq *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(rq.RemoteAddr)
+	if err != nil {
+		host = rq.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// AddressAllowed проверяет, что IP-адрес из заголовка агента и адрес сокета входят в подсеть.
+func AddressAllowed(subnet *net.IPNet, headerIP string, remoteIP net.IP) bool {
+	if subnet == nil {
+		return true
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(headerIP))
+	if ip == nil || !subnet.Contains(ip) {
+		return false
+	}
+
+	return remoteIP != nil && subnet.Contains(remoteIP)
+}
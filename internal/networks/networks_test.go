@@ -0,0 +1,45 @@
+package networks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAddressAllowed(t *testing.T) {
+	subnet, err := ParseSubnet("192.168.1.0/24")
+	if err != nil {
+		t.Fatalf("Error parse subnet: %s", err.Error())
+	}
+
+	tests := []struct {
+		name     string
+		subnet   *net.IPNet
+		headerIP string
+		remoteIP net.IP
+		want     bool
+	}{
+		{name: "Проверка без доверенной подсети", subnet: nil, headerIP: "", remoteIP: nil, want: true},
+		{name: "Проверка агента из подсети", subnet: subnet, headerIP: "192.168.1.10",
+			remoteIP: net.ParseIP("192.168.1.10"), want: true},
+		{name: "Проверка пустого заголовка", subnet: subnet, headerIP: "",
+			remoteIP: net.ParseIP("192.168.1.10"), want: false},
+		{name: "Проверка заголовка не из подсети", subnet: subnet, headerIP: "10.0.0.1",
+			remoteIP: net.ParseIP("192.168.1.10"), want: false},
+		{name: "Проверка сокета не из подсети", subnet: subnet, headerIP: "192.168.1.10",
+			remoteIP: net.ParseIP("10.0.0.1"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AddressAllowed(tt.subnet, tt.headerIP, tt.remoteIP); got != tt.want {
+				t.Errorf("AddressAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Проверка неверного CIDR", func(t *testing.T) {
+		if _, err := ParseSubnet("192.168.1.0/33"); err == nil {
+			t.Errorf("Error parse subnet")
+		}
+	})
+}
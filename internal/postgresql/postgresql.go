@@ -5,61 +5,71 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 
 	"github.com/andynikk/advancedmetrics/internal/constants"
 	"github.com/andynikk/advancedmetrics/internal/encoding"
 )
 
-type Context struct {
-	Ctx        context.Context
-	CancelFunc context.CancelFunc
-}
-
 // DBConnector структура хранения конекта с базой данной
 type DBConnector struct {
-	Pool    *pgxpool.Pool
-	Context Context
+	Pool *pgxpool.Pool
 }
 
-type transitMetrics struct {
-	MType string
-	ID    string
-	Value *float64
-	Delta *int64
-	Hash  string
+// PoolConfig настройки пула соединений. Нулевые значения - настройки pgx по умолчанию.
+// MaxConns: максимальное количество соединений
+// ConnectTimeout: время ожидания установки одного соединения
+type PoolConfig struct {
+	MaxConns       int32
+	ConnectTimeout time.Duration
 }
 
-type arrTransitMetrics struct {
-	Arr []transitMetrics
+func (pc PoolConfig) parse(dsn string) (*pgxpool.Config, error) {
+	config, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if pc.MaxConns > 0 {
+		config.MaxConns = pc.MaxConns
+	}
+	if pc.ConnectTimeout > 0 {
+		config.ConnConfig.ConnectTimeout = pc.ConnectTimeout
+	}
+	return config, nil
 }
 
 // PoolDB создает коннект с базой данных.
-// Хранит коннект (pgxpool.Connect) в настройках.
-// Из конекта создает Pool, при необходимости.
-func PoolDB(dsn string) (*DBConnector, error) {
+// Если базы метрик нет, создает ее и возвращает Pool соединений с ней.
+func PoolDB(ctx context.Context, dsn string, pc PoolConfig) (*DBConnector, error) {
 	if dsn == "" {
-		return new(DBConnector), errors.New("пустой путь к базе")
+		return nil, errors.New("пустой путь к базе")
 	}
 
-	ctx, cancelFunc := context.WithCancel(context.Background())
-	defer cancelFunc()
-
-	pool, err := pgxpool.Connect(ctx, dsn)
+	config, err := pc.parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	config.MaxConns = 1
+	pool, err := pgxpool.ConnectConfig(ctx, config)
 	if err != nil {
-		fmt.Print(err.Error())
+		return nil, err
 	}
+	defer pool.Close()
 
 	strQuery := fmt.Sprintf(constants.QueryCheckExistDB, constants.NameDB)
 	rows, err := pool.Query(ctx, strQuery)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	exist := rows.Next()
+	rows.Close()
 
-	if !rows.Next() {
+	if !exist {
 		strQuery = fmt.Sprintf(constants.QueryDB, constants.NameDB)
 		if _, err = pool.Exec(ctx, strQuery); err != nil {
 			return nil, err
@@ -67,141 +77,91 @@ func PoolDB(dsn string) (*DBConnector, error) {
 	}
 
 	dsn = strings.Replace(dsn, "/"+constants.NameDB, "", -1)
-	pool, err = pgxpool.Connect(ctx, dsn+"/"+constants.NameDB)
+	config, err = pc.parse(dsn + "/" + constants.NameDB)
 	if err != nil {
 		return nil, err
 	}
-
-	dbc := DBConnector{
-		Pool: pool,
-		Context: Context{
-			Ctx:        ctx,
-			CancelFunc: cancelFunc,
-		},
+	poolDB, err := pgxpool.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, err
 	}
-	return &dbc, nil
-}
-
-// SetMetric2DB Добавляет метрики в БД.
-// Из массива (тип encoding.ArrMetrics) создает запрос к БД по имени и типу метрики.
-// По найденным метрикам создает набор SQL-запросов update
-// По не найденным метрикам создает набор SQL-запросов insert
-// Далает вызов БД один раз, сразу по всем update &  insert
-func (DataBase *DBConnector) SetMetric2DB(storedData encoding.ArrMetrics) error {
 
-	ctx := context.Background()
-	conn, err := DataBase.Pool.Acquire(ctx)
+	return &DBConnector{Pool: poolDB}, nil
+}
 
-	if err != nil {
-		return err
-	}
-	defer conn.Release()
+// Batch пакет запросов, который отправляется в базу за одно обращение. Реализуется *pgx.Batch.
+type Batch interface {
+	Queue(query string, arguments ...interface{})
+	Len() int
+}
 
-	tx, err := conn.Begin(ctx)
-	if err != nil {
-		constants.Logger.ErrorLog(err)
+// QueueUpsert добавляет в пакет параметризованные запросы записи метрик.
+// Из повторов метрики в пакете остается последний.
+// Запросы упорядочены по типу и имени, чтобы параллельные транзакции блокировали строки в одном порядке.
+func QueueUpsert(batch Batch, storedData encoding.ArrMetrics) {
+	type metricKey struct {
+		MType string
+		ID    string
 	}
 
-	allWhereVal := ""
-
-	var allTM []transitMetrics
+	last := make(map[metricKey]encoding.Metrics, len(storedData))
+	keys := make([]metricKey, 0, len(storedData))
 	for _, data := range storedData {
-		if allWhereVal != "" {
-			allWhereVal = allWhereVal + " or "
+		key := metricKey{MType: data.MType, ID: data.ID}
+		if _, ok := last[key]; !ok {
+			keys = append(keys, key)
 		}
-		allWhereVal = allWhereVal + fmt.Sprintf(
-			`("MType" = '%s' and "ID" = '%s')`,
-			data.MType, data.ID)
-
-		allTM = append(allTM, transitMetrics{
-			MType: data.MType,
-			ID:    data.ID,
-			Value: data.Value,
-			Delta: data.Delta,
-			Hash:  data.Hash,
-		})
-	}
-	allArrTM := new(arrTransitMetrics)
-	allArrTM.Arr = allTM
-
-	if allWhereVal == "" {
-		return nil
-	}
-	allWhereVal = "(" + allWhereVal + ")"
-	txtQuery := fmt.Sprintf(`SELECT * FROM metrics.store WHERE %s;`, allWhereVal)
-
-	var updTM []transitMetrics
-	rows, err := conn.Query(ctx, txtQuery)
-	if err != nil {
-		constants.Logger.ErrorLog(err)
-		return err
+		last[key] = data
 	}
-	for rows.Next() {
-		var d encoding.Metrics
-
-		err = rows.Scan(&d.ID, &d.MType, &d.Value, &d.Delta, &d.Hash)
-		if err != nil {
-			constants.Logger.ErrorLog(err)
-			continue
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].MType != keys[j].MType {
+			return keys[i].MType < keys[j].MType
 		}
+		return keys[i].ID < keys[j].ID
+	})
 
-		updTM = append(updTM, transitMetrics{MType: d.MType, ID: d.ID})
-	}
-	updArrTM := new(arrTransitMetrics)
-	updArrTM.Arr = updTM
-
-	txtQueryUpdata := ""
-	txtQueryInsert := ""
-
-	for _, val := range allArrTM.Arr {
-		sValue := fmt.Sprintf("%d", 0)
-		if val.Value != nil {
-			sValue = fmt.Sprintf("%f", *val.Value)
-		}
-		sDelta := fmt.Sprintf("%d", 0)
-		if val.Delta != nil {
-			sDelta = fmt.Sprintf("%d", *val.Delta)
-		}
+	for _, key := range keys {
+		data := last[key]
 
-		if ok := updArrTM.find(val.MType, val.ID); ok {
-			if txtQueryUpdata != "" {
-				txtQueryUpdata = txtQueryUpdata + "\n"
-			}
-			txtQueryUpdata = txtQueryUpdata + fmt.Sprintf(
-				`UPDATE metrics.store SET "Value"=%s, "Delta"=%s, "Hash"='%s' WHERE	"ID" = '%s'	and "MType" = '%s';`,
-				sValue, sDelta, val.Hash, val.ID, val.MType)
-			continue
+		var value float64
+		if data.Value != nil {
+			value = *data.Value
 		}
-
-		if txtQueryInsert != "" {
-			txtQueryInsert = txtQueryInsert + "\n"
+		var delta int64
+		if data.Delta != nil {
+			delta = *data.Delta
 		}
-		txtQueryInsert = txtQueryInsert + fmt.Sprintf(
-			`INSERT INTO metrics.store ("ID", "MType", "Value", "Delta", "Hash") VALUES ('%s', '%s', %v, %s, '%s');`,
-			val.ID, val.MType, sValue, sDelta, val.Hash)
+		batch.Queue(constants.QueryUpsert, data.ID, data.MType, value, delta, data.Hash, data.Timestamp)
 	}
+}
 
-	txtExec := txtQueryInsert + "\n" + txtQueryUpdata
-	if _, err := conn.Exec(ctx, txtExec); err != nil {
-		conn.Release()
-		return errors.New("ошибка изменения данных в БД")
+// SetMetric2DB Добавляет метрики в БД.
+// Все метрики записываются одним пакетом запросов INSERT ... ON CONFLICT в одной транзакции.
+func (DataBase *DBConnector) SetMetric2DB(ctx context.Context, storedData encoding.ArrMetrics) error {
+	batch := &pgx.Batch{}
+	QueueUpsert(batch, storedData)
+	if batch.Len() == 0 {
+		return nil
 	}
 
-	if err := tx.Commit(ctx); err != nil {
-		constants.Logger.ErrorLog(err)
+	tx, err := DataBase.Pool.Begin(ctx)
+	if err != nil {
+		return err
 	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
 
-	conn.Release()
-	ctx.Done()
-
-	return nil
-}
-
-func (atm arrTransitMetrics) find(mtype string, id string) bool {
-	for _, val := range atm.Arr {
-		if val.MType == mtype && val.ID == id {
-			return true
+	results := tx.SendBatch(ctx, batch)
+	for i := 0; i < batch.Len(); i++ {
+		if _, err = results.Exec(); err != nil {
+			results.Close()
+			return err
 		}
 	}
-	return false
+	if err = results.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
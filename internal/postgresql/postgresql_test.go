@@ -0,0 +1,217 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/migrations"
+)
+
+type fakeQuery struct {
+	query string
+	args  []interface{}
+}
+
+// fakeBatch пакет запросов вместо *pgx.Batch, сохраняет запросы для проверки.
+type fakeBatch struct {
+	queries []fakeQuery
+}
+
+func (b *fakeBatch) Queue(query string, arguments ...interface{}) {
+	b.queries = append(b.queries, fakeQuery{query: query, args: arguments})
+}
+
+func (b *fakeBatch) Len() int {
+	return len(b.queries)
+}
+
+func TestQueueUpsert(t *testing.T) {
+	injection := `x'); DROP TABLE metrics.store; --`
+	gauge, newGauge, delta := 0.5, 1.5, int64(3)
+	metrics := encoding.ArrMetrics{
+		{ID: injection, MType: "gauge", Value: &gauge},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "Alloc", MType: "gauge", Value: &gauge},
+		{ID: "Alloc", MType: "gauge", Value: &newGauge},
+	}
+
+	batch := &fakeBatch{}
+	QueueUpsert(batch, metrics)
+
+	t.Run("Checking parameterized queries", func(t *testing.T) {
+		for _, q := range batch.queries {
+			if q.query != constants.QueryUpsert || strings.Contains(q.query, "DROP") {
+				t.Errorf("Error query must be constant: %s", q.query)
+			}
+			if len(q.args) != 6 {
+				t.Errorf("Error query must have 6 arguments: %v", q.args)
+			}
+		}
+	})
+	t.Run("Checking duplicates and order", func(t *testing.T) {
+		if batch.Len() != 3 {
+			t.Fatalf("Error duplicates must be collapsed, got %d queries", batch.Len())
+		}
+		want := []string{"PollCount", "Alloc", injection}
+		for i, q := range batch.queries {
+			if q.args[0] != want[i] {
+				t.Errorf("Error query %d: got %v, want %s", i, q.args[0], want[i])
+			}
+		}
+		if batch.queries[1].args[2] != newGauge {
+			t.Errorf("Error last value must win: %v", batch.queries[1].args)
+		}
+		if batch.queries[0].args[2] != float64(0) || batch.queries[0].args[3] != delta {
+			t.Errorf("Error absent value must be 0: %v", batch.queries[0].args)
+		}
+	})
+	t.Run("Checking pgx batch", func(t *testing.T) {
+		b := &pgx.Batch{}
+		QueueUpsert(b, metrics)
+		if b.Len() != 3 {
+			t.Errorf("Error pgx batch must contain 3 queries, got %d", b.Len())
+		}
+	})
+}
+
+// TestSetMetric2DB проверяет запись в настоящую базу из DATABASE_DSN, без нее тест пропускается.
+func TestSetMetric2DB(t *testing.T) {
+	dsn := os.Getenv("DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("не задана DATABASE_DSN")
+	}
+
+	ctx := context.Background()
+	dbc, err := PoolDB(ctx, dsn, PoolConfig{})
+	if err != nil {
+		t.Fatalf("Error connect DB: %s", err.Error())
+	}
+	defer dbc.Pool.Close()
+
+	migrator, err := migrations.New(dbc.Pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(ctx, 0); err != nil {
+		t.Fatalf("Error migrate DB: %s", err.Error())
+	}
+
+	// Имена метрик уникальны для запуска, чтобы не задеть метрики в базе.
+	prefix := fmt.Sprintf("TestSetMetric2DB%d", time.Now().UnixNano())
+	counterID, gaugeID := prefix+"PollCount", prefix+"Alloc"
+	defer func() {
+		if _, err := dbc.Pool.Exec(ctx, `DELETE FROM metrics.store WHERE "ID" LIKE $1`, prefix+"%"); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	upsert := func(metrics ...encoding.Metrics) {
+		t.Helper()
+		at := time.Now()
+		for i := range metrics {
+			metrics[i].Timestamp = &at
+		}
+		if err := dbc.SetMetric2DB(ctx, metrics); err != nil {
+			t.Fatalf("Error upsert: %s", err.Error())
+		}
+	}
+	counter := func(delta int64) encoding.Metrics {
+		return encoding.Metrics{ID: counterID, MType: "counter", Delta: &delta}
+	}
+	gauge := func(value float64) encoding.Metrics {
+		return encoding.Metrics{ID: gaugeID, MType: "gauge", Value: &value}
+	}
+
+	t.Run("Checking repeated upserts", func(t *testing.T) {
+		// Сервер записывает накопленную сумму counter: 5, затем 5+7, затем дважды 5+7+3 в одном пакете.
+		upsert(counter(5), gauge(1.5))
+		upsert(counter(12), gauge(0.25))
+		upsert(counter(15), counter(15), gauge(-3))
+
+		var delta int64
+		var value float64
+		err := dbc.Pool.QueryRow(ctx, `SELECT "Delta" FROM metrics.store WHERE "ID" = $1 AND "MType" = $2`,
+			counterID, "counter").Scan(&delta)
+		if err != nil || delta != 15 {
+			t.Errorf("Error counter total: %d, %v", delta, err)
+		}
+		err = dbc.Pool.QueryRow(ctx, `SELECT "Value" FROM metrics.store WHERE "ID" = $1 AND "MType" = $2`,
+			gaugeID, "gauge").Scan(&value)
+		if err != nil || value != -3 {
+			t.Errorf("Error gauge must be replaced: %v, %v", value, err)
+		}
+	})
+
+	t.Run("Checking concurrent upserts", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 1; i <= 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				delta, value := int64(15+i), float64(i)
+				metrics := encoding.ArrMetrics{
+					{ID: counterID, MType: "counter", Delta: &delta},
+					{ID: gaugeID, MType: "gauge", Value: &value},
+				}
+				if err := dbc.SetMetric2DB(ctx, metrics); err != nil {
+					t.Errorf("Error concurrent upsert: %s", err.Error())
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		rows, err := dbc.Pool.Query(ctx, `SELECT "MType", count(*) FROM metrics.store WHERE "ID" LIKE $1 GROUP BY "MType"`,
+			prefix+"%")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		found := 0
+		for rows.Next() {
+			var mType string
+			var n int
+			if err = rows.Scan(&mType, &n); err != nil {
+				t.Fatal(err)
+			}
+			found++
+			if n != 1 {
+				t.Errorf("Error metric %s stored in %d rows", mType, n)
+			}
+		}
+		if found != 2 {
+			t.Errorf("Error stored metric types: %d", found)
+		}
+	})
+
+	t.Run("Checking unique key", func(t *testing.T) {
+		_, err := dbc.Pool.Exec(ctx, `INSERT INTO metrics.store ("ID", "MType", "Value", "Delta", "Hash") VALUES ($1, $2, 0, 1, '')`,
+			counterID, "counter")
+		if err == nil || !strings.Contains(err.Error(), "23505") {
+			t.Errorf("Error duplicate (ID, MType) must violate unique key: %v", err)
+		}
+	})
+}
+
+func TestSamplePartition(t *testing.T) {
+	at := time.Date(2022, 9, 1, 23, 30, 0, 0, time.FixedZone("MSK", 3*60*60))
+	name := SamplePartition(at)
+	if name != "samples_20220901" {
+		t.Errorf("Error partition name must use UTC day: %s", name)
+	}
+	day, ok := samplePartitionDay(name)
+	if !ok || !day.Equal(time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Error partition day: %v %v", day, ok)
+	}
+	if _, ok = samplePartitionDay("store"); ok {
+		t.Errorf("Error foreign table must be ignored")
+	}
+}
@@ -0,0 +1,126 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+)
+
+// Секции таблицы metrics.samples создаются по суткам UTC и называются samples_ГГГГММДД.
+const (
+	samplePartitionPrefix = "samples_"
+	samplePartitionLayout = "20060102"
+)
+
+// SamplePartition имя секции истории, в которую попадает момент t.
+func SamplePartition(t time.Time) string {
+	return samplePartitionPrefix + t.UTC().Format(samplePartitionLayout)
+}
+
+// samplePartitionDay начало суток секции по ее имени.
+func samplePartitionDay(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, samplePartitionPrefix) {
+		return time.Time{}, false
+	}
+	day, err := time.Parse(samplePartitionLayout, strings.TrimPrefix(name, samplePartitionPrefix))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return day, true
+}
+
+// EnsureSamplePartitions создает секции истории на все сутки от from до to включительно.
+func (DataBase *DBConnector) EnsureSamplePartitions(ctx context.Context, from time.Time, to time.Time) error {
+	day := from.UTC().Truncate(24 * time.Hour)
+	for !day.After(to.UTC()) {
+		next := day.Add(24 * time.Hour)
+		query := fmt.Sprintf(constants.QueryCreateSamplePartition,
+			SamplePartition(day), day.Format(time.RFC3339), next.Format(time.RFC3339))
+		if _, err := DataBase.Pool.Exec(ctx, query); err != nil {
+			return err
+		}
+		day = next
+	}
+	return nil
+}
+
+// DropSamplePartitions удаляет секции истории, все значения которых старше before.
+// Возвращает имена удаленных секций.
+func (DataBase *DBConnector) DropSamplePartitions(ctx context.Context, before time.Time) ([]string, error) {
+	rows, err := DataBase.Pool.Query(ctx, constants.QuerySamplePartitions)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var dropped []string
+	for _, name := range names {
+		day, ok := samplePartitionDay(name)
+		if !ok || day.Add(24*time.Hour).After(before) {
+			continue
+		}
+		if _, err = DataBase.Pool.Exec(ctx, fmt.Sprintf(constants.QueryDropSamplePartition, name)); err != nil {
+			return dropped, err
+		}
+		dropped = append(dropped, name)
+	}
+	return dropped, nil
+}
+
+// AppendSamples добавляет в историю значения метрик на момент at одним пакетом запросов.
+func (DataBase *DBConnector) AppendSamples(ctx context.Context, metrics encoding.ArrMetrics, at time.Time) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+	for _, m := range metrics {
+		batch.Queue(constants.QueryInsertSample, m.ID, m.MType, m.Value, m.Delta, at)
+	}
+
+	results := DataBase.Pool.SendBatch(ctx, batch)
+	for i := 0; i < batch.Len(); i++ {
+		if _, err := results.Exec(); err != nil {
+			results.Close()
+			return err
+		}
+	}
+	return results.Close()
+}
+
+// Samples значения метрики из истории за период [from, to) по возрастанию времени.
+func (DataBase *DBConnector) Samples(ctx context.Context, id string, mType string, from time.Time, to time.Time) ([]encoding.Sample, error) {
+	rows, err := DataBase.Pool.Query(ctx, constants.QuerySelectSamples, id, mType, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := make([]encoding.Sample, 0)
+	for rows.Next() {
+		var s encoding.Sample
+		if err = rows.Scan(&s.Time, &s.Value, &s.Delta); err != nil {
+			return nil, err
+		}
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
@@ -0,0 +1,322 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/encryption"
+)
+
+// MetricKey ключ метрики в физическом хранилище.
+type MetricKey struct {
+	ID    string
+	MType string
+}
+
+// Backend физическое хранилище метрик (БД, файл и т.п.).
+// Все методы получают контекст и возвращают ошибку, решение о том, что с ней делать, принимает сервер.
+type Backend interface {
+	// Name имя хранилища, под которым оно зарегистрировано.
+	Name() string
+	// Init подключается к хранилищу и создает нужные структуры (таблицы, файлы).
+	Init(ctx context.Context) error
+	// Upsert добавляет метрики или заменяет уже сохраненные с тем же ID и типом.
+	Upsert(ctx context.Context, metrics encoding.ArrMetrics) error
+	// LoadAll возвращает все сохраненные метрики.
+	LoadAll(ctx context.Context) (encoding.ArrMetrics, error)
+	// Delete удаляет метрики по ключам.
+	Delete(ctx context.Context, keys ...MetricKey) error
+	// Health проверяет доступность хранилища.
+	Health(ctx context.Context) error
+	// Close освобождает ресурсы хранилища.
+	Close() error
+}
+
+// BackendConfig настройки, из которых создаются хранилища.
+type BackendConfig struct {
+	DatabaseDsn          string
+	Migrate              bool
+	SamplesRetention     time.Duration
+	DBMaxConns           int32
+	DBConnectTimeout     time.Duration
+	DBQueryTimeout       time.Duration
+	DBRetryTimeout       time.Duration
+	DBBufferSize         int
+	StoreFile            string
+	BoltFile             string
+	BoltCompactInterval  time.Duration
+	FileSync             string
+	FileSyncInterval     time.Duration
+	FileSnapshotInterval time.Duration
+	FileWALMaxSize       int64
+	SnapshotCompress     bool
+	SnapshotEncryption   string
+	SnapshotKey          string
+	SnapshotPK           *encryption.KeyEncryption
+	WriteObserver        WriteObserver
+}
+
+// ErrUnknownBackend хранилище с таким именем не зарегистрировано.
+var ErrUnknownBackend = errors.New("неизвестное хранилище")
+
+// BackendFactory создает хранилище по настройкам.
+type BackendFactory func(cfg BackendConfig) (Backend, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]BackendFactory)
+)
+
+// RegisterBackend регистрирует хранилище под именем name.
+// Имя указывается в параметре STORAGE.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if factory == nil {
+		panic("repository: RegisterBackend factory is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic("repository: RegisterBackend called twice for backend " + name)
+	}
+	backends[name] = factory
+}
+
+// BackendNames имена зарегистрированных хранилищ.
+func BackendNames() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// NewBackend создает хранилище по имени, не подключаясь к нему.
+func NewBackend(name string, cfg BackendConfig) (Backend, error) {
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q, доступны: %s", ErrUnknownBackend, name, strings.Join(BackendNames(), ", "))
+	}
+	return factory(cfg)
+}
+
+// WriteObserver получает длительность и результат записи метрик в хранилище backend.
+type WriteObserver func(backend string, elapsed time.Duration, err error)
+
+// Backends набор подключенных хранилищ в порядке, указанном в настройках.
+// observer получает результат каждой записи Upsert, nil - запись не наблюдается.
+type Backends struct {
+	list     []Backend
+	observer WriteObserver
+}
+
+// NewBackends набор из уже подключенных хранилищ backends с наблюдателем записи observer, может быть nil.
+func NewBackends(observer WriteObserver, backends ...Backend) Backends {
+	return Backends{list: backends, observer: observer}
+}
+
+// InitBackends создает и подключает хранилища names.
+// Неизвестное имя хранилища или хранилище, которое не удалось подключить, - ошибка настройки,
+// и тогда не подключается ни одно хранилище: уже подключенные закрываются.
+// Недоступность базы данных ошибкой не считается, хранилище db подключается к ней в фоне.
+// Результат каждой записи получает cfg.WriteObserver.
+func InitBackends(ctx context.Context, names []string, cfg BackendConfig) (Backends, error) {
+	created := make([]Backend, 0, len(names))
+	for _, name := range names {
+		backend, err := NewBackend(name, cfg)
+		if err != nil {
+			return Backends{}, err
+		}
+		created = append(created, backend)
+	}
+
+	var errs []string
+	initialized := make([]Backend, 0, len(created))
+	for _, backend := range created {
+		if err := backend.Init(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", backend.Name(), err.Error()))
+			continue
+		}
+		initialized = append(initialized, backend)
+	}
+	if len(errs) != 0 {
+		if err := NewBackends(nil, initialized...).Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+		return Backends{}, joinErrors(errs)
+	}
+
+	return NewBackends(cfg.WriteObserver, initialized...), nil
+}
+
+// List хранилища набора в порядке, указанном в настройках.
+func (b Backends) List() []Backend {
+	return b.list
+}
+
+// Get возвращает хранилище по имени.
+func (b Backends) Get(name string) (Backend, bool) {
+	for _, backend := range b.list {
+		if backend.Name() == name {
+			return backend, true
+		}
+	}
+	return nil, false
+}
+
+// Upsert записывает метрики во все хранилища.
+// Ошибка одного хранилища не мешает записи в остальные.
+func (b Backends) Upsert(ctx context.Context, metrics encoding.ArrMetrics) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	var errs []string
+	for _, backend := range b.list {
+		start := time.Now()
+		err := backend.Upsert(ctx, metrics)
+		if b.observer != nil {
+			b.observer(backend.Name(), time.Since(start), err)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", backend.Name(), err.Error()))
+		}
+	}
+	return joinErrors(errs)
+}
+
+// Delete удаляет метрики по ключам из всех хранилищ.
+func (b Backends) Delete(ctx context.Context, keys ...MetricKey) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var errs []string
+	for _, backend := range b.list {
+		if err := backend.Delete(ctx, keys...); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", backend.Name(), err.Error()))
+		}
+	}
+	return joinErrors(errs)
+}
+
+// Close закрывает все хранилища.
+func (b Backends) Close() error {
+	var errs []string
+	for _, backend := range b.list {
+		if err := backend.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", backend.Name(), err.Error()))
+		}
+	}
+	return joinErrors(errs)
+}
+
+// BufferedBackend хранилище, которое при недоступности копит метрики в буфере.
+type BufferedBackend interface {
+	// Buffered количество значений, ожидающих записи.
+	Buffered() int
+	// DownSince время, с которого хранилище недоступно, нулевое время - хранилище доступно.
+	DownSince() time.Time
+}
+
+// BackendStatus состояние хранилища.
+// Status: up - хранилище доступно, down - недоступно
+// Error: причина недоступности
+// Buffered: количество значений, ожидающих записи
+// Since: время, с которого хранилище недоступно
+type BackendStatus struct {
+	Name     string     `json:"name"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Buffered int        `json:"buffered,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+// Status проверяет доступность всех хранилищ.
+// Возвращает состояния хранилищ и признак доступности всех хранилищ.
+func (b Backends) Status(ctx context.Context) ([]BackendStatus, bool) {
+	healthy := true
+	statuses := make([]BackendStatus, 0, len(b.list))
+	for _, backend := range b.list {
+		status := BackendStatus{Name: backend.Name(), Status: constants.StatusUp}
+		if err := backend.Health(ctx); err != nil {
+			healthy = false
+			status.Status = constants.StatusDown
+			status.Error = err.Error()
+		}
+		if buffered, ok := backend.(BufferedBackend); ok {
+			status.Buffered = buffered.Buffered()
+			if since := buffered.DownSince(); !since.IsZero() {
+				status.Since = &since
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, healthy
+}
+
+func joinErrors(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// metricKey ключ метрики для слияния наборов метрик.
+func metricKey(m encoding.Metrics) MetricKey {
+	return MetricKey{ID: m.ID, MType: m.MType}
+}
+
+// mergeMetrics заменяет в stored метрики из metrics и добавляет новые, сохраняя порядок.
+func mergeMetrics(stored encoding.ArrMetrics, metrics encoding.ArrMetrics) encoding.ArrMetrics {
+	idx := make(map[MetricKey]int, len(stored))
+	for i, m := range stored {
+		idx[metricKey(m)] = i
+	}
+	for _, m := range metrics {
+		if i, ok := idx[metricKey(m)]; ok {
+			stored[i] = m
+			continue
+		}
+		idx[metricKey(m)] = len(stored)
+		stored = append(stored, m)
+	}
+	return stored
+}
+
+// DefaultStorage хранилища по умолчанию, если параметр STORAGE не задан:
+// БД, если указана строка соединения, иначе файл.
+func DefaultStorage(databaseDsn string, storeFile string) []string {
+	if databaseDsn != "" {
+		return []string{constants.MetricsStorageDB.String()}
+	}
+	if storeFile != "" {
+		return []string{constants.MetricsStorageFile.String()}
+	}
+	return nil
+}
+
+// ParseStorage разбирает список хранилищ, разделенных запятой.
+func ParseStorage(storage string) []string {
+	var names []string
+	for _, name := range strings.Split(storage, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,111 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+)
+
+func TestFileBackend(t *testing.T) {
+	ctx := context.Background()
+	cfg := repository.BackendConfig{StoreFile: filepath.Join(t.TempDir(), "metrics.json")}
+
+	storage, err := repository.InitBackends(ctx, []string{"file"}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	backend, ok := storage.Get("file")
+	if !ok {
+		t.Fatal("Error file backend is not registered")
+	}
+
+	gauge, delta := 0.5, int64(3)
+	batch1 := encoding.ArrMetrics{
+		{ID: "Alloc", MType: "gauge", Value: &gauge},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+	}
+	newGauge := 1.5
+	batch2 := encoding.ArrMetrics{{ID: "Alloc", MType: "gauge", Value: &newGauge}}
+
+	t.Run("Checking upsert", func(t *testing.T) {
+		if err = storage.Upsert(ctx, batch1); err != nil {
+			t.Fatal(err)
+		}
+		if err = storage.Upsert(ctx, batch2); err != nil {
+			t.Fatal(err)
+		}
+		metrics, err := backend.LoadAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != 2 {
+			t.Fatalf("Error upsert must keep both metrics, got %d", len(metrics))
+		}
+		for _, m := range metrics {
+			if m.ID == "Alloc" && *m.Value != newGauge {
+				t.Errorf("Error upsert must replace Alloc: %+v", m)
+			}
+		}
+	})
+	t.Run("Checking delete", func(t *testing.T) {
+		if err = backend.Delete(ctx, repository.MetricKey{ID: "Alloc", MType: "gauge"}); err != nil {
+			t.Fatal(err)
+		}
+		metrics, err := backend.LoadAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != 1 || metrics[0].ID != "PollCount" {
+			t.Errorf("Error delete: %+v", metrics)
+		}
+	})
+	t.Run("Checking health", func(t *testing.T) {
+		if err = backend.Health(ctx); err != nil {
+			t.Errorf("Error health: %s", err.Error())
+		}
+	})
+}
+
+func TestInitBackends(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Checking unknown backend", func(t *testing.T) {
+		storage, err := repository.InitBackends(ctx, []string{"file", "unknown"},
+			repository.BackendConfig{StoreFile: filepath.Join(t.TempDir(), "metrics.json")})
+		if !errors.Is(err, repository.ErrUnknownBackend) || len(storage.List()) != 0 {
+			t.Errorf("Error unknown backend must fail configuration")
+		}
+	})
+	t.Run("Checking failed backend", func(t *testing.T) {
+		dir := t.TempDir()
+		storage, err := repository.InitBackends(ctx, []string{"bolt", "file"},
+			repository.BackendConfig{
+				BoltFile:  filepath.Join(dir, "metrics.db"),
+				StoreFile: filepath.Join(dir, "missing", "metrics.json"),
+			})
+		if err == nil || errors.Is(err, repository.ErrUnknownBackend) || len(storage.List()) != 0 {
+			t.Errorf("Error failed backend must fail configuration")
+		}
+		// Подключенное хранилище bolt закрыто и не держит файл базы.
+		storage, err = repository.InitBackends(ctx, []string{"bolt"},
+			repository.BackendConfig{BoltFile: filepath.Join(dir, "metrics.db")})
+		if err != nil {
+			t.Fatalf("Error reopen bolt after failed configuration: %s", err.Error())
+		}
+		storage.Close()
+	})
+	t.Run("Checking default storage", func(t *testing.T) {
+		if names := repository.DefaultStorage("postgres://localhost", "/tmp/metrics.json"); len(names) != 1 || names[0] != "db" {
+			t.Errorf("Error default storage with DSN: %v", names)
+		}
+		if names := repository.DefaultStorage("", "/tmp/metrics.json"); len(names) != 1 || names[0] != "file" {
+			t.Errorf("Error default storage without DSN: %v", names)
+		}
+	})
+}
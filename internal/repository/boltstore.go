@@ -0,0 +1,282 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+)
+
+var boltBucket = []byte("metrics")
+
+// boltCompactMinSize меньшие файлы не сжимаются: выигрыш не стоит перезаписи файла.
+const boltCompactMinSize = 1 << 20
+
+func init() {
+	RegisterBackend(constants.MetricsStorageBolt.String(), NewBoltBackend)
+}
+
+// BoltBackend хранение метрик во встроенной базе bbolt.
+// Каждый пакет метрик записывается одной транзакцией, после фиксации данные уже на диске.
+// BoltFile: путь к файлу базы
+// CompactInterval: интервал проверки, не пора ли сжать файл базы
+type BoltBackend struct {
+	BoltFile        string
+	CompactInterval time.Duration
+
+	mu   sync.RWMutex
+	db   *bolt.DB
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewBoltBackend создает хранилище bbolt в файле BOLT_FILE.
+func NewBoltBackend(cfg BackendConfig) (Backend, error) {
+	if cfg.BoltFile == "" {
+		return nil, errors.New("не указан файл базы bbolt")
+	}
+	return &BoltBackend{BoltFile: cfg.BoltFile, CompactInterval: cfg.BoltCompactInterval}, nil
+}
+
+// Name имя хранилища bbolt.
+func (b *BoltBackend) Name() string {
+	return constants.MetricsStorageBolt.String()
+}
+
+// Init открывает файл базы, создает корзину метрик и запускает периодическое сжатие.
+func (b *BoltBackend) Init(ctx context.Context) error {
+	db, err := openBolt(b.BoltFile)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.db = db
+	b.mu.Unlock()
+
+	if b.CompactInterval > 0 {
+		b.stop = make(chan struct{})
+		b.done = make(chan struct{})
+		go b.compactLoop()
+	}
+
+	return nil
+}
+
+func openBolt(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func boltKey(key MetricKey) []byte {
+	return []byte(key.MType + "\x00" + key.ID)
+}
+
+// Upsert записывает пакет метрик одной транзакцией: либо весь пакет, либо ничего.
+func (b *BoltBackend) Upsert(ctx context.Context, metrics encoding.ArrMetrics) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.db == nil {
+		return errors.New("база bbolt не открыта")
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, m := range metrics {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			value, err := json.Marshal(record{Metrics: m, Timestamp: m.Timestamp})
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(boltKey(metricKey(m)), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadAll читает все метрики из базы.
+func (b *BoltBackend) LoadAll(ctx context.Context) (encoding.ArrMetrics, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.db == nil {
+		return nil, errors.New("база bbolt не открыта")
+	}
+
+	var arrMetrics encoding.ArrMetrics
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+			var r record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			arrMetrics = append(arrMetrics, fromRecords([]record{r})...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return arrMetrics, nil
+}
+
+// Delete удаляет метрики одной транзакцией.
+func (b *BoltBackend) Delete(ctx context.Context, keys ...MetricKey) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.db == nil {
+		return errors.New("база bbolt не открыта")
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, key := range keys {
+			if err := bucket.Delete(boltKey(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Health проверяет, что база открыта и читается.
+func (b *BoltBackend) Health(ctx context.Context) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.db == nil {
+		return errors.New("база bbolt не открыта")
+	}
+	return b.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltBucket) == nil {
+			return errors.New("в базе bbolt нет корзины метрик")
+		}
+		return nil
+	})
+}
+
+// Close останавливает сжатие и закрывает базу.
+func (b *BoltBackend) Close() error {
+	if b.stop != nil {
+		close(b.stop)
+		<-b.done
+		b.stop = nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.db == nil {
+		return nil
+	}
+	err := b.db.Close()
+	b.db = nil
+
+	return err
+}
+
+func (b *BoltBackend) compactLoop() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.CompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !b.needsCompaction() {
+				continue
+			}
+			if err := b.Compact(); err != nil {
+				constants.Logger.ErrorLog(err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// needsCompaction файл стоит сжать, если больше половины его занято свободными страницами.
+func (b *BoltBackend) needsCompaction() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.db == nil {
+		return false
+	}
+	info, err := os.Stat(b.BoltFile)
+	if err != nil || info.Size() < boltCompactMinSize {
+		return false
+	}
+	return int64(b.db.Stats().FreeAlloc)*2 > info.Size()
+}
+
+// Compact переписывает базу в новый файл без свободных страниц и подменяет им старый.
+// На время сжатия запись и чтение ждут.
+func (b *BoltBackend) Compact() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.db == nil {
+		return errors.New("база bbolt не открыта")
+	}
+
+	tmpPath := b.BoltFile + ".compact"
+	os.Remove(tmpPath)
+	dst, err := bolt.Open(tmpPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	if err = bolt.Compact(dst, b.db, 0); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err = b.db.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, b.BoltFile); err != nil {
+		os.Remove(tmpPath)
+	}
+
+	// База открывается заново и в случае ошибки переименования: тогда со старым файлом.
+	db, errOpen := openBolt(b.BoltFile)
+	if errOpen != nil {
+		b.db = nil
+		return errOpen
+	}
+	b.db = db
+
+	return err
+}
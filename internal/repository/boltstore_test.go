@@ -0,0 +1,86 @@
+package repository_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+)
+
+func TestBoltBackend(t *testing.T) {
+	ctx := context.Background()
+	cfg := repository.BackendConfig{BoltFile: filepath.Join(t.TempDir(), "metrics.bolt")}
+
+	backend, err := repository.NewBackend("bolt", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = backend.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := make(encoding.ArrMetrics, 0, 100)
+	for i := 0; i < 100; i++ {
+		value := float64(i)
+		batch = append(batch, encoding.Metrics{ID: fmt.Sprintf("Gauge%d", i), MType: "gauge", Value: &value})
+	}
+	delta := int64(7)
+	batch = append(batch, encoding.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+
+	t.Run("Checking upsert and reload", func(t *testing.T) {
+		if err = backend.Upsert(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+		if err = backend.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err = backend.Init(ctx); err != nil {
+			t.Fatal(err)
+		}
+		metrics, err := backend.LoadAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != len(batch) {
+			t.Errorf("Error reload: %d metrics, want %d", len(metrics), len(batch))
+		}
+	})
+	t.Run("Checking delete", func(t *testing.T) {
+		keys := make([]repository.MetricKey, 0, 50)
+		for i := 0; i < 50; i++ {
+			keys = append(keys, repository.MetricKey{ID: fmt.Sprintf("Gauge%d", i), MType: "gauge"})
+		}
+		if err = backend.Delete(ctx, keys...); err != nil {
+			t.Fatal(err)
+		}
+		metrics, err := backend.LoadAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != len(batch)-50 {
+			t.Errorf("Error delete: %d metrics, want %d", len(metrics), len(batch)-50)
+		}
+	})
+	t.Run("Checking compaction", func(t *testing.T) {
+		if err = backend.(*repository.BoltBackend).Compact(); err != nil {
+			t.Fatal(err)
+		}
+		metrics, err := backend.LoadAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != len(batch)-50 {
+			t.Errorf("Error compaction lost metrics: %d", len(metrics))
+		}
+		if err = backend.Health(ctx); err != nil {
+			t.Errorf("Error health after compaction: %s", err.Error())
+		}
+	})
+
+	if err = backend.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
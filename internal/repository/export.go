@@ -0,0 +1,249 @@
+package repository
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+)
+
+// ErrUnknownFormat формат выгрузки не json, не csv и не openmetrics.
+var ErrUnknownFormat = errors.New("неизвестный формат выгрузки метрик")
+
+// csvHeader заголовок выгрузки в CSV.
+var csvHeader = []string{"id", "type", "value", "timestamp"}
+
+// openMetricsName допустимое имя метрики в формате OpenMetrics.
+var openMetricsName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// ContentType тип содержимого для формата выгрузки.
+func ContentType(format string) string {
+	switch format {
+	case constants.ExportCSV:
+		return "text/csv; charset=utf-8"
+	case constants.ExportOpenMetrics:
+		return "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	default:
+		return "application/json"
+	}
+}
+
+// sortMetrics сортирует метрики по типу и имени, чтобы выгрузки одного состояния совпадали.
+func sortMetrics(metrics encoding.ArrMetrics) {
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType < metrics[j].MType
+		}
+		return metrics[i].ID < metrics[j].ID
+	})
+}
+
+// formatValue значение метрики текстом, для gauge без потери точности.
+func formatValue(m encoding.Metrics) (string, error) {
+	switch {
+	case m.MType == "gauge" && m.Value != nil:
+		return strconv.FormatFloat(*m.Value, 'g', -1, 64), nil
+	case m.MType == "counter" && m.Delta != nil:
+		return strconv.FormatInt(*m.Delta, 10), nil
+	case m.MType != "gauge" && m.MType != "counter":
+		return "", fmt.Errorf("%w: %s", ErrUnknownType, m.MType)
+	default:
+		return "", fmt.Errorf("%w: %s", ErrBadValue, m.ID)
+	}
+}
+
+// parseValue метрика типа mType со значением из текста.
+func parseValue(id string, mType string, value string) (encoding.Metrics, error) {
+	m := encoding.Metrics{ID: id, MType: mType}
+	switch mType {
+	case "gauge":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return m, fmt.Errorf("%w: %s: %s", ErrBadValue, id, err.Error())
+		}
+		m.Value = &v
+	case "counter":
+		d, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return m, fmt.Errorf("%w: %s: %s", ErrBadValue, id, err.Error())
+		}
+		m.Delta = &d
+	default:
+		return m, fmt.Errorf("%w: %s", ErrUnknownType, mType)
+	}
+	return m, nil
+}
+
+// EncodeMetrics записывает метрики в w в формате format, отсортированными по типу и имени:
+// json: массив encoding.Metrics, как его принимает /updates
+// csv: колонки id, type, value, timestamp (RFC 3339)
+// openmetrics: текстовый формат OpenMetrics, counter с суффиксом _total, время в секундах
+func EncodeMetrics(w io.Writer, format string, metrics encoding.ArrMetrics) error {
+	sorted := make(encoding.ArrMetrics, len(metrics))
+	copy(sorted, metrics)
+	sortMetrics(sorted)
+
+	switch format {
+	case constants.ExportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(toRecords(sorted))
+
+	case constants.ExportCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvHeader); err != nil {
+			return err
+		}
+		for _, m := range sorted {
+			value, err := formatValue(m)
+			if err != nil {
+				return err
+			}
+			timestamp := ""
+			if m.Timestamp != nil {
+				timestamp = m.Timestamp.UTC().Format(time.RFC3339Nano)
+			}
+			if err = cw.Write([]string{m.ID, m.MType, value, timestamp}); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+
+	case constants.ExportOpenMetrics:
+		bw := bufio.NewWriter(w)
+		for _, m := range sorted {
+			if !openMetricsName.MatchString(m.ID) {
+				return fmt.Errorf("метрика %q: имя недопустимо в формате OpenMetrics", m.ID)
+			}
+			value, err := formatValue(m)
+			if err != nil {
+				return err
+			}
+			name := m.ID
+			if m.MType == "counter" {
+				name += "_total"
+			}
+			fmt.Fprintf(bw, "# TYPE %s %s\n", m.ID, m.MType)
+			if m.Timestamp != nil {
+				ms := m.Timestamp.UnixMilli()
+				fmt.Fprintf(bw, "%s %s %d.%03d\n", name, value, ms/1000, ms%1000)
+			} else {
+				fmt.Fprintf(bw, "%s %s\n", name, value)
+			}
+		}
+		fmt.Fprintln(bw, "# EOF")
+		return bw.Flush()
+
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+}
+
+// DecodeMetrics читает метрики в формате format, записанные EncodeMetrics.
+// Хеши метрик не проверяются и не сохраняются: выгрузка могла быть сделана сервером с другим ключом.
+func DecodeMetrics(r io.Reader, format string) (encoding.ArrMetrics, error) {
+	var metrics encoding.ArrMetrics
+
+	switch format {
+	case constants.ExportJSON:
+		var records []record
+		if err := json.NewDecoder(r).Decode(&records); err != nil {
+			return nil, err
+		}
+		metrics = fromRecords(records)
+		for i := range metrics {
+			if _, err := formatValue(metrics[i]); err != nil {
+				return nil, err
+			}
+			metrics[i].Hash = ""
+		}
+
+	case constants.ExportCSV:
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, record := range records {
+			if i == 0 && strings.Join(record, ",") == strings.Join(csvHeader, ",") {
+				continue
+			}
+			if len(record) != len(csvHeader) {
+				return nil, fmt.Errorf("строка %d: ожидается %d колонки", i+1, len(csvHeader))
+			}
+			m, err := parseValue(record[0], record[1], record[2])
+			if err != nil {
+				return nil, fmt.Errorf("строка %d: %w", i+1, err)
+			}
+			if record[3] != "" {
+				timestamp, err := time.Parse(time.RFC3339Nano, record[3])
+				if err != nil {
+					return nil, fmt.Errorf("строка %d: %w", i+1, err)
+				}
+				m.Timestamp = &timestamp
+			}
+			metrics = append(metrics, m)
+		}
+
+	case constants.ExportOpenMetrics:
+		types := make(map[string]string)
+		scanner := bufio.NewScanner(r)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "# EOF" {
+				break
+			}
+			if line == "" || strings.HasPrefix(line, "#") {
+				if fields := strings.Fields(line); len(fields) == 4 && fields[1] == "TYPE" {
+					types[fields[2]] = fields[3]
+				}
+				continue
+			}
+			if strings.Contains(line, "{") {
+				return nil, fmt.Errorf("строка %d: метки не поддерживаются", n)
+			}
+
+			fields := strings.Fields(line)
+			if len(fields) < 2 || len(fields) > 3 {
+				return nil, fmt.Errorf("строка %d: неверный формат", n)
+			}
+			id, mType := fields[0], types[fields[0]]
+			if base := strings.TrimSuffix(id, "_total"); base != id && types[base] == "counter" {
+				id, mType = base, "counter"
+			}
+			m, err := parseValue(id, mType, fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("строка %d: %w", n, err)
+			}
+			if len(fields) == 3 {
+				sec, err := strconv.ParseFloat(fields[2], 64)
+				if err != nil {
+					return nil, fmt.Errorf("строка %d: неверное время: %s", n, fields[2])
+				}
+				whole, frac := math.Modf(sec)
+				timestamp := time.Unix(int64(whole), int64(math.Round(frac*1000))*int64(time.Millisecond)).UTC()
+				m.Timestamp = &timestamp
+			}
+			metrics = append(metrics, m)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+
+	return metrics, nil
+}
@@ -0,0 +1,169 @@
+package repository_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+)
+
+func TestExportFormats(t *testing.T) {
+	at := time.Date(2022, 5, 1, 10, 0, 0, 250*int(time.Millisecond), time.UTC)
+	value, delta := 0.1+0.2, int64(42)
+	metrics := encoding.ArrMetrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta, Timestamp: &at},
+		{ID: "Alloc", MType: "gauge", Value: &value},
+	}
+
+	for _, format := range []string{constants.ExportJSON, constants.ExportCSV, constants.ExportOpenMetrics} {
+		t.Run("Checking "+format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := repository.EncodeMetrics(&buf, format, metrics); err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := repository.DecodeMetrics(&buf, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decoded) != 2 {
+				t.Fatalf("Error decoded metrics: %v", decoded)
+			}
+			// Метрики выгружаются отсортированными по типу и имени.
+			counter, gauge := decoded[0], decoded[1]
+			if counter.ID != "PollCount" || *counter.Delta != delta || !counter.Timestamp.Equal(at) {
+				t.Errorf("Error decoded counter: %+v", counter)
+			}
+			if gauge.ID != "Alloc" || *gauge.Value != value || gauge.Timestamp != nil {
+				t.Errorf("Error decoded gauge: %+v", gauge)
+			}
+		})
+	}
+
+	t.Run("Checking openmetrics text", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := repository.EncodeMetrics(&buf, constants.ExportOpenMetrics, metrics); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), "PollCount_total 42 1651399200.250\n") ||
+			!strings.HasSuffix(buf.String(), "# EOF\n") {
+			t.Errorf("Error openmetrics text:\n%s", buf.String())
+		}
+	})
+
+	t.Run("Checking errors", func(t *testing.T) {
+		if err := repository.EncodeMetrics(&bytes.Buffer{}, "xml", metrics); !errors.Is(err, repository.ErrUnknownFormat) {
+			t.Errorf("Error unknown format: %v", err)
+		}
+		if _, err := repository.DecodeMetrics(strings.NewReader("id,type,value,timestamp\nAlloc,gauge,abc,\n"),
+			constants.ExportCSV); !errors.Is(err, repository.ErrBadValue) {
+			t.Errorf("Error bad csv value: %v", err)
+		}
+		if _, err := repository.DecodeMetrics(strings.NewReader("Alloc 1\n# EOF\n"),
+			constants.ExportOpenMetrics); !errors.Is(err, repository.ErrUnknownType) {
+			t.Errorf("Error untyped openmetrics sample: %v", err)
+		}
+	})
+}
+
+func TestStoreImport(t *testing.T) {
+	at := time.Now()
+	newStore := func(t *testing.T) *repository.Store {
+		store := repository.NewStore()
+		for _, m := range [][3]string{{"gauge", "Alloc", "1"}, {"counter", "PollCount", "5"}, {"gauge", "Old", "7"}} {
+			if _, err := store.UpdateText(m[0], m[1], m[2]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return store
+	}
+	value, delta := 2.5, int64(3)
+	imported := encoding.ArrMetrics{
+		{ID: "Alloc", MType: "gauge", Value: &value},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "New", MType: "counter", Delta: &delta},
+	}
+	text := func(store *repository.Store, id string) string {
+		mt, ok := store.Get(id)
+		if !ok {
+			return ""
+		}
+		return repository.MetricText(mt)
+	}
+
+	t.Run("Checking dry run", func(t *testing.T) {
+		store := newStore(t)
+		result, err := store.Import(imported, constants.ImportReplace, true, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report := result.Report
+		if report.Added != 1 || report.Changed != 2 || report.Removed != 1 || len(report.Changes) != 4 {
+			t.Errorf("Error dry run report: %+v", report)
+		}
+		if text(store, "Alloc") != "1" || text(store, "Old") != "7" || text(store, "New") != "" {
+			t.Error("Error dry run changed store")
+		}
+	})
+
+	t.Run("Checking replace", func(t *testing.T) {
+		store := newStore(t)
+		result, err := store.Import(imported, constants.ImportReplace, false, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text(store, "Alloc") != "2.5" || text(store, "PollCount") != "3" || text(store, "Old") != "" {
+			t.Errorf("Error replace: %v", store.TextMetricsAndValue())
+		}
+		if len(result.Updated) != 3 || len(result.Deleted) != 1 || result.Deleted[0].ID != "Old" {
+			t.Errorf("Error replace result: %+v", result)
+		}
+	})
+
+	t.Run("Checking merge", func(t *testing.T) {
+		store := newStore(t)
+		if _, err := store.Import(imported, constants.ImportMerge, false, at); err != nil {
+			t.Fatal(err)
+		}
+		if text(store, "PollCount") != "3" || text(store, "Old") != "7" || text(store, "New") != "3" {
+			t.Errorf("Error merge: %v", store.TextMetricsAndValue())
+		}
+	})
+
+	t.Run("Checking counters add", func(t *testing.T) {
+		store := newStore(t)
+		result, err := store.Import(imported, constants.ImportCountersAdd, false, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text(store, "PollCount") != "8" || text(store, "Alloc") != "2.5" || text(store, "Old") != "7" {
+			t.Errorf("Error counters add: %v", store.TextMetricsAndValue())
+		}
+		for _, c := range result.Report.Changes {
+			if c.ID == "PollCount" && (c.Old != "5" || c.New != "8") {
+				t.Errorf("Error counters add change: %+v", c)
+			}
+		}
+	})
+
+	t.Run("Checking errors", func(t *testing.T) {
+		store := newStore(t)
+		if _, err := store.Import(imported, "sum", false, at); !errors.Is(err, repository.ErrUnknownImportMode) {
+			t.Errorf("Error unknown mode: %v", err)
+		}
+		mismatch := encoding.ArrMetrics{
+			{ID: "New", MType: "counter", Delta: &delta},
+			{ID: "Alloc", MType: "counter", Delta: &delta},
+		}
+		if _, err := store.Import(mismatch, constants.ImportMerge, false, at); !errors.Is(err, repository.ErrTypeMismatch) {
+			t.Errorf("Error type mismatch: %v", err)
+		}
+		if text(store, "New") != "" {
+			t.Error("Error failed import changed store")
+		}
+	})
+}
@@ -0,0 +1,506 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+)
+
+// Операции в журнале файлового хранилища.
+const (
+	walOpUpsert = "upsert"
+	walOpDelete = "delete"
+)
+
+func init() {
+	RegisterBackend(constants.MetricsStorageFile.String(), NewFileBackend)
+}
+
+// walRecord запись журнала: одна строка JSON на пакет метрик.
+type walRecord struct {
+	Op      string      `json:"op"`
+	Metrics []record    `json:"metrics,omitempty"`
+	Keys    []MetricKey `json:"keys,omitempty"`
+}
+
+// FileBackend хранение метрик в файле: снимок всех метрик и журнал изменений после снимка.
+// Каждый пакет метрик дописывается одной строкой в журнал STORE_FILE.wal.
+// Снимок пишется во временный файл и переименовывается в STORE_FILE, после чего журнал очищается.
+// При подключении читается снимок и поверх него применяется журнал.
+// StoreFile: путь к файлу снимка
+// Sync: когда сбрасывать журнал на диск (always, interval, never)
+// SyncInterval: интервал сброса журнала на диск для режима interval
+// SnapshotInterval: интервал записи снимка
+// WALMaxSize: размер журнала в байтах, после которого пишется снимок
+// Codec: сжатие и шифрование снимка и журнала
+type FileBackend struct {
+	StoreFile        string
+	Sync             string
+	SyncInterval     time.Duration
+	SnapshotInterval time.Duration
+	WALMaxSize       int64
+	Codec            *SnapshotCodec
+
+	mu      sync.Mutex
+	metrics map[MetricKey]encoding.Metrics
+	wal     *os.File
+	walSize int64
+	dirty   bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewFileBackend создает хранилище в файле STORE_FILE.
+func NewFileBackend(cfg BackendConfig) (Backend, error) {
+	if cfg.StoreFile == "" {
+		return nil, errors.New("не указан файл хранения метрик")
+	}
+
+	syncMode := cfg.FileSync
+	if syncMode == "" {
+		syncMode = constants.FileSyncAlways
+	}
+	switch syncMode {
+	case constants.FileSyncAlways, constants.FileSyncInterval, constants.FileSyncNever:
+	default:
+		return nil, fmt.Errorf("неизвестный режим сброса на диск %q, доступны: %s, %s, %s", syncMode,
+			constants.FileSyncAlways, constants.FileSyncInterval, constants.FileSyncNever)
+	}
+
+	codec, err := NewSnapshotCodec(cfg.SnapshotCompress, cfg.SnapshotEncryption, cfg.SnapshotKey, cfg.SnapshotPK)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileBackend{
+		StoreFile:        cfg.StoreFile,
+		Sync:             syncMode,
+		SyncInterval:     cfg.FileSyncInterval,
+		SnapshotInterval: cfg.FileSnapshotInterval,
+		WALMaxSize:       cfg.FileWALMaxSize,
+		Codec:            codec,
+	}, nil
+}
+
+// Name имя файлового хранилища.
+func (f *FileBackend) Name() string {
+	return constants.MetricsStorageFile.String()
+}
+
+func (f *FileBackend) walFile() string {
+	return f.StoreFile + ".wal"
+}
+
+// Init восстанавливает метрики из снимка и журнала, записывает новый снимок и открывает журнал.
+func (f *FileBackend) Init(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := os.Stat(filepath.Dir(f.StoreFile)); err != nil {
+		return err
+	}
+
+	metrics, err := f.readSnapshot()
+	if err != nil {
+		return err
+	}
+	f.metrics = make(map[MetricKey]encoding.Metrics, len(metrics))
+	for _, m := range metrics {
+		f.metrics[metricKey(m)] = m
+	}
+
+	walSize, err := f.replayWAL()
+	if err != nil {
+		return err
+	}
+	if walSize > 0 {
+		// Журнал переносится в снимок и очищается сразу: иначе новые записи легли бы после оборванной при сбое строки.
+		if err = f.snapshot(); err != nil {
+			return err
+		}
+	}
+
+	if err = f.openWAL(walSize > 0); err != nil {
+		return err
+	}
+
+	interval := f.SnapshotInterval
+	if f.Sync == constants.FileSyncInterval && f.SyncInterval > 0 && (interval <= 0 || f.SyncInterval < interval) {
+		interval = f.SyncInterval
+	}
+	if interval > 0 {
+		f.stop = make(chan struct{})
+		f.done = make(chan struct{})
+		go f.backgroundLoop(interval)
+	}
+
+	return nil
+}
+
+// readSnapshot читает снимок метрик в любом формате: JSON прежних версий или с заголовком.
+// Отсутствующий или пустой файл - пустой снимок.
+func (f *FileBackend) readSnapshot() (encoding.ArrMetrics, error) {
+	res, err := os.ReadFile(f.StoreFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(bytes.TrimSpace(res)) == 0 {
+		return nil, nil
+	}
+
+	if res, err = f.Codec.Decode(res); err != nil {
+		return nil, fmt.Errorf("снимок %s: %w", f.StoreFile, err)
+	}
+
+	var records []record
+	if err = json.Unmarshal(res, &records); err != nil {
+		return nil, fmt.Errorf("снимок %s поврежден: %w", f.StoreFile, err)
+	}
+	return fromRecords(records), nil
+}
+
+// replayWAL применяет к метрикам записи журнала и возвращает размер журнала.
+// Чтение останавливается на первой неполной или поврежденной строке: это запись, прерванная сбоем.
+func (f *FileBackend) replayWAL() (int64, error) {
+	file, err := os.Open(f.walFile())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) != 0 {
+				constants.Logger.InfoLog(fmt.Sprintf("журнал %s: отброшена неполная запись %d", f.walFile(), n))
+			}
+			return info.Size(), nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		line, err = f.decodeWALLine(line)
+		if err != nil {
+			return 0, fmt.Errorf("журнал %s, строка %d: %w", f.walFile(), n, err)
+		}
+
+		var record walRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			constants.Logger.InfoLog(fmt.Sprintf("журнал %s: отброшены записи начиная с поврежденной строки %d", f.walFile(), n))
+			return info.Size(), nil
+		}
+		f.apply(record)
+	}
+}
+
+// encodeWALLine шифрует строку журнала, если шифрование включено. Зашифрованная строка пишется в base64.
+func (f *FileBackend) encodeWALLine(line []byte) ([]byte, error) {
+	if !f.Codec.Encrypted() {
+		return line, nil
+	}
+	frame, err := f.Codec.Encode(line)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(frame)))
+	base64.StdEncoding.Encode(encoded, frame)
+	return encoded, nil
+}
+
+// decodeWALLine расшифровывает строку журнала. Строка JSON возвращается как есть.
+func (f *FileBackend) decodeWALLine(line []byte) ([]byte, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] == '{' {
+		return line, nil
+	}
+	frame := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(frame, line)
+	if err != nil {
+		// Строка не в base64 - повреждена, ее отбросит разбор JSON.
+		return line, nil
+	}
+	return f.Codec.Decode(frame[:n])
+}
+
+func (f *FileBackend) apply(record walRecord) {
+	switch record.Op {
+	case walOpUpsert:
+		for _, m := range fromRecords(record.Metrics) {
+			f.metrics[metricKey(m)] = m
+		}
+	case walOpDelete:
+		for _, key := range record.Keys {
+			delete(f.metrics, key)
+		}
+	}
+}
+
+func (f *FileBackend) openWAL(truncate bool) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	wal, err := os.OpenFile(f.walFile(), flags, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := wal.Stat()
+	if err != nil {
+		wal.Close()
+		return err
+	}
+	f.wal = wal
+	f.walSize = info.Size()
+
+	return nil
+}
+
+// Upsert дописывает пакет метрик в журнал и, если журнал разросся, пишет снимок.
+func (f *FileBackend) Upsert(ctx context.Context, metrics encoding.ArrMetrics) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.write(walRecord{Op: walOpUpsert, Metrics: toRecords(metrics)})
+}
+
+// LoadAll возвращает все метрики, упорядоченные по типу и имени.
+func (f *FileBackend) LoadAll(ctx context.Context) (encoding.ArrMetrics, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.metrics == nil {
+		return nil, errors.New("файловое хранилище не открыто")
+	}
+	return f.sortedMetrics(), nil
+}
+
+func (f *FileBackend) sortedMetrics() encoding.ArrMetrics {
+	arrMetrics := make(encoding.ArrMetrics, 0, len(f.metrics))
+	for _, m := range f.metrics {
+		arrMetrics = append(arrMetrics, m)
+	}
+	sort.Slice(arrMetrics, func(i, j int) bool {
+		if arrMetrics[i].MType != arrMetrics[j].MType {
+			return arrMetrics[i].MType < arrMetrics[j].MType
+		}
+		return arrMetrics[i].ID < arrMetrics[j].ID
+	})
+	return arrMetrics
+}
+
+// Delete записывает удаление метрик в журнал.
+func (f *FileBackend) Delete(ctx context.Context, keys ...MetricKey) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.write(walRecord{Op: walOpDelete, Keys: keys})
+}
+
+// write добавляет запись в журнал и применяет ее к метрикам. Вызывается под f.mu.
+func (f *FileBackend) write(record walRecord) error {
+	if f.wal == nil {
+		return errors.New("файловое хранилище не открыто")
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if line, err = f.encodeWALLine(line); err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	n, err := f.wal.Write(line)
+	f.walSize += int64(n)
+	if err != nil {
+		return err
+	}
+	if f.Sync == constants.FileSyncAlways {
+		if err = f.wal.Sync(); err != nil {
+			return err
+		}
+	} else {
+		f.dirty = true
+	}
+	f.apply(record)
+
+	if f.WALMaxSize > 0 && f.walSize >= f.WALMaxSize {
+		return f.compact()
+	}
+	return nil
+}
+
+// Compact пишет снимок всех метрик и очищает журнал.
+func (f *FileBackend) Compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.wal == nil {
+		return errors.New("файловое хранилище не открыто")
+	}
+	return f.compact()
+}
+
+func (f *FileBackend) compact() error {
+	if f.walSize == 0 {
+		return nil
+	}
+	if err := f.snapshot(); err != nil {
+		return err
+	}
+	if err := f.wal.Truncate(0); err != nil {
+		return err
+	}
+	f.walSize = 0
+	f.dirty = false
+
+	return f.wal.Sync()
+}
+
+// snapshot атомарно заменяет файл снимка: запись во временный файл, сброс на диск и переименование.
+func (f *FileBackend) snapshot() error {
+	data, err := json.MarshalIndent(toRecords(f.sortedMetrics()), "", " ")
+	if err != nil {
+		return err
+	}
+	if data, err = f.Codec.Encode(data); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(f.StoreFile)
+	tmp, err := os.CreateTemp(dir, filepath.Base(f.StoreFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err = os.Rename(tmpName, f.StoreFile); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir сбрасывает на диск каталог, чтобы переименование пережило сбой.
+// Не все системы позволяют открыть каталог на запись, такая ошибка не считается ошибкой записи.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+
+	_ = d.Sync()
+	return nil
+}
+
+// Health проверяет, что журнал открыт и каталог хранилища доступен.
+func (f *FileBackend) Health(ctx context.Context) error {
+	f.mu.Lock()
+	opened := f.wal != nil
+	f.mu.Unlock()
+
+	if !opened {
+		return errors.New("файловое хранилище не открыто")
+	}
+	_, err := os.Stat(filepath.Dir(f.StoreFile))
+	return err
+}
+
+// Close останавливает фоновые задачи, пишет снимок и закрывает журнал.
+func (f *FileBackend) Close() error {
+	if f.stop != nil {
+		close(f.stop)
+		<-f.done
+		f.stop = nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.wal == nil {
+		return nil
+	}
+	err := f.compact()
+	if errClose := f.wal.Close(); err == nil {
+		err = errClose
+	}
+	f.wal = nil
+
+	return err
+}
+
+func (f *FileBackend) backgroundLoop(interval time.Duration) {
+	defer close(f.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastSnapshot := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			f.mu.Lock()
+			var err error
+			if f.SnapshotInterval > 0 && time.Since(lastSnapshot) >= f.SnapshotInterval {
+				err = f.compact()
+				lastSnapshot = time.Now()
+			} else if f.dirty {
+				err = f.wal.Sync()
+				f.dirty = false
+			}
+			f.mu.Unlock()
+			if err != nil {
+				constants.Logger.ErrorLog(err)
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
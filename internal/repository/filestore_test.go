@@ -0,0 +1,121 @@
+package repository_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+)
+
+func TestFileBackendWAL(t *testing.T) {
+	ctx := context.Background()
+	storeFile := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := repository.BackendConfig{StoreFile: storeFile, FileSync: "always"}
+
+	gauge, delta := 0.5, int64(3)
+	timestamp := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	batch := encoding.ArrMetrics{
+		{ID: "Alloc", MType: "gauge", Value: &gauge, Timestamp: &timestamp},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+	}
+
+	open := func(cfg repository.BackendConfig) repository.Backend {
+		backend, err := repository.NewFileBackend(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = backend.Init(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return backend
+	}
+
+	t.Run("Checking replay after crash", func(t *testing.T) {
+		crashed := open(cfg)
+		if err := crashed.Upsert(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+		// Сбой посреди записи: в журнале осталась оборванная строка, Close не вызывался.
+		wal, err := os.OpenFile(storeFile+".wal", os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = wal.WriteString(`{"op":"upsert","metrics":[{"id":"Torn"`); err != nil {
+			t.Fatal(err)
+		}
+		wal.Close()
+
+		restored := open(cfg)
+		defer restored.Close()
+
+		metrics, err := restored.LoadAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != 2 {
+			t.Fatalf("Error replay must restore both metrics, got %+v", metrics)
+		}
+		for _, m := range metrics {
+			if m.ID == "Alloc" && (m.Timestamp == nil || !m.Timestamp.Equal(timestamp)) {
+				t.Errorf("Error replay must restore timestamp: %+v", m)
+			}
+		}
+		info, err := os.Stat(storeFile + ".wal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != 0 {
+			t.Errorf("Error replayed journal must be moved to snapshot, size %d", info.Size())
+		}
+	})
+	t.Run("Checking compaction", func(t *testing.T) {
+		cfg := cfg
+		cfg.FileWALMaxSize = 1
+		backend := open(cfg)
+		defer backend.Close()
+
+		newGauge := 2.5
+		if err := backend.Upsert(ctx, encoding.ArrMetrics{{ID: "Alloc", MType: "gauge", Value: &newGauge}}); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(storeFile + ".wal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != 0 {
+			t.Errorf("Error journal must be truncated after compaction, size %d", info.Size())
+		}
+
+		snapshot := open(repository.BackendConfig{StoreFile: storeFile})
+		defer snapshot.Close()
+		metrics, err := snapshot.LoadAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range metrics {
+			if m.ID == "Alloc" && *m.Value != newGauge {
+				t.Errorf("Error snapshot must contain new value: %+v", m)
+			}
+		}
+	})
+	t.Run("Checking timestamp is not in API", func(t *testing.T) {
+		body, err := json.Marshal(batch[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(body), "timestamp") {
+			t.Errorf("Error timestamp in API JSON: %s", body)
+		}
+	})
+	t.Run("Checking unknown sync mode", func(t *testing.T) {
+		if _, err := repository.NewFileBackend(repository.BackendConfig{StoreFile: storeFile, FileSync: "sometimes"}); err == nil {
+			t.Errorf("Error unknown sync mode must be rejected")
+		}
+	})
+}
@@ -0,0 +1,225 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+)
+
+// ErrUnknownImportMode режим загрузки не replace, не merge и не counters-add.
+var ErrUnknownImportMode = errors.New("неизвестный режим загрузки метрик")
+
+// Действия с метрикой при загрузке.
+const (
+	ActionAdd    = "add"
+	ActionChange = "change"
+	ActionRemove = "remove"
+)
+
+// ImportChange изменение одной метрики при загрузке.
+// Old и New значения до и после загрузки, как их выводит MetricText.
+type ImportChange struct {
+	ID     string `json:"id"`
+	MType  string `json:"type"`
+	Action string `json:"action"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+// ImportReport итог загрузки метрик. При DryRun описывает изменения, которые были бы сделаны.
+// Persisted, PersistError заполняет сервер: записаны ли загруженные метрики в физические хранилища
+// и ошибка записи. Метрики, которые не удалось записать, уже загружены в память сервера.
+type ImportReport struct {
+	Mode         string         `json:"mode"`
+	DryRun       bool           `json:"dry_run"`
+	Added        int            `json:"added"`
+	Changed      int            `json:"changed"`
+	Removed      int            `json:"removed"`
+	Unchanged    int            `json:"unchanged"`
+	Changes      []ImportChange `json:"changes"`
+	Persisted    bool           `json:"persisted"`
+	PersistError string         `json:"persist_error,omitempty"`
+}
+
+// ImportResult итог загрузки и то, что нужно записать в физические хранилища.
+// Updated: новые значения добавленных и измененных метрик
+// Deleted: ключи удаленных метрик
+type ImportResult struct {
+	Report  ImportReport
+	Updated encoding.ArrMetrics
+	Deleted []MetricKey
+}
+
+// Delete удаляет метрики по именам.
+func (s *Store) Delete(ids ...string) {
+	epoch := s.begin()
+	defer s.end(epoch)
+
+	s.delete(epoch, ids...)
+}
+
+// delete удаляет метрики, как Delete, в эпохе epoch.
+func (s *Store) delete(epoch uint64, ids ...string) {
+	for _, id := range ids {
+		s.replace(epoch, id, nil)
+	}
+}
+
+// importMetrics проверяет загружаемые метрики и сводит повторы одной метрики в одно значение:
+// для counters-add значения counter складываются, в остальных режимах остается последнее значение.
+func importMetrics(metrics encoding.ArrMetrics, mode string) (encoding.ArrMetrics, error) {
+	idx := make(map[string]int, len(metrics))
+	imported := make(encoding.ArrMetrics, 0, len(metrics))
+	for _, m := range metrics {
+		if _, err := formatValue(m); err != nil {
+			return nil, err
+		}
+		if ReservedID(m.ID) {
+			return nil, fmt.Errorf("%w: %s", ErrReservedID, m.ID)
+		}
+		if len(m.Labels) != 0 {
+			return nil, fmt.Errorf("%w: %s", ErrLabelsUnsupported, m.ID)
+		}
+		i, ok := idx[m.ID]
+		if !ok {
+			idx[m.ID] = len(imported)
+			imported = append(imported, m)
+			continue
+		}
+		if imported[i].MType != m.MType {
+			return nil, fmt.Errorf("%w: %s %s", ErrTypeMismatch, m.ID, imported[i].MType)
+		}
+		if mode == constants.ImportCountersAdd && m.MType == "counter" {
+			delta := *imported[i].Delta + *m.Delta
+			m.Delta = &delta
+		}
+		imported[i] = m
+	}
+	return imported, nil
+}
+
+// Import загружает метрики в хранилище в режиме mode:
+// replace: хранилище содержит только загружаемые метрики, остальные удаляются
+// merge: загружаемые метрики заменяют значения, остальные метрики не меняются
+// counters-add: значения counter прибавляются к текущим, gauge заменяются
+// При dryRun хранилище не меняется, отчет описывает изменения, которые были бы сделаны.
+// Метрики проверяются до изменения хранилища: при ошибке не загружается ни одна метрика.
+// Время изменения загруженных метрик - at.
+func (s *Store) Import(metrics encoding.ArrMetrics, mode string, dryRun bool, at time.Time) (ImportResult, error) {
+	switch mode {
+	case constants.ImportReplace, constants.ImportMerge, constants.ImportCountersAdd:
+	default:
+		return ImportResult{}, fmt.Errorf("%w: %s", ErrUnknownImportMode, mode)
+	}
+
+	imported, err := importMetrics(metrics, mode)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	s.importMu.Lock()
+	defer s.importMu.Unlock()
+
+	current := make(map[string]encoding.Metrics)
+	for _, m := range s.Snapshot() {
+		current[m.ID] = m
+	}
+
+	result := ImportResult{Report: ImportReport{Mode: mode, DryRun: dryRun, Changes: []ImportChange{}}}
+	report := &result.Report
+
+	var restore, add encoding.ArrMetrics
+	for _, m := range imported {
+		m.Hash = ""
+		m.Timestamp = &at
+
+		old, ok := current[m.ID]
+		if ok && old.MType != m.MType && mode != constants.ImportReplace {
+			return ImportResult{}, fmt.Errorf("%w: %s %s", ErrTypeMismatch, m.ID, old.MType)
+		}
+
+		change := ImportChange{ID: m.ID, MType: m.MType, Action: ActionAdd, New: MetricText(m)}
+		if mode == constants.ImportCountersAdd && m.MType == "counter" {
+			if ok && *m.Delta == 0 {
+				report.Unchanged++
+				continue
+			}
+			if ok {
+				delta := *old.Delta + *m.Delta
+				change.New = MetricText(encoding.Metrics{Delta: &delta})
+			}
+			add = append(add, m)
+		} else {
+			if ok && old.MType == m.MType && MetricText(old) == MetricText(m) {
+				report.Unchanged++
+				continue
+			}
+			restore = append(restore, m)
+		}
+
+		if ok {
+			change.Action = ActionChange
+			change.Old = MetricText(old)
+			report.Changed++
+			if old.MType != m.MType {
+				result.Deleted = append(result.Deleted, metricKey(old))
+			}
+		} else {
+			report.Added++
+		}
+		report.Changes = append(report.Changes, change)
+	}
+
+	var removed []string
+	if mode == constants.ImportReplace {
+		keep := make(map[string]bool, len(imported))
+		for _, m := range imported {
+			keep[m.ID] = true
+		}
+		for id, old := range current {
+			if keep[id] {
+				continue
+			}
+			removed = append(removed, id)
+			result.Deleted = append(result.Deleted, metricKey(old))
+			report.Changes = append(report.Changes,
+				ImportChange{ID: id, MType: old.MType, Action: ActionRemove, Old: MetricText(old)})
+			report.Removed++
+		}
+	}
+
+	sort.Slice(report.Changes, func(i, j int) bool {
+		if report.Changes[i].MType != report.Changes[j].MType {
+			return report.Changes[i].MType < report.Changes[j].MType
+		}
+		return report.Changes[i].ID < report.Changes[j].ID
+	})
+
+	if dryRun {
+		return result, nil
+	}
+
+	// Загрузка применяется одним изменением, Snapshot не видит ее частично.
+	epoch := s.begin()
+	defer s.end(epoch)
+
+	s.delete(epoch, removed...)
+	if err = s.restore(epoch, restore); err != nil {
+		return ImportResult{}, err
+	}
+	result.Updated = append(result.Updated, restore...)
+	for _, m := range add {
+		mt, err := s.update(epoch, m)
+		if err != nil {
+			return result, err
+		}
+		mt.Timestamp = &at
+		result.Updated = append(result.Updated, mt)
+	}
+
+	return result, nil
+}
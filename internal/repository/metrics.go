@@ -24,10 +24,6 @@ type Counter int64
 
 type MutexRepo map[string]Metric
 
-type MapMetrics struct {
-	MutexRepo
-}
-
 type Metric interface {
 	String() string
 	Type() string
@@ -48,14 +44,12 @@ func (g *Gauge) Type() string {
 }
 
 // GetMetrics Сохраняет метрику в формате encoding.Metrics.
-// И возращает ее в вызываемую процедуру.
+// И возращает ее в вызываемую процедуру. Хеш вычисляется по схеме v1.
 func (g *Gauge) GetMetrics(mType string, id string, hashKey string) encoding.Metrics {
 
 	value := float64(*g)
-	msg := fmt.Sprintf("%s:%s:%f", id, mType, value)
-	heshVal := cryptohash.HeshSHA256(msg, hashKey)
-
-	mt := encoding.Metrics{ID: id, MType: mType, Value: &value, Hash: heshVal}
+	mt := encoding.Metrics{ID: id, MType: mType, Value: &value}
+	mt.Hash = cryptohash.MetricHash(constants.HashSchemeV1, hashKey, &mt)
 
 	return mt
 }
@@ -112,15 +106,12 @@ func (c *Counter) String() string {
 }
 
 // GetMetrics Сохраняет метрику в формате encoding.Metrics.
-// И возращает ее в вызываемую процедуру.
+// И возращает ее в вызываемую процедуру. Хеш вычисляется по схеме v1.
 func (c *Counter) GetMetrics(mType string, id string, hashKey string) encoding.Metrics {
 
 	delta := int64(*c)
-
-	msg := fmt.Sprintf("%s:%s:%d", id, mType, delta)
-	heshVal := cryptohash.HeshSHA256(msg, hashKey)
-
-	mt := encoding.Metrics{ID: id, MType: mType, Delta: &delta, Hash: heshVal}
+	mt := encoding.Metrics{ID: id, MType: mType, Delta: &delta}
+	mt.Hash = cryptohash.MetricHash(constants.HashSchemeV1, hashKey, &mt)
 
 	return mt
 }
@@ -129,17 +120,3 @@ func (c *Counter) GetMetrics(mType string, id string, hashKey string) encoding.M
 func (c *Counter) Type() string {
 	return "counter"
 }
-
-////////////////////////////////////////////////////////////////////////////////
-
-func (mm *MapMetrics) TextMetricsAndValue() []string {
-	const msgFormat = "%s = %s"
-
-	var msg []string
-
-	for key, val := range mm.MutexRepo {
-		msg = append(msg, fmt.Sprintf(msgFormat, key, val.String()))
-	}
-
-	return msg
-}
@@ -0,0 +1,344 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+)
+
+// ErrQueueClosed очередь записи остановлена, метрики нужно записывать напрямую.
+var ErrQueueClosed = errors.New("очередь записи метрик остановлена")
+
+// queuedSamples значения метрик для истории на момент at.
+type queuedSamples struct {
+	metrics encoding.ArrMetrics
+	at      time.Time
+}
+
+// QueueStats состояние очереди записи.
+// Depth: метрик и значений истории в очереди
+// Capacity: размер очереди
+// Flushes: количество записей очереди в хранилища
+// FlushErrors: количество записей, завершившихся ошибкой
+// Blocked: сколько раз запрос ждал свободного места в очереди
+// Direct: сколько раз запрос не дождался места и записал метрики в хранилища сам
+// DroppedSamples: значения истории, которые не удалось записать и которые потеряны
+// LastFlush: длительность последней записи
+// MaxFlush: наибольшая длительность записи
+type QueueStats struct {
+	Depth          int
+	Capacity       int
+	Flushes        int64
+	FlushErrors    int64
+	Blocked        int64
+	Direct         int64
+	DroppedSamples int64
+	LastFlush      time.Duration
+	MaxFlush       time.Duration
+}
+
+// WriteQueue очередь отложенной записи метрик в хранилища.
+// Запрос только ставит метрики в очередь, запись в хранилища идет в фоне.
+// Для каждой метрики в очереди хранится последнее значение, значения истории хранятся все.
+// Очередь записывается, когда в ней набралось FlushSize значений или прошло FlushInterval.
+// Заполненная очередь задерживает запросы, пока запись не освободит место.
+// Значения, которые сейчас записываются, тоже занимают место в очереди.
+// Capacity: размер очереди
+// FlushSize: количество значений, при котором очередь записывается, не дожидаясь интервала;
+// метрики записываются в хранилища пакетами этого размера
+// FlushInterval: наибольшее время, которое метрика ждет записи
+type WriteQueue struct {
+	Capacity      int
+	FlushSize     int
+	FlushInterval time.Duration
+
+	storage     Backends
+	keepSamples bool
+
+	mu       sync.Mutex
+	pending  map[MetricKey]encoding.Metrics
+	samples  []queuedSamples
+	nSamples int
+	writing  int
+	space    chan struct{}
+	closed   bool
+	stats    QueueStats
+
+	flushMu sync.Mutex
+	flush   chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewWriteQueue создает очередь записи в хранилища storage и запускает фоновую запись.
+func NewWriteQueue(storage Backends, capacity int, flushSize int, flushInterval time.Duration) *WriteQueue {
+	if flushSize <= 0 || flushSize > capacity {
+		flushSize = capacity
+	}
+
+	q := &WriteQueue{
+		Capacity:      capacity,
+		FlushSize:     flushSize,
+		FlushInterval: flushInterval,
+		storage:       storage,
+		keepSamples:   storage.KeepsSamples(),
+		pending:       make(map[MetricKey]encoding.Metrics),
+		flush:         make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	q.stats.Capacity = capacity
+	go q.run()
+
+	return q
+}
+
+// depth количество значений в очереди вместе с записываемыми. Вызывается под q.mu.
+func (q *WriteQueue) depth() int {
+	return len(q.pending) + q.nSamples + q.writing
+}
+
+// Enqueue ставит метрики и их значения на момент at в очередь.
+// Если очередь заполнена, ждет, пока запись освободит место, или до отмены ctx.
+// Не дождавшись места, записывает метрики в хранилища сам: к этому времени они уже приняты сервером,
+// и ошибка заставила бы клиента повторить запрос и учесть дельты counter дважды.
+func (q *WriteQueue) Enqueue(ctx context.Context, metrics encoding.ArrMetrics, at time.Time) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	blocked := false
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return ErrQueueClosed
+		}
+
+		added := 0
+		for _, m := range metrics {
+			if _, ok := q.pending[metricKey(m)]; !ok {
+				added++
+			}
+		}
+		if q.keepSamples {
+			added += len(metrics)
+		}
+
+		// Пакет больше всей очереди принимается в пустую очередь, иначе он не будет принят никогда.
+		if q.depth()+added <= q.Capacity || q.depth() == 0 {
+			for _, m := range metrics {
+				q.pending[metricKey(m)] = m
+			}
+			if q.keepSamples {
+				q.samples = append(q.samples, queuedSamples{metrics: metrics, at: at})
+				q.nSamples += len(metrics)
+			}
+			full := q.depth() >= q.FlushSize
+			q.mu.Unlock()
+
+			if full {
+				q.signal()
+			}
+			return nil
+		}
+
+		if !blocked {
+			blocked = true
+			q.stats.Blocked++
+		}
+		if q.space == nil {
+			q.space = make(chan struct{})
+		}
+		space := q.space
+		q.mu.Unlock()
+
+		q.signal()
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return q.writeDirect(metrics, at)
+		}
+	}
+}
+
+// writeDirect записывает метрики в хранилища, минуя очередь.
+// Запись идет под flushMu, чтобы более старые значения из очереди не записались поверх.
+// Метрики, которые уже есть в очереди, только заменяются в ней: очередь запишет их сама.
+// Запрос уже отменен, поэтому запись ограничена своим временем constants.WriteDirectTimeout.
+func (q *WriteQueue) writeDirect(metrics encoding.ArrMetrics, at time.Time) error {
+	q.mu.Lock()
+	q.stats.Direct++
+	q.mu.Unlock()
+
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	q.mu.Lock()
+	var direct encoding.ArrMetrics
+	for _, m := range metrics {
+		if _, ok := q.pending[metricKey(m)]; ok {
+			q.pending[metricKey(m)] = m
+		} else {
+			direct = append(direct, m)
+		}
+	}
+	q.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), constants.WriteDirectTimeout)
+	defer cancel()
+
+	var errs []string
+	if len(direct) != 0 {
+		if err := q.storage.Upsert(ctx, direct); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if q.keepSamples {
+		if err := q.storage.AppendSamples(ctx, metrics, at); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return joinErrors(errs)
+}
+
+// signal запускает запись очереди, не дожидаясь интервала.
+func (q *WriteQueue) signal() {
+	select {
+	case q.flush <- struct{}{}:
+	default:
+	}
+}
+
+// Flush записывает очередь в хранилища.
+// Метрики, которые не удалось записать, возвращаются в очередь, если их не сменили более новые значения.
+// Ждущие места запросы продолжаются только после записи, когда место действительно освободилось.
+// Значения истории при ошибке не возвращаются: хранилище db само копит их, пока база недоступна,
+// а повтор записал бы значения дважды в хранилища, где запись удалась. Потерянные значения считает
+// QueueStats.DroppedSamples.
+func (q *WriteQueue) Flush(ctx context.Context) error {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	q.mu.Lock()
+	pending, samples := q.pending, q.samples
+	q.pending = make(map[MetricKey]encoding.Metrics)
+	q.writing = len(pending) + q.nSamples
+	q.samples = nil
+	q.nSamples = 0
+	q.mu.Unlock()
+
+	if len(pending) == 0 && len(samples) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	metrics := make(encoding.ArrMetrics, 0, len(pending))
+	for _, m := range pending {
+		metrics = append(metrics, m)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType < metrics[j].MType
+		}
+		return metrics[i].ID < metrics[j].ID
+	})
+
+	var errs []string
+	var failed encoding.ArrMetrics
+	for len(metrics) != 0 {
+		n := q.FlushSize
+		if n <= 0 || n > len(metrics) {
+			n = len(metrics)
+		}
+		if err := q.storage.Upsert(ctx, metrics[:n]); err != nil {
+			errs = append(errs, err.Error())
+			failed = append(failed, metrics[:n]...)
+		}
+		metrics = metrics[n:]
+	}
+	var dropped int64
+	for _, s := range samples {
+		if err := q.storage.AppendSamples(ctx, s.metrics, s.at); err != nil {
+			errs = append(errs, err.Error())
+			dropped += int64(len(s.metrics))
+		}
+	}
+	latency := time.Since(start)
+
+	// Неудачные метрики занимали место как записываемые, поэтому с ними очередь не больше Capacity.
+	q.mu.Lock()
+	q.writing = 0
+	for _, m := range failed {
+		if _, ok := q.pending[metricKey(m)]; !ok {
+			q.pending[metricKey(m)] = m
+		}
+	}
+	if q.space != nil {
+		close(q.space)
+		q.space = nil
+	}
+	q.stats.Flushes++
+	q.stats.DroppedSamples += dropped
+	q.stats.LastFlush = latency
+	if latency > q.stats.MaxFlush {
+		q.stats.MaxFlush = latency
+	}
+	if len(errs) != 0 {
+		q.stats.FlushErrors++
+	}
+	q.mu.Unlock()
+
+	return joinErrors(errs)
+}
+
+// Stats состояние очереди.
+func (q *WriteQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := q.stats
+	stats.Depth = q.depth()
+	return stats
+}
+
+// Close останавливает фоновую запись и записывает остаток очереди.
+// После Close Enqueue возвращает ErrQueueClosed.
+func (q *WriteQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.mu.Unlock()
+
+	close(q.stop)
+	<-q.done
+
+	return q.Flush(ctx)
+}
+
+func (q *WriteQueue) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-q.flush:
+		case <-q.stop:
+			return
+		}
+		if err := q.Flush(context.Background()); err != nil {
+			constants.Logger.ErrorLog(err)
+		}
+	}
+}
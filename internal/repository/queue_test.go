@@ -0,0 +1,158 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+	"github.com/andynikk/advancedmetrics/internal/repository/repositorytest"
+)
+
+func gaugeMetric(id string, value float64) encoding.ArrMetrics {
+	return encoding.ArrMetrics{{ID: id, MType: "gauge", Value: &value}}
+}
+
+func TestWriteQueue(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Checking coalescing", func(t *testing.T) {
+		backend := repositorytest.NewFakeBackend("queue")
+		queue := repository.NewWriteQueue(repository.NewBackends(nil, backend), 100, 50, time.Hour)
+
+		for i := 1; i <= 3; i++ {
+			if err := queue.Enqueue(ctx, gaugeMetric("Alloc", float64(i)), time.Now()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Одна метрика и три значения истории.
+		if depth := queue.Stats().Depth; depth != 4 {
+			t.Errorf("Error queue depth: %d", depth)
+		}
+
+		if err := queue.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+		batches := backend.Batches()
+		if len(batches) != 1 || len(batches[0]) != 1 || *batches[0][0].Value != 3 {
+			t.Errorf("Error coalesced batches: %v", batches)
+		}
+		if samples := backend.SampleCount(); samples != 3 {
+			t.Errorf("Error samples written: %d", samples)
+		}
+		if err := queue.Enqueue(ctx, gaugeMetric("Alloc", 4), time.Now()); !errors.Is(err, repository.ErrQueueClosed) {
+			t.Errorf("Error enqueue after close: %v", err)
+		}
+	})
+
+	t.Run("Checking failed write", func(t *testing.T) {
+		backend := repositorytest.NewFakeBackend("queue")
+		backend.UpsertErr = errors.New("storage unavailable")
+		backend.SamplesErr = errors.New("storage unavailable")
+		queue := repository.NewWriteQueue(repository.NewBackends(nil, backend), 100, 50, time.Hour)
+		defer queue.Close(ctx)
+
+		for _, id := range []string{"A", "B"} {
+			if err := queue.Enqueue(ctx, gaugeMetric(id, 1), time.Now()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := queue.Flush(ctx); err == nil {
+			t.Error("Error flush must return storage error")
+		}
+		// Метрики возвращаются в очередь, значения истории теряются и учитываются.
+		if stats := queue.Stats(); stats.Depth != 2 || stats.DroppedSamples != 2 || stats.FlushErrors != 1 {
+			t.Errorf("Error stats after failed flush: %+v", stats)
+		}
+		backend.UpsertErr = nil
+	})
+
+	t.Run("Checking flush on size", func(t *testing.T) {
+		backend := repositorytest.NewFakeBackend("queue")
+		queue := repository.NewWriteQueue(repository.NewBackends(nil, backend), 100, 4, time.Hour)
+		defer queue.Close(ctx)
+
+		for _, id := range []string{"A", "B"} {
+			if err := queue.Enqueue(ctx, gaugeMetric(id, 1), time.Now()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for queue.Stats().Flushes == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if stats := queue.Stats(); stats.Flushes == 0 || stats.Depth != 0 {
+			t.Errorf("Error flush on size: %+v", stats)
+		}
+	})
+
+	t.Run("Checking backpressure", func(t *testing.T) {
+		backend := repositorytest.NewFakeBackend("queue")
+		backend.Block = make(chan struct{})
+		queue := repository.NewWriteQueue(repository.NewBackends(nil, backend), 4, 4, time.Hour)
+
+		// Первый пакет заполняет очередь, запись зависает в хранилище.
+		if err := queue.Enqueue(ctx, gaugeMetric("A", 1), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if err := queue.Enqueue(ctx, gaugeMetric("B", 1), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Пока хранилище не ответило, записываемые значения занимают место, и запрос ждет.
+		waited := make(chan error, 1)
+		go func() {
+			waited <- queue.Enqueue(ctx, gaugeMetric("C", 1), time.Now())
+		}()
+
+		// Запрос, не дождавшийся места, записывает метрики сам после записи очереди,
+		// и более старое значение A из очереди не записывается поверх нового.
+		direct := make(chan error, 1)
+		go func() {
+			shortCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+			defer cancel()
+			metrics := append(gaugeMetric("A", 2), gaugeMetric("D", 1)...)
+			direct <- queue.Enqueue(shortCtx, metrics, time.Now())
+		}()
+
+		deadline := time.Now().Add(time.Second)
+		for queue.Stats().Direct == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		stats := queue.Stats()
+		if stats.Direct != 1 || stats.Blocked != 2 || stats.Depth != 4 {
+			t.Errorf("Error stats during blocked flush: %+v", stats)
+		}
+		select {
+		case err := <-waited:
+			t.Errorf("Error enqueue finished during blocked flush: %v", err)
+		case err := <-direct:
+			t.Errorf("Error direct write finished during blocked flush: %v", err)
+		default:
+		}
+
+		close(backend.Block)
+		if err := <-waited; err != nil {
+			t.Errorf("Error enqueue after flush: %v", err)
+		}
+		if err := <-direct; err != nil {
+			t.Errorf("Error direct write: %v", err)
+		}
+		if err := queue.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		written := map[string]float64{}
+		for _, batch := range backend.Batches() {
+			for _, m := range batch {
+				written[m.ID] = *m.Value
+			}
+		}
+		if len(written) != 4 || written["A"] != 2 {
+			t.Errorf("Error written metrics after close: %v", written)
+		}
+	})
+}
@@ -0,0 +1,37 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+)
+
+// record метрика в том виде, в котором ее записывают файловое хранилище, bbolt и выгрузка json:
+// вместе со временем последнего изменения. В JSON encoding.Metrics время не входит,
+// чтобы сервер не принимал его от агентов и не отдавал в ответах API.
+type record struct {
+	encoding.Metrics
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+// toRecords метрики со временем изменения для записи.
+func toRecords(metrics encoding.ArrMetrics) []record {
+	records := make([]record, len(metrics))
+	for i, m := range metrics {
+		records[i] = record{Metrics: m, Timestamp: m.Timestamp}
+	}
+	return records
+}
+
+// fromRecords метрики, прочитанные из записи, со временем изменения.
+func fromRecords(records []record) encoding.ArrMetrics {
+	if records == nil {
+		return nil
+	}
+	metrics := make(encoding.ArrMetrics, len(records))
+	for i, r := range records {
+		metrics[i] = r.Metrics
+		metrics[i].Timestamp = r.Timestamp
+	}
+	return metrics
+}
@@ -0,0 +1,132 @@
+// Package repositorytest: хранилище метрик в памяти для тестов пакетов, работающих с repository.Backend.
+package repositorytest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+)
+
+// FakeBackend хранилище, поведение которого задает тест, и которое запоминает все записи.
+// Реализует repository.Backend и repository.SampleStore.
+// Metrics, LoadErr: результат LoadAll
+// UpsertErr: ошибка каждой записи Upsert, записанные с ошибкой метрики не запоминаются
+// SamplesErr: ошибка каждой записи AppendSamples, значения при ошибке не запоминаются
+// HealthErr: результат Health
+// Block: если задан, Upsert ждет, пока из него можно прочитать, например до close(Block)
+// Поля задаются до передачи хранилища в тестируемый код.
+type FakeBackend struct {
+	Metrics    encoding.ArrMetrics
+	LoadErr    error
+	UpsertErr  error
+	SamplesErr error
+	HealthErr  error
+	Block      chan struct{}
+
+	name string
+
+	mu      sync.Mutex
+	batches []encoding.ArrMetrics
+	samples map[repository.MetricKey][]encoding.Sample
+	nSample int
+	closed  bool
+}
+
+// NewFakeBackend создает пустое хранилище с именем name.
+func NewFakeBackend(name string) *FakeBackend {
+	return &FakeBackend{name: name, samples: make(map[repository.MetricKey][]encoding.Sample)}
+}
+
+func (b *FakeBackend) Name() string                     { return b.name }
+func (b *FakeBackend) Init(ctx context.Context) error   { return nil }
+func (b *FakeBackend) Health(ctx context.Context) error { return b.HealthErr }
+
+func (b *FakeBackend) LoadAll(ctx context.Context) (encoding.ArrMetrics, error) {
+	return b.Metrics, b.LoadErr
+}
+
+func (b *FakeBackend) Upsert(ctx context.Context, metrics encoding.ArrMetrics) error {
+	if b.Block != nil {
+		<-b.Block
+	}
+	if b.UpsertErr != nil {
+		return b.UpsertErr
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.batches = append(b.batches, metrics)
+	return nil
+}
+
+func (b *FakeBackend) Delete(ctx context.Context, _ ...repository.MetricKey) error {
+	return nil
+}
+
+func (b *FakeBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+func (b *FakeBackend) AppendSamples(ctx context.Context, metrics encoding.ArrMetrics, at time.Time) error {
+	if b.SamplesErr != nil {
+		return b.SamplesErr
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range metrics {
+		key := repository.MetricKey{ID: m.ID, MType: m.MType}
+		b.samples[key] = append(b.samples[key], encoding.Sample{Time: at, Value: m.Value, Delta: m.Delta})
+	}
+	b.nSample += len(metrics)
+	return nil
+}
+
+func (b *FakeBackend) Samples(ctx context.Context, key repository.MetricKey, from time.Time, to time.Time) ([]encoding.Sample, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	samples := make([]encoding.Sample, 0)
+	for _, s := range b.samples[key] {
+		if !s.Time.Before(from) && s.Time.Before(to) {
+			samples = append(samples, s)
+		}
+	}
+	return samples, nil
+}
+
+// Batches пакеты метрик, записанные Upsert, в порядке записи.
+func (b *FakeBackend) Batches() []encoding.ArrMetrics {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]encoding.ArrMetrics(nil), b.batches...)
+}
+
+// Last последний пакет, записанный Upsert, nil - записей не было.
+func (b *FakeBackend) Last() encoding.ArrMetrics {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.batches) == 0 {
+		return nil
+	}
+	return b.batches[len(b.batches)-1]
+}
+
+// SampleCount количество значений, добавленных в историю AppendSamples.
+func (b *FakeBackend) SampleCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.nSample
+}
+
+// Closed вызывался ли Close.
+func (b *FakeBackend) Closed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
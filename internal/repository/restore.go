@@ -0,0 +1,158 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+)
+
+// ErrUnknownRestorePolicy политика восстановления не primary, не newest и не merge.
+var ErrUnknownRestorePolicy = errors.New("неизвестная политика восстановления")
+
+// ErrRestoreUnavailable ни одно хранилище не удалось прочитать при политике primary или newest.
+var ErrRestoreUnavailable = errors.New("не удалось прочитать ни одно хранилище")
+
+// RestoreSource что было прочитано из одного хранилища при восстановлении.
+// Loaded: сколько метрик прочитано
+// Restored: сколько из них попало во временное хранилище
+// Newest: время самого позднего изменения среди прочитанных метрик
+// Error: ошибка чтения хранилища
+type RestoreSource struct {
+	Backend  string     `json:"backend"`
+	Loaded   int        `json:"loaded"`
+	Restored int        `json:"restored"`
+	Newest   *time.Time `json:"newest,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// RestoreReport итог восстановления метрик при запуске сервера.
+type RestoreReport struct {
+	Policy   string          `json:"policy"`
+	Sources  []RestoreSource `json:"sources"`
+	Restored int             `json:"restored"`
+	Duration time.Duration   `json:"duration"`
+}
+
+// String отчет одной строкой для журнала.
+func (r RestoreReport) String() string {
+	sources := make([]string, 0, len(r.Sources))
+	for _, s := range r.Sources {
+		if s.Error != "" {
+			sources = append(sources, fmt.Sprintf("%s: error %s", s.Backend, s.Error))
+			continue
+		}
+		sources = append(sources, fmt.Sprintf("%s: %d of %d", s.Backend, s.Restored, s.Loaded))
+	}
+	return fmt.Sprintf("restored %d metrics, policy %s, %s (%s)",
+		r.Restored, r.Policy, strings.Join(sources, "; "), r.Duration)
+}
+
+// newestTimestamp время самого позднего изменения среди метрик, nil если ни у одной нет времени.
+func newestTimestamp(metrics encoding.ArrMetrics) *time.Time {
+	var newest *time.Time
+	for _, m := range metrics {
+		if m.Timestamp != nil && (newest == nil || m.Timestamp.After(*newest)) {
+			newest = m.Timestamp
+		}
+	}
+	return newest
+}
+
+// newer true, если метрика a изменена позже b. Метрика без времени старше любой метрики со временем.
+func newer(a *time.Time, b *time.Time) bool {
+	if a == nil {
+		return false
+	}
+	return b == nil || a.After(*b)
+}
+
+// Restore читает метрики из хранилищ и выбирает, какие значения восстановить, по политике policy:
+// primary: все метрики первого хранилища, которое удалось прочитать, в порядке списка хранилищ
+// newest: все метрики хранилища, в котором самое позднее изменение; при равенстве - первого по списку
+// merge: для каждой метрики значение с самым поздним временем изменения из всех хранилищ
+// Каждая метрика восстанавливается ровно один раз, значения разных хранилищ не складываются.
+// Если при primary или newest не прочитано ни одно хранилище, возвращает ErrRestoreUnavailable:
+// пустое восстановление обнулило бы счетчики, сохраненные в недоступном хранилище.
+func (b Backends) Restore(ctx context.Context, policy string) (encoding.ArrMetrics, RestoreReport, error) {
+	report := RestoreReport{Policy: policy, Sources: make([]RestoreSource, 0, len(b.list))}
+	switch policy {
+	case constants.RestorePrimary, constants.RestoreNewest, constants.RestoreMerge:
+	default:
+		return nil, report, fmt.Errorf("%w: %s", ErrUnknownRestorePolicy, policy)
+	}
+
+	start := time.Now()
+	loaded := make([]encoding.ArrMetrics, 0, len(b.list))
+	for _, backend := range b.list {
+		source := RestoreSource{Backend: backend.Name()}
+		metrics, err := backend.LoadAll(ctx)
+		if err != nil {
+			source.Error = err.Error()
+			metrics = nil
+		}
+		source.Loaded = len(metrics)
+		source.Newest = newestTimestamp(metrics)
+
+		report.Sources = append(report.Sources, source)
+		loaded = append(loaded, metrics)
+
+		// Для primary остальные хранилища не читаются.
+		if policy == constants.RestorePrimary && err == nil {
+			break
+		}
+	}
+
+	var restored encoding.ArrMetrics
+	switch policy {
+	case constants.RestorePrimary, constants.RestoreNewest:
+		chosen := -1
+		for i, source := range report.Sources {
+			if source.Error != "" {
+				continue
+			}
+			if chosen == -1 || newer(source.Newest, report.Sources[chosen].Newest) {
+				chosen = i
+			}
+		}
+		if chosen == -1 && len(report.Sources) != 0 {
+			report.Duration = time.Since(start)
+			return nil, report, fmt.Errorf("%w: %s", ErrRestoreUnavailable, report.String())
+		}
+		if chosen != -1 {
+			restored = loaded[chosen]
+			report.Sources[chosen].Restored = len(restored)
+		}
+
+	case constants.RestoreMerge:
+		idx := make(map[MetricKey]int)
+		var from []int
+		for i, metrics := range loaded {
+			for _, m := range metrics {
+				key := metricKey(m)
+				j, ok := idx[key]
+				if !ok {
+					idx[key] = len(restored)
+					restored = append(restored, m)
+					from = append(from, i)
+					continue
+				}
+				if newer(m.Timestamp, restored[j].Timestamp) {
+					restored[j] = m
+					from[j] = i
+				}
+			}
+		}
+		for _, i := range from {
+			report.Sources[i].Restored++
+		}
+	}
+
+	report.Restored = len(restored)
+	report.Duration = time.Since(start)
+	return restored, report, nil
+}
@@ -0,0 +1,131 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+	"github.com/andynikk/advancedmetrics/internal/repository/repositorytest"
+)
+
+func counterAt(id string, delta int64, at time.Time) encoding.Metrics {
+	return encoding.Metrics{ID: id, MType: "counter", Delta: &delta, Timestamp: &at}
+}
+
+func TestBackendsRestore(t *testing.T) {
+	ctx := context.Background()
+	older := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Minute)
+
+	// В БД счетчик PollCount свежее, в файле свежее RandomValue.
+	db := repositorytest.NewFakeBackend("db")
+	db.Metrics = encoding.ArrMetrics{
+		counterAt("PollCount", 10, newer),
+		counterAt("RandomValue", 1, older),
+	}
+	file := repositorytest.NewFakeBackend("file")
+	file.Metrics = encoding.ArrMetrics{
+		counterAt("PollCount", 7, older),
+		counterAt("RandomValue", 2, newer.Add(time.Second)),
+		counterAt("FileOnly", 3, older),
+	}
+	broken := repositorytest.NewFakeBackend("bolt")
+	broken.LoadErr = errors.New("bolt unavailable")
+
+	restored := func(metrics encoding.ArrMetrics) map[string]int64 {
+		values := make(map[string]int64)
+		for _, m := range metrics {
+			if _, ok := values[m.ID]; ok {
+				t.Errorf("Error metric %s restored twice", m.ID)
+			}
+			values[m.ID] = *m.Delta
+		}
+		return values
+	}
+
+	t.Run("Checking primary", func(t *testing.T) {
+		metrics, report, err := repository.NewBackends(nil, broken, db, file).Restore(ctx, constants.RestorePrimary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := restored(metrics)
+		if len(values) != 2 || values["PollCount"] != 10 || values["RandomValue"] != 1 {
+			t.Errorf("Error primary restore: %v", values)
+		}
+		if len(report.Sources) != 2 || report.Sources[0].Error == "" || report.Sources[1].Restored != 2 {
+			t.Errorf("Error primary report: %+v", report)
+		}
+	})
+
+	t.Run("Checking newest", func(t *testing.T) {
+		metrics, report, err := repository.NewBackends(nil, db, file).Restore(ctx, constants.RestoreNewest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := restored(metrics)
+		if len(values) != 3 || values["PollCount"] != 7 || values["RandomValue"] != 2 {
+			t.Errorf("Error newest restore: %v", values)
+		}
+		if report.Sources[0].Restored != 0 || report.Sources[1].Restored != 3 || report.Restored != 3 {
+			t.Errorf("Error newest report: %+v", report)
+		}
+	})
+
+	t.Run("Checking merge", func(t *testing.T) {
+		metrics, report, err := repository.NewBackends(nil, db, broken, file).Restore(ctx, constants.RestoreMerge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := restored(metrics)
+		if len(values) != 3 || values["PollCount"] != 10 || values["RandomValue"] != 2 || values["FileOnly"] != 3 {
+			t.Errorf("Error merge restore: %v", values)
+		}
+		if report.Sources[0].Restored != 1 || report.Sources[2].Restored != 2 {
+			t.Errorf("Error merge report: %+v", report)
+		}
+	})
+
+	t.Run("Checking no source readable", func(t *testing.T) {
+		for _, policy := range []string{constants.RestorePrimary, constants.RestoreNewest} {
+			_, report, err := repository.NewBackends(nil, broken).Restore(ctx, policy)
+			if !errors.Is(err, repository.ErrRestoreUnavailable) || len(report.Sources) != 1 {
+				t.Errorf("Error %s restore without readable source: %v %+v", policy, err, report)
+			}
+		}
+		if _, _, err := repository.NewBackends(nil).Restore(ctx, constants.RestorePrimary); err != nil {
+			t.Errorf("Error restore without storages: %v", err)
+		}
+	})
+
+	t.Run("Checking unknown policy", func(t *testing.T) {
+		if _, _, err := repository.NewBackends(nil, db).Restore(ctx, "sum"); !errors.Is(err, repository.ErrUnknownRestorePolicy) {
+			t.Errorf("Error unknown policy: %v", err)
+		}
+	})
+
+	t.Run("Checking counters are not added", func(t *testing.T) {
+		metrics, _, err := repository.NewBackends(nil, db, file).Restore(ctx, constants.RestoreMerge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := repository.NewStore()
+		if _, err = store.UpdateText("counter", "PollCount", "5"); err != nil {
+			t.Fatal(err)
+		}
+		if err = store.Restore(metrics); err != nil {
+			t.Fatal(err)
+		}
+		if mt, _ := store.Get("PollCount"); *mt.Delta != 10 {
+			t.Errorf("Error restored counter: %d", *mt.Delta)
+		}
+		for _, mt := range store.Snapshot() {
+			if mt.ID == "PollCount" && !mt.Timestamp.Equal(newer) {
+				t.Errorf("Error restored timestamp: %v", mt.Timestamp)
+			}
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+)
+
+// ErrNoSampleStore ни одно из подключенных хранилищ не хранит историю метрик.
+var ErrNoSampleStore = errors.New("история метрик не хранится: нужно хранилище db")
+
+// SampleStore хранилище истории значений метрик.
+type SampleStore interface {
+	// AppendSamples добавляет в историю значения метрик на момент at.
+	AppendSamples(ctx context.Context, metrics encoding.ArrMetrics, at time.Time) error
+	// Samples значения метрики за период [from, to) по возрастанию времени.
+	Samples(ctx context.Context, key MetricKey, from time.Time, to time.Time) ([]encoding.Sample, error)
+}
+
+// KeepsSamples хотя бы одно из хранилищ ведет историю метрик.
+func (b Backends) KeepsSamples() bool {
+	for _, backend := range b.list {
+		if _, ok := backend.(SampleStore); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendSamples добавляет значения метрик в историю всех хранилищ, которые ее ведут.
+func (b Backends) AppendSamples(ctx context.Context, metrics encoding.ArrMetrics, at time.Time) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	var errs []string
+	for _, backend := range b.list {
+		store, ok := backend.(SampleStore)
+		if !ok {
+			continue
+		}
+		if err := store.AppendSamples(ctx, metrics, at); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", backend.Name(), err.Error()))
+		}
+	}
+	return joinErrors(errs)
+}
+
+// Samples значения метрики из истории первого хранилища, которое ее ведет.
+func (b Backends) Samples(ctx context.Context, key MetricKey, from time.Time, to time.Time) ([]encoding.Sample, error) {
+	for _, backend := range b.list {
+		if store, ok := backend.(SampleStore); ok {
+			return store.Samples(ctx, key, from, to)
+		}
+	}
+	return nil, ErrNoSampleStore
+}
@@ -0,0 +1,184 @@
+package repository
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/andynikk/advancedmetrics/internal/compression"
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encryption"
+)
+
+// Формат снимка с заголовком:
+// метка AMSNAP (6 байт) | версия (1 байт) | флаги (1 байт) | шифрование (1 байт) | данные.
+// Снимок без метки - JSON прежних версий сервера, он читается как есть.
+const (
+	snapshotVersion    byte = 1
+	snapshotHeaderSize      = 9
+
+	snapshotFlagGzip byte = 1
+
+	snapshotCipherNone byte = 0
+	snapshotCipherAES  byte = 1
+	snapshotCipherRSA  byte = 2
+)
+
+var snapshotMagic = []byte("AMSNAP")
+
+// SnapshotCodec сжимает и шифрует снимок и журнал файлового хранилища.
+// Compress: сжимать данные gzip
+// Encryption: шифрование (none, aes, rsa)
+// Key: ключ AES-GCM для шифрования aes
+// PK: ключ RSA сервера, для шифрования rsa им шифруется случайный ключ AES-GCM каждого снимка
+type SnapshotCodec struct {
+	Compress   bool
+	Encryption string
+	Key        []byte
+	PK         *encryption.KeyEncryption
+}
+
+// NewSnapshotCodec проверяет настройки шифрования снимка.
+// keyHex: ключ AES в шестнадцатеричном виде длиной 16, 24 или 32 байта
+func NewSnapshotCodec(compress bool, encryptionType string, keyHex string, pk *encryption.KeyEncryption) (*SnapshotCodec, error) {
+	codec := &SnapshotCodec{Compress: compress, Encryption: encryptionType, PK: pk}
+
+	switch encryptionType {
+	case "", constants.SnapshotEncryptionNone:
+		codec.Encryption = constants.SnapshotEncryptionNone
+	case constants.SnapshotEncryptionAES:
+		key, err := hex.DecodeString(keyHex)
+		if err != nil {
+			return nil, fmt.Errorf("ключ шифрования снимка: %w", err)
+		}
+		if _, err = aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("ключ шифрования снимка: %w", err)
+		}
+		codec.Key = key
+	case constants.SnapshotEncryptionRSA:
+		if pk == nil || pk.PrivateKey == nil {
+			return nil, errors.New("для шифрования снимка rsa нужен приватный ключ CRYPTO_KEY")
+		}
+	default:
+		return nil, fmt.Errorf("неизвестное шифрование снимка %q, доступны: %s, %s, %s", encryptionType,
+			constants.SnapshotEncryptionNone, constants.SnapshotEncryptionAES, constants.SnapshotEncryptionRSA)
+	}
+
+	return codec, nil
+}
+
+// Encrypted данные шифруются.
+func (c *SnapshotCodec) Encrypted() bool {
+	return c != nil && c.Encryption != "" && c.Encryption != constants.SnapshotEncryptionNone
+}
+
+// Plain данные пишутся без заголовка, как в прежних версиях сервера.
+func (c *SnapshotCodec) Plain() bool {
+	return c == nil || (!c.Compress && !c.Encrypted())
+}
+
+// Encode сжимает и шифрует данные по настройкам и добавляет заголовок.
+func (c *SnapshotCodec) Encode(data []byte) ([]byte, error) {
+	if c.Plain() {
+		return data, nil
+	}
+
+	header := make([]byte, 0, snapshotHeaderSize)
+	header = append(header, snapshotMagic...)
+	header = append(header, snapshotVersion, 0, snapshotCipherNone)
+
+	if c.Compress {
+		header[7] |= snapshotFlagGzip
+		compressed, err := compression.Compress(data)
+		if err != nil {
+			return nil, err
+		}
+		data = compressed
+	}
+
+	switch c.Encryption {
+	case constants.SnapshotEncryptionAES:
+		header[8] = snapshotCipherAES
+		aead, err := snapshotGCM(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		frame := append(header, nonce...)
+		return aead.Seal(frame, nonce, data, header), nil
+	case constants.SnapshotEncryptionRSA:
+		header[8] = snapshotCipherRSA
+		encrypted, err := c.PK.HybridEncrypt(data)
+		if err != nil {
+			return nil, err
+		}
+		return append(header, encrypted...), nil
+	}
+
+	return append(header, data...), nil
+}
+
+// Decode определяет формат по заголовку, расшифровывает и распаковывает данные.
+// Данные без заголовка возвращаются как есть.
+func (c *SnapshotCodec) Decode(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, snapshotMagic) {
+		return data, nil
+	}
+	if len(data) < snapshotHeaderSize {
+		return nil, errors.New("заголовок снимка обрезан")
+	}
+	if data[6] != snapshotVersion {
+		return nil, fmt.Errorf("неизвестная версия снимка: %d", data[6])
+	}
+	header, body := data[:snapshotHeaderSize], data[snapshotHeaderSize:]
+
+	var err error
+	switch header[8] {
+	case snapshotCipherNone:
+	case snapshotCipherAES:
+		if c == nil || c.Key == nil {
+			return nil, errors.New("снимок зашифрован aes, ключ SNAPSHOT_KEY не задан")
+		}
+		aead, err := snapshotGCM(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(body) < aead.NonceSize() {
+			return nil, errors.New("снимок обрезан")
+		}
+		body, err = aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], header)
+		if err != nil {
+			return nil, fmt.Errorf("не удалось расшифровать снимок: %w", err)
+		}
+	case snapshotCipherRSA:
+		if c == nil || c.PK == nil || c.PK.PrivateKey == nil {
+			return nil, errors.New("снимок зашифрован rsa, приватный ключ CRYPTO_KEY не задан")
+		}
+		if body, err = c.PK.HybridDecrypt(body); err != nil {
+			return nil, fmt.Errorf("не удалось расшифровать снимок: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("неизвестное шифрование снимка: %d", header[8])
+	}
+
+	if header[7]&snapshotFlagGzip != 0 {
+		return compression.Decompress(body)
+	}
+	return body, nil
+}
+
+func snapshotGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,142 @@
+package repository_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/encryption"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+)
+
+func TestSnapshotCodec(t *testing.T) {
+	ctx := context.Background()
+	aesKey := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+	pvk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := &encryption.KeyEncryption{PrivateKey: pvk, PublicKey: &pvk.PublicKey}
+
+	gauge := 0.5
+	batch := encoding.ArrMetrics{{ID: "Alloc", MType: "gauge", Value: &gauge}}
+
+	tests := []struct {
+		name string
+		cfg  repository.BackendConfig
+	}{
+		{name: "gzip", cfg: repository.BackendConfig{SnapshotCompress: true}},
+		{name: "aes", cfg: repository.BackendConfig{SnapshotEncryption: "aes", SnapshotKey: aesKey}},
+		{name: "gzip and rsa", cfg: repository.BackendConfig{SnapshotCompress: true, SnapshotEncryption: "rsa", SnapshotPK: pk}},
+	}
+	for _, tt := range tests {
+		t.Run("Checking "+tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.StoreFile = filepath.Join(t.TempDir(), "metrics.json")
+
+			backend, err := repository.NewFileBackend(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = backend.Init(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err = backend.Upsert(ctx, batch); err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.SnapshotEncryption != "" {
+				wal, err := os.ReadFile(cfg.StoreFile + ".wal")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(wal, []byte("Alloc")) {
+					t.Errorf("Error journal must be encrypted")
+				}
+			}
+			if err = backend.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(cfg.StoreFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(data, []byte("AMSNAP")) {
+				t.Errorf("Error snapshot must have header")
+			}
+			if cfg.SnapshotEncryption != "" && bytes.Contains(data, []byte("Alloc")) {
+				t.Errorf("Error snapshot must be encrypted")
+			}
+
+			restored, err := repository.NewFileBackend(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = restored.Init(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer restored.Close()
+			metrics, err := restored.LoadAll(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(metrics) != 1 || *metrics[0].Value != gauge {
+				t.Errorf("Error restore snapshot: %+v", metrics)
+			}
+		})
+	}
+
+	t.Run("Checking plain snapshot", func(t *testing.T) {
+		storeFile := filepath.Join(t.TempDir(), "metrics.json")
+		plain := []byte(`[{"id":"Alloc","type":"gauge","value":0.5}]`)
+		if err := os.WriteFile(storeFile, plain, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		backend, err := repository.NewFileBackend(repository.BackendConfig{StoreFile: storeFile,
+			SnapshotEncryption: "aes", SnapshotKey: aesKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = backend.Init(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer backend.Close()
+		metrics, err := backend.LoadAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != 1 || metrics[0].ID != "Alloc" {
+			t.Errorf("Error read plain snapshot: %+v", metrics)
+		}
+	})
+	t.Run("Checking wrong key", func(t *testing.T) {
+		codec, err := repository.NewSnapshotCodec(false, "aes", aesKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame, err := codec.Encode([]byte("[]"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := repository.NewSnapshotCodec(false, "aes", "ff"+aesKey[2:], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = other.Decode(frame); err == nil {
+			t.Errorf("Error snapshot must not decrypt with wrong key")
+		}
+	})
+	t.Run("Checking rsa without key", func(t *testing.T) {
+		if _, err := repository.NewSnapshotCodec(false, "rsa", "", nil); err == nil {
+			t.Errorf("Error rsa encryption requires private key")
+		}
+	})
+}
@@ -0,0 +1,519 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+)
+
+var (
+	// ErrUnknownType тип метрики не gauge и не counter.
+	ErrUnknownType = errors.New("неизвестный тип метрики")
+	// ErrBadValue значение метрики не задано или не соответствует типу.
+	ErrBadValue = errors.New("неверное значение метрики")
+	// ErrTypeMismatch метрика с этим именем уже хранится с другим типом.
+	ErrTypeMismatch = errors.New("метрика уже хранится с другим типом")
+	// ErrReservedID имя метрики занято метриками самого сервера.
+	ErrReservedID = errors.New("имя метрики зарезервировано для метрик сервера")
+	// ErrLabelsUnsupported метрика с метками. Хранилища ведут метрики только по имени,
+	// метки входят лишь в хеш схемы v2, поэтому такие метрики не принимаются, а не теряют метки.
+	ErrLabelsUnsupported = errors.New("метки метрик не поддерживаются")
+)
+
+// storeShards количество сегментов хранилища, степень двойки.
+const storeShards = 64
+
+// storeMetric значение метрики. Тип задается при создании и не меняется,
+// значение читается атомарно, без блокировки сегмента на запись.
+// Изменения идут под mu: так снимок получает значение до изменения, см. snapshotState.
+type storeMetric struct {
+	mu      sync.Mutex
+	mType   string
+	gauge   atomic.Uint64 // биты float64
+	delta   atomic.Int64
+	updated atomic.Int64 // время последнего изменения, UnixNano
+}
+
+func (sm *storeMetric) metrics(id string) encoding.Metrics {
+	mt := encoding.Metrics{ID: id, MType: sm.mType}
+	if sm.mType == "gauge" {
+		value := math.Float64frombits(sm.gauge.Load())
+		mt.Value = &value
+	} else {
+		delta := sm.delta.Load()
+		mt.Delta = &delta
+	}
+	return mt
+}
+
+type storeShard struct {
+	mu      sync.RWMutex
+	metrics map[string]*storeMetric
+}
+
+// preImage значение метрики на момент начала снимка. exists false - метрики тогда не было.
+type preImage struct {
+	exists  bool
+	mt      encoding.Metrics
+	updated int64
+}
+
+// imageOf значение метрики sm для снимка, sm nil - метрики нет.
+func imageOf(id string, sm *storeMetric) preImage {
+	if sm == nil {
+		return preImage{}
+	}
+	return preImage{exists: true, mt: sm.metrics(id), updated: sm.updated.Load()}
+}
+
+// snapshotState выполняющийся снимок хранилища.
+// Пакеты изменений эпохи cut и позже начаты после снимка и в него не попадают:
+// перед первым изменением метрики они запоминают в pre ее значение на момент снимка.
+// Пакеты более ранних эпох попадают в снимок целиком: снимок ждет их завершения,
+// а их изменения метрик, уже запомненных в pre, применяются и к запомненным значениям.
+type snapshotState struct {
+	cut uint64
+
+	mu  sync.Mutex
+	pre map[string]preImage
+}
+
+// change вызывается под блокировкой метрики id перед ее изменением пакетом эпохи epoch.
+// Пакет, начатый после снимка, запоминает значение метрики до изменения.
+// Для пакета, начатого до снимка, возвращает true, если значение уже запомнено:
+// тогда изменение нужно применить и к нему через apply.
+func (st *snapshotState) change(epoch uint64, id string, sm *storeMetric) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	_, ok := st.pre[id]
+	if epoch < st.cut {
+		return ok
+	}
+	if !ok {
+		st.pre[id] = imageOf(id, sm)
+	}
+	return false
+}
+
+// apply применяет изменение пакета, начатого до снимка, к запомненному значению метрики id.
+func (st *snapshotState) apply(id string, fn func(p *preImage)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	p := st.pre[id]
+	fn(&p)
+	st.pre[id] = p
+}
+
+// Store временное хранилище метрик сервера в памяти.
+// Метрики разделены по сегментам по хешу имени, у каждого сегмента своя блокировка.
+// Блокировка на запись нужна только при добавлении новой метрики: значения существующих
+// метрик меняются атомарно под блокировкой на чтение, поэтому чтение не задерживает запись.
+// Метрики идентифицируются именем, как и в MutexRepo.
+// Каждое изменение (Update, пакет UpdateBatch, Restore, Delete, загрузка Import) относится к эпохе,
+// в которой начато. Snapshot начинает новую эпоху и не останавливает изменения:
+// пакет попадает в снимок целиком или не попадает совсем, см. snapshotState.
+type Store struct {
+	shards [storeShards]storeShard
+
+	epoch    atomic.Uint64
+	inflight [2]atomic.Int64
+	snap     atomic.Pointer[snapshotState]
+	snapMu   sync.Mutex
+	importMu sync.Mutex
+}
+
+// NewStore создает пустое хранилище метрик.
+func NewStore() *Store {
+	s := &Store{}
+	for i := range s.shards {
+		s.shards[i].metrics = make(map[string]*storeMetric)
+	}
+	return s
+}
+
+// shard сегмент метрики по хешу FNV-1a имени.
+func (s *Store) shard(id string) *storeShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+	return &s.shards[h&(storeShards-1)]
+}
+
+// begin начинает изменение хранилища и возвращает его эпоху. Изменение завершает end.
+func (s *Store) begin() uint64 {
+	for {
+		epoch := s.epoch.Load()
+		s.inflight[epoch&1].Add(1)
+		if s.epoch.Load() == epoch {
+			return epoch
+		}
+		s.inflight[epoch&1].Add(-1)
+	}
+}
+
+func (s *Store) end(epoch uint64) {
+	s.inflight[epoch&1].Add(-1)
+}
+
+// metric возвращает метрику id, создавая ее с типом mType, если ее нет.
+func (s *Store) metric(epoch uint64, id string, mType string) (*storeMetric, error) {
+	sh := s.shard(id)
+
+	sh.mu.RLock()
+	sm, ok := sh.metrics[id]
+	sh.mu.RUnlock()
+
+	if !ok {
+		sh.mu.Lock()
+		if sm, ok = sh.metrics[id]; !ok {
+			if st := s.snap.Load(); st != nil {
+				st.change(epoch, id, nil)
+			}
+			sm = &storeMetric{mType: mType}
+			sh.metrics[id] = sm
+		}
+		sh.mu.Unlock()
+	}
+
+	if sm.mType != mType {
+		return nil, fmt.Errorf("%w: %s %s", ErrTypeMismatch, id, sm.mType)
+	}
+	return sm, nil
+}
+
+// Update устанавливает значение gauge или прибавляет значение counter.
+// Возвращает значение метрики после изменения, без хеша.
+func (s *Store) Update(m encoding.Metrics) (encoding.Metrics, error) {
+	epoch := s.begin()
+	defer s.end(epoch)
+
+	return s.update(epoch, m)
+}
+
+// UpdateBatch применяет метрики по порядку, как Update, и возвращает их значения после изменения.
+// Сначала проверяются все метрики пакета, и при ошибке не применяется ни одна.
+// Если метрику с другим типом одновременно создал другой запрос, обработка прекращается
+// на ней и вместе с ошибкой возвращаются уже примененные метрики.
+// Snapshot видит пакет целиком или не видит совсем.
+func (s *Store) UpdateBatch(metrics encoding.ArrMetrics) (encoding.ArrMetrics, error) {
+	types := make(map[string]string, len(metrics))
+	for _, m := range metrics {
+		if err := check(m); err != nil {
+			return nil, err
+		}
+		mType, ok := types[m.ID]
+		if !ok {
+			if cur, found := s.Get(m.ID); found {
+				mType, ok = cur.MType, true
+			}
+		}
+		if ok && mType != m.MType {
+			return nil, fmt.Errorf("%w: %s %s", ErrTypeMismatch, m.ID, mType)
+		}
+		types[m.ID] = m.MType
+	}
+
+	epoch := s.begin()
+	defer s.end(epoch)
+
+	updated := make(encoding.ArrMetrics, 0, len(metrics))
+	for _, m := range metrics {
+		mt, err := s.update(epoch, m)
+		if err != nil {
+			return updated, err
+		}
+		updated = append(updated, mt)
+	}
+	return updated, nil
+}
+
+// check проверяет тип, значение, имя и метки метрики до изменения хранилища.
+func check(m encoding.Metrics) error {
+	switch m.MType {
+	case "gauge":
+		if m.Value == nil {
+			return fmt.Errorf("%w: %s", ErrBadValue, m.ID)
+		}
+	case "counter":
+		if m.Delta == nil {
+			return fmt.Errorf("%w: %s", ErrBadValue, m.ID)
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownType, m.MType)
+	}
+	if ReservedID(m.ID) {
+		return fmt.Errorf("%w: %s", ErrReservedID, m.ID)
+	}
+	if len(m.Labels) != 0 {
+		return fmt.Errorf("%w: %s", ErrLabelsUnsupported, m.ID)
+	}
+	return nil
+}
+
+// update изменяет метрику, как Update, в эпохе epoch.
+func (s *Store) update(epoch uint64, m encoding.Metrics) (encoding.Metrics, error) {
+	if err := check(m); err != nil {
+		return encoding.Metrics{}, err
+	}
+
+	sm, err := s.metric(epoch, m.ID, m.MType)
+	if err != nil {
+		return encoding.Metrics{}, err
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	st := s.snap.Load()
+	preserved := st != nil && st.change(epoch, m.ID, sm)
+
+	mt := encoding.Metrics{ID: m.ID, MType: m.MType}
+	if m.MType == "gauge" {
+		value := *m.Value
+		sm.gauge.Store(math.Float64bits(value))
+		mt.Value = &value
+	} else {
+		delta := sm.delta.Add(*m.Delta)
+		mt.Delta = &delta
+	}
+	updated := time.Now().UnixNano()
+	sm.updated.Store(updated)
+
+	if preserved {
+		st.apply(m.ID, func(p *preImage) {
+			if !p.exists || p.mt.MType != m.MType {
+				*p = preImage{exists: true, mt: encoding.Metrics{ID: m.ID, MType: m.MType}}
+			}
+			if m.MType == "gauge" {
+				value := *m.Value
+				p.mt.Value = &value
+			} else {
+				delta := *m.Delta
+				if p.mt.Delta != nil {
+					delta += *p.mt.Delta
+				}
+				p.mt.Delta = &delta
+			}
+			p.updated = updated
+		})
+	}
+	return mt, nil
+}
+
+// Restore заменяет метрики значениями из физического хранилища.
+// В отличие от Update значение counter не прибавляется, а устанавливается.
+// Время изменения берется из Timestamp, без него метрика считается измененной сейчас.
+func (s *Store) Restore(metrics encoding.ArrMetrics) error {
+	epoch := s.begin()
+	defer s.end(epoch)
+
+	return s.restore(epoch, metrics)
+}
+
+// restore заменяет метрики, как Restore, в эпохе epoch.
+func (s *Store) restore(epoch uint64, metrics encoding.ArrMetrics) error {
+	for _, m := range metrics {
+		sm := &storeMetric{mType: m.MType}
+		switch {
+		case m.MType == "gauge" && m.Value != nil:
+			sm.gauge.Store(math.Float64bits(*m.Value))
+		case m.MType == "counter" && m.Delta != nil:
+			sm.delta.Store(*m.Delta)
+		case m.MType != "gauge" && m.MType != "counter":
+			return fmt.Errorf("%w: %s", ErrUnknownType, m.MType)
+		default:
+			return fmt.Errorf("%w: %s", ErrBadValue, m.ID)
+		}
+		updated := time.Now()
+		if m.Timestamp != nil {
+			updated = *m.Timestamp
+		}
+		sm.updated.Store(updated.UnixNano())
+
+		s.replace(epoch, m.ID, sm)
+	}
+	return nil
+}
+
+// replace заменяет метрику id на sm в эпохе epoch, sm nil - удаляет ее.
+func (s *Store) replace(epoch uint64, id string, sm *storeMetric) {
+	sh := s.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	old := sh.metrics[id]
+	if old != nil {
+		old.mu.Lock()
+		defer old.mu.Unlock()
+	}
+
+	st := s.snap.Load()
+	preserved := st != nil && st.change(epoch, id, old)
+	if sm == nil {
+		delete(sh.metrics, id)
+	} else {
+		sh.metrics[id] = sm
+	}
+	if preserved {
+		st.apply(id, func(p *preImage) {
+			*p = imageOf(id, sm)
+		})
+	}
+}
+
+// UpdateText разбирает значение метрики из текста и применяет его, как Update.
+func (s *Store) UpdateText(mType string, id string, value string) (encoding.Metrics, error) {
+	m := encoding.Metrics{ID: id, MType: mType}
+	switch mType {
+	case "gauge":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return encoding.Metrics{}, fmt.Errorf("%w: %s", ErrBadValue, err.Error())
+		}
+		m.Value = &v
+	case "counter":
+		d, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return encoding.Metrics{}, fmt.Errorf("%w: %s", ErrBadValue, err.Error())
+		}
+		m.Delta = &d
+	default:
+		return encoding.Metrics{}, fmt.Errorf("%w: %s", ErrUnknownType, mType)
+	}
+	return s.Update(m)
+}
+
+// Get текущее значение метрики id, без хеша.
+func (s *Store) Get(id string) (encoding.Metrics, bool) {
+	sh := s.shard(id)
+
+	sh.mu.RLock()
+	sm, ok := sh.metrics[id]
+	sh.mu.RUnlock()
+
+	if !ok {
+		return encoding.Metrics{}, false
+	}
+	return sm.metrics(id), true
+}
+
+// Snapshot значения всех метрик без определенного порядка, со временем последнего изменения.
+// Снимок согласован: пакет UpdateBatch или загрузка Import видны целиком или не видны совсем.
+// Снимок ждет только изменения, начатые до него; изменения, начатые во время чтения, не ждут снимка.
+// Снимки выполняются по одному.
+func (s *Store) Snapshot() encoding.ArrMetrics {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	st := &snapshotState{cut: s.epoch.Load() + 1, pre: make(map[string]preImage)}
+	s.snap.Store(st)
+	s.epoch.Store(st.cut)
+	defer s.snap.Store(nil)
+
+	for s.inflight[(st.cut-1)&1].Load() != 0 {
+		time.Sleep(50 * time.Microsecond)
+	}
+
+	snapshot := make(encoding.ArrMetrics, 0, s.Len())
+	add := func(p preImage) {
+		updated := time.Unix(0, p.updated).UTC()
+		p.mt.Timestamp = &updated
+		snapshot = append(snapshot, p.mt)
+	}
+
+	seen := make(map[string]bool)
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		for id, sm := range sh.metrics {
+			seen[id] = true
+
+			sm.mu.Lock()
+			st.mu.Lock()
+			p, ok := st.pre[id]
+			st.mu.Unlock()
+			if !ok {
+				p = imageOf(id, sm)
+			}
+			sm.mu.Unlock()
+
+			if p.exists {
+				add(p)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+
+	// Метрики, удаленные после начала снимка.
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for id, p := range st.pre {
+		if p.exists && !seen[id] {
+			add(p)
+		}
+	}
+	return snapshot
+}
+
+// Len количество метрик в хранилище.
+func (s *Store) Len() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		n += len(sh.metrics)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// ReservedID имя id относится к метрикам самого сервера, см. пакет telemetry.
+func ReservedID(id string) bool {
+	return strings.HasPrefix(id, constants.SelfMetricsPrefix)
+}
+
+// MetricText значение метрики строкой, как его выводит Metric.String.
+func MetricText(mt encoding.Metrics) string {
+	if mt.Value != nil {
+		g := Gauge(*mt.Value)
+		return g.String()
+	}
+	if mt.Delta != nil {
+		c := Counter(*mt.Delta)
+		return c.String()
+	}
+	return ""
+}
+
+// TextMetricsAndValue строки "имя = значение" для всех метрик, отсортированные по типу и имени.
+func (s *Store) TextMetricsAndValue() []string {
+	const msgFormat = "%s = %s"
+
+	snapshot := s.Snapshot()
+	sort.Slice(snapshot, func(i, j int) bool {
+		if snapshot[i].MType != snapshot[j].MType {
+			return snapshot[i].MType < snapshot[j].MType
+		}
+		return snapshot[i].ID < snapshot[j].ID
+	})
+
+	var msg []string
+	for _, mt := range snapshot {
+		msg = append(msg, fmt.Sprintf(msgFormat, mt.ID, MetricText(mt)))
+	}
+
+	return msg
+}
@@ -0,0 +1,272 @@
+package repository_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/repository"
+)
+
+func TestStore(t *testing.T) {
+	store := repository.NewStore()
+
+	t.Run("Checking update", func(t *testing.T) {
+		if _, err := store.UpdateText("gauge", "Alloc", "0.5"); err != nil {
+			t.Fatal(err)
+		}
+		mt, err := store.UpdateText("gauge", "Alloc", "1.5")
+		if err != nil || *mt.Value != 1.5 {
+			t.Errorf("Error gauge update: %v %v", mt, err)
+		}
+
+		delta := int64(2)
+		for i := 0; i < 2; i++ {
+			mt, err = store.Update(encoding.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+		}
+		if err != nil || *mt.Delta != 4 {
+			t.Errorf("Error counter update: %v %v", mt, err)
+		}
+	})
+
+	t.Run("Checking errors", func(t *testing.T) {
+		if _, err := store.UpdateText("histogram", "X", "1"); !errors.Is(err, repository.ErrUnknownType) {
+			t.Errorf("Error unknown type: %v", err)
+		}
+		if _, err := store.UpdateText("counter", "X", "1.5"); !errors.Is(err, repository.ErrBadValue) {
+			t.Errorf("Error bad value: %v", err)
+		}
+		if _, err := store.Update(encoding.Metrics{ID: "X", MType: "gauge"}); !errors.Is(err, repository.ErrBadValue) {
+			t.Errorf("Error missing value: %v", err)
+		}
+		if _, err := store.UpdateText("counter", "Alloc", "1"); !errors.Is(err, repository.ErrTypeMismatch) {
+			t.Errorf("Error type mismatch: %v", err)
+		}
+		gauge := 1.0
+		labeled := encoding.Metrics{ID: "X", MType: "gauge", Value: &gauge, Labels: map[string]string{"host": "a"}}
+		if _, err := store.Update(labeled); !errors.Is(err, repository.ErrLabelsUnsupported) {
+			t.Errorf("Error labels must be rejected: %v", err)
+		}
+		var delta int64 = 1
+		batch := encoding.ArrMetrics{
+			{ID: "X", MType: "counter", Delta: &delta},
+			{ID: "X", MType: "gauge", Value: &gauge},
+		}
+		if applied, err := store.UpdateBatch(batch); !errors.Is(err, repository.ErrTypeMismatch) || len(applied) != 0 {
+			t.Errorf("Error batch type mismatch: %v %v", applied, err)
+		}
+		if _, ok := store.Get("X"); ok {
+			t.Error("Error invalid update created metric")
+		}
+	})
+
+	t.Run("Checking snapshot", func(t *testing.T) {
+		if snapshot := store.Snapshot(); len(snapshot) != 2 {
+			t.Errorf("Error snapshot: %v", snapshot)
+		}
+		text := store.TextMetricsAndValue()
+		if len(text) != 2 || text[0] != "PollCount = 4" || text[1] != "Alloc = 1.5" {
+			t.Errorf("Error text: %v", text)
+		}
+	})
+
+	t.Run("Checking concurrent counters", func(t *testing.T) {
+		const workers, increments = 16, 1000
+
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < increments; i++ {
+					if _, err := store.UpdateText("counter", "Concurrent", "1"); err != nil {
+						t.Error(err)
+						return
+					}
+					store.Snapshot()
+				}
+			}()
+		}
+		wg.Wait()
+
+		mt, _ := store.Get("Concurrent")
+		if *mt.Delta != workers*increments {
+			t.Errorf("Error concurrent counter: %d", *mt.Delta)
+		}
+	})
+
+	t.Run("Checking batch in snapshot", func(t *testing.T) {
+		const batchSize, batches = 32, 500
+
+		batchStore := repository.NewStore()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 1; i <= batches; i++ {
+				value := float64(i)
+				batch := make(encoding.ArrMetrics, 0, batchSize)
+				for j := 0; j < batchSize; j++ {
+					batch = append(batch, encoding.Metrics{ID: fmt.Sprintf("Batch%d", j), MType: "gauge", Value: &value})
+				}
+				if _, err := batchStore.UpdateBatch(batch); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+
+		for running := true; running; {
+			select {
+			case <-done:
+				running = false
+			default:
+			}
+			snapshot := batchStore.Snapshot()
+			if len(snapshot) != 0 && len(snapshot) != batchSize {
+				t.Fatalf("Error snapshot sees part of batch: %d metrics", len(snapshot))
+			}
+			for _, mt := range snapshot {
+				if *mt.Value != *snapshot[0].Value {
+					t.Fatalf("Error snapshot mixes batches: %s = %v, %s = %v",
+						snapshot[0].ID, *snapshot[0].Value, mt.ID, *mt.Value)
+				}
+			}
+		}
+	})
+
+	t.Run("Checking import in snapshot", func(t *testing.T) {
+		const imports = 300
+
+		// Загрузки поочередно заменяют все метрики набором Even или Odd.
+		set := func(prefix string, value float64) encoding.ArrMetrics {
+			metrics := make(encoding.ArrMetrics, 0, 16)
+			for j := 0; j < 16; j++ {
+				metrics = append(metrics, encoding.Metrics{ID: fmt.Sprintf("%s%d", prefix, j), MType: "gauge", Value: &value})
+			}
+			return metrics
+		}
+
+		importStore := repository.NewStore()
+		if err := importStore.Restore(set("Even", 0)); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 1; i <= imports; i++ {
+				prefix := "Even"
+				if i%2 == 1 {
+					prefix = "Odd"
+				}
+				if _, err := importStore.Import(set(prefix, float64(i)), constants.ImportReplace, false, time.Now()); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+
+		for running := true; running; {
+			select {
+			case <-done:
+				running = false
+			default:
+			}
+			snapshot := importStore.Snapshot()
+			if len(snapshot) != 16 {
+				t.Fatalf("Error snapshot sees part of import: %d metrics", len(snapshot))
+			}
+			for _, mt := range snapshot {
+				if mt.ID[0] != snapshot[0].ID[0] || *mt.Value != *snapshot[0].Value {
+					t.Fatalf("Error snapshot mixes imports: %s = %v, %s = %v",
+						snapshot[0].ID, *snapshot[0].Value, mt.ID, *mt.Value)
+				}
+			}
+		}
+	})
+}
+
+// mutexRepo прежнее временное хранилище сервера: одна блокировка на все метрики.
+type mutexRepo struct {
+	sync.Mutex
+	repo repository.MutexRepo
+}
+
+func (m *mutexRepo) update(id string, value string) {
+	m.Lock()
+	defer m.Unlock()
+	metric, ok := m.repo[id]
+	if !ok {
+		c := repository.Counter(0)
+		metric = &c
+		m.repo[id] = metric
+	}
+	metric.SetFromText(value)
+}
+
+func (m *mutexRepo) get(id string) {
+	m.Lock()
+	defer m.Unlock()
+	if metric, ok := m.repo[id]; ok {
+		_ = metric.String()
+	}
+}
+
+func (m *mutexRepo) snapshot() {
+	m.Lock()
+	defer m.Unlock()
+	snapshot := make(encoding.ArrMetrics, 0, len(m.repo))
+	for id, metric := range m.repo {
+		snapshot = append(snapshot, metric.GetMetrics(metric.Type(), id, ""))
+	}
+}
+
+// Смешанная нагрузка: на 100 операций 90 записей, 9 чтений одной метрики и один снимок всех метрик.
+const benchMetrics = 256
+
+func benchmarkMixed(b *testing.B, update func(id string), get func(id string), snapshot func()) {
+	ids := make([]string, benchMetrics)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("Metric%d", i)
+		update(ids[i])
+	}
+
+	// Каждая горутина начинает со своей метрики, общий счетчик операций сам стал бы узким местом.
+	var worker atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := worker.Add(1) * 37
+		for pb.Next() {
+			n++
+			id := ids[n%benchMetrics]
+			switch {
+			case n%100 == 0:
+				snapshot()
+			case n%10 == 0:
+				get(id)
+			default:
+				update(id)
+			}
+		}
+	})
+}
+
+func BenchmarkMutexRepoMixed(b *testing.B) {
+	m := &mutexRepo{repo: make(repository.MutexRepo)}
+	benchmarkMixed(b,
+		func(id string) { m.update(id, "1") },
+		m.get,
+		m.snapshot)
+}
+
+func BenchmarkStoreMixed(b *testing.B) {
+	store := repository.NewStore()
+	benchmarkMixed(b,
+		func(id string) { _, _ = store.UpdateText("counter", id, "1") },
+		func(id string) { store.Get(id) },
+		func() { store.Snapshot() })
+}
@@ -2,193 +2,586 @@ package repository
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"os"
-
-	"github.com/jackc/pgx/v4/pgxpool"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
 
 	"github.com/andynikk/advancedmetrics/internal/constants"
 	"github.com/andynikk/advancedmetrics/internal/encoding"
+	"github.com/andynikk/advancedmetrics/internal/migrations"
 	"github.com/andynikk/advancedmetrics/internal/postgresql"
 )
 
-// TypeStoreDataDB Структура хранения настроек БД
-// DBC: конект с базой данных
-// Ctx: контекст на момент создания
-// DBDsn: строка соединения с базой данных
-type TypeStoreDataDB struct {
-	DBC   postgresql.DBConnector
-	Ctx   context.Context
-	DBDsn string
+// ErrDBUnavailable база данных недоступна, сервер переподключается в фоне.
+var ErrDBUnavailable = errors.New("база данных недоступна")
+
+func init() {
+	RegisterBackend(constants.MetricsStorageDB.String(), NewDBBackend)
 }
 
-// TypeStoreDataFile Структура хранения настроек файла
-// StoreFile путь к файлу хранения метрик
-type TypeStoreDataFile struct {
-	StoreFile string
+// pendingSamples значения метрик для истории, принятые, пока база была недоступна.
+type pendingSamples struct {
+	metrics encoding.ArrMetrics
+	at      time.Time
 }
 
-type MapTypeStore = map[string]TypeStoreData
+// DBBackend хранение метрик в базе данных PostgreSQL.
+// Если база недоступна при старте или в работе, хранилище продолжает принимать метрики в буфер,
+// переподключается в фоне с нарастающей паузой и записывает буфер после подключения.
+// DBDsn: строка соединения с базой данных
+// Migrate: применять миграции схемы при подключении
+// SamplesRetention: сколько хранить историю значений метрик, 0 - хранить всю историю
+// Pool: настройки пула соединений
+// RetryTimeout: сколько при старте ждать базу, прежде чем продолжить подключение в фоне
+// QueryTimeout: время ожидания записи в базу, 0 - без ограничения
+// BufferSize: сколько значений истории хранить в буфере, старые значения отбрасываются
+type DBBackend struct {
+	DBDsn            string
+	Migrate          bool
+	SamplesRetention time.Duration
+	Pool             postgresql.PoolConfig
+	RetryTimeout     time.Duration
+	QueryTimeout     time.Duration
+	BufferSize       int
+
+	mu             sync.Mutex
+	dbc            *postgresql.DBConnector
+	up             bool
+	lastErr        error
+	downSince      time.Time
+	pending        map[MetricKey]encoding.Metrics
+	pendingSamples []pendingSamples
+	bufferedCount  int
+	droppedSamples int
+
+	down chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
 
-type TypeStoreData interface {
-	WriteMetric(storedData encoding.ArrMetrics)
-	GetMetric() ([]encoding.Metrics, error)
-	CreateTable() bool
-	ConnDB() *pgxpool.Pool
+// NewDBBackend создает хранилище в базе данных по строке соединения DATABASE_DSN.
+func NewDBBackend(cfg BackendConfig) (Backend, error) {
+	if cfg.DatabaseDsn == "" {
+		return nil, errors.New("не указана строка соединения с базой данных")
+	}
+	return &DBBackend{
+		DBDsn:            cfg.DatabaseDsn,
+		Migrate:          cfg.Migrate,
+		SamplesRetention: cfg.SamplesRetention,
+		Pool:             postgresql.PoolConfig{MaxConns: cfg.DBMaxConns, ConnectTimeout: cfg.DBConnectTimeout},
+		RetryTimeout:     cfg.DBRetryTimeout,
+		QueryTimeout:     cfg.DBQueryTimeout,
+		BufferSize:       cfg.DBBufferSize,
+	}, nil
+}
+
+// Name имя хранилища в базе данных.
+func (sdb *DBBackend) Name() string {
+	return constants.MetricsStorageDB.String()
 }
 
-// InitStoreDB инициализация хранилища БД
-func InitStoreDB(mts MapTypeStore, store string) (MapTypeStore, error) {
-	if _, findKey := mts[constants.MetricsStorageDB.String()]; findKey {
-		ctx := context.Background()
+// Init подключается к базе данных и проверяет версию схемы.
+// При включенном MIGRATE недостающие миграции применяются, иначе устаревшая схема - ошибка подключения.
+// Если за RetryTimeout подключиться не удалось, хранилище начинает работу без базы и подключается в фоне.
+// Запускает обслуживание истории: создание секций на ближайшие сутки и удаление устаревших.
+func (sdb *DBBackend) Init(ctx context.Context) error {
+	sdb.pending = make(map[MetricKey]encoding.Metrics)
+	sdb.down = make(chan struct{}, 1)
 
-		dbc, err := postgresql.PoolDB(store)
-		if err != nil {
-			return nil, err
+	dbc, err := connectWithRetry(ctx, sdb.DBDsn, sdb.Pool, sdb.RetryTimeout)
+
+	if err == nil {
+		if err = sdb.setup(ctx, dbc); err != nil {
+			dbc.Pool.Close()
+			return err
 		}
+		sdb.dbc = dbc
+		sdb.up = true
+	} else {
+		constants.Logger.ErrorLog(fmt.Errorf("%w, метрики будут записаны после подключения: %s", ErrDBUnavailable, err.Error()))
+		sdb.lastErr = err
+		sdb.downSince = time.Now()
+	}
+
+	sdb.stop = make(chan struct{})
+	sdb.done = make(chan struct{})
+	go sdb.run()
 
-		mts[constants.MetricsStorageDB.String()] = &TypeStoreDataDB{
-			DBC: *dbc, Ctx: ctx, DBDsn: store,
+	return nil
+}
+
+// connectWithRetry подключается к базе, повторяя попытки с нарастающей паузой в течение timeout.
+// При timeout 0 выполняется одна попытка.
+func connectWithRetry(ctx context.Context, dsn string, pc postgresql.PoolConfig, timeout time.Duration) (*postgresql.DBConnector, error) {
+	if timeout <= 0 {
+		return postgresql.PoolDB(ctx, dsn, pc)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	b := newBackoff()
+	for {
+		dbc, err := postgresql.PoolDB(ctx, dsn, pc)
+		if err == nil {
+			return dbc, nil
 		}
-		if ok := mts[constants.MetricsStorageDB.String()].CreateTable(); !ok {
+		select {
+		case <-ctx.Done():
 			return nil, err
+		case <-time.After(b.next()):
 		}
 	}
-	//if _, findKey := mts[constants.MetricsStorageFile.String()]; findKey {
-	//	mts[constants.MetricsStorageDB.String()] = &TypeStoreDataFile{StoreFile: store}
-	//}
+}
 
-	return mts, nil
+// setup готовит схему базы после подключения.
+func (sdb *DBBackend) setup(ctx context.Context, dbc *postgresql.DBConnector) error {
+	if err := sdb.migrate(ctx, dbc); err != nil {
+		return err
+	}
+	return sdb.maintainSamples(ctx, dbc)
 }
 
-// InitStoreFile инициализация хранилища в файле
-func InitStoreFile(mts MapTypeStore, store string) (MapTypeStore, error) {
+func (sdb *DBBackend) migrate(ctx context.Context, dbc *postgresql.DBConnector) error {
+	migrator, err := migrations.New(dbc.Pool)
+	if err != nil {
+		return err
+	}
+	if !sdb.Migrate {
+		return migrator.Check(ctx)
+	}
 
-	if _, findKey := mts[constants.MetricsStorageFile.String()]; findKey {
-		mts[constants.MetricsStorageDB.String()] = &TypeStoreDataFile{StoreFile: store}
+	applied, err := migrator.Up(ctx, 0)
+	for _, m := range applied {
+		constants.Logger.InfoLog(fmt.Sprintf("применена миграция %d_%s", m.Version, m.Name))
 	}
+	return err
+}
+
+// connection соединение с базой, если она доступна.
+func (sdb *DBBackend) connection() (*postgresql.DBConnector, error) {
+	sdb.mu.Lock()
+	defer sdb.mu.Unlock()
 
-	return mts, nil
+	if sdb.dbc == nil || !sdb.up {
+		if sdb.lastErr == nil {
+			return nil, ErrDBUnavailable
+		}
+		return nil, fmt.Errorf("%w: %s", ErrDBUnavailable, sdb.lastErr.Error())
+	}
+	return sdb.dbc, nil
 }
 
-// WriteMetric Запись метрик в базу данных
-func (sdb *TypeStoreDataDB) WriteMetric(storedData encoding.ArrMetrics) {
-	dataBase := sdb.DBC
-	if err := dataBase.SetMetric2DB(storedData); err != nil {
-		constants.Logger.ErrorLog(err)
+func (sdb *DBBackend) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if sdb.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, sdb.QueryTimeout)
 }
 
-// GetMetric Получение метрик из базы данных
-func (sdb *TypeStoreDataDB) GetMetric() ([]encoding.Metrics, error) {
-	var arrMatrics []encoding.Metrics
+// failed проверяет, не потеряно ли соединение после ошибки запроса.
+// Если база не отвечает, хранилище переходит к записи в буфер и возвращает true.
+func (sdb *DBBackend) failed(dbc *postgresql.DBConnector, err error) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if dbc.Pool.Ping(ctx) == nil {
+		return false
+	}
 
-	ctx := context.Background()
-	defer ctx.Done()
+	sdb.mu.Lock()
+	if sdb.up {
+		sdb.up = false
+		sdb.lastErr = err
+		sdb.downSince = time.Now()
+		constants.Logger.ErrorLog(fmt.Errorf("%w, метрики будут записаны после подключения: %s", ErrDBUnavailable, err.Error()))
+	}
+	sdb.mu.Unlock()
+
+	select {
+	case sdb.down <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Upsert Запись метрик в базу данных.
+// Пока база недоступна, метрики копятся в буфере: для каждой метрики хранится последнее значение.
+func (sdb *DBBackend) Upsert(ctx context.Context, metrics encoding.ArrMetrics) error {
+	if sdb.bufferMetrics(metrics) {
+		return nil
+	}
 
-	conn, err := sdb.DBC.Pool.Acquire(ctx)
+	dbc, err := sdb.connection()
 	if err != nil {
-		constants.Logger.ErrorLog(err)
-		return nil, errors.New("ошибка создания соединения с БД")
+		return err
 	}
-	defer conn.Release()
+	queryCtx, cancel := sdb.withTimeout(ctx)
+	defer cancel()
 
-	poolRow, err := conn.Query(sdb.Ctx, constants.QuerySelect)
+	err = dbc.SetMetric2DB(queryCtx, metrics)
+	if err != nil && sdb.failed(dbc, err) {
+		sdb.bufferMetrics(metrics)
+		return nil
+	}
+	return err
+}
+
+// bufferMetrics добавляет метрики в буфер, если база недоступна.
+func (sdb *DBBackend) bufferMetrics(metrics encoding.ArrMetrics) bool {
+	sdb.mu.Lock()
+	defer sdb.mu.Unlock()
+
+	if sdb.up || sdb.pending == nil {
+		return false
+	}
+	for _, m := range metrics {
+		sdb.pending[metricKey(m)] = m
+	}
+	return true
+}
+
+// AppendSamples добавляет значения метрик в историю.
+// Пока база недоступна, значения копятся в буфере размером BufferSize.
+func (sdb *DBBackend) AppendSamples(ctx context.Context, metrics encoding.ArrMetrics, at time.Time) error {
+	if sdb.bufferSamples(metrics, at) {
+		return nil
+	}
+
+	dbc, err := sdb.connection()
 	if err != nil {
-		conn.Release()
-		constants.Logger.ErrorLog(err)
-		return nil, errors.New("ошибка чтения БД")
+		return err
 	}
-	defer poolRow.Close()
+	queryCtx, cancel := sdb.withTimeout(ctx)
+	defer cancel()
 
-	for poolRow.Next() {
-		var nst encoding.Metrics
+	err = dbc.AppendSamples(queryCtx, metrics, at)
+	if err != nil && sdb.failed(dbc, err) {
+		sdb.bufferSamples(metrics, at)
+		return nil
+	}
+	return err
+}
 
-		err = poolRow.Scan(&nst.ID, &nst.MType, &nst.Value, &nst.Delta, &nst.Hash)
-		if err != nil {
-			constants.Logger.ErrorLog(err)
-			continue
-		}
-		arrMatrics = append(arrMatrics, nst)
+// bufferSamples добавляет значения истории в буфер, если база недоступна.
+func (sdb *DBBackend) bufferSamples(metrics encoding.ArrMetrics, at time.Time) bool {
+	sdb.mu.Lock()
+	defer sdb.mu.Unlock()
+
+	if sdb.up || sdb.pending == nil {
+		return false
+	}
+	sdb.pendingSamples = append(sdb.pendingSamples, pendingSamples{metrics: metrics, at: at})
+	sdb.bufferedCount += len(metrics)
+	for sdb.BufferSize > 0 && sdb.bufferedCount > sdb.BufferSize && len(sdb.pendingSamples) > 1 {
+		sdb.bufferedCount -= len(sdb.pendingSamples[0].metrics)
+		sdb.droppedSamples += len(sdb.pendingSamples[0].metrics)
+		sdb.pendingSamples = sdb.pendingSamples[1:]
 	}
+	return true
+}
 
-	ctx.Done()
-	conn.Release()
+// Buffered количество метрик и значений истории, ожидающих записи в базу.
+func (sdb *DBBackend) Buffered() int {
+	sdb.mu.Lock()
+	defer sdb.mu.Unlock()
 
-	return arrMatrics, nil
+	return len(sdb.pending) + sdb.bufferedCount
 }
 
-// ConnDB Возвращает соединение с базой данных
-func (sdb *TypeStoreDataDB) ConnDB() *pgxpool.Pool {
-	return sdb.DBC.Pool
+// DownSince время, с которого база недоступна. Нулевое время - база доступна.
+func (sdb *DBBackend) DownSince() time.Time {
+	sdb.mu.Lock()
+	defer sdb.mu.Unlock()
+
+	if sdb.up {
+		return time.Time{}
+	}
+	return sdb.downSince
 }
 
-// CreateTable Проверка и создание, если таковых нет, таблиц в базе данных
-func (sdb *TypeStoreDataDB) CreateTable() bool {
-	ctx := context.Background()
-	conn, err := sdb.DBC.Pool.Acquire(ctx)
+// LoadAll Получение метрик из базы данных
+func (sdb *DBBackend) LoadAll(ctx context.Context) (encoding.ArrMetrics, error) {
+	dbc, err := sdb.connection()
 	if err != nil {
-		constants.Logger.ErrorLog(err)
-		return false
+		return nil, err
 	}
-	defer conn.Release()
-	if _, err := conn.Exec(sdb.Ctx, constants.QuerySchema); err != nil {
-		conn.Release()
-		constants.Logger.ErrorLog(err)
-		return false
+
+	rows, err := dbc.Pool.Query(ctx, constants.QuerySelect)
+	if err != nil {
+		return nil, err
 	}
-	if _, err := conn.Exec(sdb.Ctx, constants.QueryTable); err != nil {
-		conn.Release()
-		constants.Logger.ErrorLog(err)
-		return false
+	defer rows.Close()
+
+	var arrMatrics encoding.ArrMetrics
+	for rows.Next() {
+		var nst encoding.Metrics
+
+		if err = rows.Scan(&nst.ID, &nst.MType, &nst.Value, &nst.Delta, &nst.Hash, &nst.Timestamp); err != nil {
+			return nil, err
+		}
+		// В таблице заполнены обе колонки значения, лишнюю убираем по типу метрики.
+		switch nst.MType {
+		case "gauge":
+			nst.Delta = nil
+		case "counter":
+			nst.Value = nil
+		}
+		arrMatrics = append(arrMatrics, nst)
 	}
-	conn.Release()
-	ctx.Done()
 
-	return true
+	return arrMatrics, rows.Err()
 }
 
-////////////////////////////////////////////////////////////////////////////////////////////////////////
+// Delete Удаление метрик из базы данных
+func (sdb *DBBackend) Delete(ctx context.Context, keys ...MetricKey) error {
+	dbc, err := sdb.connection()
+	if err != nil {
+		return err
+	}
 
-// WriteMetric Запись метрик в файл
-func (f *TypeStoreDataFile) WriteMetric(storedData encoding.ArrMetrics) {
-	arrJSON, err := json.Marshal(storedData)
+	tx, err := dbc.Pool.Begin(ctx)
 	if err != nil {
-		constants.Logger.ErrorLog(err)
-		return
+		return err
 	}
-	if err := os.WriteFile(f.StoreFile, arrJSON, 0777); err != nil {
-		constants.Logger.ErrorLog(err)
-		return
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	for _, key := range keys {
+		if _, err = tx.Exec(ctx, constants.QueryDelete, key.ID, key.MType); err != nil {
+			return err
+		}
 	}
+
+	return tx.Commit(ctx)
 }
 
-// GetMetric Получение метрик из файла
-func (f *TypeStoreDataFile) GetMetric() ([]encoding.Metrics, error) {
-	res, err := os.ReadFile(f.StoreFile)
+// Health проверяет соединение с базой данных
+func (sdb *DBBackend) Health(ctx context.Context) error {
+	dbc, err := sdb.connection()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	return dbc.Pool.Ping(ctx)
+}
+
+// Close останавливает фоновые задачи и закрывает соединения с базой данных.
+// Если база так и не стала доступна, возвращает ошибку с количеством незаписанных значений.
+func (sdb *DBBackend) Close() error {
+	if sdb.stop != nil {
+		close(sdb.stop)
+		<-sdb.done
+		sdb.stop = nil
+	}
+
+	sdb.mu.Lock()
+	defer sdb.mu.Unlock()
+
+	var err error
+	if buffered := len(sdb.pending) + sdb.bufferedCount; buffered != 0 {
+		err = fmt.Errorf("%w: не записано метрик и значений истории: %d", ErrDBUnavailable, buffered)
+	}
+	if sdb.dbc != nil {
+		sdb.dbc.Pool.Close()
+		sdb.dbc = nil
 	}
-	var arrMatric []encoding.Metrics
-	if err := json.Unmarshal(res, &arrMatric); err != nil {
+	sdb.up = false
+
+	return err
+}
+
+// Samples значения метрики из истории за период [from, to).
+func (sdb *DBBackend) Samples(ctx context.Context, key MetricKey, from time.Time, to time.Time) ([]encoding.Sample, error) {
+	dbc, err := sdb.connection()
+	if err != nil {
 		return nil, err
 	}
+	return dbc.Samples(ctx, key.ID, key.MType, from, to)
+}
 
-	return arrMatric, nil
+// maintainSamples создает секции истории на сегодня и завтра и удаляет секции старше SamplesRetention.
+func (sdb *DBBackend) maintainSamples(ctx context.Context, dbc *postgresql.DBConnector) error {
+	now := time.Now()
+	if err := dbc.EnsureSamplePartitions(ctx, now, now.Add(24*time.Hour)); err != nil {
+		return err
+	}
+	if sdb.SamplesRetention <= 0 {
+		return nil
+	}
+
+	dropped, err := dbc.DropSamplePartitions(ctx, now.Add(-sdb.SamplesRetention))
+	for _, name := range dropped {
+		constants.Logger.InfoLog(fmt.Sprintf("удалена секция истории %s", name))
+	}
+	return err
 }
 
-// ConnDB Возвращает с файлом. Для файла не используется. Возвращает nil
-func (f *TypeStoreDataFile) ConnDB() *pgxpool.Pool {
-	return nil
+// reconnect подключается к базе, если соединения еще не было, и записывает буфер.
+// Хранилище считается доступным только после записи всего буфера.
+func (sdb *DBBackend) reconnect(ctx context.Context) error {
+	sdb.mu.Lock()
+	dbc := sdb.dbc
+	sdb.mu.Unlock()
+
+	if dbc == nil {
+		var err error
+		if dbc, err = postgresql.PoolDB(ctx, sdb.DBDsn, sdb.Pool); err != nil {
+			return err
+		}
+		if err = sdb.setup(ctx, dbc); err != nil {
+			dbc.Pool.Close()
+			return err
+		}
+		sdb.mu.Lock()
+		sdb.dbc = dbc
+		sdb.mu.Unlock()
+	} else if err := dbc.Pool.Ping(ctx); err != nil {
+		return err
+	}
+
+	for {
+		sdb.mu.Lock()
+		pending, samples, dropped := sdb.pending, sdb.pendingSamples, sdb.droppedSamples
+		if len(pending) == 0 && len(samples) == 0 {
+			sdb.up = true
+			sdb.lastErr = nil
+			sdb.mu.Unlock()
+			return nil
+		}
+		sdb.pending = make(map[MetricKey]encoding.Metrics)
+		sdb.pendingSamples = nil
+		sdb.bufferedCount = 0
+		sdb.droppedSamples = 0
+		sdb.mu.Unlock()
+
+		if dropped != 0 {
+			constants.Logger.InfoLog(fmt.Sprintf("буфер истории переполнен, отброшено значений: %d", dropped))
+		}
+
+		pending, samples, err := flush(ctx, dbc, pending, samples)
+		if err == nil {
+			continue
+		}
+
+		// Незаписанное возвращается в буфер, более новые значения метрик не затираются.
+		sdb.mu.Lock()
+		for key, m := range pending {
+			if _, ok := sdb.pending[key]; !ok {
+				sdb.pending[key] = m
+			}
+		}
+		sdb.pendingSamples = append(samples, sdb.pendingSamples...)
+		for _, s := range samples {
+			sdb.bufferedCount += len(s.metrics)
+		}
+		sdb.mu.Unlock()
+		return err
+	}
 }
 
-// CreateTable Проверка и создание, если нет, файла для хранения метрик
-func (f *TypeStoreDataFile) CreateTable() bool {
-	if _, err := os.Create(f.StoreFile); err != nil {
-		constants.Logger.ErrorLog(err)
-		return false
+// flush записывает буфер в базу и возвращает то, что записать не удалось.
+func flush(ctx context.Context, dbc *postgresql.DBConnector, pending map[MetricKey]encoding.Metrics,
+	samples []pendingSamples) (map[MetricKey]encoding.Metrics, []pendingSamples, error) {
+
+	if len(pending) != 0 {
+		metrics := make(encoding.ArrMetrics, 0, len(pending))
+		for _, m := range pending {
+			metrics = append(metrics, m)
+		}
+		if err := dbc.SetMetric2DB(ctx, metrics); err != nil {
+			return pending, samples, err
+		}
+	}
+	if len(samples) == 0 {
+		return nil, nil, nil
 	}
 
-	return true
+	// Секций истории за время недоступности базы может еще не быть.
+	if err := dbc.EnsureSamplePartitions(ctx, samples[0].at, samples[len(samples)-1].at); err != nil {
+		return nil, samples, err
+	}
+	for i, s := range samples {
+		if err := dbc.AppendSamples(ctx, s.metrics, s.at); err != nil {
+			return nil, samples[i:], err
+		}
+	}
+	return nil, nil, nil
+}
+
+// run переподключается к базе после сбоев и раз в час обслуживает секции истории.
+func (sdb *DBBackend) run() {
+	defer close(sdb.done)
+
+	maintain := time.NewTicker(time.Hour)
+	defer maintain.Stop()
+
+	b := newBackoff()
+	var retry <-chan time.Time
+	if !sdb.DownSince().IsZero() {
+		retry = time.After(b.next())
+	}
+
+	for {
+		select {
+		case <-sdb.down:
+			if retry == nil {
+				retry = time.After(b.next())
+			}
+		case <-retry:
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			err := sdb.reconnect(ctx)
+			cancel()
+			if err != nil {
+				sdb.mu.Lock()
+				sdb.lastErr = err
+				sdb.mu.Unlock()
+				retry = time.After(b.next())
+				continue
+			}
+			retry = nil
+			b.reset()
+			constants.Logger.InfoLog("соединение с базой данных восстановлено")
+		case <-maintain.C:
+			dbc, err := sdb.connection()
+			if err != nil {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			if err = sdb.maintainSamples(ctx, dbc); err != nil {
+				constants.Logger.ErrorLog(err)
+			}
+			cancel()
+		case <-sdb.stop:
+			return
+		}
+	}
+}
+
+// backoff пауза между попытками подключения: от backoffMin, удваивается до backoffMax,
+// со случайным разбросом ±10%, чтобы серверы не переподключались одновременно.
+type backoff struct {
+	delay time.Duration
+}
+
+const (
+	backoffMin = 500 * time.Millisecond
+	backoffMax = 30 * time.Second
+)
+
+func newBackoff() *backoff {
+	return &backoff{delay: backoffMin}
+}
+
+func (b *backoff) next() time.Duration {
+	delay := b.delay
+	b.delay *= 2
+	if b.delay > backoffMax {
+		b.delay = backoffMax
+	}
+	return delay - delay/10 + time.Duration(rand.Int63n(int64(delay)/5))
+}
+
+func (b *backoff) reset() {
+	b.delay = backoffMin
 }
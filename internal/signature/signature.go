@@ -0,0 +1,184 @@
+// Package signature подпись запросов агентов собственными ключами Ed25519.
+//
+// Каждый агент подписывает запрос своим приватным ключом,
+// сервер проверяет подпись по реестру открытых ключей доверенных агентов.
+// Утечка настроек одного агента не позволяет подделать запросы остальных.
+package signature
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encryption"
+)
+
+// ErrUnknownAgent агента нет в реестре доверенных агентов.
+var ErrUnknownAgent = errors.New("агент не зарегистрирован")
+
+// ErrInvalidSignature подпись не совпала с открытым ключом агента.
+var ErrInvalidSignature = errors.New("подпись не прошла проверку")
+
+// Sign подписывает сообщение и возвращает подпись в base64.
+func Sign(privateKey ed25519.PrivateKey, message []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, message))
+}
+
+// LoadPrivateKey читает приватный ключ Ed25519 агента (например, выпущенный "encryption issue -key-type ed25519").
+func LoadPrivateKey(keyPath string) (ed25519.PrivateKey, error) {
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := LoadPrivateKeyPEM(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyPath, err)
+	}
+	return privateKey, nil
+}
+
+// LoadPrivateKeyPEM разбирает приватный ключ Ed25519 в формате PEM.
+func LoadPrivateKeyPEM(keyData []byte) (ed25519.PrivateKey, error) {
+	signer, err := encryption.LoadSignerPEM(keyData)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := signer.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("приватный ключ не является ключом Ed25519")
+	}
+	return privateKey, nil
+}
+
+// ParsePublicKey разбирает открытый ключ Ed25519 из PEM-блока "PUBLIC KEY" или из сертификата.
+func ParsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("открытый ключ не найден")
+	}
+
+	var publicKey interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKey = key
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKey = cert.PublicKey
+	default:
+		return nil, fmt.Errorf("неподдерживаемый тип блока PEM: %s", block.Type)
+	}
+
+	edKey, ok := publicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("открытый ключ не является ключом Ed25519")
+	}
+	return edKey, nil
+}
+
+// Registry реестр открытых ключей доверенных агентов.
+// Идентификатор агента: имя файла ключа или сертификата без расширения.
+type Registry struct {
+	sync.RWMutex
+	dir  string
+	keys map[string]ed25519.PublicKey
+}
+
+// NewRegistry загружает открытые ключи агентов из каталога dir.
+func NewRegistry(dir string) (*Registry, error) {
+	r := &Registry{dir: dir, keys: make(map[string]ed25519.PublicKey)}
+	if err := r.Reload(); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// Reload перечитывает каталог с ключами агентов.
+// При ошибке чтения каталога прежний реестр сохраняется.
+func (r *Registry) Reload() error {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]ed25519.PublicKey)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(r.dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			constants.Logger.ErrorLog(err)
+			continue
+		}
+		publicKey, err := ParsePublicKey(data)
+		if err != nil {
+			constants.Logger.ErrorLog(fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		agentID := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		keys[agentID] = publicKey
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.keys = keys
+
+	return nil
+}
+
+// AgentIDs идентификаторы зарегистрированных агентов.
+func (r *Registry) AgentIDs() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	ids := make([]string, 0, len(r.keys))
+	for id := range r.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Verify проверяет подпись сообщения агентом agentID.
+// Ошибка содержит идентификатор агента и причину отказа.
+func (r *Registry) Verify(agentID string, message []byte, sign string) error {
+	if agentID == "" {
+		return errors.New("не указан идентификатор агента")
+	}
+
+	r.RLock()
+	publicKey, ok := r.keys[agentID]
+	r.RUnlock()
+	if !ok {
+		return fmt.Errorf("агент %s: %w", agentID, ErrUnknownAgent)
+	}
+
+	rawSign, err := base64.StdEncoding.DecodeString(sign)
+	if err != nil {
+		return fmt.Errorf("агент %s: подпись не в формате base64: %w", agentID, err)
+	}
+	if !ed25519.Verify(publicKey, message, rawSign) {
+		return fmt.Errorf("агент %s: %w", agentID, ErrInvalidSignature)
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package signature
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andynikk/advancedmetrics/internal/encryption"
+)
+
+func writePublicKey(t *testing.T, dir string, agentID string) ed25519.PrivateKey {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err = os.WriteFile(filepath.Join(dir, agentID+".pub"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return privateKey
+}
+
+func TestRegistry(t *testing.T) {
+	dir := t.TempDir()
+	message := []byte("POST\n/updates\n1\nnonce\nbody")
+
+	agent1Key := writePublicKey(t, dir, "agent1")
+
+	pair, err := encryption.CreateCertificate(encryption.CertOptions{KeyType: encryption.KeyTypeEd25519, CommonName: "agent2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "agent2.cer"), pair.CertPEM.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	agent2Key, err := LoadPrivateKeyPEM(pair.KeyPEM.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry, err := NewRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Checking public key", func(t *testing.T) {
+		if err = registry.Verify("agent1", message, Sign(agent1Key, message)); err != nil {
+			t.Errorf("Error verify agent1: %s", err.Error())
+		}
+	})
+	t.Run("Checking certificate", func(t *testing.T) {
+		if err = registry.Verify("agent2", message, Sign(agent2Key, message)); err != nil {
+			t.Errorf("Error verify agent2: %s", err.Error())
+		}
+	})
+	t.Run("Checking foreign key", func(t *testing.T) {
+		err = registry.Verify("agent1", message, Sign(agent2Key, message))
+		if !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Error foreign key must be rejected: %v", err)
+		}
+	})
+	t.Run("Checking tampered message", func(t *testing.T) {
+		err = registry.Verify("agent1", []byte("tampered"), Sign(agent1Key, message))
+		if !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Error tampered message must be rejected: %v", err)
+		}
+	})
+	t.Run("Checking unknown agent", func(t *testing.T) {
+		err = registry.Verify("agent3", message, Sign(agent1Key, message))
+		if !errors.Is(err, ErrUnknownAgent) {
+			t.Errorf("Error unknown agent must be rejected: %v", err)
+		}
+	})
+	t.Run("Checking reload", func(t *testing.T) {
+		agent3Key := writePublicKey(t, dir, "agent3")
+		if err = os.Remove(filepath.Join(dir, "agent1.pub")); err != nil {
+			t.Fatal(err)
+		}
+		if err = registry.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		if err = registry.Verify("agent3", message, Sign(agent3Key, message)); err != nil {
+			t.Errorf("Error verify reloaded agent3: %s", err.Error())
+		}
+		if err = registry.Verify("agent1", message, Sign(agent1Key, message)); !errors.Is(err, ErrUnknownAgent) {
+			t.Errorf("Error removed agent1 must be rejected: %v", err)
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package telemetry
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+)
+
+// LatencyBuckets границы корзин гистограмм длительности, в секундах.
+var LatencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// SizeBuckets границы корзин гистограмм размера, в байтах.
+var SizeBuckets = []float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+// Histogram гистограмма значений с фиксированными границами корзин.
+// Значения добавляются атомарно, без блокировки.
+type Histogram struct {
+	bounds []float64
+	counts []atomic.Int64 // последняя корзина - значения больше всех границ
+	sum    atomic.Uint64  // биты float64
+}
+
+// NewHistogram создает гистограмму с границами корзин bounds по возрастанию.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]atomic.Int64, len(bounds)+1),
+	}
+}
+
+// Observe добавляет значение v в гистограмму.
+func (h *Histogram) Observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Count количество значений в гистограмме.
+func (h *Histogram) Count() int64 {
+	var n int64
+	for i := range h.counts {
+		n += h.counts[i].Load()
+	}
+	return n
+}
+
+// metrics гистограмма в виде метрик с именем name, как в OpenMetrics:
+// counter name_bucket_le_<граница> - количество значений не больше границы (накопительно),
+// counter name_count - количество значений, gauge name_sum - сумма значений.
+func (h *Histogram) metrics(name string) encoding.ArrMetrics {
+	metrics := make(encoding.ArrMetrics, 0, len(h.counts)+2)
+
+	var cumulative int64
+	for i := range h.counts {
+		cumulative += h.counts[i].Load()
+		le := "inf"
+		if i < len(h.bounds) {
+			le = strings.ReplaceAll(strconv.FormatFloat(h.bounds[i], 'f', -1, 64), ".", "_")
+		}
+		metrics = append(metrics, counter(name+"_bucket_le_"+le, cumulative))
+	}
+	metrics = append(metrics,
+		counter(name+"_count", cumulative),
+		gauge(name+"_sum", math.Float64frombits(h.sum.Load())))
+
+	return metrics
+}
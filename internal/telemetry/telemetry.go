@@ -0,0 +1,196 @@
+// Package telemetry: метрики самого сервера метрик.
+//
+// Сервер считает запросы к каждому маршруту, их длительность и размер тел,
+// ошибки дешифровки, распаковки и проверки хешей, длительность записи в хранилища
+// и размер временного хранилища. Метрики отдаются с зарезервированным префиксом
+// constants.SelfMetricsPrefix, метрики агентов с таким префиксом сервер не принимает.
+package telemetry
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andynikk/advancedmetrics/internal/constants"
+	"github.com/andynikk/advancedmetrics/internal/encoding"
+)
+
+// routeStats метрики одного маршрута сервера.
+type routeStats struct {
+	requests      atomic.Int64
+	errors        atomic.Int64
+	responseBytes atomic.Int64
+	latency       *Histogram
+	requestBytes  *Histogram
+}
+
+// storageStats метрики записи в одно хранилище.
+type storageStats struct {
+	errors  atomic.Int64
+	latency *Histogram
+}
+
+// Registry метрики сервера.
+// DecryptFailures, DecompressFailures, HashFailures - количество запросов,
+// тело которых не удалось расшифровать, распаковать, и метрик с неверным хешем.
+type Registry struct {
+	DecryptFailures    atomic.Int64
+	DecompressFailures atomic.Int64
+	HashFailures       atomic.Int64
+
+	mu       sync.RWMutex
+	routes   map[string]*routeStats
+	storage  map[string]*storageStats
+	gauges   map[string]func() float64
+	counters map[string]func() int64
+}
+
+// NewRegistry создает пустой набор метрик сервера.
+func NewRegistry() *Registry {
+	return &Registry{
+		routes:   make(map[string]*routeStats),
+		storage:  make(map[string]*storageStats),
+		gauges:   make(map[string]func() float64),
+		counters: make(map[string]func() int64),
+	}
+}
+
+// route метрики маршрута name, создает их при первом обращении.
+func (r *Registry) route(name string) *routeStats {
+	r.mu.RLock()
+	rs, ok := r.routes[name]
+	r.mu.RUnlock()
+	if ok {
+		return rs
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rs, ok = r.routes[name]; !ok {
+		rs = &routeStats{latency: NewHistogram(LatencyBuckets), requestBytes: NewHistogram(SizeBuckets)}
+		r.routes[name] = rs
+	}
+	return rs
+}
+
+// ObserveRequest учитывает запрос к маршруту route: http-статус ответа, длительность,
+// размер тела запроса и ответа в байтах. Статус 400 и выше считается ошибкой.
+func (r *Registry) ObserveRequest(route string, status int, elapsed time.Duration, requestBytes int64, responseBytes int64) {
+	rs := r.route(route)
+	rs.requests.Add(1)
+	if status >= 400 {
+		rs.errors.Add(1)
+	}
+	rs.responseBytes.Add(responseBytes)
+	rs.latency.Observe(elapsed.Seconds())
+	rs.requestBytes.Observe(float64(requestBytes))
+}
+
+// ObserveWrite учитывает запись метрик в хранилище backend.
+// Подходит как repository.WriteObserver.
+func (r *Registry) ObserveWrite(backend string, elapsed time.Duration, err error) {
+	r.mu.RLock()
+	ss, ok := r.storage[backend]
+	r.mu.RUnlock()
+	if !ok {
+		r.mu.Lock()
+		if ss, ok = r.storage[backend]; !ok {
+			ss = &storageStats{latency: NewHistogram(LatencyBuckets)}
+			r.storage[backend] = ss
+		}
+		r.mu.Unlock()
+	}
+
+	if err != nil {
+		ss.errors.Add(1)
+	}
+	ss.latency.Observe(elapsed.Seconds())
+}
+
+// Gauge добавляет метрику gauge name, значение которой вычисляется value при чтении.
+func (r *Registry) Gauge(name string, value func() float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges[name] = value
+}
+
+// Counter добавляет метрику counter name, значение которой вычисляется value при чтении.
+func (r *Registry) Counter(name string, value func() int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] = value
+}
+
+// Metrics все метрики сервера, отсортированные по имени.
+// Имена метрик начинаются с constants.SelfMetricsPrefix:
+// http_<маршрут>_requests, _errors, _response_bytes, _latency_seconds, _request_bytes;
+// decrypt_failures, decompress_failures, hash_failures;
+// storage_<хранилище>_write_errors, _write_latency_seconds; а также метрики, добавленные Gauge и Counter.
+func (r *Registry) Metrics() encoding.ArrMetrics {
+	const prefix = constants.SelfMetricsPrefix
+
+	metrics := encoding.ArrMetrics{
+		counter(prefix+"decrypt_failures", r.DecryptFailures.Load()),
+		counter(prefix+"decompress_failures", r.DecompressFailures.Load()),
+		counter(prefix+"hash_failures", r.HashFailures.Load()),
+	}
+
+	r.mu.RLock()
+	gauges := make(map[string]func() float64, len(r.gauges))
+	for name, value := range r.gauges {
+		gauges[name] = value
+	}
+	counters := make(map[string]func() int64, len(r.counters))
+	for name, value := range r.counters {
+		counters[name] = value
+	}
+	for name, rs := range r.routes {
+		name = prefix + "http_" + name
+		metrics = append(metrics,
+			counter(name+"_requests", rs.requests.Load()),
+			counter(name+"_errors", rs.errors.Load()),
+			counter(name+"_response_bytes", rs.responseBytes.Load()))
+		metrics = append(metrics, rs.latency.metrics(name+"_latency_seconds")...)
+		metrics = append(metrics, rs.requestBytes.metrics(name+"_request_bytes")...)
+	}
+	for name, ss := range r.storage {
+		name = prefix + "storage_" + name
+		metrics = append(metrics, counter(name+"_write_errors", ss.errors.Load()))
+		metrics = append(metrics, ss.latency.metrics(name+"_write_latency_seconds")...)
+	}
+	r.mu.RUnlock()
+
+	// Значения вычисляются вне блокировки: функция может обращаться к другим блокировкам сервера.
+	for name, value := range gauges {
+		metrics = append(metrics, gauge(prefix+name, value()))
+	}
+	for name, value := range counters {
+		metrics = append(metrics, counter(prefix+name, value()))
+	}
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].ID < metrics[j].ID })
+	return metrics
+}
+
+// Get метрика сервера по полному имени id.
+func (r *Registry) Get(id string) (encoding.Metrics, bool) {
+	if !strings.HasPrefix(id, constants.SelfMetricsPrefix) {
+		return encoding.Metrics{}, false
+	}
+	for _, mt := range r.Metrics() {
+		if mt.ID == id {
+			return mt, true
+		}
+	}
+	return encoding.Metrics{}, false
+}
+
+func gauge(id string, value float64) encoding.Metrics {
+	return encoding.Metrics{ID: id, MType: "gauge", Value: &value}
+}
+
+func counter(id string, delta int64) encoding.Metrics {
+	return encoding.Metrics{ID: id, MType: "counter", Delta: &delta}
+}
@@ -0,0 +1,82 @@
+package telemetry
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{0.5, 1})
+	for _, v := range []float64{0.25, 0.5, 0.75, 3} {
+		h.Observe(v)
+	}
+
+	got := make(map[string]float64)
+	for _, mt := range h.metrics("latency") {
+		if mt.Delta != nil {
+			got[mt.ID] = float64(*mt.Delta)
+		} else {
+			got[mt.ID] = *mt.Value
+		}
+	}
+	want := map[string]float64{
+		"latency_bucket_le_0_5": 2,
+		"latency_bucket_le_1":   3,
+		"latency_bucket_le_inf": 4,
+		"latency_count":         4,
+		"latency_sum":           4.5,
+	}
+	for id, value := range want {
+		if got[id] != value {
+			t.Errorf("Error histogram %s: %v, want %v", id, got[id], value)
+		}
+	}
+	if h.Count() != 4 {
+		t.Errorf("Error histogram count: %d", h.Count())
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	r.ObserveRequest("updates", http.StatusOK, 2*time.Millisecond, 300, 10)
+	r.ObserveRequest("updates", http.StatusBadRequest, time.Millisecond, 100, 20)
+	r.ObserveWrite("db", 3*time.Millisecond, errors.New("connection refused"))
+	r.HashFailures.Add(1)
+	r.Gauge("repo_size", func() float64 { return 7 })
+	r.Counter("write_queue_flushes", func() int64 { return 3 })
+
+	metrics := r.Metrics()
+	for i := 1; i < len(metrics); i++ {
+		if metrics[i-1].ID >= metrics[i].ID {
+			t.Fatalf("Error metrics are not sorted: %s, %s", metrics[i-1].ID, metrics[i].ID)
+		}
+	}
+
+	counters := map[string]int64{
+		"server_http_updates_requests":                     2,
+		"server_http_updates_errors":                       1,
+		"server_http_updates_response_bytes":               30,
+		"server_http_updates_request_bytes_bucket_le_256":  1,
+		"server_http_updates_latency_seconds_count":        2,
+		"server_storage_db_write_errors":                   1,
+		"server_storage_db_write_latency_seconds_count":    1,
+		"server_hash_failures":                             1,
+		"server_decrypt_failures":                          0,
+		"server_http_updates_request_bytes_bucket_le_1024": 2,
+		"server_write_queue_flushes":                       3,
+	}
+	for id, delta := range counters {
+		mt, ok := r.Get(id)
+		if !ok || mt.Delta == nil || *mt.Delta != delta {
+			t.Errorf("Error metric %s: %+v", id, mt)
+		}
+	}
+	if mt, ok := r.Get("server_repo_size"); !ok || *mt.Value != 7 {
+		t.Errorf("Error gauge server_repo_size: %+v", mt)
+	}
+	if _, ok := r.Get("Alloc"); ok {
+		t.Error("Error agent metric found in server metrics")
+	}
+}